@@ -93,7 +93,12 @@ func (j diskJournal) readOrdinal(path string) (
 	if err != nil {
 		return 0, err
 	}
-	return makeJournalOrdinal(string(buf))
+	o, err := makeJournalOrdinal(string(buf))
+	if err != nil {
+		return 0, errJournalPointerCorrupt{
+			filepath.Base(path), err.Error()}
+	}
+	return o, nil
 }
 
 func (j diskJournal) writeOrdinal(
@@ -210,6 +215,192 @@ func (j diskJournal) appendJournalEntry(
 	return j.writeLatestOrdinal(next)
 }
 
+// appendJournalEntries appends the given entries to the journal, like
+// calling appendJournalEntry for each of them, with o applying to
+// the first one. However, all the entries are written before the
+// earliest and latest ordinals are updated, and the latest ordinal
+// is written only once, last, so that if the append is interrupted
+// before then, the journal is as it was before, except possibly for
+// stray entry files past the latest ordinal, which later appends
+// overwrite. Nothing is fsynced, so this only holds if the process
+// dies, not if the machine crashes and the writes reach the disk
+// out of order.
+func (j diskJournal) appendJournalEntries(
+	o *journalOrdinal, entries []interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var first journalOrdinal
+	empty := false
+	lo, err := j.readLatestOrdinal()
+	if os.IsNotExist(err) {
+		empty = true
+		if o != nil {
+			first = *o
+		}
+	} else if err != nil {
+		return err
+	} else {
+		first = lo + 1
+		if first == 0 {
+			return fmt.Errorf("Ordinal rollover for %+v", entries[0])
+		}
+		if o != nil && first != *o {
+			return fmt.Errorf(
+				"%v unexpectedly does not follow %v for %+v",
+				*o, lo, entries[0])
+		}
+	}
+
+	last := first + journalOrdinal(len(entries)-1)
+	if last < first {
+		return fmt.Errorf("Ordinal rollover for %+v",
+			entries[len(entries)-1])
+	}
+
+	for i, entry := range entries {
+		err := j.writeJournalEntry(first+journalOrdinal(i), entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if empty {
+		err := j.writeEarliestOrdinal(first)
+		if err != nil {
+			return err
+		}
+	}
+	return j.writeLatestOrdinal(last)
+}
+
+// removeEarliest removes the earliest entry in the journal, and
+// returns its ordinal. If that entry was the only one, the journal
+// becomes empty. The earliest ordinal is advanced before the entry
+// itself is removed, so that an interruption can at worst leave a
+// stray entry file behind.
+func (j diskJournal) removeEarliest() (journalOrdinal, error) {
+	earliestOrdinal, err := j.readEarliestOrdinal()
+	if err != nil {
+		return 0, err
+	}
+
+	latestOrdinal, err := j.readLatestOrdinal()
+	if err != nil {
+		return 0, err
+	}
+
+	if earliestOrdinal == latestOrdinal {
+		err := os.Remove(j.earliestPath())
+		if err != nil {
+			return 0, err
+		}
+		err = os.Remove(j.latestPath())
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err := j.writeEarliestOrdinal(earliestOrdinal + 1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = os.Remove(j.journalEntryPath(earliestOrdinal))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return earliestOrdinal, nil
+}
+
+// removeLatest removes the latest entry in the journal, and returns
+// its ordinal. If that entry was the only one, the journal becomes
+// empty. As with removeEarliest, the latest ordinal is moved back
+// before the entry itself is removed.
+func (j diskJournal) removeLatest() (journalOrdinal, error) {
+	earliestOrdinal, err := j.readEarliestOrdinal()
+	if err != nil {
+		return 0, err
+	}
+
+	latestOrdinal, err := j.readLatestOrdinal()
+	if err != nil {
+		return 0, err
+	}
+
+	if earliestOrdinal == latestOrdinal {
+		err := os.Remove(j.earliestPath())
+		if err != nil {
+			return 0, err
+		}
+		err = os.Remove(j.latestPath())
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err := j.writeLatestOrdinal(latestOrdinal - 1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = os.Remove(j.journalEntryPath(latestOrdinal))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return latestOrdinal, nil
+}
+
+// scanOrdinals returns the sorted ordinals of the entry files present
+// in the journal's directory, regardless of the earliest and latest
+// ordinals.
+func (j diskJournal) scanOrdinals() ([]journalOrdinal, error) {
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by name, and ordinals are fixed-width hex, so
+	// the result is sorted too.
+	var ordinals []journalOrdinal
+	for _, fi := range fileInfos {
+		o, err := makeJournalOrdinal(fi.Name())
+		if err != nil {
+			// Not an entry file.
+			continue
+		}
+		ordinals = append(ordinals, o)
+	}
+	return ordinals, nil
+}
+
+// clearOrdinals removes the earliest and latest ordinals, making the
+// journal empty, without removing any entry files.
+func (j diskJournal) clearOrdinals() error {
+	for _, path := range []string{j.earliestPath(), j.latestPath()} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStrayEntry removes the entry file for o, which must be
+// outside of the range of the earliest and latest ordinals.
+func (j diskJournal) removeStrayEntry(o journalOrdinal) error {
+	err := os.Remove(j.journalEntryPath(o))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (j diskJournal) journalLength() (uint64, error) {
 	first, err := j.readEarliestOrdinal()
 	if os.IsNotExist(err) {
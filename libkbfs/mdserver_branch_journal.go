@@ -5,9 +5,13 @@
 package libkbfs
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 )
 
 // An mdServerBranchJournal wraps a diskJournal to provide a
@@ -19,14 +23,71 @@ import (
 // since then we would require the ordinals to be something other than
 // MetadataRevisions.
 type mdServerBranchJournal struct {
-	j diskJournal
+	j mdJournalStore
 }
 
+// mdJournalStore is the on-disk format of an mdServerBranchJournal:
+// either a diskJournal, with one file per entry, or a
+// compactMDJournal, with a single file for all of them. Missing
+// earliest or latest ordinals are signalled by errors for which
+// os.IsNotExist is true.
+type mdJournalStore interface {
+	readEarliestOrdinal() (journalOrdinal, error)
+	readLatestOrdinal() (journalOrdinal, error)
+	writeEarliestOrdinal(o journalOrdinal) error
+	writeLatestOrdinal(o journalOrdinal) error
+	readJournalEntry(o journalOrdinal) (interface{}, error)
+	appendJournalEntry(o *journalOrdinal, entry interface{}) error
+	appendJournalEntries(o *journalOrdinal, entries []interface{}) error
+	removeEarliest() (journalOrdinal, error)
+	removeLatest() (journalOrdinal, error)
+	scanOrdinals() ([]journalOrdinal, error)
+	clearOrdinals() error
+	removeStrayEntry(o journalOrdinal) error
+	journalLength() (uint64, error)
+}
+
+var _ mdJournalStore = diskJournal{}
+
+// errJournalPointerCorrupt is returned when the earliest or latest
+// ordinal of a journal can't be read, e.g. because its file is
+// truncated or malformed, or isn't a valid MetadataRevision, or when
+// the two are inconsistent. rebuildPointers can recover from it,
+// since it doesn't read them.
+type errJournalPointerCorrupt struct {
+	pointer string
+	reason  string
+}
+
+func (e errJournalPointerCorrupt) Error() string {
+	return fmt.Sprintf("Corrupt journal pointer %s: %s",
+		e.pointer, e.reason)
+}
+
+// makeMDServerBranchJournal returns the journal in the given
+// directory, in the compact format if dir has a compact journal file,
+// and in the file-per-entry format otherwise.
 func makeMDServerBranchJournal(codec Codec, dir string) mdServerBranchJournal {
+	if _, err := os.Stat(compactMDJournalPath(dir)); err == nil {
+		return makeCompactMDServerBranchJournal(dir)
+	}
 	j := makeDiskJournal(codec, dir, reflect.TypeOf(MdID{}))
 	return mdServerBranchJournal{j}
 }
 
+// makeCompactMDServerBranchJournal returns a journal in the given
+// directory in the compact format, which should only be used for a
+// directory without a journal in the file-per-entry format.
+func makeCompactMDServerBranchJournal(dir string) mdServerBranchJournal {
+	return mdServerBranchJournal{makeCompactMDJournal(dir)}
+}
+
+// isCompact returns whether the journal is in the compact format.
+func (j mdServerBranchJournal) isCompact() bool {
+	_, ok := j.j.(compactMDJournal)
+	return ok
+}
+
 func ordinalToRevision(o journalOrdinal) (MetadataRevision, error) {
 	r := MetadataRevision(o)
 	if r < MetadataRevisionInitial {
@@ -55,7 +116,12 @@ func (j mdServerBranchJournal) readEarliestRevision() (
 	} else if err != nil {
 		return MetadataRevisionUninitialized, err
 	}
-	return ordinalToRevision(o)
+	r, err := ordinalToRevision(o)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			errJournalPointerCorrupt{"EARLIEST", err.Error()}
+	}
+	return r, nil
 }
 
 func (j mdServerBranchJournal) writeEarliestRevision(r MetadataRevision) error {
@@ -74,7 +140,12 @@ func (j mdServerBranchJournal) readLatestRevision() (
 	} else if err != nil {
 		return MetadataRevisionUninitialized, err
 	}
-	return ordinalToRevision(o)
+	r, err := ordinalToRevision(o)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			errJournalPointerCorrupt{"LATEST", err.Error()}
+	}
+	return r, nil
 }
 
 func (j mdServerBranchJournal) writeLatestRevision(r MetadataRevision) error {
@@ -101,6 +172,241 @@ func (j mdServerBranchJournal) readMdID(r MetadataRevision) (MdID, error) {
 
 // All functions below are public functions.
 
+// checkPointers returns an errJournalPointerCorrupt if either of the
+// earliest and latest revisions can't be read, if exactly one of them
+// is set, or if the earliest revision is greater than the latest one.
+func (j mdServerBranchJournal) checkPointers() error {
+	_, _, err := j.readPointers()
+	return err
+}
+
+// readPointers returns the earliest and latest revisions, after
+// checking them as checkPointers does.
+func (j mdServerBranchJournal) readPointers() (
+	earliest, latest MetadataRevision, err error) {
+	earliest, err = j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	latest, err = j.readLatestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+
+	if (earliest == MetadataRevisionUninitialized) !=
+		(latest == MetadataRevisionUninitialized) {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			errJournalPointerCorrupt{"EARLIEST", fmt.Sprintf(
+				"Inconsistent earliest revision %s and "+
+					"latest revision %s", earliest, latest)}
+	}
+
+	if earliest > latest {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			errJournalPointerCorrupt{"EARLIEST", fmt.Sprintf(
+				"Earliest revision %s is greater than "+
+					"latest revision %s", earliest, latest)}
+	}
+
+	return earliest, latest, nil
+}
+
+// rebuildPointers resets the earliest and latest revisions to the
+// lowest and highest ones whose entries are present, or empties the
+// journal if there are none, and returns the new values. It fails
+// without changing anything if the present entries don't form a
+// contiguous range, since then it's unclear which of them are valid.
+func (j mdServerBranchJournal) rebuildPointers() (
+	earliest, latest MetadataRevision, err error) {
+	ordinals, err := j.j.scanOrdinals()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+
+	if len(ordinals) == 0 {
+		err := j.j.clearOrdinals()
+		if err != nil {
+			return MetadataRevisionUninitialized,
+				MetadataRevisionUninitialized, err
+		}
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, nil
+	}
+
+	for i := 1; i < len(ordinals); i++ {
+		if ordinals[i] != ordinals[i-1]+1 {
+			return MetadataRevisionUninitialized,
+				MetadataRevisionUninitialized, fmt.Errorf(
+					"Entries are missing between %s and %s",
+					ordinals[i-1], ordinals[i])
+		}
+	}
+
+	earliest, err = ordinalToRevision(ordinals[0])
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	latest, err = ordinalToRevision(ordinals[len(ordinals)-1])
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+
+	err = j.writeEarliestRevision(earliest)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	err = j.writeLatestRevision(latest)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	return earliest, latest, nil
+}
+
+// mdBranchJournalRepair is what reconcile changed in a journal to
+// undo the effects of an interrupted append or removal.
+type mdBranchJournalRepair struct {
+	// cleared is true if only one of the earliest and latest
+	// revisions was set, and the journal was emptied.
+	cleared bool
+	// If oldLatest is set, the latest revision pointed at a
+	// missing entry, and was moved back to newLatest, which is
+	// MetadataRevisionUninitialized if no entry was left.
+	oldLatest, newLatest MetadataRevision
+	// strays are the ordinals of the entries outside of the
+	// journal's range that were removed.
+	strays []journalOrdinal
+}
+
+func (r mdBranchJournalRepair) repaired() bool {
+	return r.cleared || r.oldLatest != MetadataRevisionUninitialized ||
+		len(r.strays) > 0
+}
+
+func (r mdBranchJournalRepair) String() string {
+	var fixes []string
+	if r.cleared {
+		fixes = append(fixes,
+			"cleared a lone earliest or latest revision")
+	}
+	if r.oldLatest != MetadataRevisionUninitialized {
+		fixes = append(fixes, fmt.Sprintf(
+			"moved the latest revision back from %s to %s",
+			r.oldLatest, r.newLatest))
+	}
+	if len(r.strays) > 0 {
+		fixes = append(fixes, fmt.Sprintf(
+			"removed stray entries %v", r.strays))
+	}
+	return strings.Join(fixes, ", ")
+}
+
+// reconcile brings the journal back to the last consistent state
+// after an unclean shutdown. Since entries are written before the
+// latest revision that covers them, an interrupted append can leave
+// entries past the latest revision, and a lost write can leave the
+// latest revision pointing at a missing entry; both are rolled back.
+// Only the first append and the removal of the last entry set one of
+// the earliest and latest revisions without the other, so when that
+// and at most the entry it points at are all there is, the journal
+// is emptied. Entries left outside of the resulting range, e.g. by
+// an interrupted removeEarliest, are removed.
+//
+// Anything else, such as an earliest revision greater than the
+// latest one, isn't the result of an interruption, so it is left for
+// checkPointers to report.
+func (j mdServerBranchJournal) reconcile() (mdBranchJournalRepair, error) {
+	var repair mdBranchJournalRepair
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return mdBranchJournalRepair{}, err
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return mdBranchJournalRepair{}, err
+	}
+	ordinals, err := j.j.scanOrdinals()
+	if err != nil {
+		return mdBranchJournalRepair{}, err
+	}
+
+	switch {
+	case (earliest == MetadataRevisionUninitialized) !=
+		(latest == MetadataRevisionUninitialized):
+		set := earliest
+		if set == MetadataRevisionUninitialized {
+			set = latest
+		}
+		o := journalOrdinal(set)
+		if len(ordinals) > 1 ||
+			(len(ordinals) == 1 && ordinals[0] != o) {
+			return mdBranchJournalRepair{}, nil
+		}
+		err := j.j.clearOrdinals()
+		if err != nil {
+			return mdBranchJournalRepair{}, err
+		}
+		repair.cleared = true
+		earliest = MetadataRevisionUninitialized
+		latest = MetadataRevisionUninitialized
+
+	case earliest > latest:
+		return mdBranchJournalRepair{}, nil
+
+	case latest != MetadataRevisionUninitialized:
+		newLatest := latest
+		for ; newLatest >= earliest; newLatest-- {
+			_, err := j.readMdID(newLatest)
+			if err == nil {
+				break
+			} else if !os.IsNotExist(err) {
+				return mdBranchJournalRepair{}, err
+			}
+		}
+		if newLatest == latest {
+			break
+		}
+
+		if newLatest < earliest {
+			newLatest = MetadataRevisionUninitialized
+			err = j.j.clearOrdinals()
+		} else {
+			err = j.writeLatestRevision(newLatest)
+		}
+		if err != nil {
+			return mdBranchJournalRepair{}, err
+		}
+		repair.oldLatest = latest
+		repair.newLatest = newLatest
+		latest = newLatest
+		if latest == MetadataRevisionUninitialized {
+			earliest = MetadataRevisionUninitialized
+		}
+	}
+
+	for _, o := range ordinals {
+		r := MetadataRevision(o)
+		if latest != MetadataRevisionUninitialized &&
+			r >= earliest && r <= latest {
+			continue
+		}
+		err := j.j.removeStrayEntry(o)
+		if err != nil {
+			return mdBranchJournalRepair{}, err
+		}
+		repair.strays = append(repair.strays, o)
+	}
+	return repair, nil
+}
+
 func (j mdServerBranchJournal) journalLength() (uint64, error) {
 	return j.j.journalLength()
 }
@@ -117,20 +423,13 @@ func (j mdServerBranchJournal) getHead() (MdID, error) {
 
 func (j mdServerBranchJournal) getRange(
 	start, stop MetadataRevision) (MetadataRevision, []MdID, error) {
-	earliestRevision, err := j.readEarliestRevision()
+	earliestRevision, latestRevision, err := j.readPointers()
 	if err != nil {
 		return MetadataRevisionUninitialized, nil, err
 	} else if earliestRevision == MetadataRevisionUninitialized {
 		return MetadataRevisionUninitialized, nil, nil
 	}
 
-	latestRevision, err := j.readLatestRevision()
-	if err != nil {
-		return MetadataRevisionUninitialized, nil, err
-	} else if latestRevision == MetadataRevisionUninitialized {
-		return MetadataRevisionUninitialized, nil, nil
-	}
-
 	if start < earliestRevision {
 		start = earliestRevision
 	}
@@ -154,6 +453,56 @@ func (j mdServerBranchJournal) getRange(
 	return start, mdIDs, nil
 }
 
+// removeEarliest removes the earliest revision in the journal, and
+// returns it along with its MdID.
+func (j mdServerBranchJournal) removeEarliest() (
+	MetadataRevision, MdID, error) {
+	earliestRevision, err := j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	} else if earliestRevision == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, MdID{},
+			errors.New("Cannot remove from an empty journal")
+	}
+
+	mdID, err := j.readMdID(earliestRevision)
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	}
+
+	_, err = j.j.removeEarliest()
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	}
+
+	return earliestRevision, mdID, nil
+}
+
+// removeLatest removes the latest revision in the journal, and
+// returns it along with its MdID.
+func (j mdServerBranchJournal) removeLatest() (
+	MetadataRevision, MdID, error) {
+	latestRevision, err := j.readLatestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	} else if latestRevision == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, MdID{},
+			errors.New("Cannot remove from an empty journal")
+	}
+
+	mdID, err := j.readMdID(latestRevision)
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	}
+
+	_, err = j.j.removeLatest()
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	}
+
+	return latestRevision, mdID, nil
+}
+
 func (j mdServerBranchJournal) append(r MetadataRevision, mdID MdID) error {
 	o, err := revisionToOrdinal(r)
 	if err != nil {
@@ -161,3 +510,103 @@ func (j mdServerBranchJournal) append(r MetadataRevision, mdID MdID) error {
 	}
 	return j.j.appendJournalEntry(&o, mdID)
 }
+
+// appendBatch appends the given MdIDs to the journal, with the first
+// one at revision start, writing the latest revision only once; see
+// diskJournal.appendJournalEntries.
+func (j mdServerBranchJournal) appendBatch(
+	start MetadataRevision, mdIDs []MdID) error {
+	o, err := revisionToOrdinal(start)
+	if err != nil {
+		return err
+	}
+	entries := make([]interface{}, len(mdIDs))
+	for i, mdID := range mdIDs {
+		entries[i] = mdID
+	}
+	return j.j.appendJournalEntries(&o, entries)
+}
+
+// convertMDServerBranchJournal converts the journal in dir to the
+// compact format if compact is true, and to the file-per-entry format
+// otherwise, keeping its entries and its earliest and latest
+// revisions. Stray entries outside of that range are dropped. Other
+// files in dir are left alone.
+//
+// The new journal is complete before the old one is removed, and the
+// compact journal file, which decides the format, is created
+// atomically when converting to it and removed last when converting
+// from it, so an interrupted conversion leaves either the old or the
+// new journal in effect, and can be retried.
+func convertMDServerBranchJournal(codec Codec, dir string, compact bool) error {
+	src := makeMDServerBranchJournal(codec, dir)
+	if src.isCompact() == compact {
+		return nil
+	}
+
+	err := src.checkPointers()
+	if err != nil {
+		return err
+	}
+	earliest, mdIDs, err := src.getRange(MetadataRevisionInitial, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+
+	if !compact {
+		dj := makeDiskJournal(codec, dir, reflect.TypeOf(MdID{}))
+		dst := mdServerBranchJournal{dj}
+		// Clear any pointers left behind by an interrupted
+		// conversion to the compact format.
+		err := dj.clearOrdinals()
+		if err != nil {
+			return err
+		}
+		if len(mdIDs) > 0 {
+			err := dst.appendBatch(earliest, mdIDs)
+			if err != nil {
+				return err
+			}
+		}
+		return os.Remove(compactMDJournalPath(dir))
+	}
+
+	tmpDir := filepath.Join(dir, "compact.tmp")
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+	cj := makeCompactMDJournal(tmpDir)
+	err = cj.init()
+	if err != nil {
+		return err
+	}
+	if len(mdIDs) > 0 {
+		err := mdServerBranchJournal{cj}.appendBatch(earliest, mdIDs)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(cj.path(), compactMDJournalPath(dir))
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	// Now remove the old journal.
+	dj := makeDiskJournal(codec, dir, reflect.TypeOf(MdID{}))
+	ordinals, err := dj.scanOrdinals()
+	if err != nil {
+		return err
+	}
+	for _, o := range ordinals {
+		err := os.Remove(dj.journalEntryPath(o))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return dj.clearOrdinals()
+}
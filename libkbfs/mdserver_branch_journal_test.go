@@ -0,0 +1,485 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readDirForTest returns the names and contents of the regular
+// files in dir.
+func readDirForTest(t *testing.T, dir string) map[string]string {
+	fileInfos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	files := make(map[string]string)
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		files[fi.Name()] = string(buf)
+	}
+	return files
+}
+
+func TestMDServerBranchJournalAppendBatch(t *testing.T) {
+	codec := NewCodecMsgpack()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_branch_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var mdIDs []MdID
+	for i := 0; i < 10; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	// Sequential appends and a batch append, each after an
+	// initial single append, give the same files.
+	seqDir := filepath.Join(tempdir, "seq")
+	seq := makeMDServerBranchJournal(codec, seqDir)
+	for i, mdID := range mdIDs {
+		err := seq.append(MetadataRevision(i+5), mdID)
+		require.NoError(t, err)
+	}
+
+	batchDir := filepath.Join(tempdir, "batch")
+	batch := makeMDServerBranchJournal(codec, batchDir)
+	err = batch.append(5, mdIDs[0])
+	require.NoError(t, err)
+	err = batch.appendBatch(6, mdIDs[1:])
+	require.NoError(t, err)
+
+	require.Equal(t, readDirForTest(t, seqDir), readDirForTest(t, batchDir))
+
+	// A batch append to an empty journal also matches.
+	emptyBatchDir := filepath.Join(tempdir, "emptyBatch")
+	emptyBatch := makeMDServerBranchJournal(codec, emptyBatchDir)
+	err = emptyBatch.appendBatch(5, mdIDs)
+	require.NoError(t, err)
+	require.Equal(t, readDirForTest(t, seqDir),
+		readDirForTest(t, emptyBatchDir))
+
+	// The batch must follow the latest revision.
+	err = batch.appendBatch(16, mdIDs)
+	require.Error(t, err)
+
+	// Make writing the third entry of the next batch fail, by
+	// putting a directory in its place.
+	before := readDirForTest(t, batchDir)
+	err = os.Mkdir(filepath.Join(batchDir, journalOrdinal(17).String()), 0700)
+	require.NoError(t, err)
+	err = batch.appendBatch(15, mdIDs)
+	require.Error(t, err)
+
+	// The journal is as before, apart from the stray entries.
+	earliest, gotIDs, err := batch.getRange(1, 100)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), earliest)
+	require.Equal(t, mdIDs, gotIDs)
+	err = batch.checkPointers()
+	require.NoError(t, err)
+	after := readDirForTest(t, batchDir)
+	for name, contents := range before {
+		require.Equal(t, contents, after[name])
+	}
+
+	// Once the obstacle is gone, the batch can be retried.
+	err = os.Remove(filepath.Join(batchDir, journalOrdinal(17).String()))
+	require.NoError(t, err)
+	err = batch.appendBatch(15, mdIDs)
+	require.NoError(t, err)
+	_, all, err := batch.getRange(1, 100)
+	require.NoError(t, err)
+	require.Equal(t, append(append([]MdID(nil), mdIDs...), mdIDs...), all)
+}
+
+// checkBranchJournalForTest checks that j has the given MdIDs,
+// starting at revision start, and no others.
+func checkBranchJournalForTest(t *testing.T, j mdServerBranchJournal,
+	start MetadataRevision, mdIDs []MdID) {
+	err := j.checkPointers()
+	require.NoError(t, err)
+	earliest, gotIDs, err := j.getRange(1, 100)
+	require.NoError(t, err)
+	if len(mdIDs) == 0 {
+		require.Equal(t, MetadataRevisionUninitialized, earliest)
+		require.Equal(t, 0, len(gotIDs))
+		return
+	}
+	require.Equal(t, start, earliest)
+	require.Equal(t, mdIDs, gotIDs)
+	length, err := j.journalLength()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(mdIDs)), length)
+}
+
+func TestMDServerBranchJournalCompact(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_branch_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var mdIDs []MdID
+	for i := 0; i < 10; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	j := makeCompactMDServerBranchJournal(tempdir)
+	require.True(t, j.isCompact())
+	checkBranchJournalForTest(t, j, 0, nil)
+
+	err = j.append(5, mdIDs[0])
+	require.NoError(t, err)
+	err = j.appendBatch(6, mdIDs[1:])
+	require.NoError(t, err)
+	checkBranchJournalForTest(t, j, 5, mdIDs)
+
+	// Appends must follow the latest revision.
+	err = j.append(16, mdIDs[0])
+	require.Error(t, err)
+
+	rev, mdID, err := j.removeEarliest()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), rev)
+	require.Equal(t, mdIDs[0], mdID)
+	rev, mdID, err = j.removeLatest()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(14), rev)
+	require.Equal(t, mdIDs[9], mdID)
+	checkBranchJournalForTest(t, j, 6, mdIDs[1:9])
+
+	// The journal is found again in its directory.
+	j = makeMDServerBranchJournal(NewCodecMsgpack(), tempdir)
+	require.True(t, j.isCompact())
+	checkBranchJournalForTest(t, j, 6, mdIDs[1:9])
+
+	// Lose the pointers, and rebuild them from the records.
+	err = j.j.clearOrdinals()
+	require.NoError(t, err)
+	earliest, latest, err := j.rebuildPointers()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(6), earliest)
+	require.Equal(t, MetadataRevision(13), latest)
+	checkBranchJournalForTest(t, j, 6, mdIDs[1:9])
+
+	// Empty the journal, and start it over at a lower revision.
+	for i := 0; i < 8; i++ {
+		_, _, err := j.removeEarliest()
+		require.NoError(t, err)
+	}
+	checkBranchJournalForTest(t, j, 0, nil)
+	err = j.appendBatch(2, mdIDs[:3])
+	require.NoError(t, err)
+	checkBranchJournalForTest(t, j, 2, mdIDs[:3])
+	ordinals, err := j.j.scanOrdinals()
+	require.NoError(t, err)
+	require.Equal(t, []journalOrdinal{2, 3, 4}, ordinals)
+
+	// Removing records from the front eventually shrinks the
+	// file, so that a journal used as a queue doesn't grow
+	// without bound.
+	path := compactMDJournalPath(tempdir)
+	nextRev := MetadataRevision(5)
+	var maxSize int64
+	for i := 0; i < 4*compactMDJournalMinDeadRecords; i++ {
+		err := j.append(nextRev, mdIDs[i%len(mdIDs)])
+		require.NoError(t, err)
+		nextRev++
+		_, _, err = j.removeEarliest()
+		require.NoError(t, err)
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		if fi.Size() > maxSize {
+			maxSize = fi.Size()
+		}
+	}
+	require.True(t, maxSize <= compactMDJournalHeaderLen+
+		2*(compactMDJournalMinDeadRecords+3)*compactMDJournalRecordLen)
+	err = j.checkPointers()
+	require.NoError(t, err)
+	earliest, gotIDs, err := j.getRange(1, nextRev)
+	require.NoError(t, err)
+	require.Equal(t, nextRev-3, earliest)
+	require.Equal(t, []MdID{
+		mdIDs[(4*compactMDJournalMinDeadRecords-3)%len(mdIDs)],
+		mdIDs[(4*compactMDJournalMinDeadRecords-2)%len(mdIDs)],
+		mdIDs[(4*compactMDJournalMinDeadRecords-1)%len(mdIDs)],
+	}, gotIDs)
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	// An empty file is a fresh journal.
+	err = ioutil.WriteFile(path, nil, 0600)
+	require.NoError(t, err)
+	checkBranchJournalForTest(t, j, 0, nil)
+	err = j.appendBatch(2, mdIDs[:3])
+	require.NoError(t, err)
+	checkBranchJournalForTest(t, j, 2, mdIDs[:3])
+}
+
+func TestMDServerBranchJournalConvert(t *testing.T) {
+	codec := NewCodecMsgpack()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_branch_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var mdIDs []MdID
+	for i := 0; i < 10; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	j := makeMDServerBranchJournal(codec, tempdir)
+	err = j.appendBatch(3, mdIDs)
+	require.NoError(t, err)
+	_, _, err = j.removeEarliest()
+	require.NoError(t, err)
+	// Other files in the directory are left alone.
+	err = ioutil.WriteFile(filepath.Join(tempdir, "WRITERS"), []byte("x"), 0600)
+	require.NoError(t, err)
+	before := readDirForTest(t, tempdir)
+
+	err = convertMDServerBranchJournal(codec, tempdir, true)
+	require.NoError(t, err)
+	j = makeMDServerBranchJournal(codec, tempdir)
+	require.True(t, j.isCompact())
+	checkBranchJournalForTest(t, j, 4, mdIDs[1:])
+	var names []string
+	for name := range readDirForTest(t, tempdir) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"JOURNAL", "WRITERS"}, names)
+
+	// Converting to the current format does nothing.
+	err = convertMDServerBranchJournal(codec, tempdir, true)
+	require.NoError(t, err)
+
+	err = convertMDServerBranchJournal(codec, tempdir, false)
+	require.NoError(t, err)
+	j = makeMDServerBranchJournal(codec, tempdir)
+	require.False(t, j.isCompact())
+	checkBranchJournalForTest(t, j, 4, mdIDs[1:])
+	require.Equal(t, before, readDirForTest(t, tempdir))
+
+	// Empty journals convert too.
+	emptyDir := filepath.Join(tempdir, "empty")
+	err = convertMDServerBranchJournal(codec, emptyDir, true)
+	require.NoError(t, err)
+	j = makeMDServerBranchJournal(codec, emptyDir)
+	require.True(t, j.isCompact())
+	checkBranchJournalForTest(t, j, 0, nil)
+}
+
+func TestMDServerBranchJournalReconcile(t *testing.T) {
+	codec := NewCodecMsgpack()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_branch_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var mdIDs []MdID
+	for i := 0; i < 10; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	makeJournal := func(name string, n int) (
+		mdServerBranchJournal, diskJournal) {
+		j := makeMDServerBranchJournal(
+			codec, filepath.Join(tempdir, name))
+		if n > 0 {
+			err := j.appendBatch(5, mdIDs[:n])
+			require.NoError(t, err)
+		}
+		return j, j.j.(diskJournal)
+	}
+
+	// A consistent journal is left alone.
+	j, _ := makeJournal("consistent", 5)
+	repair, err := j.reconcile()
+	require.NoError(t, err)
+	require.False(t, repair.repaired())
+	checkBranchJournalForTest(t, j, 5, mdIDs[:5])
+
+	// An append interrupted after its entry was written, but
+	// before the latest revision was, is rolled back.
+	j, dj := makeJournal("entryWritten", 5)
+	err = dj.writeJournalEntry(10, mdIDs[5])
+	require.NoError(t, err)
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []journalOrdinal{10}, repair.strays)
+	checkBranchJournalForTest(t, j, 5, mdIDs[:5])
+	_, err = os.Stat(dj.journalEntryPath(10))
+	require.True(t, os.IsNotExist(err))
+	err = j.append(10, mdIDs[5])
+	require.NoError(t, err)
+	checkBranchJournalForTest(t, j, 5, mdIDs[:6])
+
+	// So is a first append interrupted after the earliest
+	// revision was written.
+	j, dj = makeJournal("firstAppend", 0)
+	err = dj.writeJournalEntry(5, mdIDs[0])
+	require.NoError(t, err)
+	err = dj.writeEarliestOrdinal(5)
+	require.NoError(t, err)
+	require.Error(t, j.checkPointers())
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.True(t, repair.cleared)
+	require.Equal(t, []journalOrdinal{5}, repair.strays)
+	checkBranchJournalForTest(t, j, 0, nil)
+
+	// A latest revision pointing at a missing entry, e.g. if the
+	// entry's write was lost, is moved back to the last entry
+	// present.
+	j, dj = makeJournal("entryLost", 5)
+	err = dj.writeLatestOrdinal(11)
+	require.NoError(t, err)
+	err = os.Remove(dj.journalEntryPath(9))
+	require.NoError(t, err)
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(11), repair.oldLatest)
+	require.Equal(t, MetadataRevision(8), repair.newLatest)
+	checkBranchJournalForTest(t, j, 5, mdIDs[:4])
+
+	// If no entry is left, the journal is emptied.
+	j, dj = makeJournal("allLost", 1)
+	err = os.Remove(dj.journalEntryPath(5))
+	require.NoError(t, err)
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, repair.newLatest)
+	checkBranchJournalForTest(t, j, 0, nil)
+
+	// An interrupted removeEarliest leaves a stray entry behind.
+	j, dj = makeJournal("removeEarliest", 5)
+	err = dj.writeEarliestOrdinal(6)
+	require.NoError(t, err)
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []journalOrdinal{5}, repair.strays)
+	checkBranchJournalForTest(t, j, 6, mdIDs[1:5])
+
+	// Inverted pointers aren't the result of an interruption, so
+	// they are left for checkPointers to report.
+	j, dj = makeJournal("inverted", 5)
+	err = dj.writeEarliestOrdinal(9)
+	require.NoError(t, err)
+	err = dj.writeLatestOrdinal(6)
+	require.NoError(t, err)
+	repair, err = j.reconcile()
+	require.NoError(t, err)
+	require.False(t, repair.repaired())
+	require.Error(t, j.checkPointers())
+
+	// A compact journal is reconciled the same way.
+	cj := makeCompactMDServerBranchJournal(
+		filepath.Join(tempdir, "compact"))
+	err = cj.appendBatch(5, mdIDs[:5])
+	require.NoError(t, err)
+	_, _, err = cj.removeLatest()
+	require.NoError(t, err)
+	err = cj.j.(compactMDJournal).writeLatestOrdinal(9)
+	require.NoError(t, err)
+	repair, err = cj.reconcile()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(9), repair.oldLatest)
+	require.Equal(t, MetadataRevision(8), repair.newLatest)
+	checkBranchJournalForTest(t, cj, 5, mdIDs[:4])
+}
+
+func TestMDServerBranchJournalCorruptPointers(t *testing.T) {
+	codec := NewCodecMsgpack()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_branch_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var mdIDs []MdID
+	for i := 0; i < 5; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	// requireCorrupt checks that the given pointer file, once
+	// overwritten with the given contents, makes the journal
+	// reads fail with errJournalPointerCorrupt, and that
+	// rebuildPointers recovers from it. If valid is set, the
+	// pointer itself is valid, but not with the other one.
+	requireCorrupt := func(
+		name string, latest bool, contents string, valid bool) {
+		j := makeMDServerBranchJournal(
+			codec, filepath.Join(tempdir, name))
+		err := j.appendBatch(5, mdIDs)
+		require.NoError(t, err)
+		dj := j.j.(diskJournal)
+		path := dj.earliestPath()
+		if latest {
+			path = dj.latestPath()
+		}
+		err = ioutil.WriteFile(path, []byte(contents), 0600)
+		require.NoError(t, err)
+
+		_, _, err = j.getRange(5, 9)
+		require.IsType(t, errJournalPointerCorrupt{}, err, name)
+		require.IsType(t, errJournalPointerCorrupt{}, j.checkPointers())
+		if latest {
+			_, err = j.readLatestRevision()
+		} else {
+			_, err = j.readEarliestRevision()
+		}
+		if valid {
+			require.NoError(t, err)
+		} else {
+			require.IsType(t, errJournalPointerCorrupt{}, err)
+		}
+
+		_, _, err = j.rebuildPointers()
+		require.NoError(t, err)
+		checkBranchJournalForTest(t, j, 5, mdIDs)
+	}
+
+	requireCorrupt("truncated", false, "00000000", false)
+	requireCorrupt("empty", true, "", false)
+	requireCorrupt("malformed", true, "000000000000000g", false)
+	// Both are above the highest MetadataRevision.
+	requireCorrupt("negative", false, "ffffffffffffffff", false)
+	requireCorrupt("huge", true, "8000000000000000", false)
+	requireCorrupt("zero", false, "0000000000000000", false)
+	requireCorrupt("inverted", false, "000000000000000a", true)
+
+	// A compact journal with a truncated header.
+	cj := makeCompactMDServerBranchJournal(
+		filepath.Join(tempdir, "compact"))
+	err = cj.appendBatch(5, mdIDs)
+	require.NoError(t, err)
+	err = os.Truncate(cj.j.(compactMDJournal).path(), 20)
+	require.NoError(t, err)
+	_, _, err = cj.getRange(5, 9)
+	require.IsType(t, errJournalPointerCorrupt{}, err)
+}
@@ -0,0 +1,618 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// compactMDJournal stores an ordered list of MdIDs in a single
+// append-only file, as an alternative to a diskJournal with one file
+// per entry, which is inode-heavy and slow to scan for long
+// histories.
+//
+// The file is dir/JOURNAL, and looks like:
+//
+//	header:  magic (8 bytes), base, earliest, latest (8 bytes each)
+//	records: ordinal (8 bytes), MdID length (1 byte), MdID (padded)
+//
+// with all integers big-endian. The record for ordinal o is at
+// offset compactMDJournalHeaderLen+(o-base)*compactMDJournalRecordLen.
+// Ordinal 0 is reserved: an earliest or latest ordinal of 0 means
+// that pointer is unset, and a record with ordinal 0 has been
+// removed.
+//
+// Records are always written and synced before the header that
+// points to them, and removals update the header before zeroing the
+// removed record, so an interruption can at worst leave stray
+// records outside of [earliest, latest], which later appends
+// overwrite.
+//
+// Once enough records have been removed from the front, the file is
+// rewritten without them, with base set to earliest; see compact.
+//
+// Like diskJournal, this class is not goroutine-safe.
+type compactMDJournal struct {
+	dir string
+}
+
+var compactMDJournalMagic = []byte("MDJRNL\x00\x01")
+
+const (
+	compactMDJournalHeaderLen = 32
+	compactMDJournalRecordLen = 8 + 1 + MaxHashByteLength
+	// compactMDJournalMinDeadRecords is the smallest number of
+	// removed records before earliest for which removeEarliest
+	// compacts the file.
+	compactMDJournalMinDeadRecords = 128
+)
+
+var _ mdJournalStore = compactMDJournal{}
+
+func makeCompactMDJournal(dir string) compactMDJournal {
+	return compactMDJournal{dir}
+}
+
+func compactMDJournalPath(dir string) string {
+	return filepath.Join(dir, "JOURNAL")
+}
+
+func (j compactMDJournal) path() string {
+	return compactMDJournalPath(j.dir)
+}
+
+type compactMDJournalHeader struct {
+	base, earliest, latest journalOrdinal
+}
+
+func (h compactMDJournalHeader) empty() bool {
+	return h.earliest == 0 && h.latest == 0
+}
+
+func (j compactMDJournal) recordOffset(
+	h compactMDJournalHeader, o journalOrdinal) int64 {
+	return compactMDJournalHeaderLen +
+		int64(o-h.base)*compactMDJournalRecordLen
+}
+
+// notExistError returns an error for which os.IsNotExist is true,
+// matching what diskJournal returns for missing files.
+func (j compactMDJournal) notExistError(what string) error {
+	return &os.PathError{
+		Op:   "read " + what,
+		Path: j.path(),
+		Err:  os.ErrNotExist,
+	}
+}
+
+// readHeader returns the header, which is all zeroes if the file
+// doesn't exist yet or is empty, e.g. because it was created but
+// never written.
+func (j compactMDJournal) readHeader() (compactMDJournalHeader, error) {
+	f, err := os.Open(j.path())
+	if os.IsNotExist(err) {
+		return compactMDJournalHeader{}, nil
+	} else if err != nil {
+		return compactMDJournalHeader{}, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, compactMDJournalHeaderLen)
+	_, err = io.ReadFull(f, buf)
+	if err == io.EOF {
+		return compactMDJournalHeader{}, nil
+	} else if err == io.ErrUnexpectedEOF {
+		// The header holds the earliest and latest ordinals.
+		return compactMDJournalHeader{}, errJournalPointerCorrupt{
+			"header", fmt.Sprintf("%s is truncated", j.path())}
+	} else if err != nil {
+		return compactMDJournalHeader{}, err
+	}
+	if !bytes.Equal(buf[:8], compactMDJournalMagic) {
+		return compactMDJournalHeader{}, fmt.Errorf(
+			"%s is not a compact journal", j.path())
+	}
+	return compactMDJournalHeader{
+		base:     journalOrdinal(binary.BigEndian.Uint64(buf[8:])),
+		earliest: journalOrdinal(binary.BigEndian.Uint64(buf[16:])),
+		latest:   journalOrdinal(binary.BigEndian.Uint64(buf[24:])),
+	}, nil
+}
+
+// openFile opens the journal file for writing, creating it along
+// with dir if needed.
+func (j compactMDJournal) openFile() (*os.File, error) {
+	err := os.MkdirAll(j.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(j.path(), os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// init creates the journal file, empty, if it doesn't exist yet.
+func (j compactMDJournal) init() error {
+	_, err := os.Stat(j.path())
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := j.openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return j.writeHeader(f, compactMDJournalHeader{})
+}
+
+// writeHeader writes and syncs the given header.
+func (j compactMDJournal) writeHeader(
+	f *os.File, h compactMDJournalHeader) error {
+	buf := make([]byte, compactMDJournalHeaderLen)
+	copy(buf, compactMDJournalMagic)
+	binary.BigEndian.PutUint64(buf[8:], uint64(h.base))
+	binary.BigEndian.PutUint64(buf[16:], uint64(h.earliest))
+	binary.BigEndian.PutUint64(buf[24:], uint64(h.latest))
+	_, err := f.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// updateHeader reads the header, applies update to it, and writes it
+// back.
+func (j compactMDJournal) updateHeader(
+	update func(h *compactMDJournalHeader)) error {
+	h, err := j.readHeader()
+	if err != nil {
+		return err
+	}
+	f, err := j.openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	update(&h)
+	return j.writeHeader(f, h)
+}
+
+func encodeCompactMDJournalRecord(o journalOrdinal, mdID MdID) ([]byte, error) {
+	buf := make([]byte, compactMDJournalRecordLen)
+	if o == 0 {
+		return buf, nil
+	}
+	idBytes := mdID.Bytes()
+	if len(idBytes) > MaxHashByteLength {
+		return nil, fmt.Errorf("MdID %s is too long", mdID)
+	}
+	binary.BigEndian.PutUint64(buf, uint64(o))
+	buf[8] = byte(len(idBytes))
+	copy(buf[9:], idBytes)
+	return buf, nil
+}
+
+// readRecord returns the ordinal and MdID stored in the record slot
+// for o, or a zero ordinal if the slot is past the end of the file.
+func (j compactMDJournal) readRecord(f *os.File,
+	h compactMDJournalHeader, o journalOrdinal) (
+	journalOrdinal, MdID, error) {
+	if o < h.base {
+		return 0, MdID{}, nil
+	}
+	buf := make([]byte, compactMDJournalRecordLen)
+	_, err := f.ReadAt(buf, j.recordOffset(h, o))
+	if err == io.EOF {
+		return 0, MdID{}, nil
+	} else if err != nil {
+		return 0, MdID{}, err
+	}
+	stored := journalOrdinal(binary.BigEndian.Uint64(buf))
+	if stored == 0 {
+		return 0, MdID{}, nil
+	}
+	n := int(buf[8])
+	if n > MaxHashByteLength {
+		return 0, MdID{}, fmt.Errorf(
+			"Invalid MdID length %d for ordinal %s", n, stored)
+	}
+	mdID, err := MdIDFromBytes(buf[9 : 9+n])
+	if err != nil {
+		return 0, MdID{}, err
+	}
+	return stored, mdID, nil
+}
+
+// The functions below implement mdJournalStore.
+
+func (j compactMDJournal) readEarliestOrdinal() (journalOrdinal, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if h.earliest == 0 {
+		return 0, j.notExistError("earliest ordinal")
+	}
+	return h.earliest, nil
+}
+
+func (j compactMDJournal) readLatestOrdinal() (journalOrdinal, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if h.latest == 0 {
+		return 0, j.notExistError("latest ordinal")
+	}
+	return h.latest, nil
+}
+
+func (j compactMDJournal) writeEarliestOrdinal(o journalOrdinal) error {
+	return j.updateHeader(func(h *compactMDJournalHeader) {
+		h.earliest = o
+	})
+}
+
+func (j compactMDJournal) writeLatestOrdinal(o journalOrdinal) error {
+	return j.updateHeader(func(h *compactMDJournalHeader) {
+		h.latest = o
+	})
+}
+
+func (j compactMDJournal) readJournalEntry(o journalOrdinal) (
+	interface{}, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(j.path())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stored, mdID, err := j.readRecord(f, h, o)
+	if err != nil {
+		return nil, err
+	}
+	if stored != o {
+		return nil, j.notExistError(fmt.Sprintf("entry %s", o))
+	}
+	return mdID, nil
+}
+
+func (j compactMDJournal) appendJournalEntry(
+	o *journalOrdinal, entry interface{}) error {
+	return j.appendJournalEntries(o, []interface{}{entry})
+}
+
+// appendJournalEntries is like diskJournal.appendJournalEntries, but
+// o must be non-nil, since ordinal 0 is reserved.
+func (j compactMDJournal) appendJournalEntries(
+	o *journalOrdinal, entries []interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if o == nil || *o == 0 {
+		return fmt.Errorf("Appends to a compact journal need a " +
+			"non-zero ordinal")
+	}
+
+	mdIDType := reflect.TypeOf(MdID{})
+	for _, entry := range entries {
+		if entryType := reflect.TypeOf(entry); entryType != mdIDType {
+			panic(fmt.Errorf("Expected entry type %v, got %v",
+				mdIDType, entryType))
+		}
+	}
+
+	h, err := j.readHeader()
+	if err != nil {
+		return err
+	}
+
+	f, err := j.openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	first := *o
+	if h.latest == 0 {
+		// Start over with the new entries, discarding any
+		// stray records. The header is written first, so the
+		// stray records are never read with the new base.
+		h = compactMDJournalHeader{base: first}
+		err := j.writeHeader(f, h)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(compactMDJournalHeaderLen)
+		if err != nil {
+			return err
+		}
+	} else {
+		next := h.latest + 1
+		if next == 0 {
+			return fmt.Errorf("Ordinal rollover for %+v", entries[0])
+		}
+		if first != next {
+			return fmt.Errorf(
+				"%v unexpectedly does not follow %v for %+v",
+				first, h.latest, entries[0])
+		}
+	}
+
+	last := first + journalOrdinal(len(entries)-1)
+	if last < first {
+		return fmt.Errorf("Ordinal rollover for %+v",
+			entries[len(entries)-1])
+	}
+
+	buf := make([]byte, 0, len(entries)*compactMDJournalRecordLen)
+	for i, entry := range entries {
+		record, err := encodeCompactMDJournalRecord(
+			first+journalOrdinal(i), entry.(MdID))
+		if err != nil {
+			return err
+		}
+		buf = append(buf, record...)
+	}
+	_, err = f.WriteAt(buf, j.recordOffset(h, first))
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	if h.earliest == 0 {
+		h.earliest = first
+	}
+	h.latest = last
+	return j.writeHeader(f, h)
+}
+
+// zeroRecord marks the record for o as removed.
+func (j compactMDJournal) zeroRecord(
+	f *os.File, h compactMDJournalHeader, o journalOrdinal) error {
+	buf, err := encodeCompactMDJournalRecord(0, MdID{})
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(buf, j.recordOffset(h, o))
+	return err
+}
+
+func (j compactMDJournal) removeEarliest() (journalOrdinal, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if h.earliest == 0 {
+		return 0, j.notExistError("earliest ordinal")
+	}
+	if h.latest == 0 {
+		return 0, j.notExistError("latest ordinal")
+	}
+
+	removed := h.earliest
+	if h.earliest == h.latest {
+		h.earliest, h.latest = 0, 0
+	} else {
+		h.earliest++
+	}
+	err = func() error {
+		f, err := j.openFile()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = j.writeHeader(f, h)
+		if err != nil {
+			return err
+		}
+		return j.zeroRecord(f, h, removed)
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	if h.empty() {
+		// Drop all the records, as the next append would.
+		err = j.compact(h)
+	} else if dead := h.earliest - h.base; dead >=
+		compactMDJournalMinDeadRecords && dead > h.latest-h.earliest {
+		err = j.compact(h)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// compact rewrites the journal file, whose header is h, without the
+// records before h.earliest, by writing a temporary file and
+// renaming it into place. The records from h.earliest on, including
+// any stray ones past h.latest, are copied as they are.
+func (j compactMDJournal) compact(h compactMDJournalHeader) (err error) {
+	newH := compactMDJournalHeader{}
+	if !h.empty() {
+		newH = h
+		newH.base = h.earliest
+	}
+
+	tmpPath := j.path() + ".tmp"
+	tmp, err := os.OpenFile(
+		tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			_ = tmp.Close()
+		}
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if !h.empty() {
+		f, err := os.Open(j.path())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Seek(j.recordOffset(h, h.earliest), 0)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Seek(compactMDJournalHeaderLen, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tmp, f)
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// writeHeader syncs the records copied above too.
+	err = j.writeHeader(tmp, newH)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	tmp = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, j.path())
+}
+
+func (j compactMDJournal) removeLatest() (journalOrdinal, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if h.earliest == 0 {
+		return 0, j.notExistError("earliest ordinal")
+	}
+	if h.latest == 0 {
+		return 0, j.notExistError("latest ordinal")
+	}
+
+	f, err := j.openFile()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	removed := h.latest
+	if h.earliest == h.latest {
+		h.earliest, h.latest = 0, 0
+	} else {
+		h.latest--
+	}
+	err = j.writeHeader(f, h)
+	if err != nil {
+		return 0, err
+	}
+	err = j.zeroRecord(f, h, removed)
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// scanOrdinals returns the sorted ordinals of all the records that
+// haven't been removed, regardless of the earliest and latest
+// ordinals.
+func (j compactMDJournal) scanOrdinals() ([]journalOrdinal, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(j.path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	count := (fi.Size() - compactMDJournalHeaderLen) /
+		compactMDJournalRecordLen
+
+	var ordinals []journalOrdinal
+	for i := int64(0); i < count; i++ {
+		o := h.base + journalOrdinal(i)
+		stored, _, err := j.readRecord(f, h, o)
+		if err != nil {
+			return nil, err
+		}
+		if stored == o {
+			ordinals = append(ordinals, o)
+		}
+	}
+	return ordinals, nil
+}
+
+func (j compactMDJournal) clearOrdinals() error {
+	h, err := j.readHeader()
+	if err != nil {
+		return err
+	}
+	if h.empty() {
+		return nil
+	}
+	return j.updateHeader(func(h *compactMDJournalHeader) {
+		h.earliest, h.latest = 0, 0
+	})
+}
+
+// removeStrayEntry marks the record for o, which must be outside of
+// [earliest, latest], as removed.
+func (j compactMDJournal) removeStrayEntry(o journalOrdinal) error {
+	h, err := j.readHeader()
+	if err != nil {
+		return err
+	}
+	if o < h.base {
+		// There's no record for o.
+		return nil
+	}
+	f, err := j.openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return j.zeroRecord(f, h, o)
+}
+
+func (j compactMDJournal) journalLength() (uint64, error) {
+	h, err := j.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if h.earliest == 0 {
+		return 0, nil
+	}
+	return uint64(h.latest - h.earliest + 1), nil
+}
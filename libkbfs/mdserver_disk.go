@@ -15,6 +15,7 @@ import (
 
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/syndtr/goleveldb/leveldb"
 	"golang.org/x/net/context"
 )
@@ -22,15 +23,19 @@ import (
 type mdServerDiskShared struct {
 	dirPath string
 
-	// Protects handleDb, branchDb, tlfStorage, and
-	// truncateLockManager. After Shutdown() is called, handleDb,
-	// branchDb, tlfStorage, and truncateLockManager are nil.
+	// Protects handleDb, branchDb, tlfStorage, tlfStorageOpens,
+	// and truncateLockManager. After Shutdown() is called,
+	// handleDb, branchDb, tlfStorage, and truncateLockManager are
+	// nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb *leveldb.DB
 	// (TLF ID, device KID) -> branch ID
 	branchDb   *leveldb.DB
 	tlfStorage map[TlfID]*mdServerTlfStorage
+	// tlfStorageOpens holds the storages that getStorage is
+	// opening, outside of lock.
+	tlfStorageOpens map[TlfID]*mdServerDiskStorageOpen
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
@@ -71,6 +76,7 @@ func newMDServerDisk(config Config, dirPath string,
 		handleDb:            handleDb,
 		branchDb:            branchDb,
 		tlfStorage:          make(map[TlfID]*mdServerTlfStorage),
+		tlfStorageOpens:     make(map[TlfID]*mdServerDiskStorageOpen),
 		truncateLockManager: &truncateLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 		shutdownFunc:        shutdownFunc,
@@ -102,7 +108,22 @@ func NewMDServerTempDir(config Config) (*MDServerDisk, error) {
 
 var errMDServerDiskShutdown = errors.New("MDServerDisk is shutdown")
 
-func (md *MDServerDisk) getStorage(tlfID TlfID) (*mdServerTlfStorage, error) {
+// mdServerDiskStorageOpen is an open of a TLF's storage by
+// getStorage, which other callers for the same TLF wait on. storage
+// and err are set before done is closed.
+type mdServerDiskStorageOpen struct {
+	done    chan struct{}
+	storage *mdServerTlfStorage
+	err     error
+}
+
+// getStorage returns the open storage of the given TLF, opening it
+// if needed. Unless create is set, it returns nil if the TLF has no
+// storage directory yet, rather than create one, so that reads, e.g.
+// probes of unknown TLF IDs, leave nothing behind; until its first
+// put, such a TLF is empty.
+func (md *MDServerDisk) getStorage(ctx context.Context, tlfID TlfID,
+	create bool) (*mdServerTlfStorage, error) {
 	storage, err := func() (*mdServerTlfStorage, error) {
 		md.lock.RLock()
 		defer md.lock.RUnlock()
@@ -120,22 +141,110 @@ func (md *MDServerDisk) getStorage(tlfID TlfID) (*mdServerTlfStorage, error) {
 		return storage, nil
 	}
 
-	md.lock.Lock()
-	defer md.lock.Unlock()
-	if md.tlfStorage == nil {
-		return nil, errMDServerDiskShutdown
+	if !create {
+		_, err := os.Stat(md.storagePath(tlfID))
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, MDServerError{err}
+		}
+	}
+
+	// Either find the storage, or an open of it to wait on, or
+	// start an open of it.
+	var open *mdServerDiskStorageOpen
+	var opener bool
+	err = func() error {
+		md.lock.Lock()
+		defer md.lock.Unlock()
+		if md.tlfStorage == nil {
+			return errMDServerDiskShutdown
+		}
+
+		storage = md.tlfStorage[tlfID]
+		if storage != nil {
+			return nil
+		}
+
+		open = md.tlfStorageOpens[tlfID]
+		if open == nil {
+			open = &mdServerDiskStorageOpen{
+				done: make(chan struct{}),
+			}
+			md.tlfStorageOpens[tlfID] = open
+			opener = true
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
 	}
 
-	storage = md.tlfStorage[tlfID]
 	if storage != nil {
 		return storage, nil
 	}
 
-	path := filepath.Join(md.dirPath, tlfID.String())
-	storage = makeMDServerTlfStorage(
-		md.config.Codec(), md.config.Crypto(), path)
+	if !opener {
+		select {
+		case <-open.done:
+			return open.storage, open.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// Open the storage outside of md.lock, so that a slow open,
+	// or one that fails, holds up only the callers for this TLF.
+	open.storage, open.err = md.openStorage(ctx, tlfID)
 
-	md.tlfStorage[tlfID] = storage
+	md.lock.Lock()
+	delete(md.tlfStorageOpens, tlfID)
+	if open.err == nil {
+		if md.tlfStorage != nil {
+			md.tlfStorage[tlfID] = open.storage
+		} else {
+			_ = open.storage.close()
+			open.storage, open.err = nil, errMDServerDiskShutdown
+		}
+	}
+	md.lock.Unlock()
+	close(open.done)
+	return open.storage, open.err
+}
+
+func (md *MDServerDisk) storagePath(tlfID TlfID) string {
+	return filepath.Join(md.dirPath, tlfID.String())
+}
+
+// openStorage makes and opens the storage of the given TLF.
+func (md *MDServerDisk) openStorage(ctx context.Context, tlfID TlfID) (
+	*mdServerTlfStorage, error) {
+	codec, crypto, path :=
+		md.config.Codec(), md.config.Crypto(), md.storagePath(tlfID)
+	registry := md.config.MetricsRegistry()
+	if registry == nil {
+		storage := makeMDServerTlfStorage(codec, crypto, path)
+		err := storage.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	}
+
+	// The lock contention stats of all the storages are shared,
+	// under the same names in the registry.
+	storage := makeMDServerTlfStorageWithLockMetrics(
+		codec, crypto, path, registry)
+	storage.putLockHoldTimer = metrics.GetOrRegisterTimer(
+		"MDServerDisk.PutLockHold", registry)
+	storage.putWrittenMeter = metrics.GetOrRegisterMeter(
+		"MDServerDisk.PutWritten", registry)
+	storage.putDedupedMeter = metrics.GetOrRegisterMeter(
+		"MDServerDisk.PutDeduped", registry)
+	err := storage.open(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return storage, nil
 }
 
@@ -322,12 +431,15 @@ func (md *MDServerDisk) GetForTLF(ctx context.Context, id TlfID,
 		return nil, MDServerError{err}
 	}
 
-	tlfStorage, err := md.getStorage(id)
+	tlfStorage, err := md.getStorage(ctx, id, false)
 	if err != nil {
 		return nil, err
 	}
+	if tlfStorage == nil {
+		return nil, nil
+	}
 
-	return tlfStorage.getForTLF(currentUID, key.kid, bid)
+	return tlfStorage.getForTLF(ctx, currentUID, key.kid, bid)
 }
 
 // GetRange implements the MDServer interface for MDServerDisk.
@@ -358,12 +470,15 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id TlfID,
 		return nil, MDServerError{err}
 	}
 
-	tlfStorage, err := md.getStorage(id)
+	tlfStorage, err := md.getStorage(ctx, id, false)
 	if err != nil {
 		return nil, err
 	}
+	if tlfStorage == nil {
+		return nil, nil
+	}
 
-	return tlfStorage.getRange(currentUID, key.kid, bid, start, stop)
+	return tlfStorage.getRange(ctx, currentUID, key.kid, bid, start, stop)
 }
 
 // Put implements the MDServer interface for MDServerDisk.
@@ -378,12 +493,12 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned) error
 		return MDServerError{err}
 	}
 
-	tlfStorage, err := md.getStorage(rmds.MD.ID)
+	tlfStorage, err := md.getStorage(ctx, rmds.MD.ID, true)
 	if err != nil {
 		return err
 	}
 
-	recordBranchID, err := tlfStorage.put(currentUID, key.kid, rmds)
+	recordBranchID, err := tlfStorage.put(ctx, currentUID, key.kid, rmds)
 	if err != nil {
 		return err
 	}
@@ -507,7 +622,11 @@ func (md *MDServerDisk) Shutdown() {
 	md.tlfStorage = nil
 
 	for _, s := range tlfStorage {
-		s.shutdown()
+		err := s.close()
+		if err != nil {
+			md.log.Warning("error closing TLF storage in %s: %s",
+				s.dir, err)
+		}
 	}
 
 	if md.shutdownFunc != nil {
@@ -39,6 +39,12 @@ const (
 	// StatusCodeMDServerErrorConflictFolderMapping is the error code for a folder handle to folder ID
 	// mapping conflict error.
 	StatusCodeMDServerErrorConflictFolderMapping = 2810
+	// StatusCodeMDServerErrorTooManyBranches is the error code to indicate a TLF has reached its
+	// limit on unmerged branches.
+	StatusCodeMDServerErrorTooManyBranches = 2811
+	// StatusCodeMDServerErrorBranchClosed is the error code to indicate a put to an unmerged
+	// branch that has been closed.
+	StatusCodeMDServerErrorBranchClosed = 2812
 )
 
 // MDServerError is a generic server-side error.
@@ -267,6 +273,53 @@ func (e MDServerErrorConflictFolderMapping) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// MDServerErrorTooManyBranches is returned when a put would create a new
+// unmerged branch in a TLF that already has the maximum number of them.
+type MDServerErrorTooManyBranches struct {
+	Desc  string
+	Limit int
+}
+
+// Error implements the Error interface for MDServerErrorTooManyBranches.
+func (e MDServerErrorTooManyBranches) Error() string {
+	if e.Desc == "" {
+		return fmt.Sprintf("Too many branches: the limit is %d", e.Limit)
+	}
+	return e.Desc
+}
+
+// ToStatus implements the ExportableError interface for MDServerErrorTooManyBranches.
+func (e MDServerErrorTooManyBranches) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorTooManyBranches
+	s.Name = "TOO_MANY_BRANCHES"
+	s.Desc = e.Error()
+	return
+}
+
+// MDServerErrorBranchClosed is returned when a put is made to an
+// unmerged branch that has been closed, e.g. because it has been
+// resolved and merged.
+type MDServerErrorBranchClosed struct {
+	Desc string
+	BID  BranchID
+}
+
+// Error implements the Error interface for MDServerErrorBranchClosed.
+func (e MDServerErrorBranchClosed) Error() string {
+	if e.Desc == "" {
+		return fmt.Sprintf("Branch %s is closed", e.BID)
+	}
+	return e.Desc
+}
+
+// ToStatus implements the ExportableError interface for MDServerErrorBranchClosed.
+func (e MDServerErrorBranchClosed) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorBranchClosed
+	s.Name = "BRANCH_CLOSED"
+	s.Desc = e.Error()
+	return
+}
+
 // MDServerErrorUnwrapper is an implementation of rpc.ErrorUnwrapper
 // for errors coming from the MDServer.
 type MDServerErrorUnwrapper struct{}
@@ -323,6 +376,12 @@ func (eu MDServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, d
 	case StatusCodeMDServerErrorConflictFolderMapping:
 		appError = MDServerErrorConflictFolderMapping{Desc: s.Desc}
 		break
+	case StatusCodeMDServerErrorTooManyBranches:
+		appError = MDServerErrorTooManyBranches{Desc: s.Desc}
+		break
+	case StatusCodeMDServerErrorBranchClosed:
+		appError = MDServerErrorBranchClosed{Desc: s.Desc}
+		break
 	default:
 		ase := libkb.AppStatusError{
 			Code:   s.Code,
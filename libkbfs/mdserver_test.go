@@ -5,9 +5,11 @@
 package libkbfs
 
 import (
+	"os"
 	"testing"
 
 	"github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 
 	"golang.org/x/net/context"
@@ -174,3 +176,86 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 	_, err = mdServer.RegisterForUpdate(ctx, id2, MetadataRevisionInitial)
 	require.NoError(t, err)
 }
+
+func TestMDServerDiskReadsDontCreateStorage(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerTempDir(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Reads of a TLF that was never written find it empty, and
+	// leave no directory behind.
+	rmds, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Nil(t, rmds)
+	rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 0)
+	_, err = os.Stat(mdServer.storagePath(id))
+	require.True(t, os.IsNotExist(err))
+
+	// The first put creates it.
+	rmds, err = NewRootMetadataSignedForTest(id, h)
+	require.NoError(t, err)
+	rmds.MD.SerializedPrivateMetadata = []byte{0x1}
+	rmds.MD.Revision = MetadataRevisionInitial
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.clearCachedMetadataIDForTest()
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	_, err = os.Stat(mdServer.storagePath(id))
+	require.NoError(t, err)
+
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionInitial, head.MD.Revision)
+}
+
+func TestMDServerDiskLockMetrics(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	registry := config.MetricsRegistry()
+	require.NotNil(t, registry)
+	mdServer, err := NewMDServerTempDir(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	require.NoError(t, err)
+	rmds.MD.SerializedPrivateMetadata = []byte{0x1}
+	rmds.MD.Revision = MetadataRevisionInitial
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.clearCachedMetadataIDForTest()
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	_, err = mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+
+	// The storage the server opened for the TLF records its lock
+	// contention stats in the config's registry.
+	for _, name := range []string{
+		"MDServerTlfStorage.Lock.Put.Write.Wait",
+		"MDServerTlfStorage.Lock.Get.Read.Wait",
+	} {
+		timer, ok := registry.Get(name).(metrics.Timer)
+		require.True(t, ok, name)
+		require.True(t, timer.Count() > 0, name)
+	}
+}
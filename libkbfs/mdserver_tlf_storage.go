@@ -5,14 +5,26 @@
 package libkbfs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
 )
 
 // mdServerTlfStorage stores an ordered list of metadata IDs for each
@@ -21,8 +33,21 @@ import (
 //
 // The directory layout looks like:
 //
+// dir/VERSION
+// dir/CONFIG
+// dir/EPOCH
+// dir/EPOCH_LOCK
+// dir/OPEN_LOCK
+// dir/MDIDS
 // dir/md_branch_journals/00..00/EARLIEST
 // dir/md_branch_journals/00..00/LATEST
+// dir/md_branch_journals/00..00/WRITERS
+// dir/md_branch_journals/00..00/PINNED
+// dir/md_branch_journals/00..00/FLUSH_CURSORS
+// dir/md_branch_journals/00..00/APPROXIMATE_TIMES
+// dir/md_branch_journals/00..00/MERKLE
+// dir/md_branch_journals/00..00/REVISIONS
+// dir/md_branch_journals/5f..3d/CLOSED
 // dir/md_branch_journals/00..00/0...001
 // dir/md_branch_journals/00..00/0...002
 // dir/md_branch_journals/00..00/0...fff
@@ -31,14 +56,72 @@ import (
 // dir/md_branch_journals/5f..3d/0...0ff
 // dir/md_branch_journals/5f..3d/0...100
 // dir/md_branch_journals/5f..3d/0...fff
+// dir/md_branch_tombstones/5f..3d/...
 // dir/mds/0100/0...01
 // ...
 // dir/mds/01ff/f...ff
+// dir/key_bundles/0100/0...01
+// ...
+// dir/md_change_feed/EARLIEST
+// dir/md_change_feed/LATEST
+// dir/md_change_feed/0...001
+// ...
+// dir/md_change_feed_checkpoints/indexer
+//
+// The VERSION file holds the version of the on-disk format, so that
+// a directory written by newer code isn't misread by older code.
+//
+// The optional CONFIG file holds an mdServerTlfStorageConfig as
+// JSON, with settings for this TLF that override the ones the
+// mdServerTlfStorage was made with.
+//
+// The MDIDS file holds the sorted list of the IDs of all the MD
+// objects in dir/mds. It is read into memory by open, and atomically
+// replaced before every MD object is added or removed, with that
+// object marked as pending, so that if the process dies before the
+// change is made, the next open can tell by checking just that
+// object. If the file is missing or invalid, open rebuilds it by
+// scanning dir/mds.
+//
+// The EPOCH file holds a counter that is incremented by every open,
+// so that if the same dir is ever opened twice, only the most recent
+// opener may write to it. Opens increment it while holding a lock
+// on the EPOCH_LOCK file, and replace it by renaming, so that no two
+// opens get the same epoch and readers never see a partial write.
+// Each write checks that the EPOCH file is still the one its
+// instance's open wrote while holding a shared lock on EPOCH_LOCK
+// (see mdEpochFence), so that no open can come in between.
+//
+// Each open instance holds a lock on the OPEN_LOCK file until it is
+// closed: a shared one, or an exclusive one if exclusive is set. No
+// open waits for the lock: while an exclusive instance holds it,
+// other opens fail with a retriable error, and an exclusive open
+// fails while any other instance holds it. (On Windows, where
+// lockFile takes no lock, this gives no protection.)
 //
 // Each branch has its own subdirectory with a journal; the journal
 // ordinals are just MetadataRevisions, and the journal entries are
 // just MdIDs. (Branches are usually temporary, so no need to splay
-// them.)
+// them.) Each branch subdirectory also has a WRITERS file, which is
+// an index of the UIDs that have written to that branch, and which
+// can be rebuilt from the branch's history, and may have a PINNED
+// file, which lists the revisions that must not be pruned, a
+// FLUSH_CURSORS file, which holds the last revision each downstream
+// destination has flushed, below which alone prune may go, and an
+// APPROXIMATE_TIMES file, which lists the revisions whose timestamps
+// were reconstructed by repairTimestamps. The MERKLE file holds the
+// mdMerkleFrontier of the branch's Merkle tree as of some revision,
+// and is ignored unless that is the branch's latest revision. With
+// revisionIndex set, the REVISIONS file maps each revision of the
+// branch to the ID and path of its MD object, for operators; see
+// formatRevisionIndexEntry. An unmerged branch may also
+// have a CLOSED file, which means it has been closed by closeBranch
+// and can no longer be put to. A journal may instead be in the
+// compact format, in a single JOURNAL file; see compactMDJournal.
+//
+// A soft-deleted branch has its subdirectory moved to
+// dir/md_branch_tombstones, where it is invisible to reads, until it
+// is either restored or purged.
 //
 // The Metadata objects are stored separately in dir/mds. Each block
 // has its own subdirectory with its ID as a name. The MD
@@ -46,40 +129,704 @@ import (
 // subdirectories -- one byte for the hash type (currently only one)
 // plus the first byte of the hash data -- using the first four
 // characters of the name to keep the number of directories in dir
-// itself to a manageable number, similar to git.
+// itself to a manageable number, similar to git. An MD object may be
+// stored as a delta against another one in the same branch, in
+// which case its file starts with mdDeltaMagic.
+//
+// If dedupKeyBundles is set, MD objects stored in full have their
+// key generations moved to dir/key_bundles, which is splayed like
+// dir/mds, and their files start with mdKeyBundleRefMagic.
+//
+// If changeFeed is set, dir/md_change_feed is a journal with an
+// mdChangeFeedEntry for each successful put, across all branches,
+// and its ordinals are the sequence numbers of the entries. Each
+// file in dir/md_change_feed_checkpoints holds the sequence number
+// up to which the consumer it is named after has processed the
+// feed.
+//
+// If splitHeaders is set, each MD object put also has its
+// mdStoredHeader stored in dir/md_headers, which is splayed like
+// dir/mds, so that getMDHeader can read it without the rest of the
+// object.
+//
+// If highWaterKey is set, each file in dir/md_high_water_marks holds
+// the mdHighWaterMark of the branch it is named after.
+//
+// The annotations of an MD object put with putAnnotated are stored
+// in dir/md_annotations, which is splayed like dir/mds.
+//
+// An MD object that put stores in full is first written to a file in
+// dir/md_staging without holding lock, and then only renamed into
+// dir/mds under it. The directory is removed once empty, and by
+// open, along with any files left by a crash.
 type mdServerTlfStorage struct {
 	codec  Codec
 	crypto cryptoPure
+	clock  Clock
 	dir    string
 
 	// Protects any IO operations in dir or any of its children,
-	// as well as branchJournals and its contents.
+	// as well as state, branchJournals and its contents,
+	// quiesced, rekeyLeases, the write buffer, and the MDs held by
+	// read snapshots.
 	//
 	// TODO: Consider using https://github.com/pkg/singlefile
 	// instead.
-	lock           sync.RWMutex
+	lock  mdServerTlfStorageLock
+	state mdServerTlfStorageState
+	// branchJournals is non-nil only when state is
+	// mdServerTlfStorageOpen.
 	branchJournals map[BranchID]mdServerBranchJournal
+	// When quiesced is true, mutating operations fail with a
+	// retriable error, but reads proceed as usual.
+	quiesced bool
+	// rekeyLeases maps each branch with a rekey in progress to
+	// the time its lease expires.
+	rekeyLeases map[BranchID]time.Time
+	// epoch is the value of the EPOCH file written by open. If
+	// the file changes afterwards, another instance has opened
+	// dir, and this one is fenced off from writing, as checked
+	// through fence.
+	epoch uint64
+	fence *mdEpochFence
+	// exclusive makes open fail with
+	// errMDServerTlfStorageFileLocked if another instance has dir
+	// open, instead of fencing that instance off, e.g. so that
+	// maintenance skips TLFs that are in use. It must be set
+	// before open.
+	exclusive bool
+	// unlockOpen releases the lock on the OPEN_LOCK file taken by
+	// open, and is called by close.
+	unlockOpen func() error
+
+	// maxMDSize is the maximum encoded size of an MD object that
+	// put will accept. A non-positive value means no limit.
+	maxMDSize int64
+
+	// readFile and writeFile are used to read and write MD
+	// objects; they are ioutil.ReadFile and ioutil.WriteFile
+	// except in tests.
+	readFile  func(filename string) ([]byte, error)
+	writeFile func(filename string, data []byte, perm os.FileMode) error
+	// linkFile is used by snapshot to hard-link MD objects; it is
+	// os.Link except in tests.
+	linkFile func(oldname, newname string) error
+
+	// maxOpenFiles, if positive, is the maximum number of MD
+	// object files that may be open at once, across all
+	// goroutines. It must be set before open, which makes
+	// openFiles, a semaphore with that many slots that favors
+	// normal-priority operations over background ones.
+	maxOpenFiles int
+	openFiles    *mdServerTlfStorageSemaphore
+
+	// waitingReaders is the number of normal-priority readers
+	// blocked on lock, accessed atomically. Background operations
+	// holding lock for writing check it to know when to yield.
+	waitingReaders int32
+
+	// writeBufferConfig enables buffering of MD object writes if
+	// its maxBytes is positive. It must be set before open.
+	writeBufferConfig mdWriteBufferConfig
+	// writeBuffer holds the encoded MD objects that have been
+	// put but not yet written to disk, and writeBufferBytes
+	// their total size.
+	writeBuffer      map[MdID]bufferedMD
+	writeBufferBytes int64
+	// writeBufferPuts counts the MDs added to writeBuffer, and
+	// numbers each one so that they're flushed in put order.
+	writeBufferPuts uint64
+
+	// deltaFullInterval, if positive, enables storing each MD
+	// object as a delta against the previous revision of its
+	// branch, when that saves enough space. An MD whose revision
+	// is a multiple of deltaFullInterval is always stored in
+	// full, which bounds the number of deltas applied to read an
+	// MD.
+	deltaFullInterval int
+
+	// baseMaxMDSize and baseWriteBufferConfig are the values of
+	// maxMDSize and writeBufferConfig before open applied the
+	// overrides in dir/CONFIG.
+	baseMaxMDSize         int64
+	baseWriteBufferConfig mdWriteBufferConfig
+
+	// paranoidPuts makes put check, besides the usual successor
+	// checks, that the predecessor of each new MD resolves to the
+	// head recorded in the journal; see checkPrevRootLocked.
+	paranoidPuts bool
+
+	// verifyEncodedPuts makes put decode each MD it has just
+	// encoded, and check that the result has the same ID, before
+	// writing it anywhere, so that an encoding that doesn't
+	// round-trip is caught by the put rather than by later reads.
+	// It must be set before open.
+	verifyEncodedPuts bool
+
+	// maxBranches, if positive, is the number of unmerged branches
+	// above which put refuses to create a new one. The master
+	// branch doesn't count.
+	maxBranches int
+
+	// compactJournals makes new branch journals use the compact
+	// single-file format. Existing journals keep their format;
+	// see convertMDServerBranchJournal.
+	compactJournals bool
+
+	// dedupKeyBundles makes put store the writer and reader key
+	// generations of each MD stored in full separately, by
+	// content, so that the MDs between two rekeys share them.
+	// Key bundles are never removed, since they may be shared.
+	dedupKeyBundles bool
+
+	// writeRateLimit limits the rate of puts, separately for the
+	// merged branch and for the unmerged branches, whose token
+	// buckets are mergedWriteBucket and unmergedWriteBucket.
+	writeRateLimit      mdWriteRateLimit
+	mergedWriteBucket   mdWriteTokenBucket
+	unmergedWriteBucket mdWriteTokenBucket
+
+	// decodeLimits bounds the resources used to decode each MD
+	// object read from disk, to guard against corrupt or crafted
+	// objects. It must be set before open.
+	decodeLimits mdDecodeLimits
+
+	// changeFeed makes put record each new revision in an on-disk
+	// change feed, which external indexers can read with
+	// consumeChangeFeed. It must be set before open.
+	changeFeed bool
+	// changeFeedBehind is set when put failed to feed a revision,
+	// so that the next put catches the feed up instead.
+	changeFeedBehind bool
+
+	// splitHeaders makes put also store the header of each MD
+	// object separately, for getMDHeader. MD objects put without
+	// it have their headers read from the whole object.
+	splitHeaders bool
+
+	// highWaterKey, if non-empty, makes the storage keep a
+	// high-water mark for each branch: the highest revision it
+	// has had on disk, MACed with this key. A branch whose latest
+	// revision is below its mark has been rolled back, and its
+	// head is neither served nor extended until acceptRollback is
+	// called for it. It must be set before open, which loads the
+	// marks into highWaterMarks.
+	highWaterKey   []byte
+	highWaterMarks map[BranchID]MetadataRevision
+
+	// readerCacheLock protects readerCacheHeadID and readers,
+	// which hold the users known to be readers as of the master
+	// head with that ID, so that getForTLFIfChanged can check
+	// permissions without reading the head. Since an MD never
+	// changes once stored, the cache is valid as long as the
+	// master head is the same.
+	readerCacheLock   sync.Mutex
+	readerCacheHeadID MdID
+	readers           map[keybase1.UID]bool
+
+	// idFunc computes the ID of an MD, under which it is stored
+	// and against which it is checked when read. It defaults to
+	// RootMetadata.MetadataID, and can be replaced, before open,
+	// by tests or by migrations between hash schemes.
+	idFunc func(md *RootMetadata) (MdID, error)
+
+	// authorizer, if non-nil, is asked about every get and put
+	// that passes the built-in reader or writer check, and can
+	// deny it. It must be set before open.
+	authorizer mdServerTlfStorageAuthorizer
+
+	// ownershipCheck says what open does if dir isn't owned by
+	// the current user, or is writable by others, which hints
+	// that another process may be writing to it too. Warnings go
+	// to log.
+	ownershipCheck mdServerTlfStorageOwnershipCheck
+	log            logger.Logger
+
+	// symlinkCheck says which symlinks within dir are followed.
+	// open checks all of them, and since symlinks may be made
+	// later, the paths of MD objects, their headers, and key
+	// bundles are checked again on each read and write. It must
+	// be set before open.
+	symlinkCheck mdServerTlfStorageSymlinkCheck
+
+	// coldMDsDir, if non-empty, is a directory on a slower,
+	// cheaper device laid out like dir/mds, to which
+	// demoteColdMDs moves the MD objects of all but the latest
+	// hotRevisions revisions of each branch. Reads look in both
+	// places, and new MD objects are always written to dir/mds.
+	// Both must be set before open.
+	coldMDsDir   string
+	hotRevisions int
+
+	// maxColdReads, if positive, is the maximum number of MD
+	// objects read from coldMDsDir at once, so that a scan of
+	// old history can't saturate the cold device, or take all of
+	// openFiles, at the expense of reads of hot MDs. It must be
+	// set before open, which makes coldReads, a semaphore with
+	// that many slots. A cold read takes its slot in coldReads
+	// before the one in openFiles.
+	maxColdReads int
+	coldReads    *mdServerTlfStorageSemaphore
+
+	// retainGrace, if positive, is the number of revisions below
+	// the point up to which prune would otherwise remove them,
+	// i.e. the last ones flushed to every destination and below
+	// upTo, that prune keeps anyway, so that catching up and
+	// resolving conflicts needn't fetch them remotely. Pinned
+	// revisions are kept regardless. It must be set before open.
+	retainGrace int
+
+	// revisionIndex makes the storage keep a REVISIONS file for
+	// each branch, mapping its revisions to their MD objects, so
+	// that they can be found on disk by revision without decoding
+	// them. It's only a navigation aid: put appends to it and
+	// prune rewrites it, but failures to do so are only logged,
+	// and open rebuilds it from the journals. It must be set
+	// before open.
+	revisionIndex bool
+
+	// quarantineCorrupt makes reads move an MD object that doesn't
+	// decode, or doesn't match its ID, to dir/corrupt, instead of
+	// just failing. If quarantineFallback is non-nil, the MD is
+	// then fetched from it, checked against the ID, and written
+	// back, and the read is retried once; otherwise, or if that
+	// fails, the read fails with errMDCorruptQuarantined. Both
+	// must be set before open. quarantineLock serializes the
+	// quarantining of objects by concurrent readers.
+	quarantineCorrupt  bool
+	quarantineFallback MDServer
+	quarantineLock     sync.Mutex
+
+	// mdCache, if non-nil, caches verified MDs in memory, so that
+	// repeated reads of the same MD skip the disk. It may be
+	// shared by the storages of many TLFs, to bound their memory
+	// use together. It must be set before open.
+	mdCache *mdServerMDCache
+
+	// headChanged is closed, and replaced by a new channel,
+	// whenever a put succeeds, and on close, to wake up
+	// waitForHeadAfter callers. It is non-nil only while open.
+	headChanged chan struct{}
+
+	// heldMDs counts the unreleased read snapshots that refer to
+	// each MD, and deferredRemovals holds the MDs that have been
+	// pruned but are still held, and so are removed only once
+	// they are no longer held.
+	heldMDs          map[MdID]int
+	deferredRemovals map[MdID]bool
+
+	// mdIDIndex is the sorted list of the IDs of all MD objects
+	// on disk. It is non-nil only when state is
+	// mdServerTlfStorageOpen. mdIDIndexPending is the pending MD
+	// object last written to the MDIDS file.
+	mdIDIndex        mdIDList
+	mdIDIndexPending MdID
+
+	// stagedMDs numbers the files put writes to dir/md_staging,
+	// accessed atomically.
+	stagedMDs uint64
+
+	// putLockHoldTimer, if non-nil, records how long each put
+	// holds lock for writing. It must be set before open.
+	putLockHoldTimer metrics.Timer
+
+	// writtenMDs counts the MD objects put has stored, and
+	// dedupedMDs the puts of MD objects that were already
+	// stored, both accessed atomically. putWrittenMeter and
+	// putDedupedMeter, if non-nil, are marked along with them,
+	// and must be set before open.
+	writtenMDs      uint64
+	dedupedMDs      uint64
+	putWrittenMeter metrics.Meter
+	putDedupedMeter metrics.Meter
+
+	// growthWindow is the window over which growthRate computes
+	// the rate of puts. It must be set before open, which makes
+	// growth, which samples the MD objects put since then. A
+	// non-positive value means defaultMDGrowthWindow.
+	growthWindow time.Duration
+	growth       *mdGrowthTracker
+}
+
+// mdServerTlfStorageConfig holds per-TLF settings which override the
+// ones the mdServerTlfStorage was made with. A nil field means no
+// override. Fields are exported only for serialization.
+type mdServerTlfStorageConfig struct {
+	MaxMDSize           *int64 `json:",omitempty"`
+	WriteBufferMaxBytes *int64 `json:",omitempty"`
+	// WriteBufferMaxAge is in the format accepted by
+	// time.ParseDuration, e.g. "30s".
+	WriteBufferMaxAge *string `json:",omitempty"`
+}
+
+// apply returns the given settings with the overrides in c applied,
+// or an error if any of them are invalid.
+func (c mdServerTlfStorageConfig) apply(
+	maxMDSize int64, writeBufferConfig mdWriteBufferConfig) (
+	int64, mdWriteBufferConfig, error) {
+	if c.MaxMDSize != nil {
+		maxMDSize = *c.MaxMDSize
+	}
+	if c.WriteBufferMaxBytes != nil {
+		if *c.WriteBufferMaxBytes < 0 {
+			return 0, mdWriteBufferConfig{}, fmt.Errorf(
+				"Negative WriteBufferMaxBytes %d",
+				*c.WriteBufferMaxBytes)
+		}
+		writeBufferConfig.maxBytes = *c.WriteBufferMaxBytes
+	}
+	if c.WriteBufferMaxAge != nil {
+		maxAge, err := time.ParseDuration(*c.WriteBufferMaxAge)
+		if err != nil {
+			return 0, mdWriteBufferConfig{}, fmt.Errorf(
+				"Invalid WriteBufferMaxAge: %v", err)
+		}
+		if maxAge < 0 {
+			return 0, mdWriteBufferConfig{}, fmt.Errorf(
+				"Negative WriteBufferMaxAge %s", maxAge)
+		}
+		writeBufferConfig.maxAge = maxAge
+	}
+	return maxMDSize, writeBufferConfig, nil
+}
+
+// mdServerTlfStorageState is the lifecycle state of an
+// mdServerTlfStorage. It starts out as mdServerTlfStorageNotOpen,
+// becomes mdServerTlfStorageOpen after a successful call to open,
+// and becomes mdServerTlfStorageClosed after a call to close.
+type mdServerTlfStorageState int
+
+const (
+	mdServerTlfStorageNotOpen mdServerTlfStorageState = iota
+	mdServerTlfStorageOpen
+	mdServerTlfStorageClosed
+)
+
+// defaultMDServerMaxMDSize is the default value of
+// mdServerTlfStorage.maxMDSize. It is far bigger than any legitimate
+// MD object should be.
+const defaultMDServerMaxMDSize = 64 * 1024 * 1024
+
+// mdServerTlfStorageVersion is the version of the on-disk format
+// written by this code. It should be bumped whenever a change is made
+// that older code can't read correctly.
+//
+// Version 2 added MD objects stored as deltas.
+const mdServerTlfStorageVersion = 2
+
+// mdServerTlfStorageVersionTooNewError is returned by
+// mdServerTlfStorage.open when dir was written with a newer on-disk
+// format than this code supports.
+type mdServerTlfStorageVersionTooNewError struct {
+	dir              string
+	version          int
+	supportedVersion int
 }
 
+func (e mdServerTlfStorageVersionTooNewError) Error() string {
+	return fmt.Sprintf(
+		"Storage in %s has version %d, but only versions up to %d "+
+			"are supported", e.dir, e.version, e.supportedVersion)
+}
+
+// makeMDServerTlfStorage returns a new mdServerTlfStorage for the
+// given directory. It does no IO; open must be called on the
+// returned storage before it can be used.
 func makeMDServerTlfStorage(
 	codec Codec, crypto cryptoPure, dir string) *mdServerTlfStorage {
 	journal := &mdServerTlfStorage{
-		codec:          codec,
-		crypto:         crypto,
-		dir:            dir,
-		branchJournals: make(map[BranchID]mdServerBranchJournal),
+		codec:     codec,
+		crypto:    crypto,
+		clock:     wallClock{},
+		dir:       dir,
+		maxMDSize: defaultMDServerMaxMDSize,
+		readFile:  ioutil.ReadFile,
+		writeFile: ioutil.WriteFile,
+		linkFile:  os.Link,
+		log:       logger.NewNull(),
+		idFunc: func(md *RootMetadata) (MdID, error) {
+			return md.MetadataID(crypto)
+		},
 	}
 	return journal
 }
 
+// makeMDServerTlfStorageWithLockMetrics is like
+// makeMDServerTlfStorage, but the returned storage's lock registers,
+// in the given registry, the timers and counters in which it records
+// how long each category of operation waits for it and holds it, and
+// how often it's found taken; see contentionStats.
+func makeMDServerTlfStorageWithLockMetrics(codec Codec, crypto cryptoPure,
+	dir string, r metrics.Registry) *mdServerTlfStorage {
+	s := makeMDServerTlfStorage(codec, crypto, dir)
+	s.lock.stats = makeMDLockStats(r)
+	return s
+}
+
+// mdServerTlfStorageOwnershipCheck is the strictness of the check
+// open makes on the ownership and mode of the storage directory. It
+// has no effect on platforms without Unix-style ownership.
+type mdServerTlfStorageOwnershipCheck int
+
+const (
+	// mdServerTlfStorageOwnershipIgnore skips the check.
+	mdServerTlfStorageOwnershipIgnore mdServerTlfStorageOwnershipCheck = iota
+	// mdServerTlfStorageOwnershipWarn logs a warning on failure.
+	mdServerTlfStorageOwnershipWarn
+	// mdServerTlfStorageOwnershipRefuse makes open fail on failure.
+	mdServerTlfStorageOwnershipRefuse
+)
+
+// mdServerTlfStorageOwnershipError is returned by checkDirOwnership
+// when a storage directory may be shared with another user.
+type mdServerTlfStorageOwnershipError struct {
+	dir     string
+	problem string
+}
+
+func (e mdServerTlfStorageOwnershipError) Error() string {
+	return fmt.Sprintf("Storage directory %s may be shared: %s",
+		e.dir, e.problem)
+}
+
+// checkVersion reads the on-disk format version of s.dir, returning
+// an error if it's newer than what this code supports. If s.dir
+// doesn't have a version yet, the current version is written.
+func (s *mdServerTlfStorage) checkVersion() error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(s.versionPath())
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(s.versionPath(),
+			[]byte(strconv.Itoa(mdServerTlfStorageVersion)), 0600)
+	} else if err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(string(buf))
+	if err != nil {
+		return fmt.Errorf("Invalid storage version in %s: %q",
+			s.versionPath(), buf)
+	}
+
+	if version > mdServerTlfStorageVersion {
+		return mdServerTlfStorageVersionTooNewError{
+			dir:              s.dir,
+			version:          version,
+			supportedVersion: mdServerTlfStorageVersion,
+		}
+	}
+
+	if version < mdServerTlfStorageVersion {
+		// Older versions are a subset of the current one, so
+		// upgrading just needs the version to be bumped, so
+		// that older code doesn't misread any newer features
+		// written from now on.
+		return ioutil.WriteFile(s.versionPath(),
+			[]byte(strconv.Itoa(mdServerTlfStorageVersion)), 0600)
+	}
+
+	return nil
+}
+
+// The names of the subdirectories of an mdServerTlfStorage directory.
+const (
+	mdServerBranchJournalsDirName        = "md_branch_journals"
+	mdServerBranchTombstonesDirName      = "md_branch_tombstones"
+	mdServerMDsDirName                   = "mds"
+	mdServerChangeFeedDirName            = "md_change_feed"
+	mdServerChangeFeedCheckpointsDirName = "md_change_feed_checkpoints"
+	mdServerMDHeadersDirName             = "md_headers"
+	mdServerHighWaterMarksDirName        = "md_high_water_marks"
+	mdServerAnnotationsDirName           = "md_annotations"
+	mdServerMDStagingDirName             = "md_staging"
+)
+
+// readConfig returns the contents of the CONFIG file, which is empty
+// if the file doesn't exist.
+func (s *mdServerTlfStorage) readConfig() (mdServerTlfStorageConfig, error) {
+	var config mdServerTlfStorageConfig
+	buf, err := ioutil.ReadFile(s.configPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return mdServerTlfStorageConfig{}, err
+	}
+
+	err = json.Unmarshal(buf, &config)
+	if err != nil {
+		return mdServerTlfStorageConfig{}, fmt.Errorf(
+			"Invalid config in %s: %v", s.configPath(), err)
+	}
+	return config, nil
+}
+
+// readEpoch returns the value of the EPOCH file, or 0 if it doesn't
+// exist.
+func (s *mdServerTlfStorage) readEpoch() (uint64, error) {
+	buf, err := ioutil.ReadFile(s.epochPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	epoch, err := strconv.ParseUint(string(buf), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid epoch in %s: %q", s.epochPath(), buf)
+	}
+	return epoch, nil
+}
+
+// advanceEpoch increments the value of the EPOCH file and returns
+// the new value, along with the new EPOCH file, opened. It holds a
+// lock on the EPOCH_LOCK file while doing so, so that concurrent
+// opens, even from other processes, get distinct epochs, and it
+// waits for any writes that hold an mdEpochFence.
+func (s *mdServerTlfStorage) advanceEpoch() (
+	epoch uint64, epochFile *os.File, err error) {
+	unlock, err := lockFile(s.epochLockPath(), true, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		unlockErr := unlock()
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+
+	epoch, err = s.readEpoch()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	epoch++
+	err = writeFileAtomically(s.epochPath(),
+		[]byte(strconv.FormatUint(epoch, 10)), 0600)
+	if err != nil {
+		return 0, nil, err
+	}
+	epochFile, err = os.Open(s.epochPath())
+	if err != nil {
+		return 0, nil, err
+	}
+	return epoch, epochFile, nil
+}
+
+var errMDServerTlfStorageFileLocked = errors.New(
+	"The file is locked by another mdServerTlfStorage")
+
+// writeFileAtomically writes data to the file at path by writing it
+// to path.tmp first and then renaming that over path, so that readers
+// see either the old or the new contents, and never a partial write.
+// It also leaves any other hard links to the old file untouched.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, perm)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
+
+// listTLFStorageDirs returns the IDs of the TLFs with an
+// mdServerTlfStorage directory directly under root, i.e. named after
+// the TLF ID and containing both the branch journal and MD
+// subdirectories. Everything else in root, including
+// partially-initialized TLF directories, is skipped.
+func listTLFStorageDirs(root string) ([]TlfID, error) {
+	fileInfos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlfIDs []TlfID
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+
+		tlfID, err := ParseTlfID(fi.Name())
+		if err != nil {
+			continue
+		}
+
+		isStorageDir := true
+		for _, name := range []string{
+			mdServerBranchJournalsDirName, mdServerMDsDirName,
+		} {
+			subdirInfo, err := os.Stat(
+				filepath.Join(root, fi.Name(), name))
+			if os.IsNotExist(err) {
+				isStorageDir = false
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if !subdirInfo.IsDir() {
+				isStorageDir = false
+				break
+			}
+		}
+
+		if isStorageDir {
+			tlfIDs = append(tlfIDs, tlfID)
+		}
+	}
+	return tlfIDs, nil
+}
+
 // The functions below are for building various paths.
 
+func (s *mdServerTlfStorage) versionPath() string {
+	return filepath.Join(s.dir, "VERSION")
+}
+
+func (s *mdServerTlfStorage) configPath() string {
+	return filepath.Join(s.dir, "CONFIG")
+}
+
+func (s *mdServerTlfStorage) epochPath() string {
+	return filepath.Join(s.dir, "EPOCH")
+}
+
+func (s *mdServerTlfStorage) epochLockPath() string {
+	return filepath.Join(s.dir, "EPOCH_LOCK")
+}
+
+func (s *mdServerTlfStorage) openLockPath() string {
+	return filepath.Join(s.dir, "OPEN_LOCK")
+}
+
+func (s *mdServerTlfStorage) mdIDIndexPath() string {
+	return filepath.Join(s.dir, "MDIDS")
+}
+
 func (s *mdServerTlfStorage) branchJournalsPath() string {
-	return filepath.Join(s.dir, "md_branch_journals")
+	return filepath.Join(s.dir, mdServerBranchJournalsDirName)
+}
+
+func (s *mdServerTlfStorage) branchTombstonesPath() string {
+	return filepath.Join(s.dir, mdServerBranchTombstonesDirName)
+}
+
+func (s *mdServerTlfStorage) branchTombstonePath(bid BranchID) string {
+	return filepath.Join(s.branchTombstonesPath(), bid.String())
 }
 
 func (s *mdServerTlfStorage) mdsPath() string {
-	return filepath.Join(s.dir, "mds")
+	return filepath.Join(s.dir, mdServerMDsDirName)
+}
+
+func (s *mdServerTlfStorage) keyBundlePath(id string) string {
+	return filepath.Join(s.dir, "key_bundles", id[:4], id[4:])
 }
 
 func (s *mdServerTlfStorage) mdPath(id MdID) string {
@@ -87,314 +834,4177 @@ func (s *mdServerTlfStorage) mdPath(id MdID) string {
 	return filepath.Join(s.mdsPath(), idStr[:4], idStr[4:])
 }
 
-// getDataLocked verifies the MD data (but not the signature) for the
-// given ID and returns it.
-//
-// TODO: Verify signature?
-func (s *mdServerTlfStorage) getMDReadLocked(id MdID) (
-	*RootMetadataSigned, error) {
-	// Read file.
+func (s *mdServerTlfStorage) mdHeaderPath(id MdID) string {
+	idStr := id.String()
+	return filepath.Join(
+		s.dir, mdServerMDHeadersDirName, idStr[:4], idStr[4:])
+}
+
+func (s *mdServerTlfStorage) annotationsPath(id MdID) string {
+	idStr := id.String()
+	return filepath.Join(
+		s.dir, mdServerAnnotationsDirName, idStr[:4], idStr[4:])
+}
+
+func (s *mdServerTlfStorage) highWaterMarkPath(bid BranchID) string {
+	return filepath.Join(
+		s.dir, mdServerHighWaterMarksDirName, bid.String())
+}
+
+func (s *mdServerTlfStorage) coldMDPath(id MdID) string {
+	idStr := id.String()
+	return filepath.Join(s.coldMDsDir, idStr[:4], idStr[4:])
+}
+
+func (s *mdServerTlfStorage) branchJournalPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalsPath(), bid.String())
+}
+
+func (s *mdServerTlfStorage) changeFeedJournal() diskJournal {
+	return makeDiskJournal(s.codec,
+		filepath.Join(s.dir, mdServerChangeFeedDirName),
+		reflect.TypeOf(mdChangeFeedEntry{}))
+}
+
+func (s *mdServerTlfStorage) changeFeedCheckpointPath(
+	consumer string) string {
+	return filepath.Join(
+		s.dir, mdServerChangeFeedCheckpointsDirName, consumer)
+}
+
+func (s *mdServerTlfStorage) writersPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "WRITERS")
+}
+
+func (s *mdServerTlfStorage) pinnedPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "PINNED")
+}
+
+func (s *mdServerTlfStorage) flushCursorsPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "FLUSH_CURSORS")
+}
+
+func (s *mdServerTlfStorage) approximateTimesPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "APPROXIMATE_TIMES")
+}
+
+func (s *mdServerTlfStorage) merkleFrontierPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "MERKLE")
+}
+
+func (s *mdServerTlfStorage) closedPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "CLOSED")
+}
+
+// acquireFile blocks until an MD object file may be opened without
+// going over s.maxOpenFiles, with the priority set on ctx, and returns
+// a function to be called once the file is closed.
+func (s *mdServerTlfStorage) acquireFile(ctx context.Context) func() {
+	if s.openFiles == nil {
+		return func() {}
+	}
+	s.openFiles.acquire(mdServerTlfStoragePriorityFromContext(ctx))
+	return s.openFiles.release
+}
+
+// rLock takes s.lock for reading, for a get, and returns the function
+// that releases it. Unless ctx has background priority, the wait is
+// counted in s.waitingReaders, so that background operations holding
+// the lock yield to it.
+func (s *mdServerTlfStorage) rLock(ctx context.Context) func() {
+	if mdServerTlfStoragePriorityFromContext(ctx) ==
+		mdServerTlfStoragePriorityBackground {
+		return s.lock.rLockAs(mdLockCategoryGet)
+	}
+	atomic.AddInt32(&s.waitingReaders, 1)
+	unlock := s.lock.rLockAs(mdLockCategoryGet)
+	atomic.AddInt32(&s.waitingReaders, -1)
+	return unlock
+}
+
+// yieldToReadersLocked releases s.lock, which must be held for
+// writing, and takes it again if any normal-priority readers are
+// waiting for it, and returns whether it did. Since sync.RWMutex
+// admits readers already blocked on it before the next writer, they
+// run in between. Callers must revalidate any state read before the
+// yield.
+func (s *mdServerTlfStorage) yieldToReadersLocked() bool {
+	if atomic.LoadInt32(&s.waitingReaders) == 0 {
+		return false
+	}
+	category := s.lock.writeCategory
+	s.lock.Unlock()
+	s.lock.lockAs(category)
+	return true
+}
+
+// readStoredMDReadLocked returns the stored form of the MD object
+// with the given ID, which may be a delta, from the write buffer or
+// from disk, along with the time it was put.
+func (s *mdServerTlfStorage) readStoredMDReadLocked(
+	ctx context.Context, id MdID) ([]byte, time.Time, error) {
+	if b, ok := s.writeBuffer[id]; ok {
+		return b.buf, b.putTime, nil
+	}
+
+	path, fileInfo, err := s.statMDReadLocked(id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	err = s.checkSymlinks(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	_, span := startMDServerTlfStorageSpan(ctx, "read")
+	releaseCold := func() {}
+	if path != s.mdPath(id) {
+		span.SetTag("cold", true)
+		releaseCold = s.acquireColdRead(ctx)
+	}
+	release := s.acquireFile(ctx)
+	data, err := s.readFile(path)
+	release()
+	releaseCold()
+	span.Finish()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, fileInfo.ModTime(), nil
+}
+
+// checkSymlinks checks the existing components of path, if it is
+// within s.dir, for symlinks that s.symlinkCheck doesn't allow.
+func (s *mdServerTlfStorage) checkSymlinks(path string) error {
+	return checkPathSymlinks(s.dir, path, s.symlinkCheck)
+}
+
+// statMDReadLocked returns the path and file info of the MD object
+// with the given ID on disk, looking in dir/mds first and then in
+// s.coldMDsDir.
+func (s *mdServerTlfStorage) statMDReadLocked(id MdID) (
+	string, os.FileInfo, error) {
+	path := s.mdPath(id)
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) && s.coldMDsDir != "" {
+		coldPath := s.coldMDPath(id)
+		coldFileInfo, coldErr := os.Stat(coldPath)
+		if !os.IsNotExist(coldErr) {
+			return coldPath, coldFileInfo, coldErr
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return path, fileInfo, nil
+}
+
+// readEncodedMDReadLocked returns the encoded MD with the given ID,
+// applying deltas to the nearest MD stored in full if necessary,
+// along with the time it was put.
+func (s *mdServerTlfStorage) readEncodedMDReadLocked(
+	ctx context.Context, id MdID) ([]byte, time.Time, error) {
+	data, timestamp, err := s.readStoredMDReadLocked(ctx, id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !isMDDelta(data) {
+		data, err = s.restoreKeyBundlesReadLocked(ctx, data)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return data, timestamp, nil
+	}
+
+	// Walk back to the nearest full MD, and then apply the
+	// deltas in the opposite order.
+	var chain [][]mdDeltaOp
+	seen := map[MdID]bool{id: true}
+	for isMDDelta(data) {
+		err := s.checkDecodeLimits(data[len(mdDeltaMagic):])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		delta, err := decodeMDDelta(s.codec, data)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if seen[delta.BaseID] {
+			return nil, time.Time{}, fmt.Errorf(
+				"Cycle in deltas for MD %s at %s", id, delta.BaseID)
+		}
+		seen[delta.BaseID] = true
+		chain = append(chain, delta.Ops)
+
+		data, _, err = s.readStoredMDReadLocked(ctx, delta.BaseID)
+		if err != nil {
+			// Don't let a missing base look like a
+			// missing MD.
+			return nil, time.Time{}, fmt.Errorf(
+				"Couldn't read base %s for MD %s: %v",
+				delta.BaseID, id, err)
+		}
+	}
+
+	data, err = s.restoreKeyBundlesReadLocked(ctx, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	_, span := startMDServerTlfStorageSpan(ctx, "applyDeltas")
+	defer span.Finish()
+	span.SetTag("deltas", len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		data, err = applyMDDeltaOps(data, chain[i])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return data, timestamp, nil
+}
+
+// getMDAndSizeReadLocked verifies the MD data (but not the
+// signature) for the given ID and returns it, along with its encoded
+// size.
+//
+// TODO: Verify signature?
+func (s *mdServerTlfStorage) getMDAndSizeReadLocked(
+	ctx context.Context, id MdID) (*RootMetadataSigned, int64, error) {
+	if s.mdCache == nil {
+		return s.getUncachedMDAndSizeReadLocked(ctx, id)
+	}
+	if buf, timestamp, ok := s.mdCache.get(s.dir, id); ok {
+		// Already verified, and cached only after that, but
+		// compute the ID anyway so that the MD is returned in
+		// the same state as an uncached one.
+		var rmds RootMetadataSigned
+		err := s.codec.Decode(buf, &rmds)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = s.idFunc(&rmds.MD)
+		if err != nil {
+			return nil, 0, err
+		}
+		rmds.untrustedServerTimestamp = timestamp
+		return &rmds, int64(len(buf)), nil
+	}
+	rmds, size, err := s.getUncachedMDAndSizeReadLocked(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Re-encode the MD, rather than thread its encoding through
+	// the quarantine path; it decodes to the same MD either way.
+	buf, err := s.codec.Encode(rmds)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.mdCache.put(s.dir, id, buf, rmds.untrustedServerTimestamp)
+	return rmds, size, nil
+}
+
+// getUncachedMDAndSizeReadLocked is getMDAndSizeReadLocked without
+// mdCache.
+func (s *mdServerTlfStorage) getUncachedMDAndSizeReadLocked(
+	ctx context.Context, id MdID) (*RootMetadataSigned, int64, error) {
+	rmds, size, err := s.verifyMDAndSizeReadLocked(ctx, id)
+	if err == nil || !s.quarantineCorrupt {
+		return rmds, size, err
+	}
+	if _, ok := err.(mdCorruptError); !ok {
+		// An object quarantined by an earlier read looks
+		// missing, but may be repairable by now.
+		_, statErr := os.Stat(s.corruptMDPath(id))
+		if !os.IsNotExist(err) || statErr != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Quarantine the object and, if it can be repaired, retry
+	// once.
+	err = s.quarantineMDReadLocked(ctx, id, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.verifyMDAndSizeReadLocked(ctx, id)
+}
+
+// verifyMDAndSizeReadLocked reads and verifies the MD with the given
+// ID, for getMDAndSizeReadLocked, without quarantining it if it's
+// corrupt.
+func (s *mdServerTlfStorage) verifyMDAndSizeReadLocked(
+	ctx context.Context, id MdID) (*RootMetadataSigned, int64, error) {
+	data, timestamp, err := s.readEncodedMDReadLocked(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = s.checkDecodeLimits(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rmds RootMetadataSigned
+	_, span := startMDServerTlfStorageSpan(ctx, "decode")
+	err = s.codec.Decode(data, &rmds)
+	span.Finish()
+	if err != nil {
+		return nil, 0, mdCorruptError{id, err}
+	}
+
+	// Check integrity.
+
+	mdID, err := s.idFunc(&rmds.MD)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if id != mdID {
+		return nil, 0, mdCorruptError{id, fmt.Errorf(
+			"Metadata ID mismatch: expected %s, got %s", id, mdID)}
+	}
+
+	rmds.untrustedServerTimestamp = timestamp
+
+	return &rmds, int64(len(data)), nil
+}
+
+// writeMDHeaderLocked stores the header of the MD with the given ID
+// and encoding. It's written to a temporary file and renamed into
+// place, so that a read never sees a partial header.
+func (s *mdServerTlfStorage) writeMDHeaderLocked(id MdID, buf []byte) error {
+	header, err := makeMDStoredHeader(s.codec, id, buf)
+	if err != nil {
+		return err
+	}
+	headerBuf, err := s.codec.Encode(header)
+	if err != nil {
+		return err
+	}
+	path := s.mdHeaderPath(id)
+	err = s.checkSymlinks(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = s.writeFile(tmpPath, headerBuf, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
+
+// getMDHeaderReadLocked returns the MD with the given ID without its
+// serialized private metadata, along with the size of the latter.
+// If the MD has a stored header, only that is read and verified;
+// otherwise, the whole MD is read and verified, as with
+// getMDAndSizeReadLocked.
+func (s *mdServerTlfStorage) getMDHeaderReadLocked(
+	ctx context.Context, id MdID) (*RootMetadataSigned, int, error) {
+	var headerBuf []byte
+	var timestamp time.Time
+	if _, ok := s.writeBuffer[id]; !ok {
+		// Stat the MD itself, both for its timestamp and so
+		// that a header left without its MD isn't used.
+		_, fileInfo, err := s.statMDReadLocked(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		timestamp = fileInfo.ModTime()
+
+		err = s.checkSymlinks(s.mdHeaderPath(id))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		_, span := startMDServerTlfStorageSpan(ctx, "readHeader")
+		release := s.acquireFile(ctx)
+		headerBuf, err = s.readFile(s.mdHeaderPath(id))
+		release()
+		span.Finish()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+	}
+
+	if headerBuf == nil {
+		rmds, _, err := s.getMDAndSizeReadLocked(ctx, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		bodySize := len(rmds.MD.SerializedPrivateMetadata)
+		rmds.MD.SerializedPrivateMetadata = nil
+		return rmds, bodySize, nil
+	}
+
+	err := s.checkDecodeLimits(headerBuf)
+	if err != nil {
+		return nil, 0, err
+	}
+	var header mdStoredHeader
+	err = s.codec.Decode(headerBuf, &header)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = header.verify(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rmds RootMetadataSigned
+	err = s.codec.Decode(header.Header, &rmds)
+	if err != nil {
+		return nil, 0, err
+	}
+	rmds.untrustedServerTimestamp = timestamp
+	return &rmds, header.BodySize, nil
+}
+
+// checkDecodeLimits returns errMDDecodeLimitExceeded if decoding the
+// given stored msgpack data could exceed s.decodeLimits.
+func (s *mdServerTlfStorage) checkDecodeLimits(data []byte) error {
+	if !s.decodeLimits.isSet() {
+		return nil
+	}
+	return checkMsgpackDecodeLimits(data, s.decodeLimits)
+}
+
+// getMDReadLocked is like getMDAndSizeReadLocked, but without the
+// size, and untraced.
+func (s *mdServerTlfStorage) getMDReadLocked(id MdID) (
+	*RootMetadataSigned, error) {
+	rmds, _, err := s.getMDAndSizeReadLocked(context.Background(), id)
+	return rmds, err
+}
+
+// mdPreparedPut is the part of a put that is done before taking the
+// lock: the ID and encoding of the MD, and, if the MD is likely to be
+// stored in full, the path of a file in dir/md_staging to which the
+// encoding has already been written.
+type mdPreparedPut struct {
+	id         MdID
+	buf        []byte
+	stagedPath string
+}
+
+// prepareMDPut does the part of a put of the given MD by the given
+// user that doesn't need the lock. Whether the MD is stored in full
+// is only known under the lock, so the staged file is just a guess,
+// which putMDLocked falls back from, and a failure to stage the MD
+// isn't an error; putMDLocked then writes it as usual, and reports
+// any error then.
+//
+// Since this runs before the permission checks of put, it leaves
+// rmds untouched, and stages the MD only if it passes the writer
+// check of put against the current merged head, so that puts that
+// are bound to be unauthorized write nothing.
+func (s *mdServerTlfStorage) prepareMDPut(ctx context.Context,
+	currentUID keybase1.UID, rmds *RootMetadataSigned) (
+	mdPreparedPut, error) {
+	ctx, span := startMDServerTlfStorageSpan(ctx, "prepare")
+	defer span.Finish()
+
+	_, encodeSpan := startMDServerTlfStorageSpan(ctx, "encode")
+	buf, err := s.codec.Encode(rmds)
+	encodeSpan.Finish()
+	if err != nil {
+		return mdPreparedPut{}, err
+	}
+
+	// Computing the ID caches it in the MD, so compute it on a
+	// copy.
+	id, err := s.idFunc(rmds.MD.copyWithoutCachedID())
+	if err != nil {
+		return mdPreparedPut{}, err
+	}
+
+	if s.verifyEncodedPuts {
+		_, verifySpan := startMDServerTlfStorageSpan(ctx, "verify")
+		err := s.verifyEncodedMD(id, buf)
+		verifySpan.Finish()
+		if err != nil {
+			return mdPreparedPut{}, err
+		}
+	}
+
+	prep := mdPreparedPut{id: id, buf: buf}
+
+	unlock := s.lock.rLockAs(mdLockCategoryPut)
+	stage := s.state == mdServerTlfStorageOpen &&
+		s.deltaFullInterval <= 0 && !s.dedupKeyBundles &&
+		s.writeBufferConfig.maxBytes <= 0 &&
+		(s.maxMDSize <= 0 || int64(len(buf)) <= s.maxMDSize)
+	if stage {
+		_, err := s.checkWriterReadLocked(ctx, currentUID, rmds)
+		stage = err == nil
+	}
+	epoch := s.epoch
+	unlock()
+	if !stage {
+		return prep, nil
+	}
+
+	_, stageSpan := startMDServerTlfStorageSpan(ctx, "stage")
+	defer stageSpan.Finish()
+
+	path := s.stagedMDPath(id, epoch)
+	err = s.checkSymlinks(path)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		release := s.acquireFile(ctx)
+		err = s.writeFile(path, buf, 0600)
+		release()
+	}
+	if err != nil {
+		s.discardStagedMD(path)
+		return prep, nil
+	}
+	prep.stagedPath = path
+	return prep, nil
+}
+
+// checkWriterReadLocked returns the merged head, after checking
+// that the given user may put the given MD on top of it, i.e. is a
+// writer, or a reader making a valid rekey request. It's the check
+// of put that prepareMDPut also makes before staging the MD.
+func (s *mdServerTlfStorage) checkWriterReadLocked(ctx context.Context,
+	currentUID keybase1.UID, rmds *RootMetadataSigned) (
+	mergedMasterHead *RootMetadataSigned, err error) {
+	mergedMasterHead, err = s.getHeadForTLFReadLocked(ctx, NullBranchID)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	ok, err := isWriterOrValidRekey(
+		s.codec, currentUID, mergedMasterHead, rmds)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if !ok {
+		return nil, MDServerErrorUnauthorized{}
+	}
+	return mergedMasterHead, nil
+}
+
+// mdServerTlfStorageRoundTripError is returned by put, with
+// verifyEncodedPuts set, for an MD whose encoding doesn't decode back
+// to an MD with the same ID.
+type mdServerTlfStorageRoundTripError struct {
+	id MdID
+	// Either decodeErr is why the encoding didn't decode, or
+	// decodedID is the ID of what it decoded to.
+	decodeErr error
+	decodedID MdID
+}
+
+func (e mdServerTlfStorageRoundTripError) Error() string {
+	if e.decodeErr != nil {
+		return fmt.Sprintf("Encoded MD %s doesn't decode: %v",
+			e.id, e.decodeErr)
+	}
+	return fmt.Sprintf("Encoded MD %s decodes to MD %s",
+		e.id, e.decodedID)
+}
+
+// verifyEncodedMD returns an mdServerTlfStorageRoundTripError unless
+// buf decodes to an MD with the given ID.
+func (s *mdServerTlfStorage) verifyEncodedMD(id MdID, buf []byte) error {
+	var decoded RootMetadataSigned
+	err := s.codec.Decode(buf, &decoded)
+	if err != nil {
+		return mdServerTlfStorageRoundTripError{id: id, decodeErr: err}
+	}
+	decodedID, err := s.idFunc(&decoded.MD)
+	if err != nil {
+		return mdServerTlfStorageRoundTripError{id: id, decodeErr: err}
+	}
+	if decodedID != id {
+		return mdServerTlfStorageRoundTripError{
+			id: id, decodedID: decodedID}
+	}
+	return nil
+}
+
+// stagedMDPath returns a fresh path in dir/md_staging for the MD
+// with the given ID, put during the given epoch.
+func (s *mdServerTlfStorage) stagedMDPath(id MdID, epoch uint64) string {
+	return filepath.Join(s.dir, mdServerMDStagingDirName,
+		fmt.Sprintf("%s-%d-%d", id, epoch,
+			atomic.AddUint64(&s.stagedMDs, 1)))
+}
+
+// discardStagedMD removes the given file in dir/md_staging, if it's
+// still there, and dir/md_staging itself, if it's empty. Errors are
+// ignored, since open removes whatever is left.
+func (s *mdServerTlfStorage) discardStagedMD(path string) {
+	if path == "" {
+		return
+	}
+	_ = os.Remove(path)
+	_ = os.Remove(filepath.Dir(path))
+}
+
+// putMDLocked stores the MD prepared by prepareMDPut, unless it's
+// already stored, and returns whether it wrote it.
+func (s *mdServerTlfStorage) putMDLocked(ctx context.Context,
+	rmds *RootMetadataSigned, prep mdPreparedPut) (wrote bool, err error) {
+	id, buf := prep.id, prep.buf
+
+	// Check the write buffer and the disk directly, rather than
+	// read the MD, which may find it in mdCache even if its file
+	// is gone.
+	if _, ok := s.writeBuffer[id]; ok {
+		return false, nil
+	}
+	_, _, err = s.statMDReadLocked(id)
+	if os.IsNotExist(err) {
+		// Continue on.
+	} else if err != nil {
+		return false, err
+	} else {
+		// Entry exists, so nothing else to do.
+		return false, nil
+	}
+
+	if s.maxMDSize > 0 && int64(len(buf)) > s.maxMDSize {
+		return false, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf(
+				"Encoded MD size %d exceeds the limit of %d",
+				len(buf), s.maxMDSize),
+		}
+	}
+
+	encoded := buf
+	buf, err = s.maybeMakeDeltaLocked(ctx, rmds, buf)
+	if err != nil {
+		return false, err
+	}
+
+	if s.dedupKeyBundles && !isMDDelta(buf) {
+		buf, err = s.extractKeyBundlesLocked(ctx, buf)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = s.storeMDLocked(ctx, id, buf, prep.stagedPath)
+	if err != nil {
+		return false, err
+	}
+	s.growth.record(s.clock.Now(), 1, int64(len(buf)))
+
+	if s.splitHeaders {
+		// The header is written only once the MD is stored,
+		// so that a failed put leaves nothing behind. An MD
+		// without a header, e.g. because this fails, is just
+		// read in full instead.
+		err = s.writeMDHeaderLocked(id, encoded)
+		if err != nil {
+			s.log.CWarningf(ctx, "Couldn't write the header "+
+				"of MD %s: %v", id, err)
+		}
+	}
+	return true, nil
+}
+
+// storeMDLocked stores the MD with the given ID in the given stored
+// form: in the write buffer if it's enabled, or else by moving the
+// staged file at stagedPath into place, if it's non-empty and holds
+// that form, or else by writing it.
+func (s *mdServerTlfStorage) storeMDLocked(
+	ctx context.Context, id MdID, buf []byte, stagedPath string) error {
+	if s.writeBufferConfig.maxBytes > 0 {
+		return s.bufferMDLocked(id, buf)
+	}
+
+	if stagedPath != "" && !isMDDelta(buf) && !s.dedupKeyBundles {
+		err := s.moveStagedMDLocked(ctx, id, stagedPath)
+		if err == nil {
+			return nil
+		}
+		s.log.CDebugf(ctx, "Couldn't move staged MD %s: %v", id, err)
+	}
+
+	return s.writeMDLocked(ctx, id, buf)
+}
+
+// moveStagedMDLocked renames the staged file at the given path to
+// the file of the MD with the given ID. If it fails, the store is
+// left as it was.
+func (s *mdServerTlfStorage) moveStagedMDLocked(
+	ctx context.Context, id MdID, stagedPath string) error {
+	_, span := startMDServerTlfStorageSpan(ctx, "moveStaged")
+	defer span.Finish()
+
+	return s.renameMDLocked(id, stagedPath)
+}
+
+// renameMDLocked renames the file at the given path in dir/md_staging
+// to the file of the MD with the given ID. If it fails, the store is
+// left as it was.
+func (s *mdServerTlfStorage) renameMDLocked(
+	id MdID, stagedPath string) error {
+	path := s.mdPath(id)
+	if err := s.checkSymlinks(path); err != nil {
+		return err
+	}
+
+	// Find the topmost directory that MkdirAll will create, if
+	// any, so that it can be removed if the rename fails.
+	var createdDir string
+	for _, dir := range []string{s.mdsPath(), filepath.Dir(path)} {
+		_, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			createdDir = dir
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	previousPending := s.mdIDIndexPending
+	indexChanging, err := s.beginMDIDIndexChangeLocked(id, true)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.Rename(stagedPath, path)
+	}
+	if err != nil {
+		if createdDir != "" {
+			_ = os.RemoveAll(createdDir)
+		}
+		if indexChanging {
+			s.abortMDIDIndexChangeLocked(previousPending)
+		}
+		return err
+	}
+
+	s.mdIDIndex = s.mdIDIndex.insert(id)
+	return nil
+}
+
+// rewriteMDLocked replaces the stored form of the MD with the given
+// ID, which must be on disk, with data and the given timestamp, by
+// writing a temporary file and renaming it into place in dir/mds.
+// If the MD was in the cold tier, it's removed from there. Any
+// cached copy of the MD is evicted.
+func (s *mdServerTlfStorage) rewriteMDLocked(
+	id MdID, data []byte, timestamp time.Time) error {
+	tmpPath := filepath.Join(s.dir, "md_tmp")
+	for _, path := range []string{tmpPath, s.mdPath(id)} {
+		if err := s.checkSymlinks(path); err != nil {
+			return err
+		}
+	}
+	release := s.acquireFile(context.Background())
+	err := s.writeFile(tmpPath, data, 0600)
+	release()
+	if err == nil {
+		err = os.Chtimes(tmpPath, timestamp, timestamp)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.mdPath(id)), 0700)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.mdPath(id))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		if isDiskFullError(err) {
+			return MDServerErrorThrottle{errMDServerTlfStorageDiskFull}
+		}
+		return err
+	}
+	s.uncacheMD(id)
+
+	if s.coldMDsDir != "" {
+		err := os.Remove(s.coldMDPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// uncacheMD evicts the MD with the given ID from mdCache, if it's
+// there, after it has been removed, or its stored form or timestamp
+// has changed. mdCache has its own lock, so s.lock may be held for
+// either reading or writing.
+func (s *mdServerTlfStorage) uncacheMD(id MdID) {
+	if s.mdCache != nil {
+		s.mdCache.remove(s.dir, id)
+	}
+}
+
+// removeMDLocked removes the MD with the given ID from the write
+// buffer or from disk.
+func (s *mdServerTlfStorage) removeMDLocked(id MdID) error {
+	s.removeBufferedMDLocked(id)
+	s.uncacheMD(id)
+	_, err := s.beginMDIDIndexChangeLocked(id, false)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(s.mdPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.mdHeaderPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.annotationsPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.coldMDsDir != "" {
+		err := os.Remove(s.coldMDPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.mdIDIndex = s.mdIDIndex.remove(id)
+	return nil
+}
+
+// writeMDLocked writes the given encoded MD to a file in
+// dir/md_staging and then renames it into place, so that the MD's
+// file is never seen partially written. If it fails, the store is
+// left as it was.
+func (s *mdServerTlfStorage) writeMDLocked(
+	ctx context.Context, id MdID, buf []byte) error {
+	_, span := startMDServerTlfStorageSpan(ctx, "write")
+	defer span.Finish()
+
+	stagedPath := s.stagedMDPath(id, s.epoch)
+	err := s.checkSymlinks(stagedPath)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(stagedPath), 0700)
+	}
+	if err == nil {
+		release := s.acquireFile(ctx)
+		err = s.writeFile(stagedPath, buf, 0600)
+		release()
+	}
+	if err == nil {
+		err = s.renameMDLocked(id, stagedPath)
+	}
+	if err != nil {
+		// Cleanup errors are ignored in favor of the original
+		// error.
+		s.discardStagedMD(stagedPath)
+		if isDiskFullError(err) {
+			return MDServerErrorThrottle{errMDServerTlfStorageDiskFull}
+		}
+		return err
+	}
+
+	// Remove dir/md_staging if nothing else is staged there.
+	_ = os.Remove(filepath.Dir(stagedPath))
+	return nil
+}
+
+// isDiskFullError returns whether err, as returned by a file
+// operation, is due to the disk being full.
+func isDiskFullError(err error) bool {
+	switch err := err.(type) {
+	case *os.PathError:
+		return err.Err == syscall.ENOSPC
+	case *os.LinkError:
+		return err.Err == syscall.ENOSPC
+	case *os.SyscallError:
+		return err.Err == syscall.ENOSPC
+	}
+	return err == syscall.ENOSPC
+}
+
+func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
+	bid BranchID) (mdServerBranchJournal, error) {
+	j, ok := s.branchJournals[bid]
+	if ok {
+		return j, nil
+	}
+
+	if err := s.checkBranchLimitLocked(bid); err != nil {
+		return mdServerBranchJournal{}, err
+	}
+
+	dir := s.branchJournalPath(bid)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return mdServerBranchJournal{}, err
+	}
+
+	if s.compactJournals {
+		j = makeCompactMDServerBranchJournal(dir)
+	} else {
+		j = makeMDServerBranchJournal(s.codec, dir)
+	}
+	s.branchJournals[bid] = j
+	return j, nil
+}
+
+// checkBranchLimitLocked returns an MDServerErrorTooManyBranches if
+// creating a journal for the given branch would exceed maxBranches.
+func (s *mdServerTlfStorage) checkBranchLimitLocked(bid BranchID) error {
+	if s.maxBranches <= 0 || bid == NullBranchID {
+		return nil
+	}
+	if _, ok := s.branchJournals[bid]; ok {
+		return nil
+	}
+
+	branches := len(s.branchJournals)
+	if _, ok := s.branchJournals[NullBranchID]; ok {
+		branches--
+	}
+	if branches >= s.maxBranches {
+		return MDServerErrorTooManyBranches{Limit: s.maxBranches}
+	}
+	return nil
+}
+
+// getBranchIDsOnDiskReadLocked returns the IDs of all the
+// branches with a journal on disk, whether or not they have been
+// loaded into s.branchJournals.
+func (s *mdServerTlfStorage) getBranchIDsOnDiskReadLocked() (
+	[]BranchID, error) {
+	fileInfos, err := ioutil.ReadDir(s.branchJournalsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bids []BranchID
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		name := fi.Name()
+		bid := ParseBranchID(name)
+		if bid == NullBranchID && name != NullBranchID.String() {
+			// Not a branch journal.
+			continue
+		}
+		bids = append(bids, bid)
+	}
+	return bids, nil
+}
+
+// loadBranchJournalLocked returns the journal for the given branch,
+// loading it into s.branchJournals if it exists on disk but hasn't
+// been loaded yet.
+func (s *mdServerTlfStorage) loadBranchJournalLocked(bid BranchID) (
+	j mdServerBranchJournal, ok bool, err error) {
+	j, ok = s.branchJournals[bid]
+	if ok {
+		return j, true, nil
+	}
+
+	dir := s.branchJournalPath(bid)
+	_, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		return mdServerBranchJournal{}, false, nil
+	} else if err != nil {
+		return mdServerBranchJournal{}, false, err
+	}
+
+	j = makeMDServerBranchJournal(s.codec, dir)
+	s.branchJournals[bid] = j
+	return j, true, nil
+}
+
+// The functions below are for maintaining the per-branch index of
+// writers, which is a sorted list of the UIDs that have put MDs to
+// the branch.
+
+func (s *mdServerTlfStorage) readWritersReadLocked(bid BranchID) (
+	[]keybase1.UID, error) {
+	buf, err := ioutil.ReadFile(s.writersPath(bid))
+	if err != nil {
+		return nil, err
+	}
+	var writers []keybase1.UID
+	err = s.codec.Decode(buf, &writers)
+	if err != nil {
+		return nil, err
+	}
+	return writers, nil
+}
+
+func (s *mdServerTlfStorage) writeWritersLocked(
+	bid BranchID, writers []keybase1.UID) error {
+	sort.Sort(uidList(writers))
+	buf, err := s.codec.Encode(writers)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.writersPath(bid), buf, 0600)
+}
+
+func (s *mdServerTlfStorage) addWriterLocked(
+	bid BranchID, uid keybase1.UID) error {
+	writers, err := s.readWritersReadLocked(bid)
+	if os.IsNotExist(err) {
+		// Rebuild it first, in case there is existing
+		// history.
+		writers, err = s.rebuildWritersLocked(bid)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, w := range writers {
+		if w == uid {
+			return nil
+		}
+	}
+
+	return s.writeWritersLocked(bid, append(writers, uid))
+}
+
+// rebuildWritersLocked rebuilds the writer index for the given
+// branch by scanning its history. Since the UID used to put an MD
+// isn't stored, this relies on the LastModifyingUser field of each
+// MD.
+func (s *mdServerTlfStorage) rebuildWritersLocked(bid BranchID) (
+	[]keybase1.UID, error) {
+	var writers []keybase1.UID
+	if j, ok := s.branchJournals[bid]; ok {
+		_, mdIDs, err := j.getRange(
+			MetadataRevisionInitial, MetadataRevision(math.MaxInt64))
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[keybase1.UID]bool)
+		for _, mdID := range mdIDs {
+			rmds, err := s.getMDReadLocked(mdID)
+			if err != nil {
+				return nil, err
+			}
+			uid := rmds.MD.LastModifyingUser
+			if uid == keybase1.UID("") || seen[uid] {
+				continue
+			}
+			seen[uid] = true
+			writers = append(writers, uid)
+		}
+	}
+
+	err := s.writeWritersLocked(bid, writers)
+	if err != nil {
+		return nil, err
+	}
+	return writers, nil
+}
+
+// branchIDList can be used to sort BranchIDs by their string
+// representation.
+type branchIDList []BranchID
+
+func (l branchIDList) Len() int {
+	return len(l)
+}
+
+func (l branchIDList) Less(i, j int) bool {
+	return l[i].String() < l[j].String()
+}
+
+func (l branchIDList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// revisionList can be used to sort MetadataRevisions.
+type revisionList []MetadataRevision
+
+func (r revisionList) Len() int {
+	return len(r)
+}
+
+func (r revisionList) Less(i, j int) bool {
+	return r[i] < r[j]
+}
+
+func (r revisionList) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// The functions below are for maintaining the per-branch list of
+// pinned revisions, which is sorted.
+
+func (s *mdServerTlfStorage) readPinnedReadLocked(bid BranchID) (
+	[]MetadataRevision, error) {
+	buf, err := ioutil.ReadFile(s.pinnedPath(bid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var pinned []MetadataRevision
+	err = s.codec.Decode(buf, &pinned)
+	if err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+func (s *mdServerTlfStorage) writePinnedLocked(
+	bid BranchID, pinned []MetadataRevision) error {
+	if len(pinned) == 0 {
+		err := os.Remove(s.pinnedPath(bid))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sort.Sort(revisionList(pinned))
+	buf, err := s.codec.Encode(pinned)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.pinnedPath(bid), buf, 0600)
+}
+
+func (s *mdServerTlfStorage) getHeadForTLFReadLocked(
+	ctx context.Context, bid BranchID) (
+	rmds *RootMetadataSigned, err error) {
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+	err = s.checkRollbackReadLocked(bid, j)
+	if err != nil {
+		return nil, err
+	}
+	headID, err := j.getHead()
+	if err != nil {
+		return nil, err
+	}
+	if headID == (MdID{}) {
+		return nil, nil
+	}
+	// Only the priority of ctx applies; head reads aren't traced
+	// as part of the caller's operation.
+	getCtx := withMDServerTlfStoragePriority(context.Background(),
+		mdServerTlfStoragePriorityFromContext(ctx))
+	rmds, _, err = s.getMDAndSizeReadLocked(getCtx, headID)
+	return rmds, err
+}
+
+func (s *mdServerTlfStorage) checkGetParamsReadLocked(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID) error {
+	mergedMasterHead, err := s.getHeadForTLFReadLocked(ctx, NullBranchID)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	ok, err := isReader(currentUID, mergedMasterHead)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if !ok {
+		return MDServerErrorUnauthorized{}
+	}
+
+	return s.authorizeReadLocked(ctx, mdAuthzRequest{
+		op:         mdAuthzRead,
+		uid:        currentUID,
+		deviceKID:  deviceKID,
+		bid:        bid,
+		mergedHead: mergedMasterHead,
+	})
+}
+
+// mdRangeBudget bounds the work done by a single getRange call. A
+// zero field means no limit.
+type mdRangeBudget struct {
+	// maxEntries is the maximum number of MDs to return.
+	maxEntries int
+	// maxBytes is the maximum total encoded size of the MDs to
+	// return. At least one MD is always returned, even if it is
+	// by itself bigger than maxBytes.
+	maxBytes int64
+}
+
+// getRangeReadLocked returns the MDs in the given range, stopping
+// early if the given budget is exhausted, in which case truncated is
+// set to true and the caller may continue from the revision after
+// the last one returned.
+func (s *mdServerTlfStorage) getRangeReadLocked(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision, budget mdRangeBudget) (
+	rmdses []*RootMetadataSigned, truncated bool, err error) {
+	err = s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, false, nil
+	}
+
+	realStart, mdIDs, err := j.getRange(start, stop)
+	if err != nil {
+		return nil, false, err
+	}
+	var totalBytes int64
+	for i, mdID := range mdIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+
+		if budget.maxEntries > 0 && len(rmdses) >= budget.maxEntries {
+			return rmdses, true, nil
+		}
+
+		expectedRevision := realStart + MetadataRevision(i)
+		getCtx, span := startMDServerTlfStorageSpan(ctx, "getMD")
+		span.SetTag("revision", expectedRevision)
+		span.SetTag("mdID", mdID)
+		rmds, size, err := s.getMDAndSizeReadLocked(getCtx, mdID)
+		span.Finish()
+		if err != nil {
+			return nil, false, MDServerError{err}
+		}
+		if expectedRevision != rmds.MD.Revision {
+			panic(fmt.Errorf("expected revision %v, got %v",
+				expectedRevision, rmds.MD.Revision))
+		}
+
+		if budget.maxBytes > 0 && len(rmdses) > 0 &&
+			totalBytes+size > budget.maxBytes {
+			return rmdses, true, nil
+		}
+
+		totalBytes += size
+		rmdses = append(rmdses, rmds)
+	}
+
+	return rmdses, false, nil
+}
+
+func (s *mdServerTlfStorage) checkOpenReadLocked() error {
+	switch s.state {
+	case mdServerTlfStorageNotOpen:
+		return errMDServerTlfStorageNotOpen
+	case mdServerTlfStorageClosed:
+		return errMDServerTlfStorageClosed
+	}
+	return nil
+}
+
+// fenceLocked returns errMDServerTlfStorageFenced if dir has been
+// opened by another instance since this one opened it. Otherwise,
+// it keeps other instances from opening dir until the returned
+// function is called, so that the caller's writes can't race with a
+// newer open. s.lock must be held for writing.
+func (s *mdServerTlfStorage) fenceLocked() (unfence func(), err error) {
+	return s.fence.hold(s.epochPath())
+}
+
+// All functions below are public functions.
+
+var errMDServerTlfStorageNotOpen = errors.New("mdServerTlfStorage is not open")
+
+var errMDServerTlfStorageClosed = errors.New("mdServerTlfStorage is closed")
+
+var errMDServerTlfStorageQuiesced = errors.New(
+	"mdServerTlfStorage is quiesced for maintenance")
+
+var errMDServerTlfStorageDiskFull = errors.New(
+	"mdServerTlfStorage is out of disk space")
+
+var errMDServerTlfStorageRekeyInProgress = errors.New(
+	"A rekey is in progress on this branch")
+
+var errMDServerTlfStorageFenced = errors.New(
+	"mdServerTlfStorage has been opened by another instance")
+
+// mdServerTlfStorageStaleHeadError is returned by getHeadWithin when
+// the head of a branch is older than the allowed staleness.
+type mdServerTlfStorageStaleHeadError struct {
+	bid          BranchID
+	headTime     time.Time
+	staleness    time.Duration
+	maxStaleness time.Duration
+}
+
+func (e mdServerTlfStorageStaleHeadError) Error() string {
+	return fmt.Sprintf("Head of branch %s written at %s is %s old, "+
+		"which is more than the allowed %s",
+		e.bid, e.headTime, e.staleness, e.maxStaleness)
+}
+
+// mdServerTlfStorageNoSuchMDIDError is returned by getMultiple for
+// an MdID that isn't stored.
+type mdServerTlfStorageNoSuchMDIDError struct {
+	id MdID
+}
+
+func (e mdServerTlfStorageNoSuchMDIDError) Error() string {
+	return fmt.Sprintf("No MD with ID %s", e.id)
+}
+
+// maxParallelMDGets is the maximum number of MDs read concurrently
+// by getMultiple.
+const maxParallelMDGets = 4
+
+func (s *mdServerTlfStorage) journalLength(bid BranchID) (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return 0, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return 0, nil
+	}
+
+	return j.journalLength()
+}
+
+// retainedWindow returns the earliest and latest revisions of the
+// given branch that are still stored, i.e. the window within which
+// getRange calls can succeed, taking pruning into account. It reads
+// only the journal pointers. For an empty or nonexistent branch, both
+// are MetadataRevisionUninitialized.
+func (s *mdServerTlfStorage) retainedWindow(bid BranchID) (
+	earliest, latest MetadataRevision, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, nil
+	}
+
+	earliest, err = j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	latest, err = j.readLatestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	return earliest, latest, nil
+}
+
+func (s *mdServerTlfStorage) getForTLF(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID) (*RootMetadataSigned, error) {
+	rmds, _, err := s.getForTLFWithSyncState(
+		ctx, currentUID, deviceKID, bid)
+	return rmds, err
+}
+
+// mdHeadSyncState describes how current the head of a branch is, so
+// that a caller reading from a replica can decide whether the head
+// is fresh enough.
+type mdHeadSyncState struct {
+	// headTime is the (untrusted) server timestamp of the head,
+	// or zero if the branch is empty.
+	headTime time.Time
+	// lastSynced is the last revision of the branch that every
+	// downstream destination with a flush cursor has confirmed
+	// having, or MetadataRevisionUninitialized if the branch
+	// has no flush cursors.
+	lastSynced MetadataRevision
+}
+
+// getForTLFWithSyncState is like getForTLF, but also returns the
+// mdHeadSyncState of the branch.
+func (s *mdServerTlfStorage) getForTLFWithSyncState(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID) (
+	*RootMetadataSigned, mdHeadSyncState, error) {
+	_, span := startMDServerTlfStorageSpan(ctx, "getForTLF")
+	defer span.Finish()
+	span.SetTag("branch", bid)
+
+	defer s.rLock(ctx)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, mdHeadSyncState{}, err
+	}
+
+	err := s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, mdHeadSyncState{}, err
+	}
+
+	rmds, err := s.getHeadForTLFReadLocked(ctx, bid)
+	if err != nil {
+		return nil, mdHeadSyncState{}, MDServerError{err}
+	}
+
+	state := mdHeadSyncState{lastSynced: MetadataRevisionUninitialized}
+	if rmds != nil {
+		state.headTime = rmds.untrustedServerTimestamp
+	}
+	limit, ok, err := s.flushCursorLimitReadLocked(bid)
+	if err != nil {
+		return nil, mdHeadSyncState{}, MDServerError{err}
+	}
+	if ok {
+		state.lastSynced = limit - 1
+	}
+	return rmds, state, nil
+}
+
+// estimateRange returns the number of MDs and their total encoded
+// size that getRange would return for the given range. Only the MDs
+// stored as deltas or with separate key bundles are read in full;
+// see encodedMDSizeReadLocked.
+func (s *mdServerTlfStorage) estimateRange(
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	count int, bytes int64, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return 0, 0, err
+	}
+
+	err = s.checkGetParamsReadLocked(
+		context.Background(), currentUID, deviceKID, bid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	_, mdIDs, err := j.getRange(start, stop)
+	if err != nil {
+		return 0, 0, MDServerError{err}
+	}
+
+	ctx := context.Background()
+	for _, mdID := range mdIDs {
+		size, err := s.encodedMDSizeReadLocked(ctx, mdID)
+		if err != nil {
+			return 0, 0, MDServerError{err}
+		}
+		bytes += size
+	}
+
+	return len(mdIDs), bytes, nil
+}
+
+// encodedMDSizeReadLocked returns the size of the full encoding of
+// the MD with the given ID. For an MD stored in full, that's the
+// size of its file, and only the start of the file is read, to
+// check its form; otherwise, the MD is rebuilt to get its size.
+func (s *mdServerTlfStorage) encodedMDSizeReadLocked(
+	ctx context.Context, id MdID) (int64, error) {
+	var size int64
+	var prefix []byte
+	if b, ok := s.writeBuffer[id]; ok {
+		size, prefix = int64(len(b.buf)), b.buf
+	} else {
+		path, fileInfo, err := s.statMDReadLocked(id)
+		if err != nil {
+			return 0, err
+		}
+		err = s.checkSymlinks(path)
+		if err != nil {
+			return 0, err
+		}
+		size = fileInfo.Size()
+
+		release := s.acquireFile(ctx)
+		prefix, err = readFilePrefix(path, len(mdDeltaMagic))
+		release()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if !isMDDelta(prefix) && !isMDKeyBundleRef(prefix) {
+		return size, nil
+	}
+	data, _, err := s.readEncodedMDReadLocked(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// readFilePrefix returns up to the first n bytes of the file at the
+// given path.
+func readFilePrefix(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	read, err := io.ReadFull(f, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return buf[:read], err
+}
+
+// getHeadWithin is like getForTLF, but returns an
+// mdServerTlfStorageStaleHeadError if the head was written more than
+// maxStaleness ago, as determined by its (untrusted) server
+// timestamp. A nil head is never considered stale.
+func (s *mdServerTlfStorage) getHeadWithin(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID,
+	maxStaleness time.Duration) (*RootMetadataSigned, error) {
+	rmds, state, err := s.getForTLFWithSyncState(
+		ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, err
+	}
+	if rmds == nil {
+		return nil, nil
+	}
+
+	headTime := state.headTime
+	staleness := s.clock.Now().Sub(headTime)
+	if staleness > maxStaleness {
+		return nil, mdServerTlfStorageStaleHeadError{
+			bid:          bid,
+			headTime:     headTime,
+			staleness:    staleness,
+			maxStaleness: maxStaleness,
+		}
+	}
+	return rmds, nil
+}
+
+func (s *mdServerTlfStorage) getRange(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	rmdses, _, err := s.getRangeWithBudget(
+		ctx, currentUID, deviceKID, bid, start, stop, mdRangeBudget{})
+	return rmdses, err
+}
+
+// getMD returns the MD with the given ID, which may be on any
+// branch, or an mdServerTlfStorageNoSuchMDIDError if it isn't
+// stored. As with the other getters, rmds.untrustedServerTimestamp is
+// set to the time the MD was written.
+//
+// If trustServerTimestamp is true, that time is also returned as
+// trustedServerTimestamp; otherwise trustedServerTimestamp is
+// zero. Only callers for which this storage is local and trusted,
+// e.g. local journaling, should pass true, in which case the
+// timestamp may be relied upon without further verification.
+func (s *mdServerTlfStorage) getMD(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, id MdID,
+	trustServerTimestamp bool) (rmds *RootMetadataSigned,
+	trustedServerTimestamp time.Time, err error) {
+	defer s.lock.rLockAs(mdLockCategoryGet)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	err = s.checkGetParamsReadLocked(
+		ctx, currentUID, deviceKID, NullBranchID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	rmds, _, err = s.getMDAndSizeReadLocked(ctx, id)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, mdServerTlfStorageNoSuchMDIDError{id}
+	} else if err != nil {
+		return nil, time.Time{}, MDServerError{err}
+	}
+
+	if trustServerTimestamp {
+		trustedServerTimestamp = rmds.untrustedServerTimestamp
+	}
+	return rmds, trustedServerTimestamp, nil
+}
+
+// getForTLFIfChanged is like getForTLF, but if the head of the given
+// branch is the MD with ID knownID, which should be MdID{} if the
+// branch is expected to be empty, it returns changed == false and a
+// nil rmds instead. In that case, the head is resolved from the
+// journal alone, and no MD object is read, as long as the caller was
+// already found to be a reader as of the current master head.
+func (s *mdServerTlfStorage) getForTLFIfChanged(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID,
+	knownID MdID) (rmds *RootMetadataSigned, changed bool, err error) {
+	_, span := startMDServerTlfStorageSpan(ctx, "getForTLFIfChanged")
+	defer span.Finish()
+	span.SetTag("branch", bid)
+
+	defer s.rLock(ctx)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, false, err
+	}
+
+	err = s.checkReaderCachedReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var headID MdID
+	if j, ok := s.branchJournals[bid]; ok {
+		err := s.checkRollbackReadLocked(bid, j)
+		if err != nil {
+			return nil, false, MDServerError{err}
+		}
+		headID, err = j.getHead()
+		if err != nil {
+			return nil, false, MDServerError{err}
+		}
+	}
+	if headID == knownID {
+		span.SetTag("changed", false)
+		return nil, false, nil
+	}
+
+	rmds, err = s.getHeadForTLFReadLocked(ctx, bid)
+	if err != nil {
+		return nil, false, MDServerError{err}
+	}
+	span.SetTag("changed", true)
+	return rmds, true, nil
+}
+
+// checkReaderCachedReadLocked is like checkGetParamsReadLocked, but
+// uses and fills in s.readers. Only the built-in reader check is
+// cached, so if s.authorizer is set, the head is still read for it.
+func (s *mdServerTlfStorage) checkReaderCachedReadLocked(
+	ctx context.Context, currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID) error {
+	var masterHeadID MdID
+	if j, ok := s.branchJournals[NullBranchID]; ok {
+		err := s.checkRollbackReadLocked(NullBranchID, j)
+		if err != nil {
+			return MDServerError{err}
+		}
+		masterHeadID, err = j.getHead()
+		if err != nil {
+			return MDServerError{err}
+		}
+	}
+
+	s.readerCacheLock.Lock()
+	defer s.readerCacheLock.Unlock()
+	cached := s.readerCacheHeadID == masterHeadID && s.readers[currentUID]
+	if cached && s.authorizer == nil {
+		return nil
+	}
+
+	mergedMasterHead, err := s.getHeadForTLFReadLocked(ctx, NullBranchID)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if !cached {
+		ok, err := isReader(currentUID, mergedMasterHead)
+		if err != nil {
+			return MDServerError{err}
+		}
+		if !ok {
+			return MDServerErrorUnauthorized{}
+		}
+
+		if s.readerCacheHeadID != masterHeadID || s.readers == nil {
+			s.readerCacheHeadID = masterHeadID
+			s.readers = make(map[keybase1.UID]bool)
+		}
+		s.readers[currentUID] = true
+	}
+
+	return s.authorizeReadLocked(ctx, mdAuthzRequest{
+		op:         mdAuthzRead,
+		uid:        currentUID,
+		deviceKID:  deviceKID,
+		bid:        bid,
+		mergedHead: mergedMasterHead,
+	})
+}
+
+// getMDHeader is like getMD, but returns the MD without its
+// serialized private metadata, along with the size of the latter,
+// for callers that only need e.g. its revision or keys. With
+// splitHeaders, that is done without reading the rest of the MD.
+func (s *mdServerTlfStorage) getMDHeader(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, id MdID) (
+	rmds *RootMetadataSigned, bodySize int, err error) {
+	defer s.lock.rLockAs(mdLockCategoryGet)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, 0, err
+	}
+
+	err = s.checkGetParamsReadLocked(
+		ctx, currentUID, deviceKID, NullBranchID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rmds, bodySize, err = s.getMDHeaderReadLocked(ctx, id)
+	if os.IsNotExist(err) {
+		return nil, 0, mdServerTlfStorageNoSuchMDIDError{id}
+	} else if err != nil {
+		return nil, 0, MDServerError{err}
+	}
+	return rmds, bodySize, nil
+}
+
+// getMultiple returns the MDs with the given IDs, which may be on
+// any branch, along with a per-ID error. rmdses[i] and errs[i]
+// correspond to ids[i], and exactly one of them is non-nil. An ID
+// that isn't stored gets an mdServerTlfStorageNoSuchMDIDError. The
+// top-level error is non-nil only if the whole batch failed, e.g. on
+// a permission or context error, in which case rmdses and errs are
+// nil.
+func (s *mdServerTlfStorage) getMultiple(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, ids []MdID) (
+	rmdses []*RootMetadataSigned, errs []error, err error) {
+	defer s.lock.rLockAs(mdLockCategoryGet)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, nil, err
+	}
+
+	err = s.checkGetParamsReadLocked(
+		ctx, currentUID, deviceKID, NullBranchID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rmdses = make([]*RootMetadataSigned, len(ids))
+	errs = make([]error, len(ids))
+
+	numWorkers := len(ids)
+	if numWorkers > maxParallelMDGets {
+		numWorkers = maxParallelMDGets
+	}
+	indices := make(chan int, len(ids))
+	for i := range ids {
+		indices <- i
+	}
+	close(indices)
+
+	// Each worker writes only to the slots of the indices it
+	// receives, so no further synchronization is needed.
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		for i := range indices {
+			if ctx.Err() != nil {
+				return
+			}
+			rmds, _, err := s.getMDAndSizeReadLocked(ctx, ids[i])
+			if os.IsNotExist(err) {
+				errs[i] = mdServerTlfStorageNoSuchMDIDError{ids[i]}
+			} else if err != nil {
+				errs[i] = MDServerError{err}
+			} else {
+				rmdses[i] = rmds
+			}
+		}
+	}
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go worker()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return rmdses, errs, nil
+}
+
+// filterRange is like getRange, except that it returns only the MDs
+// for which pred returns true. Every MD in the range is still read
+// and decoded, but only the matching ones are kept in memory.
+func (s *mdServerTlfStorage) filterRange(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision,
+	pred func(*RootMetadataSigned) bool) ([]*RootMetadataSigned, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	err := s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	_, mdIDs, err := j.getRange(start, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	var rmdses []*RootMetadataSigned
+	for _, mdID := range mdIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		rmds, err := s.getMDReadLocked(mdID)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if pred(rmds) {
+			rmdses = append(rmdses, rmds)
+		}
+	}
+
+	return rmdses, nil
+}
+
+// rangeByWriter is like getRange, except that it returns only the
+// MDs last modified by writerUID, in order. If the branch's index of
+// writers shows that writerUID never wrote to it, nothing is read;
+// otherwise, with splitHeaders, only the headers of the other MDs
+// are read.
+func (s *mdServerTlfStorage) rangeByWriter(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID,
+	writerUID keybase1.UID, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	err := s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	// A missing index can't be rebuilt under the read lock, so
+	// then every MD is checked.
+	writers, err := s.readWritersReadLocked(bid)
+	if err == nil {
+		wrote := false
+		for _, w := range writers {
+			if w == writerUID {
+				wrote = true
+				break
+			}
+		}
+		if !wrote {
+			return nil, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, MDServerError{err}
+	}
+
+	_, mdIDs, err := j.getRange(start, stop)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	var rmdses []*RootMetadataSigned
+	for _, mdID := range mdIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var rmds *RootMetadataSigned
+		if s.splitHeaders {
+			rmds, _, err = s.getMDHeaderReadLocked(ctx, mdID)
+		} else {
+			rmds, err = s.getMDReadLocked(mdID)
+		}
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if rmds.MD.LastModifyingUser != writerUID {
+			continue
+		}
+		if s.splitHeaders {
+			rmds, err = s.getMDReadLocked(mdID)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+		}
+		rmdses = append(rmdses, rmds)
+	}
+
+	return rmdses, nil
+}
+
+// mdReaderChange describes a revision whose set of readers differs
+// from that of the previous revision. All the lists are sorted.
+type mdReaderChange struct {
+	revision MetadataRevision
+	before   []keybase1.UID
+	after    []keybase1.UID
+	added    []keybase1.UID
+	removed  []keybase1.UID
+}
+
+// readerChanges returns the revisions of the given range of the
+// given branch whose readers, i.e. the users for whom isReader would
+// return true, differ from those of the previous revision. The first
+// revision in the range is compared to its predecessor, if that is
+// still stored. Public TLFs are readable by everyone, so they never
+// have any reader changes.
+func (s *mdServerTlfStorage) readerChanges(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	[]mdReaderChange, error) {
+	fetchStart := start
+	if fetchStart > MetadataRevisionInitial {
+		fetchStart--
+	}
+	rmdses, err := s.getRange(
+		ctx, currentUID, deviceKID, bid, fetchStart, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []mdReaderChange
+	var prevReaders []keybase1.UID
+	for i, rmds := range rmdses {
+		if rmds.MD.ID.IsPublic() {
+			return nil, nil
+		}
+
+		h, err := rmds.MD.MakeBareTlfHandle()
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		readers := h.ResolvedUsers()
+		sort.Sort(uidList(readers))
+
+		if i > 0 && rmds.MD.Revision >= start {
+			added := uidListDifference(readers, prevReaders)
+			removed := uidListDifference(prevReaders, readers)
+			if len(added) > 0 || len(removed) > 0 {
+				changes = append(changes, mdReaderChange{
+					revision: rmds.MD.Revision,
+					before:   prevReaders,
+					after:    readers,
+					added:    added,
+					removed:  removed,
+				})
+			}
+		}
+		prevReaders = readers
+	}
+	return changes, nil
+}
+
+// uidListDifference returns the UIDs in the sorted list a that are
+// not in the sorted list b.
+func uidListDifference(a, b []keybase1.UID) []keybase1.UID {
+	var diff []keybase1.UID
+	j := 0
+	for _, uid := range a {
+		for j < len(b) && b[j].Less(uid) {
+			j++
+		}
+		if j < len(b) && b[j] == uid {
+			continue
+		}
+		diff = append(diff, uid)
+	}
+	return diff
+}
+
+// getRangeWithFallback is like getRange, except that the part of the
+// requested range that is below the earliest revision stored locally
+// (e.g., because it has been pruned) is fetched from the given
+// fallback MDServer instead. The fetched MDs are verified to form a
+// chain ending at the predecessor of the earliest local MD. If
+// fallback is nil, this behaves exactly like getRange.
+func (s *mdServerTlfStorage) getRangeWithFallback(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision, fallback MDServer) (
+	[]*RootMetadataSigned, error) {
+	earliest, localRmdses, err := func() (
+		*RootMetadataSigned, []*RootMetadataSigned, error) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+
+		if err := s.checkOpenReadLocked(); err != nil {
+			return nil, nil, err
+		}
+
+		err := s.checkGetParamsReadLocked(
+			ctx, currentUID, deviceKID, bid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		j, ok := s.branchJournals[bid]
+		if !ok {
+			return nil, nil, nil
+		}
+
+		earliestRevision, err := j.readEarliestRevision()
+		if err != nil {
+			return nil, nil, MDServerError{err}
+		} else if earliestRevision == MetadataRevisionUninitialized {
+			return nil, nil, nil
+		}
+
+		earliestID, err := j.readMdID(earliestRevision)
+		if err != nil {
+			return nil, nil, MDServerError{err}
+		}
+
+		earliest, err := s.getMDReadLocked(earliestID)
+		if err != nil {
+			return nil, nil, MDServerError{err}
+		}
+
+		localRmdses, _, err := s.getRangeReadLocked(ctx, currentUID,
+			deviceKID, bid, start, stop, mdRangeBudget{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return earliest, localRmdses, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	if fallback == nil || earliest == nil || start >= earliest.MD.Revision {
+		return localRmdses, nil
+	}
+
+	// Fetch everything up to the earliest local revision, even
+	// if stop is lower, so that the result can be verified.
+	mStatus := Merged
+	if bid != NullBranchID {
+		mStatus = Unmerged
+	}
+	fallbackStop := earliest.MD.Revision - 1
+	fallbackRmdses, err := fallback.GetRange(
+		ctx, earliest.MD.ID, bid, mStatus, start, fallbackStop)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedID := earliest.MD.PrevRoot
+	for i := len(fallbackRmdses) - 1; i >= 0; i-- {
+		rmds := fallbackRmdses[i]
+		expectedRevision :=
+			fallbackStop - MetadataRevision(len(fallbackRmdses)-1-i)
+		if rmds.MD.Revision != expectedRevision {
+			return nil, MDServerError{fmt.Errorf(
+				"Fallback returned revision %s, expected %s",
+				rmds.MD.Revision, expectedRevision)}
+		}
+		id, err := s.idFunc(&rmds.MD)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if id != expectedID {
+			return nil, MDServerError{fmt.Errorf(
+				"Fallback returned MD %s for revision %s, "+
+					"expected %s", id, rmds.MD.Revision,
+				expectedID)}
+		}
+		expectedID = rmds.MD.PrevRoot
+	}
+
+	var rmdses []*RootMetadataSigned
+	for _, rmds := range fallbackRmdses {
+		if rmds.MD.Revision > stop {
+			break
+		}
+		rmdses = append(rmdses, rmds)
+	}
+	return append(rmdses, localRmdses...), nil
+}
+
+// getRangeWithBudget is like getRange, except that it returns early
+// with truncated set to true if the given budget is exhausted before
+// the whole range is read.
+func (s *mdServerTlfStorage) getRangeWithBudget(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision, budget mdRangeBudget) (
+	rmdses []*RootMetadataSigned, truncated bool, err error) {
+	ctx, span := startMDServerTlfStorageSpan(ctx, "getRange")
+	defer span.Finish()
+	span.SetTag("branch", bid)
+	span.SetTag("start", start)
+	span.SetTag("stop", stop)
+
+	defer s.rLock(ctx)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, false, err
+	}
+
+	return s.getRangeReadLocked(
+		ctx, currentUID, deviceKID, bid, start, stop, budget)
+}
+
+// mdRangeShortfall says why the MDs returned by getRangeWithCoverage
+// end before the requested stop revision, if they do.
+type mdRangeShortfall int
+
+const (
+	// mdRangeComplete means every revision up to stop was
+	// returned.
+	mdRangeComplete mdRangeShortfall = iota
+	// mdRangeEndOfJournal means the journal has no revisions
+	// after the last one returned.
+	mdRangeEndOfJournal
+	// mdRangeGap means the journal has revisions after the last
+	// one returned, but the next one is missing, or is recorded
+	// with an MD of another revision.
+	mdRangeGap
+)
+
+func (sf mdRangeShortfall) String() string {
+	switch sf {
+	case mdRangeComplete:
+		return "complete"
+	case mdRangeEndOfJournal:
+		return "end of journal"
+	case mdRangeGap:
+		return "gap"
+	default:
+		return "unknown"
+	}
+}
+
+// mdRangeCoverage describes the MDs returned by getRangeWithCoverage.
+type mdRangeCoverage struct {
+	// first and last are the revisions of the first and last
+	// MDs returned, or MetadataRevisionUninitialized if none
+	// were.
+	first, last MetadataRevision
+	shortfall   mdRangeShortfall
+	// gap is the revision at which the range stopped, if
+	// shortfall is mdRangeGap.
+	gap MetadataRevision
+}
+
+// getRangeWithCoverage is like getRange, except that it also returns
+// the range of revisions actually returned, and why it ends early, if
+// it does. Unlike getRange, it doesn't fail on a missing journal entry
+// or an MD of the wrong revision in the middle of the journal, but
+// returns the MDs before it and reports the gap.
+func (s *mdServerTlfStorage) getRangeWithCoverage(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, coverage mdRangeCoverage, err error) {
+	defer s.rLock(ctx)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, mdRangeCoverage{}, err
+	}
+
+	err = s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, mdRangeCoverage{}, err
+	}
+
+	coverage.shortfall = mdRangeEndOfJournal
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, coverage, nil
+	}
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return nil, mdRangeCoverage{}, MDServerError{err}
+	} else if earliest == MetadataRevisionUninitialized {
+		return nil, coverage, nil
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return nil, mdRangeCoverage{}, MDServerError{err}
+	}
+
+	if start < earliest {
+		start = earliest
+	}
+	if stop <= latest {
+		coverage.shortfall = mdRangeComplete
+	} else {
+		stop = latest
+	}
+
+	for r := start; r <= stop; r++ {
+		if err := ctx.Err(); err != nil {
+			return nil, mdRangeCoverage{}, err
+		}
+
+		mdID, err := j.readMdID(r)
+		if os.IsNotExist(err) {
+			coverage.shortfall = mdRangeGap
+			coverage.gap = r
+			break
+		} else if err != nil {
+			return nil, mdRangeCoverage{}, MDServerError{err}
+		}
+		rmds, _, err := s.getMDAndSizeReadLocked(ctx, mdID)
+		if err != nil {
+			return nil, mdRangeCoverage{}, MDServerError{err}
+		}
+		if rmds.MD.Revision != r {
+			coverage.shortfall = mdRangeGap
+			coverage.gap = r
+			break
+		}
+
+		if len(rmdses) == 0 {
+			coverage.first = r
+		}
+		coverage.last = r
+		rmdses = append(rmdses, rmds)
+	}
+
+	return rmdses, coverage, nil
+}
+
+// mdRangeContinuation is the content of a continuation token
+// returned by pagedRange. Fields are exported only for
+// serialization.
+type mdRangeContinuation struct {
+	BID  BranchID
+	Next MetadataRevision
+	Stop MetadataRevision
+}
+
+// pagedRange is like getRangeWithBudget, except that if the result is
+// truncated, it returns an opaque continuation token instead of a
+// flag. Passing that token back with the same branch and stop
+// revision resumes right after the last MD returned, in which case
+// start is ignored. A nil token means there are no more results.
+//
+// A token for a different branch or stop revision, or one whose next
+// revision has since been pruned, is rejected with an
+// MDServerErrorBadRequest.
+func (s *mdServerTlfStorage) pagedRange(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision, budget mdRangeBudget,
+	token []byte) (
+	rmdses []*RootMetadataSigned, nextToken []byte, err error) {
+	ctx, span := startMDServerTlfStorageSpan(ctx, "getRange")
+	defer span.Finish()
+	span.SetTag("branch", bid)
+	span.SetTag("start", start)
+	span.SetTag("stop", stop)
+
+	defer s.lock.rLockAs(mdLockCategoryGet)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, nil, err
+	}
+
+	if token != nil {
+		var c mdRangeContinuation
+		err := s.codec.Decode(token, &c)
+		if err != nil {
+			return nil, nil, MDServerErrorBadRequest{
+				Reason: fmt.Sprintf("Invalid range token: %v", err)}
+		}
+		if c.BID != bid || c.Stop != stop {
+			return nil, nil, MDServerErrorBadRequest{
+				Reason: fmt.Sprintf("Range token for branch %s up "+
+					"to revision %s used for branch %s up to %s",
+					c.BID, c.Stop, bid, stop)}
+		}
+
+		if j, ok := s.branchJournals[bid]; ok {
+			earliest, err := j.readEarliestRevision()
+			if err != nil {
+				return nil, nil, MDServerError{err}
+			}
+			if earliest == MetadataRevisionUninitialized ||
+				c.Next < earliest {
+				return nil, nil, MDServerErrorBadRequest{
+					Reason: fmt.Sprintf("Revision %s of branch %s "+
+						"in range token has been pruned", c.Next, bid)}
+			}
+		}
+		start = c.Next
+	}
+
+	rmdses, truncated, err := s.getRangeReadLocked(
+		ctx, currentUID, deviceKID, bid, start, stop, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !truncated {
+		return rmdses, nil, nil
+	}
+
+	nextToken, err = s.codec.Encode(mdRangeContinuation{
+		BID:  bid,
+		Next: rmdses[len(rmdses)-1].MD.Revision + 1,
+		Stop: stop,
+	})
+	if err != nil {
+		return nil, nil, MDServerError{err}
+	}
+	return rmdses, nextToken, nil
+}
+
+// mdServerTlfStorageResyncError is returned by catchUp when it can't
+// tell which revisions come after the given MD, because the MD is
+// unknown, pruned, or not in the given branch. The caller must then
+// sync from scratch, e.g. from the head.
+type mdServerTlfStorageResyncError struct {
+	bid    BranchID
+	fromID MdID
+	reason string
+}
+
+func (e mdServerTlfStorageResyncError) Error() string {
+	return fmt.Sprintf("Can't catch up on branch %s from MD %s: %s",
+		e.bid, e.fromID, e.reason)
+}
+
+// catchUp returns the MDs of the given branch after the one with ID
+// fromID, which is usually the head the caller last saw, up to the
+// head, within the given budget. If the budget is exhausted first,
+// truncated is set to true, and the caller may continue by passing
+// the ID of the last MD returned. If fromID is the head, no MDs are
+// returned. If fromID isn't in the branch, an
+// mdServerTlfStorageResyncError is returned.
+func (s *mdServerTlfStorage) catchUp(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, fromID MdID, budget mdRangeBudget) (
+	rmdses []*RootMetadataSigned, truncated bool, err error) {
+	ctx, span := startMDServerTlfStorageSpan(ctx, "catchUp")
+	defer span.Finish()
+	span.SetTag("branch", bid)
+	span.SetTag("fromID", fromID)
+
+	defer s.rLock(ctx)()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, false, err
+	}
+
+	err = s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resyncErr := mdServerTlfStorageResyncError{bid: bid, fromID: fromID}
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		resyncErr.reason = "the branch doesn't exist"
+		return nil, false, resyncErr
+	}
+
+	// Only the header is needed for the revision.
+	from, _, err := s.getMDHeaderReadLocked(ctx, fromID)
+	if os.IsNotExist(err) {
+		resyncErr.reason = "the MD isn't stored"
+		return nil, false, resyncErr
+	} else if err != nil {
+		return nil, false, MDServerError{err}
+	}
+
+	rev := from.MD.Revision
+	_, mdIDs, err := j.getRange(rev, rev)
+	if err != nil {
+		return nil, false, MDServerError{err}
+	}
+	if len(mdIDs) != 1 || mdIDs[0] != fromID {
+		resyncErr.reason = fmt.Sprintf(
+			"it isn't revision %s of the branch", rev)
+		return nil, false, resyncErr
+	}
+
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return nil, false, MDServerError{err}
+	}
+	if rev == latest {
+		return nil, false, nil
+	}
+
+	return s.getRangeReadLocked(
+		ctx, currentUID, deviceKID, bid, rev+1, latest, budget)
+}
+
+// mdServerTlfStoragePrevRootMismatchError is wrapped in an
+// MDServerError by put in paranoid mode when the predecessor that a
+// new MD points to isn't the head recorded in the journal.
+type mdServerTlfStoragePrevRootMismatchError struct {
+	bid          BranchID
+	revision     MetadataRevision
+	prevRoot     MdID
+	headBID      BranchID
+	headRevision MetadataRevision
+	headID       MdID
+	// reason says how the mismatch was found.
+	reason string
+}
+
+func (e mdServerTlfStoragePrevRootMismatchError) Error() string {
+	return fmt.Sprintf("Revision %s of branch %s has predecessor %s, "+
+		"but the head of branch %s is revision %s with ID %s: %s",
+		e.revision, e.bid, e.prevRoot, e.headBID, e.headRevision,
+		e.headID, e.reason)
+}
+
+// checkPrevRootLocked checks, independently of
+// CheckValidSuccessorForServer, that the predecessor of rmds is the
+// given head of the given branch: that its PrevRoot is the head's ID
+// as recorded in the branch's journal, and that the MD object stored
+// under that ID is the head.
+func (s *mdServerTlfStorage) checkPrevRootLocked(rmds *RootMetadataSigned,
+	headBID BranchID, head *RootMetadataSigned) error {
+	mismatch := mdServerTlfStoragePrevRootMismatchError{
+		bid:          rmds.MD.BID,
+		revision:     rmds.MD.Revision,
+		prevRoot:     rmds.MD.PrevRoot,
+		headBID:      headBID,
+		headRevision: head.MD.Revision,
+	}
+
+	j, ok := s.branchJournals[headBID]
+	if !ok {
+		return fmt.Errorf("No journal for branch %s", headBID)
+	}
+	headID, err := j.readMdID(head.MD.Revision)
+	if err != nil {
+		return err
+	}
+	mismatch.headID = headID
+
+	if rmds.MD.PrevRoot != headID {
+		mismatch.reason = "predecessor isn't the journal's head"
+		return mismatch
+	}
+
+	prev, err := s.getMDReadLocked(rmds.MD.PrevRoot)
+	if err != nil {
+		mismatch.reason = fmt.Sprintf(
+			"couldn't read predecessor: %v", err)
+		return mismatch
+	}
+	if prev.MD.BID != headBID || prev.MD.Revision != head.MD.Revision {
+		mismatch.reason = fmt.Sprintf(
+			"predecessor is revision %s of branch %s",
+			prev.MD.Revision, prev.MD.BID)
+		return mismatch
+	}
+	return nil
+}
+
+// mdServerTlfStorageHeadMovedError is wrapped in an
+// MDServerErrorConditionFailed by putIfHead when the head of the
+// branch isn't the expected one.
+type mdServerTlfStorageHeadMovedError struct {
+	bid        BranchID
+	expectedID MdID
+	// actualID is MdID{} if the branch is empty.
+	actualID MdID
+}
+
+func (e mdServerTlfStorageHeadMovedError) Error() string {
+	return fmt.Sprintf("Head of branch %s is %s, not the expected %s",
+		e.bid, e.actualID, e.expectedID)
+}
+
+// put appends the given MD to the journal of its branch, storing the
+// MD object unless it's already stored.
+//
+// Puts are idempotent: putting an MD that's already at its revision
+// of its branch succeeds, returning the same recordBranchID as the
+// original put, without storing or appending anything. Since the
+// check and the append happen together under the lock, of any number
+// of concurrent puts of the same MD, exactly one appends it, and the
+// others find it already appended. A different MD at the same
+// revision is still a conflict.
+func (s *mdServerTlfStorage) put(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	rmds *RootMetadataSigned) (recordBranchID bool, err error) {
+	return s.putWithCondition(
+		ctx, currentUID, deviceKID, rmds, nil, nil, nil)
+}
+
+// putAnnotated is like put, but also stores the given annotations
+// for the MD, which getAnnotations returns. Annotations are
+// operational metadata, e.g. the source the MD was ingested from,
+// and are neither signed nor part of the MD ID. A revision annotated
+// with the mdRetentionLegal retention class is pinned.
+//
+// As with put, putAnnotated succeeds when the MD is already at its
+// revision of its branch, in which case its existing annotations
+// and the given ones are merged as by mergeMDAnnotations.
+func (s *mdServerTlfStorage) putAnnotated(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	rmds *RootMetadataSigned, annotations map[string]string) (
+	recordBranchID bool, err error) {
+	for k := range annotations {
+		if k == "" {
+			return false, MDServerErrorBadRequest{
+				Reason: "Empty annotation key"}
+		}
+	}
+	return s.putWithCondition(
+		ctx, currentUID, deviceKID, rmds, nil, nil, annotations)
+}
+
+// putAsync is like put, but also returns a channel which receives a
+// single value and is then closed: nil once the MD has been written
+// to disk, or the error that prevented it from being written. If
+// write buffering isn't enabled, or the MD was already written, the
+// channel is ready immediately.
+//
+// Neither the MD nor the journals are fsynced, so a nil value only
+// means the MD survives the process dying, not the machine crashing.
+func (s *mdServerTlfStorage) putAsync(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	rmds *RootMetadataSigned) (
+	recordBranchID bool, written <-chan error, err error) {
+	ch := make(chan error, 1)
+	recordBranchID, err = s.putWithCondition(
+		ctx, currentUID, deviceKID, rmds, nil, ch, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	return recordBranchID, ch, nil
+}
+
+// putIfHead is like put, except that it atomically checks that the
+// head of the MD's branch is the MD with ID expectedHeadID, which
+// should be MdID{} if the branch is expected to be empty. If it
+// isn't, it returns an MDServerErrorConditionFailed wrapping an
+// mdServerTlfStorageHeadMovedError with the actual head.
+func (s *mdServerTlfStorage) putIfHead(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	rmds *RootMetadataSigned, expectedHeadID MdID) (
+	recordBranchID bool, err error) {
+	return s.putWithCondition(
+		ctx, currentUID, deviceKID, rmds, &expectedHeadID, nil, nil)
+}
+
+// putWithCondition implements put, putAsync, putIfHead, and
+// putAnnotated. If expectedHeadID is nil, the head of the branch
+// isn't checked. If written is non-nil and the put succeeds, it is
+// notified once the MD is written to disk.
+//
+// The MD is encoded, and if possible written, by prepareMDPut before
+// the lock is taken, so that concurrent puts and reads wait only on
+// the checks and the journal append.
+func (s *mdServerTlfStorage) putWithCondition(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	rmds *RootMetadataSigned, expectedHeadID *MdID,
+	written chan<- error, annotations map[string]string) (
+	recordBranchID bool, err error) {
+	ctx, span := startMDServerTlfStorageSpan(ctx, "put")
+	defer span.Finish()
+	span.SetTag("branch", rmds.MD.BID)
+	span.SetTag("revision", rmds.MD.Revision)
+
+	prep, err := s.prepareMDPut(ctx, currentUID, rmds)
+	if err != nil {
+		return false, MDServerError{err}
+	}
+	// By the time this runs, the staged file has been moved into
+	// place if it was used.
+	defer s.discardStagedMD(prep.stagedPath)
+
+	s.lock.lockAs(mdLockCategoryPut)
+	lockedAt := time.Now()
+	defer func() {
+		held := time.Since(lockedAt)
+		s.lock.Unlock()
+		span.SetTag("lockHeld", held)
+		if s.putLockHoldTimer != nil {
+			s.putLockHoldTimer.Update(held)
+		}
+	}()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return false, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return false, err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return false, MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	mStatus := rmds.MD.MergedStatus()
+	bid := rmds.MD.BID
+
+	if (mStatus == Merged) != (bid == NullBranchID) {
+		return false, MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+	}
+
+	// Check permissions
+
+	mergedMasterHead, err := s.checkWriterReadLocked(ctx, currentUID, rmds)
+	if err != nil {
+		return false, err
+	}
+	err = s.authorizeReadLocked(ctx, mdAuthzRequest{
+		op:         mdAuthzWrite,
+		uid:        currentUID,
+		deviceKID:  deviceKID,
+		bid:        bid,
+		mergedHead: mergedMasterHead,
+		rmds:       rmds,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if bid != NullBranchID {
+		closed, err := s.isBranchClosedReadLocked(bid)
+		if err != nil {
+			return false, MDServerError{err}
+		}
+		if closed {
+			return false, MDServerErrorBranchClosed{BID: bid}
+		}
+	}
+
+	if s.isRekeyLeasedLocked(bid) {
+		// Only a valid rekey of the merged head, as
+		// isWriterOrValidRekey judges one, gets past the
+		// lease; the rekey flag alone could be set by anyone.
+		isRekey := false
+		if mergedMasterHead != nil {
+			isRekey, err = rmds.MD.IsValidRekeyRequest(
+				s.codec, &mergedMasterHead.MD, currentUID)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+		}
+		if !isRekey {
+			return false, MDServerErrorThrottle{
+				errMDServerTlfStorageRekeyInProgress}
+		}
+	}
+
+	// Only authorized puts count against the rate limit, so that
+	// others can't use up the writers' budget. Puts that fail
+	// later still count, since they cost IO too.
+	if err := s.takeWriteTokenLocked(bid); err != nil {
+		return false, err
+	}
+
+	// A put of an MD that's already at its revision, e.g. a retry
+	// or one of several identical concurrent puts, changes
+	// nothing but its annotations. This comes after the
+	// permission checks, so that a put can't be used to probe for
+	// MDs, and before the head check, which the MD itself would
+	// fail as the head.
+	alreadyPut, err := s.isMDAtRevisionReadLocked(
+		bid, rmds.MD.Revision, prep.id)
+	if err != nil {
+		return false, MDServerError{err}
+	}
+	if alreadyPut {
+		s.countPutMD(false)
+		if len(annotations) > 0 {
+			err = s.annotateLocked(
+				bid, rmds.MD.Revision, prep.id, annotations)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+		}
+		if written != nil {
+			s.addWriteWaiterLocked(prep.id, written)
+		}
+		// The original put recorded the branch ID if the MD
+		// started its branch, i.e. it's still the earliest
+		// one in the branch's journal.
+		if mStatus == Unmerged {
+			earliest, err :=
+				s.branchJournals[bid].readEarliestRevision()
+			if err != nil {
+				return false, MDServerError{err}
+			}
+			recordBranchID = earliest == rmds.MD.Revision
+		}
+		return recordBranchID, nil
+	}
+
+	if expectedHeadID != nil {
+		var headID MdID
+		if j, ok := s.branchJournals[bid]; ok {
+			headID, err = j.getHead()
+			if err != nil {
+				return false, MDServerError{err}
+			}
+		}
+		if headID != *expectedHeadID {
+			return false, MDServerErrorConditionFailed{
+				Err: mdServerTlfStorageHeadMovedError{
+					bid:        bid,
+					expectedID: *expectedHeadID,
+					actualID:   headID,
+				},
+			}
+		}
+	}
+
+	head, err := s.getHeadForTLFReadLocked(ctx, bid)
+	if err != nil {
+		return false, MDServerError{err}
+	}
+
+	if mStatus == Unmerged && head == nil {
+		if err := s.checkBootstrapBranchIDReadLocked(bid); err != nil {
+			return false, err
+		}
+
+		// Check the limit now, before the MD object is
+		// stored, rather than only when the journal is
+		// created.
+		if err := s.checkBranchLimitLocked(bid); err != nil {
+			return false, err
+		}
+
+		// currHead for unmerged history might be on the main branch
+		prevRev := rmds.MD.Revision - 1
+		rmdses, _, err := s.getRangeReadLocked(ctx, currentUID,
+			deviceKID, NullBranchID, prevRev, prevRev,
+			mdRangeBudget{})
+		if err != nil {
+			return false, MDServerError{err}
+		}
+		if len(rmdses) != 1 {
+			return false, MDServerError{
+				Err: fmt.Errorf("Expected 1 MD block got %d", len(rmdses)),
+			}
+		}
+		head = rmdses[0]
+		recordBranchID = true
+	}
+
+	// Consistency checks
+	if head != nil {
+		// Check the revision first, so that a put that lost a
+		// race always gets a conflict error that tells it
+		// which revision to rebase onto.
+		expected := head.MD.Revision + 1
+		if rmds.MD.Revision != expected {
+			return false, MDServerErrorConflictRevision{
+				Desc: fmt.Sprintf("Conflict: head of branch %s "+
+					"is at revision %d, so expected revision %d, "+
+					"actual %d", bid, head.MD.Revision, expected,
+					rmds.MD.Revision),
+				Expected: expected,
+				Actual:   rmds.MD.Revision,
+			}
+		}
+
+		if s.paranoidPuts {
+			headBID := bid
+			if recordBranchID {
+				headBID = NullBranchID
+			}
+			err := s.checkPrevRootLocked(rmds, headBID, head)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+		}
+
+		err := head.MD.CheckValidSuccessorForServer(s.crypto, &rmds.MD)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	putCtx, putSpan := startMDServerTlfStorageSpan(ctx, "putMD")
+	wrote, err := s.putMDLocked(putCtx, rmds, prep)
+	putSpan.Finish()
+	switch err.(type) {
+	case nil:
+		s.countPutMD(wrote)
+	case MDServerErrorBadRequest, MDServerErrorThrottle:
+		return false, err
+	default:
+		return false, MDServerError{err}
+	}
+
+	id := prep.id
+	j, err := s.getOrCreateBranchJournalLocked(bid)
+	if err != nil {
+		return false, err
+	}
+
+	span.SetTag("mdID", id)
+
+	// The writer index is updated before the append, so that a
+	// failure fails the put before the MD is in the journal. If
+	// the append fails instead, the index lists a writer too
+	// many, which is harmless, since it's only used to skip the
+	// branches a user hasn't written to.
+	err = s.addWriterLocked(bid, currentUID)
+	if err != nil {
+		return false, MDServerError{err}
+	}
+
+	_, appendSpan := startMDServerTlfStorageSpan(ctx, "journalAppend")
+	err = j.append(rmds.MD.Revision, id)
+	appendSpan.Finish()
+	if err != nil {
+		return false, MDServerError{err}
+	}
+
+	// The journal, not the frontier, is authoritative, so a
+	// failure to update the frontier only makes it out of date.
+	err = s.appendMerkleLeafLocked(bid, j, rmds.MD.Revision, id)
+	if err != nil {
+		s.log.CDebugf(ctx, "Couldn't update the Merkle frontier "+
+			"of branch %s: %v", bid, err)
+	}
+
+	if s.revisionIndex {
+		err = s.appendRevisionIndexLocked(bid, rmds.MD.Revision, id)
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't update the revision "+
+				"index of branch %s: %v", bid, err)
+		}
+	}
+
+	// A buffered MD may yet be lost, so it raises the high-water
+	// mark only once it's flushed.
+	if _, ok := s.writeBuffer[id]; !ok {
+		err = s.raiseHighWaterMarkLocked(bid, j)
+		if err != nil {
+			return false, MDServerError{err}
+		}
+	}
+
+	if len(annotations) > 0 {
+		err = s.annotateLocked(bid, rmds.MD.Revision, id, annotations)
+		if err != nil {
+			return false, MDServerError{err}
+		}
+	}
+
+	if s.changeFeed {
+		// The MD is already in the journal, so a failure to
+		// feed it doesn't fail the put; the feed is caught up
+		// by the next put instead, or by open.
+		if s.changeFeedBehind {
+			err = s.catchUpChangeFeedLocked()
+		} else {
+			err = s.appendChangeFeedLocked(mdChangeFeedEntry{
+				TlfID:    rmds.MD.ID,
+				BID:      bid,
+				Revision: rmds.MD.Revision,
+				ID:       id,
+				UID:      currentUID,
+			})
+		}
+		s.changeFeedBehind = err != nil
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't feed revision %s of "+
+				"branch %s: %v", rmds.MD.Revision, bid, err)
+		}
+	}
+
+	if written != nil {
+		s.addWriteWaiterLocked(id, written)
+	}
+
+	s.notifyHeadChangedLocked()
+
+	return recordBranchID, nil
+}
+
+// isMDAtRevisionReadLocked returns whether the MD with the given ID
+// is at the given revision of the given branch.
+func (s *mdServerTlfStorage) isMDAtRevisionReadLocked(
+	bid BranchID, rev MetadataRevision, id MdID) (bool, error) {
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return false, nil
+	}
+	_, mdIDs, err := j.getRange(rev, rev)
+	if err != nil {
+		return false, err
+	}
+	return len(mdIDs) == 1 && mdIDs[0] == id, nil
+}
+
+// checkBootstrapBranchIDReadLocked checks the branch ID of an
+// unmerged MD that starts a new branch. Branch IDs are chosen at
+// random by clients (see Crypto.MakeRandomBranchID) rather than
+// derived from the fork point, so there is nothing to recompute;
+// instead, the ID must not be null, and must not be that of a
+// soft-deleted branch, which a new branch would otherwise take over
+// and which could then no longer be restored.
+func (s *mdServerTlfStorage) checkBootstrapBranchIDReadLocked(
+	bid BranchID) error {
+	if bid == NullBranchID {
+		return MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+	}
+
+	_, err := os.Stat(s.branchTombstonePath(bid))
+	if err == nil {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Branch ID %s belongs to a deleted branch", bid)}
+	} else if !os.IsNotExist(err) {
+		return MDServerError{err}
+	}
+	return nil
+}
+
+// notifyHeadChangedLocked wakes up all waitForHeadAfter callers.
+func (s *mdServerTlfStorage) notifyHeadChangedLocked() {
+	close(s.headChanged)
+	s.headChanged = make(chan struct{})
+}
+
+var errMDServerTlfStorageHeadWaitTimedOut = errors.New(
+	"Timed out waiting for the head to advance")
+
+// waitForHeadAfter returns the head of the given branch as soon as
+// its revision is greater than afterRev: right away if it already
+// is, and otherwise once a put advances it. If that doesn't happen
+// within timeout, it returns errMDServerTlfStorageHeadWaitTimedOut.
+func (s *mdServerTlfStorage) waitForHeadAfter(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID,
+	afterRev MetadataRevision, timeout time.Duration) (
+	*RootMetadataSigned, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		head, headChanged, err := func() (
+			*RootMetadataSigned, <-chan struct{}, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			if err := s.checkOpenReadLocked(); err != nil {
+				return nil, nil, err
+			}
+
+			err := s.checkGetParamsReadLocked(ctx,
+				currentUID, deviceKID, bid)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			head, err := s.getHeadForTLFReadLocked(ctx, bid)
+			if err != nil {
+				return nil, nil, MDServerError{err}
+			}
+			return head, s.headChanged, nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+		if head != nil && head.MD.Revision > afterRev {
+			return head, nil
+		}
+
+		select {
+		case <-headChanged:
+		case <-timer.C:
+			return nil, errMDServerTlfStorageHeadWaitTimedOut
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// countPutMD counts a put that stored its MD object, if wrote is
+// true, or else found it already stored.
+func (s *mdServerTlfStorage) countPutMD(wrote bool) {
+	if !wrote {
+		atomic.AddUint64(&s.dedupedMDs, 1)
+		if s.putDedupedMeter != nil {
+			s.putDedupedMeter.Mark(1)
+		}
+		return
+	}
+	atomic.AddUint64(&s.writtenMDs, 1)
+	if s.putWrittenMeter != nil {
+		s.putWrittenMeter.Mark(1)
+	}
+}
+
+// putCounts returns the number of MD objects put has stored, and the
+// number of puts of MD objects that were already stored, e.g. by a
+// client retrying a put whose reply it missed, since the storage was
+// made. A high share of the latter points to a client that retries
+// needlessly.
+func (s *mdServerTlfStorage) putCounts() (written, deduped uint64) {
+	return atomic.LoadUint64(&s.writtenMDs),
+		atomic.LoadUint64(&s.dedupedMDs)
+}
+
+// writersOf returns the sorted list of UIDs that have put MDs to the
+// given branch, which may include some whose puts failed after the
+// index was updated. If the index of writers is missing, it is
+// rebuilt from the branch history.
+func (s *mdServerTlfStorage) writersOf(bid BranchID) (
+	[]keybase1.UID, error) {
+	// Take the write lock, since we may have to rebuild the
+	// index.
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.branchJournals[bid]; !ok {
+		return nil, nil
+	}
+
+	writers, err := s.readWritersReadLocked(bid)
+	if os.IsNotExist(err) {
+		return s.rebuildWritersLocked(bid)
+	} else if err != nil {
+		return nil, err
+	}
+	return writers, nil
+}
+
+// forEachBranch calls fn for every branch with a journal on disk as
+// of when forEachBranch is called, including branches that haven't
+// been accessed (and therefore loaded) yet. Branches created during
+// the iteration may or may not be visited, and branches deleted
+// during the iteration are skipped.
+//
+// fn is called with s.lock held for writing, so it must not call any
+// of the public methods of s, but it may call the *Locked helpers.
+// The lock is released between calls, so that other operations can
+// proceed while a long iteration is in progress. If fn returns an
+// error, the iteration stops and that error is returned.
+func (s *mdServerTlfStorage) forEachBranch(
+	fn func(bid BranchID, j mdServerBranchJournal) error) error {
+	bids, err := func() ([]BranchID, error) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+
+		if err := s.checkOpenReadLocked(); err != nil {
+			return nil, err
+		}
+
+		return s.getBranchIDsOnDiskReadLocked()
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, bid := range bids {
+		err := func() error {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			if err := s.checkOpenReadLocked(); err != nil {
+				return err
+			}
+
+			j, ok, err := s.loadBranchJournalLocked(bid)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// Deleted since the snapshot was taken.
+				return nil
+			}
+
+			return fn(bid, j)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// softDeleteBranch moves the journal for the given unmerged branch
+// out of the way, so that it is invisible to reads, but can still be
+// restored via undeleteBranch until it is purged via
+// purgeTombstones. The MD objects referenced by the branch are left
+// in place. The branch needn't be loaded.
+func (s *mdServerTlfStorage) softDeleteBranch(
+	ctx context.Context, bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	if bid == NullBranchID {
+		return MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+	}
+
+	_, ok, err := s.loadBranchJournalLocked(bid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	tombstonePath := s.branchTombstonePath(bid)
+	_, err = os.Stat(tombstonePath)
+	if err == nil {
+		return fmt.Errorf("Branch %s already has a tombstone", bid)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.MkdirAll(s.branchTombstonesPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(s.branchJournalPath(bid), tombstonePath)
+	if err != nil {
+		return err
+	}
+	delete(s.branchJournals, bid)
+
+	// Record the deletion time for purgeTombstones. The branch is
+	// deleted either way, so a failure only makes the tombstone
+	// look older, and thus purged sooner, than it should be.
+	now := s.clock.Now()
+	err = os.Chtimes(tombstonePath, now, now)
+	if err != nil {
+		s.log.CWarningf(ctx, "Couldn't record the deletion time "+
+			"of branch %s: %v", bid, err)
+	}
+	return nil
+}
+
+// undeleteBranch restores a branch previously deleted by
+// softDeleteBranch. It fails if the branch has since been recreated.
+func (s *mdServerTlfStorage) undeleteBranch(bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	if _, ok := s.branchJournals[bid]; ok {
+		return fmt.Errorf("Branch %s has been recreated", bid)
+	}
+
+	tombstonePath := s.branchTombstonePath(bid)
+	_, err = os.Stat(tombstonePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Branch %s has no tombstone", bid)
+	} else if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.branchJournalsPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	dir := s.branchJournalPath(bid)
+	err = os.Rename(tombstonePath, dir)
+	if err != nil {
+		return err
+	}
+
+	s.branchJournals[bid] = makeMDServerBranchJournal(s.codec, dir)
+	return nil
+}
+
+// purgeTombstones permanently removes the journals of all branches
+// that were soft-deleted more than olderThan ago, and returns their
+// IDs. As with softDeleteBranch, the MD objects referenced by those
+// branches are left in place.
+func (s *mdServerTlfStorage) purgeTombstones(olderThan time.Duration) (
+	[]BranchID, error) {
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return nil, err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return nil, MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	fileInfos, err := ioutil.ReadDir(s.branchTombstonesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cutoff := s.clock.Now().Add(-olderThan)
+	var purged []BranchID
+	for _, fi := range fileInfos {
+		if !fi.ModTime().Before(cutoff) {
+			continue
+		}
+
+		bid := ParseBranchID(fi.Name())
+		if bid == NullBranchID {
+			// Not a tombstone.
+			continue
+		}
+
+		err := os.RemoveAll(s.branchTombstonePath(bid))
+		if err != nil {
+			return nil, err
+		}
+		purged = append(purged, bid)
+	}
+	return purged, nil
+}
+
+// isBranchClosedReadLocked returns whether the given branch has been
+// closed by closeBranch. The CLOSED file of a soft-deleted branch is
+// checked too, so that a closed branch can't be recreated by a late
+// put while its tombstone is still around.
+func (s *mdServerTlfStorage) isBranchClosedReadLocked(bid BranchID) (
+	bool, error) {
+	for _, path := range []string{
+		s.closedPath(bid),
+		filepath.Join(s.branchTombstonePath(bid), "CLOSED"),
+	} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// closeBranch marks the given unmerged branch as closed, e.g. once
+// it has been resolved and merged, so that further puts to it fail
+// with MDServerErrorBranchClosed. Its history can still be read.
+// Closing a closed branch is a no-op, and a branch can't be
+// reopened.
+func (s *mdServerTlfStorage) closeBranch(bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	if bid == NullBranchID {
+		return MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+	}
+
+	if _, ok := s.branchJournals[bid]; !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	return ioutil.WriteFile(s.closedPath(bid), nil, 0600)
+}
+
+// mdBranchInfo describes a branch, as returned by listBranches.
+type mdBranchInfo struct {
+	bid BranchID
+	// latest is the latest revision of the branch, or
+	// MetadataRevisionUninitialized if it has none.
+	latest MetadataRevision
+	closed bool
+}
+
+// listBranches returns the branches with a journal on disk, in the
+// order of their IDs. Soft-deleted branches aren't included.
+func (s *mdServerTlfStorage) listBranches() ([]mdBranchInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	bids, err := s.getBranchIDsOnDiskReadLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]mdBranchInfo, 0, len(bids))
+	for _, bid := range bids {
+		j, ok := s.branchJournals[bid]
+		if !ok {
+			j = makeMDServerBranchJournal(
+				s.codec, s.branchJournalPath(bid))
+		}
+		latest, err := j.readLatestRevision()
+		if err != nil {
+			return nil, err
+		}
+		closed, err := s.isBranchClosedReadLocked(bid)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, mdBranchInfo{
+			bid:    bid,
+			latest: latest,
+			closed: closed,
+		})
+	}
+	return infos, nil
+}
+
+// mdBranchHeadSummary describes a branch and its head, as returned
+// by branchSummaries.
+type mdBranchHeadSummary struct {
+	bid BranchID
+	// headRevision is MetadataRevisionUninitialized, and headID
+	// and headTime are zero, if the branch has no MDs.
+	headRevision MetadataRevision
+	headID       MdID
+	// headTime is the untrusted server timestamp of the head.
+	headTime time.Time
+	length   uint64
+	closed   bool
+}
+
+// branchSummaries returns a summary of each branch with a journal on
+// disk, in the order of their IDs, as listBranches does, checking the
+// permissions of currentUID only once. Only the journal pointers and
+// the head MD of each branch are read, and with splitHeaders, only
+// the header of the latter.
+func (s *mdServerTlfStorage) branchSummaries(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID) (
+	[]mdBranchHeadSummary, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	err := s.checkGetParamsReadLocked(
+		ctx, currentUID, deviceKID, NullBranchID)
+	if err != nil {
+		return nil, err
+	}
+
+	bids, err := s.getBranchIDsOnDiskReadLocked()
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	summaries := make([]mdBranchHeadSummary, 0, len(bids))
+	for _, bid := range bids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		j, ok := s.branchJournals[bid]
+		if !ok {
+			j = makeMDServerBranchJournal(
+				s.codec, s.branchJournalPath(bid))
+		}
+		summary := mdBranchHeadSummary{
+			bid:          bid,
+			headRevision: MetadataRevisionUninitialized,
+		}
+		summary.closed, err = s.isBranchClosedReadLocked(bid)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		summary.length, err = j.journalLength()
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		summary.headID, err = j.getHead()
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if summary.headID != (MdID{}) {
+			head, _, err := s.getMDHeaderReadLocked(
+				ctx, summary.headID)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			summary.headRevision = head.MD.Revision
+			summary.headTime = head.untrustedServerTimestamp
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// pinRevision protects the given revision of the given branch from
+// being pruned. The revision must currently be in the branch's
+// journal. Pinning an already-pinned revision is a no-op.
+func (s *mdServerTlfStorage) pinRevision(
+	bid BranchID, rev MetadataRevision) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	_, mdIDs, err := j.getRange(rev, rev)
+	if err != nil {
+		return err
+	}
+	if len(mdIDs) == 0 {
+		return fmt.Errorf(
+			"Revision %s is not in the journal for branch %s",
+			rev, bid)
+	}
+
+	return s.pinRevisionLocked(bid, rev)
+}
+
+// pinRevisionLocked implements pinRevision, once the revision is
+// known to be in the branch's journal.
+func (s *mdServerTlfStorage) pinRevisionLocked(
+	bid BranchID, rev MetadataRevision) error {
+	pinned, err := s.readPinnedReadLocked(bid)
+	if err != nil {
+		return err
+	}
+	for _, p := range pinned {
+		if p == rev {
+			return nil
+		}
+	}
+	return s.writePinnedLocked(bid, append(pinned, rev))
+}
+
+// unpinRevision undoes the effect of pinRevision. Unpinning a
+// revision that isn't pinned is a no-op. A revision annotated with
+// the mdRetentionLegal retention class can't be unpinned.
+func (s *mdServerTlfStorage) unpinRevision(
+	bid BranchID, rev MetadataRevision) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil
+	}
+
+	_, mdIDs, err := j.getRange(rev, rev)
+	if err != nil {
+		return err
+	}
+	if len(mdIDs) == 1 {
+		annotations, err := s.readAnnotationsReadLocked(mdIDs[0])
+		if err != nil {
+			return err
+		}
+		if annotations[mdAnnotationRetention] == mdRetentionLegal {
+			return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+				"Revision %d of branch %s is under legal "+
+					"retention", rev, bid)}
+		}
+	}
+
+	pinned, err := s.readPinnedReadLocked(bid)
+	if err != nil {
+		return err
+	}
+	for i, p := range pinned {
+		if p == rev {
+			pinned = append(pinned[:i], pinned[i+1:]...)
+			return s.writePinnedLocked(bid, pinned)
+		}
+	}
+	return nil
+}
+
+// listPinned returns the sorted list of pinned revisions for the
+// given branch.
+func (s *mdServerTlfStorage) listPinned(bid BranchID) (
+	[]MetadataRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.branchJournals[bid]; !ok {
+		return nil, nil
+	}
+
+	return s.readPinnedReadLocked(bid)
+}
+
+// mdServerBranchSummary describes the contents of a branch journal,
+// and is exchanged between replicas so that only the MDs missing on
+// one side need to be shipped. Fields are exported only for
+// serialization.
+type mdServerBranchSummary struct {
+	BID BranchID
+	// Earliest and Latest are MetadataRevisionUninitialized if
+	// the branch is empty.
+	Earliest MetadataRevision
+	Latest   MetadataRevision
+	// MdIDs lists the MdIDs of the revisions Earliest through
+	// Latest, in order.
+	MdIDs []MdID
+}
+
+// summarizeBranch returns the summary of the given branch.
+func (s *mdServerTlfStorage) summarizeBranch(bid BranchID) (
+	mdServerBranchSummary, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdServerBranchSummary{}, err
+	}
+
+	return s.summarizeBranchReadLocked(bid)
+}
+
+func (s *mdServerTlfStorage) summarizeBranchReadLocked(bid BranchID) (
+	mdServerBranchSummary, error) {
+	summary := mdServerBranchSummary{
+		BID:      bid,
+		Earliest: MetadataRevisionUninitialized,
+		Latest:   MetadataRevisionUninitialized,
+	}
 
-	path := s.mdPath(id)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return summary, nil
 	}
 
-	var rmds RootMetadataSigned
-	err = s.codec.Decode(data, &rmds)
+	earliest, mdIDs, err := j.getRange(
+		MetadataRevisionInitial, MetadataRevision(math.MaxInt64))
 	if err != nil {
-		return nil, err
+		return mdServerBranchSummary{}, err
+	}
+	if len(mdIDs) == 0 {
+		return summary, nil
 	}
 
-	// Check integrity.
+	summary.Earliest = earliest
+	summary.Latest = earliest + MetadataRevision(len(mdIDs)-1)
+	summary.MdIDs = mdIDs
+	return summary, nil
+}
 
-	mdID, err := rmds.MD.MetadataID(s.crypto)
-	if err != nil {
-		return nil, err
+// diffAgainst returns, in revision order, the MdIDs of the local MDs
+// of the branch described by remote that the remote side doesn't
+// have, i.e. those whose revisions are outside of the remote's
+// window. It returns an error if the remote summary is malformed, or
+// if it has a different MdID than the local journal for any revision,
+// since then the histories have diverged and can't be reconciled by
+// just copying MDs.
+func (s *mdServerTlfStorage) diffAgainst(remote mdServerBranchSummary) (
+	[]MdID, error) {
+	remoteLength := 0
+	if remote.Earliest != MetadataRevisionUninitialized {
+		remoteLength = int(remote.Latest-remote.Earliest) + 1
 	}
-
-	if id != mdID {
+	if remoteLength < 0 || len(remote.MdIDs) != remoteLength {
 		return nil, fmt.Errorf(
-			"Metadata ID mismatch: expected %s, got %s", id, mdID)
+			"Malformed summary for branch %s: window [%s, %s] "+
+				"with %d MdIDs", remote.BID, remote.Earliest,
+			remote.Latest, len(remote.MdIDs))
 	}
 
-	fileInfo, err := os.Stat(path)
+	local, err := s.summarizeBranch(remote.BID)
 	if err != nil {
 		return nil, err
 	}
 
-	rmds.untrustedServerTimestamp = fileInfo.ModTime()
+	var missing []MdID
+	for i, mdID := range local.MdIDs {
+		rev := local.Earliest + MetadataRevision(i)
+		if remoteLength == 0 || rev < remote.Earliest ||
+			rev > remote.Latest {
+			missing = append(missing, mdID)
+			continue
+		}
 
-	return &rmds, nil
+		remoteID := remote.MdIDs[rev-remote.Earliest]
+		if remoteID != mdID {
+			return nil, fmt.Errorf(
+				"Branch %s has diverged at revision %s: "+
+					"local MD %s, remote MD %s",
+				remote.BID, rev, mdID, remoteID)
+		}
+	}
+	return missing, nil
 }
 
-func (s *mdServerTlfStorage) putMDLocked(rmds *RootMetadataSigned) error {
-	id, err := rmds.MD.MetadataID(s.crypto)
-	if err != nil {
+// setConfig replaces the contents of the CONFIG file with the given
+// config, and applies it. Fields of config that are nil revert to the
+// settings the storage was made with. The file is replaced
+// atomically, so a concurrent open sees either the old or the new
+// config.
+func (s *mdServerTlfStorage) setConfig(config mdServerTlfStorageConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
 		return err
 	}
 
-	_, err = s.getMDReadLocked(id)
-	if os.IsNotExist(err) {
-		// Continue on.
-	} else if err != nil {
+	unfence, err := s.fenceLocked()
+	if err != nil {
 		return err
-	} else {
-		// Entry exists, so nothing else to do.
-		return nil
 	}
+	defer unfence()
 
-	path := s.mdPath(id)
+	maxMDSize, writeBufferConfig, err :=
+		config.apply(s.baseMaxMDSize, s.baseWriteBufferConfig)
+	if err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
 
-	err = os.MkdirAll(filepath.Dir(path), 0700)
+	buf, err := json.MarshalIndent(config, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	buf, err := s.codec.Encode(rmds)
+	// Don't leave anything buffered beyond the new limit.
+	if s.writeBufferBytes >= writeBufferConfig.maxBytes {
+		err := s.flushWriteBufferLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	tempPath := s.configPath() + ".tmp"
+	err = ioutil.WriteFile(tempPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, s.configPath())
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, buf, 0600)
+	s.maxMDSize = maxMDSize
+	s.writeBufferConfig = writeBufferConfig
+	return nil
 }
 
-func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
-	bid BranchID) (mdServerBranchJournal, error) {
-	j, ok := s.branchJournals[bid]
-	if ok {
-		return j, nil
-	}
+// existsMD returns whether the MD object with the given ID is
+// stored, including if it's buffered, without touching the disk.
+func (s *mdServerTlfStorage) existsMD(id MdID) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	dir := filepath.Join(s.branchJournalsPath(), bid.String())
-	err := os.MkdirAll(dir, 0700)
-	if err != nil {
-		return mdServerBranchJournal{}, err
+	if err := s.checkOpenReadLocked(); err != nil {
+		return false, err
 	}
 
-	j = makeMDServerBranchJournal(s.codec, dir)
-	s.branchJournals[bid] = j
-	return j, nil
+	if _, ok := s.writeBuffer[id]; ok {
+		return true, nil
+	}
+	_, ok := s.mdIDIndex.search(id)
+	return ok, nil
 }
 
-func (s *mdServerTlfStorage) getHeadForTLFReadLocked(bid BranchID) (
-	rmds *RootMetadataSigned, err error) {
-	j, ok := s.branchJournals[bid]
+// mdServerRekeyLeaseDuration is how long a rekey lease taken by
+// beginRekey lasts, unless released earlier by endRekey. It bounds
+// how long a crashed rekeyer can block writes to a branch.
+const mdServerRekeyLeaseDuration = 5 * time.Minute
+
+// isRekeyLeasedLocked returns whether there is an unexpired rekey
+// lease on the given branch, forgetting it if it has expired.
+func (s *mdServerTlfStorage) isRekeyLeasedLocked(bid BranchID) bool {
+	expiry, ok := s.rekeyLeases[bid]
 	if !ok {
-		return nil, nil
-	}
-	headID, err := j.getHead()
-	if err != nil {
-		return nil, err
+		return false
 	}
-	if headID == (MdID{}) {
-		return nil, nil
+	if !s.clock.Now().Before(expiry) {
+		delete(s.rekeyLeases, bid)
+		return false
 	}
-	return s.getMDReadLocked(headID)
+	return true
 }
 
-func (s *mdServerTlfStorage) checkGetParamsReadLocked(
-	currentUID keybase1.UID, deviceKID keybase1.KID, bid BranchID) error {
-	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
-	if err != nil {
-		return MDServerError{err}
-	}
+// beginRekey takes a rekey lease on the given branch, which lasts
+// until endRekey is called or mdServerRekeyLeaseDuration passes.
+// While it's held, puts of MDs without the rekey flag to that branch
+// fail with a retriable MDServerErrorThrottle, so that they can't
+// interleave with the rekey. If another lease is already held,
+// beginRekey fails the same way.
+func (s *mdServerTlfStorage) beginRekey(bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	ok, err := isReader(currentUID, mergedMasterHead)
-	if err != nil {
-		return MDServerError{err}
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
 	}
-	if !ok {
-		return MDServerErrorUnauthorized{}
+
+	if s.isRekeyLeasedLocked(bid) {
+		return MDServerErrorThrottle{errMDServerTlfStorageRekeyInProgress}
 	}
 
+	if s.rekeyLeases == nil {
+		s.rekeyLeases = make(map[BranchID]time.Time)
+	}
+	s.rekeyLeases[bid] = s.clock.Now().Add(mdServerRekeyLeaseDuration)
 	return nil
 }
 
-func (s *mdServerTlfStorage) getRangeReadLocked(
-	currentUID keybase1.UID, deviceKID keybase1.KID,
-	bid BranchID, start, stop MetadataRevision) (
-	[]*RootMetadataSigned, error) {
-	err := s.checkGetParamsReadLocked(currentUID, deviceKID, bid)
-	if err != nil {
-		return nil, err
-	}
+// endRekey releases the rekey lease on the given branch, if any.
+func (s *mdServerTlfStorage) endRekey(bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	j, ok := s.branchJournals[bid]
-	if !ok {
-		return nil, nil
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
 	}
 
-	realStart, mdIDs, err := j.getRange(start, stop)
-	if err != nil {
-		return nil, err
-	}
-	var rmdses []*RootMetadataSigned
-	for i, mdID := range mdIDs {
-		expectedRevision := realStart + MetadataRevision(i)
-		rmds, err := s.getMDReadLocked(mdID)
-		if err != nil {
-			return nil, MDServerError{err}
-		}
-		if expectedRevision != rmds.MD.Revision {
-			panic(fmt.Errorf("expected revision %v, got %v",
-				expectedRevision, rmds.MD.Revision))
-		}
-		rmdses = append(rmdses, rmds)
+	delete(s.rekeyLeases, bid)
+	return nil
+}
+
+// quiesce makes put (and any other mutating operation) fail with a
+// retriable MDServerErrorThrottle until unquiesce is called, while
+// still serving reads. Unlike shutdown, this is reversible. Calling
+// quiesce on an already-quiesced storage is a no-op.
+func (s *mdServerTlfStorage) quiesce() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
 	}
 
-	return rmdses, nil
+	s.quiesced = true
+	return nil
 }
 
-func (s *mdServerTlfStorage) isShutdownReadLocked() bool {
-	return s.branchJournals == nil
-}
+// unquiesce undoes the effect of quiesce. Calling unquiesce on a
+// storage that isn't quiesced is a no-op.
+func (s *mdServerTlfStorage) unquiesce() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-// All functions below are public functions.
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
 
-var errMDServerTlfStorageShutdown = errors.New("mdServerTlfStorage is shutdown")
+	s.quiesced = false
+	return nil
+}
 
-func (s *mdServerTlfStorage) journalLength(bid BranchID) (uint64, error) {
+// divergencePoint returns the revision and ID of the merged MD that
+// the earliest entry of the given unmerged branch claims as its
+// predecessor. It returns an error if that MD isn't the one stored
+// in the merged journal at that revision.
+func (s *mdServerTlfStorage) divergencePoint(bid BranchID) (
+	MetadataRevision, MdID, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	if s.isShutdownReadLocked() {
-		return 0, errMDServerTlfStorageShutdown
+	if err := s.checkOpenReadLocked(); err != nil {
+		return MetadataRevisionUninitialized, MdID{},
+			err
+	}
+
+	return s.divergencePointReadLocked(bid)
+}
+
+func (s *mdServerTlfStorage) divergencePointReadLocked(bid BranchID) (
+	MetadataRevision, MdID, error) {
+	if bid == NullBranchID {
+		return MetadataRevisionUninitialized, MdID{},
+			MDServerErrorBadRequest{Reason: "Invalid branch ID"}
 	}
 
 	j, ok := s.branchJournals[bid]
 	if !ok {
-		return 0, nil
+		return MetadataRevisionUninitialized, MdID{},
+			fmt.Errorf("Unknown branch %s", bid)
 	}
 
-	return j.journalLength()
-}
-
-func (s *mdServerTlfStorage) getForTLF(
-	currentUID keybase1.UID, deviceKID keybase1.KID,
-	bid BranchID) (*RootMetadataSigned, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	if s.isShutdownReadLocked() {
-		return nil, errMDServerTlfStorageShutdown
+	earliestRevision, err := j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized, MdID{}, err
+	} else if earliestRevision == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, MdID{},
+			fmt.Errorf("Branch %s is empty", bid)
 	}
 
-	err := s.checkGetParamsReadLocked(currentUID, deviceKID, bid)
+	earliestID, err := j.readMdID(earliestRevision)
 	if err != nil {
-		return nil, err
+		return MetadataRevisionUninitialized, MdID{}, err
 	}
 
-	rmds, err := s.getHeadForTLFReadLocked(bid)
+	earliest, err := s.getMDReadLocked(earliestID)
 	if err != nil {
-		return nil, MDServerError{err}
+		return MetadataRevisionUninitialized, MdID{}, err
 	}
-	return rmds, nil
-}
 
-func (s *mdServerTlfStorage) getRange(
-	currentUID keybase1.UID, deviceKID keybase1.KID,
-	bid BranchID, start, stop MetadataRevision) (
-	[]*RootMetadataSigned, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	prevRev := earliestRevision - 1
+	prevRoot := earliest.MD.PrevRoot
+	if prevRev < MetadataRevisionInitial {
+		return MetadataRevisionUninitialized, MdID{}, fmt.Errorf(
+			"Branch %s starts at revision %s, which has no "+
+				"merged predecessor", bid, earliestRevision)
+	}
+
+	var mergedID MdID
+	if mj, ok := s.branchJournals[NullBranchID]; ok {
+		_, mdIDs, err := mj.getRange(prevRev, prevRev)
+		if err != nil {
+			return MetadataRevisionUninitialized, MdID{}, err
+		}
+		if len(mdIDs) == 1 {
+			mergedID = mdIDs[0]
+		}
+	}
+
+	if mergedID == (MdID{}) {
+		return MetadataRevisionUninitialized, MdID{}, fmt.Errorf(
+			"Branch %s diverges at merged revision %s, "+
+				"which isn't in the merged journal", bid, prevRev)
+	}
 
-	if s.isShutdownReadLocked() {
-		return nil, errMDServerTlfStorageShutdown
+	if mergedID != prevRoot {
+		return MetadataRevisionUninitialized, MdID{}, fmt.Errorf(
+			"Branch %s diverges at merged revision %s with "+
+				"predecessor %s, but the merged journal has %s",
+			bid, prevRev, prevRoot, mergedID)
 	}
 
-	return s.getRangeReadLocked(currentUID, deviceKID, bid, start, stop)
+	return prevRev, mergedID, nil
 }
 
-func (s *mdServerTlfStorage) put(
-	currentUID keybase1.UID, deviceKID keybase1.KID,
-	rmds *RootMetadataSigned) (recordBranchID bool, err error) {
+// open checks that dir can be used by this code, and loads the
+// journals of all existing branches, rolling back any interrupted
+// appends (see mdServerBranchJournal.reconcile) and checking that
+// their pointers are sane. It must be called (successfully) before
+// any of the other public methods, and it can be called only once.
+func (s *mdServerTlfStorage) open(ctx context.Context) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.isShutdownReadLocked() {
-		return false, errMDServerTlfStorageShutdown
+	switch s.state {
+	case mdServerTlfStorageOpen:
+		return errors.New("mdServerTlfStorage is already open")
+	case mdServerTlfStorageClosed:
+		return errMDServerTlfStorageClosed
 	}
 
-	mStatus := rmds.MD.MergedStatus()
-	bid := rmds.MD.BID
+	if s.coldMDsDir != "" && s.hotRevisions < 1 {
+		return fmt.Errorf("hotRevisions is %d, but must be at least 1 "+
+			"to use a cold tier", s.hotRevisions)
+	}
 
-	if (mStatus == Merged) != (bid == NullBranchID) {
-		return false, MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+	err := s.checkVersion()
+	if err != nil {
+		return err
 	}
 
-	// Check permissions
+	if s.ownershipCheck != mdServerTlfStorageOwnershipIgnore {
+		err := checkDirOwnership(s.dir)
+		if _, ok := err.(mdServerTlfStorageOwnershipError); ok &&
+			s.ownershipCheck == mdServerTlfStorageOwnershipWarn {
+			s.log.CWarningf(ctx, "%v", err)
+		} else if err != nil {
+			return err
+		}
+	}
 
-	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
+	err = checkDirSymlinks(s.dir, s.symlinkCheck)
 	if err != nil {
-		return false, MDServerError{err}
+		return err
 	}
 
-	ok, err := isWriterOrValidRekey(
-		s.codec, currentUID, mergedMasterHead, rmds)
+	config, err := s.readConfig()
 	if err != nil {
-		return false, MDServerError{err}
+		return err
 	}
-	if !ok {
-		return false, MDServerErrorUnauthorized{}
+	maxMDSize, writeBufferConfig, err :=
+		config.apply(s.maxMDSize, s.writeBufferConfig)
+	if err != nil {
+		return fmt.Errorf("Invalid config in %s: %v", s.configPath(), err)
+	}
+
+	// Don't wait for the lock, which maintenance may hold for a
+	// long time, but let the caller retry later.
+	unlockOpen, err := lockFile(s.openLockPath(), s.exclusive, false)
+	if err == errMDServerTlfStorageFileLocked && !s.exclusive {
+		return MDServerErrorThrottle{err}
+	} else if err != nil {
+		return err
 	}
+	defer func() {
+		if s.state != mdServerTlfStorageOpen {
+			_ = unlockOpen()
+		}
+	}()
 
-	head, err := s.getHeadForTLFReadLocked(bid)
+	epoch, epochFile, err := s.advanceEpoch()
 	if err != nil {
-		return false, MDServerError{err}
+		return err
 	}
+	fence, err := makeMDEpochFence(s.epochLockPath(), epochFile)
+	if err != nil {
+		_ = epochFile.Close()
+		return err
+	}
+	defer func() {
+		if s.state != mdServerTlfStorageOpen {
+			_ = fence.close()
+		}
+	}()
 
-	if mStatus == Unmerged && head == nil {
-		// currHead for unmerged history might be on the main branch
-		prevRev := rmds.MD.Revision - 1
-		rmdses, err := s.getRangeReadLocked(
-			currentUID, deviceKID, NullBranchID, prevRev, prevRev)
+	// Any staged MDs were left by puts that never finished.
+	err = os.RemoveAll(filepath.Join(s.dir, mdServerMDStagingDirName))
+	if err != nil {
+		return err
+	}
+
+	bids, err := s.getBranchIDsOnDiskReadLocked()
+	if err != nil {
+		return err
+	}
+
+	branchJournals := make(map[BranchID]mdServerBranchJournal)
+	for _, bid := range bids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		j := makeMDServerBranchJournal(s.codec, s.branchJournalPath(bid))
+		repair, err := j.reconcile()
 		if err != nil {
-			return false, MDServerError{err}
+			return fmt.Errorf("Branch %s: %v", bid, err)
 		}
-		if len(rmdses) != 1 {
-			return false, MDServerError{
-				Err: fmt.Errorf("Expected 1 MD block got %d", len(rmdses)),
-			}
+		if repair.repaired() {
+			s.log.CWarningf(ctx, "Repaired the journal of branch "+
+				"%s after an unclean shutdown: %s", bid, repair)
 		}
-		head = rmdses[0]
-		recordBranchID = true
-	}
-
-	// Consistency checks
-	if head != nil {
-		err := head.MD.CheckValidSuccessorForServer(s.crypto, &rmds.MD)
+		err = j.checkPointers()
 		if err != nil {
-			return false, err
+			return fmt.Errorf("Branch %s: %v", bid, err)
+		}
+		err = s.dropUnwrittenTailLocked(j)
+		if err != nil {
+			return fmt.Errorf("Branch %s: %v", bid, err)
 		}
+		branchJournals[bid] = j
 	}
 
-	err = s.putMDLocked(rmds)
+	mdIDIndex, err := s.loadMDIDIndexLocked(ctx)
 	if err != nil {
-		return false, MDServerError{err}
+		return err
 	}
 
-	id, err := rmds.MD.MetadataID(s.crypto)
-	if err != nil {
-		return false, MDServerError{err}
+	if s.maxOpenFiles > 0 {
+		s.openFiles = newMDServerTlfStorageSemaphore(s.maxOpenFiles)
 	}
+	if s.coldMDsDir != "" && s.maxColdReads > 0 {
+		s.coldReads = newMDServerTlfStorageSemaphore(s.maxColdReads)
+	}
+	s.baseMaxMDSize = s.maxMDSize
+	s.baseWriteBufferConfig = s.writeBufferConfig
+	s.maxMDSize = maxMDSize
+	s.writeBufferConfig = writeBufferConfig
+	s.branchJournals = branchJournals
+	s.heldMDs = make(map[MdID]int)
+	s.deferredRemovals = make(map[MdID]bool)
+	s.headChanged = make(chan struct{})
+	s.mdIDIndex = mdIDIndex
+	s.epoch = epoch
+	s.fence = fence
+	s.growth = makeMDGrowthTracker(s.clock.Now(), s.growthWindow)
 
-	j, err := s.getOrCreateBranchJournalLocked(bid)
-	if err != nil {
-		return false, err
+	if len(s.highWaterKey) > 0 {
+		err := s.loadHighWaterMarksLocked()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = j.append(rmds.MD.Revision, id)
-	if err != nil {
-		return false, MDServerError{err}
+	// The index isn't kept up to date by every change to the
+	// journals, e.g. by dropUnwrittenTailLocked above, so it's
+	// rebuilt here. It's only for operators, so a failure to
+	// rebuild it doesn't keep the storage from opening.
+	if s.revisionIndex {
+		for bid := range branchJournals {
+			err := s.rebuildRevisionIndexLocked(bid)
+			if err != nil {
+				s.log.CWarningf(ctx, "Couldn't rebuild "+
+					"the revision index of branch "+
+					"%s: %v", bid, err)
+			}
+		}
 	}
 
-	return recordBranchID, nil
+	if s.changeFeed {
+		err := s.catchUpChangeFeedLocked()
+		if err != nil {
+			return fmt.Errorf("Change feed: %v", err)
+		}
+	}
+
+	s.unlockOpen = unlockOpen
+	s.state = mdServerTlfStorageOpen
+	return nil
 }
 
-func (s *mdServerTlfStorage) shutdown() {
+// close makes all further calls to the public methods of s fail. It
+// is fine to call close on a storage that was never opened, and to
+// call close more than once.
+func (s *mdServerTlfStorage) close() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+
+	// Close even if the flush fails; any MDs left in the buffer
+	// are then lost, as if the process had died.
+	var err error
+	if s.state == mdServerTlfStorageOpen {
+		err = s.flushWriteBufferLocked()
+		// Read snapshots can't be used after close, so
+		// nothing holds the deferred removals anymore.
+		if unfence, fenceErr := s.fenceLocked(); fenceErr == nil {
+			for id := range s.deferredRemovals {
+				removeErr := s.removeMDLocked(id)
+				if err == nil {
+					err = removeErr
+				}
+			}
+			unfence()
+		}
+	}
+	for _, b := range s.writeBuffer {
+		notifyWriteWaiters(b.waiters, errMDServerTlfStorageClosed)
+	}
+
+	if s.headChanged != nil {
+		close(s.headChanged)
+		s.headChanged = nil
+	}
 	s.branchJournals = nil
+	s.heldMDs = nil
+	s.deferredRemovals = nil
+	s.mdIDIndex = nil
+	s.highWaterMarks = nil
+	s.growth = nil
+	s.writeBuffer = nil
+	s.writeBufferBytes = 0
+	if s.unlockOpen != nil {
+		unlockErr := s.unlockOpen()
+		if err == nil {
+			err = unlockErr
+		}
+		s.unlockOpen = nil
+	}
+	if s.fence != nil {
+		fenceErr := s.fence.close()
+		if err == nil {
+			err = fenceErr
+		}
+		s.fence = nil
+	}
+	s.state = mdServerTlfStorageClosed
+	return err
 }
@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// mdAnnotationRetention is the annotation key for the retention
+// class of a revision. A revision whose retention class is
+// mdRetentionLegal is pinned when it is put with that annotation, and
+// can't be unpinned, so prune never removes it.
+const (
+	mdAnnotationRetention = "retention"
+	mdRetentionLegal      = "legal"
+)
+
+// mergeMDAnnotations returns the annotations of an MD that already
+// has the annotations existing and is put again with the annotations
+// added. The keys of both are kept, and for a key in both, the
+// existing value wins, so that a later put can't e.g. lift a legal
+// hold.
+func mergeMDAnnotations(existing, added map[string]string) (
+	merged map[string]string, changed bool) {
+	merged = make(map[string]string, len(existing)+len(added))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range added {
+		if _, ok := merged[k]; !ok {
+			merged[k] = v
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+// readAnnotationsReadLocked returns the annotations of the MD with
+// the given ID, which are nil if it has none.
+func (s *mdServerTlfStorage) readAnnotationsReadLocked(id MdID) (
+	map[string]string, error) {
+	buf, err := ioutil.ReadFile(s.annotationsPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var annotations map[string]string
+	err = s.codec.Decode(buf, &annotations)
+	if err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+// annotateLocked merges the given annotations into those of the MD
+// with the given ID, which is at the given revision of the given
+// branch, and pins the revision if its retention class is
+// mdRetentionLegal.
+func (s *mdServerTlfStorage) annotateLocked(bid BranchID,
+	rev MetadataRevision, id MdID, annotations map[string]string) error {
+	existing, err := s.readAnnotationsReadLocked(id)
+	if err != nil {
+		return err
+	}
+	merged, changed := mergeMDAnnotations(existing, annotations)
+	if changed {
+		buf, err := s.codec.Encode(merged)
+		if err != nil {
+			return err
+		}
+		path := s.annotationsPath(id)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, buf, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	if merged[mdAnnotationRetention] == mdRetentionLegal {
+		return s.pinRevisionLocked(bid, rev)
+	}
+	return nil
+}
+
+// getAnnotations returns the annotations of the MD with the given
+// ID, as stored by putAnnotated, or nil if it has none.
+func (s *mdServerTlfStorage) getAnnotations(id MdID) (
+	map[string]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	annotations, err := s.readAnnotationsReadLocked(id)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	return annotations, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// mdAuthzOp is the kind of access an mdServerTlfStorageAuthorizer is
+// asked about.
+type mdAuthzOp int
+
+const (
+	// mdAuthzRead is any get of MDs, on any branch.
+	mdAuthzRead mdAuthzOp = iota
+	// mdAuthzWrite is a put.
+	mdAuthzWrite
+)
+
+func (op mdAuthzOp) String() string {
+	switch op {
+	case mdAuthzRead:
+		return "read"
+	case mdAuthzWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// mdAuthzRequest describes an access to an mdServerTlfStorage that
+// has already passed the built-in reader or writer check.
+type mdAuthzRequest struct {
+	op        mdAuthzOp
+	uid       keybase1.UID
+	deviceKID keybase1.KID
+	bid       BranchID
+	// mergedHead is the merged master head the built-in check
+	// was made against, or nil if there is none yet.
+	mergedHead *RootMetadataSigned
+	// rmds is the MD being put, for an mdAuthzWrite, and nil
+	// otherwise.
+	rmds *RootMetadataSigned
+}
+
+// mdServerTlfStorageAuthorizer adds deployment-specific policy, e.g.
+// a list of revoked devices or an external authorization service, on
+// top of the reader and writer checks of an mdServerTlfStorage. It
+// can only deny accesses those checks allow, never allow ones they
+// deny.
+type mdServerTlfStorageAuthorizer interface {
+	// Authorize returns whether the given access is allowed. It
+	// is called with the storage's lock held, so it must not call
+	// back into the storage. An error denies the access too.
+	Authorize(ctx context.Context, req mdAuthzRequest) (bool, error)
+}
+
+// authorizeReadLocked asks s.authorizer, if any, about the given
+// access, and returns an MDServerErrorUnauthorized if it denies it,
+// or an MDServerError wrapping its error if it fails, so that a
+// broken authorizer fails closed.
+func (s *mdServerTlfStorage) authorizeReadLocked(
+	ctx context.Context, req mdAuthzRequest) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	ok, err := s.authorizer.Authorize(ctx, req)
+	if err != nil {
+		s.log.CDebugf(ctx, "Authorizer failed for %s by %s: %v",
+			req.op, req.uid, err)
+		return MDServerError{err}
+	}
+	if !ok {
+		return MDServerErrorUnauthorized{}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// mdBlockRefChanges is the set of block references a single revision
+// added and removed, as reported by getBlockRefChanges.
+type mdBlockRefChanges struct {
+	revision MetadataRevision
+	// added holds the blocks referenced by the ops of the
+	// revision, including the new pointers of updated blocks.
+	added []BlockPointer
+	// removed holds the blocks unreferenced by the ops of the
+	// revision, including the old pointers of updated blocks.
+	removed []BlockPointer
+}
+
+// blockRefChangesForMD returns the block references added and
+// removed by the ops of the given MD. The ops are only readable by
+// the server for public TLFs, and only if they're embedded in the MD
+// rather than stored in a block of their own.
+func (s *mdServerTlfStorage) blockRefChangesForMD(
+	rmds *RootMetadataSigned) (mdBlockRefChanges, error) {
+	changes := mdBlockRefChanges{revision: rmds.MD.Revision}
+	if !rmds.MD.ID.IsPublic() {
+		return mdBlockRefChanges{}, fmt.Errorf(
+			"The changes of revision %s are encrypted",
+			rmds.MD.Revision)
+	}
+
+	var pmd PrivateMetadata
+	err := s.codec.Decode(rmds.MD.SerializedPrivateMetadata, &pmd)
+	if err != nil {
+		return mdBlockRefChanges{}, err
+	}
+	if pmd.Changes.Info.BlockPointer != zeroPtr {
+		return mdBlockRefChanges{}, fmt.Errorf(
+			"The changes of revision %s are in block %s",
+			rmds.MD.Revision, pmd.Changes.Info.BlockPointer)
+	}
+
+	for _, op := range pmd.Changes.Ops {
+		changes.added = append(changes.added, op.Refs()...)
+		changes.removed = append(changes.removed, op.Unrefs()...)
+		for _, update := range op.AllUpdates() {
+			// An update between identical pointers, which
+			// conflict resolution can make, changes nothing.
+			if update.Ref != update.Unref {
+				changes.added = append(
+					changes.added, update.Ref)
+				changes.removed = append(
+					changes.removed, update.Unref)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// getBlockRefChanges returns, for each revision of the given branch
+// between start and stop inclusive that the given user and device
+// may read, the block references it added and removed, so that a
+// block server can work out which blocks are still referenced by
+// live revisions without decoding MDs itself. The storage's codec
+// must have the op types registered, as with RegisterOps, and the
+// TLF must be public, since the server can't read the changes of a
+// private one.
+func (s *mdServerTlfStorage) getBlockRefChanges(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	[]mdBlockRefChanges, error) {
+	rmdses, err := s.getRange(
+		ctx, currentUID, deviceKID, bid, start, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]mdBlockRefChanges, 0, len(rmdses))
+	for _, rmds := range rmdses {
+		c, err := s.blockRefChangesForMD(rmds)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// mdChangeFeedEntry is the content of an entry in the change feed of
+// an mdServerTlfStorage: the given branch of the given TLF advanced
+// to the given revision, with the given MdID, put by the given
+// user. Fields are exported only for serialization.
+type mdChangeFeedEntry struct {
+	TlfID    TlfID
+	BID      BranchID
+	Revision MetadataRevision
+	ID       MdID
+	UID      keybase1.UID
+}
+
+// mdChangeFeedEvent is a change feed entry along with its sequence
+// number. Sequence numbers start at 1 and increase by 1 with each
+// entry, across all branches.
+type mdChangeFeedEvent struct {
+	seq uint64
+	mdChangeFeedEntry
+}
+
+// checkChangeFeedConsumerName returns an error if the given consumer
+// name can't be used as the name of its checkpoint file.
+func checkChangeFeedConsumerName(consumer string) error {
+	if consumer == "" || consumer == "." || consumer == ".." ||
+		strings.ContainsAny(consumer, `/\`) {
+		return fmt.Errorf("Invalid change feed consumer name %q", consumer)
+	}
+	return nil
+}
+
+// appendChangeFeedLocked appends the given entries to the change
+// feed, numbering them from 1 if it is empty.
+func (s *mdServerTlfStorage) appendChangeFeedLocked(
+	entries ...mdChangeFeedEntry) error {
+	feed := s.changeFeedJournal()
+	var o *journalOrdinal
+	_, err := feed.readLatestOrdinal()
+	if os.IsNotExist(err) {
+		first := journalOrdinal(1)
+		o = &first
+	} else if err != nil {
+		return err
+	}
+
+	feedEntries := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		feedEntries = append(feedEntries, entry)
+	}
+	return feed.appendJournalEntries(o, feedEntries)
+}
+
+// catchUpChangeFeedLocked appends to the change feed an entry for
+// each stored revision that comes after the latest one the feed has
+// for its branch. That covers puts whose feed append was lost, e.g.
+// because the process died right before it, and, when the feed has
+// just been enabled, all the revisions stored so far. Since the
+// entries appended here have to be reconstructed from the stored
+// MDs, their UIDs are the MDs' last modifying users.
+func (s *mdServerTlfStorage) catchUpChangeFeedLocked() error {
+	feed := s.changeFeedJournal()
+
+	// Find the latest fed revision of each branch by scanning back
+	// from the end of the feed, until all branches are found.
+	fed := make(map[BranchID]MetadataRevision)
+	earliest, err := feed.readEarliestOrdinal()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		latest, err := feed.readLatestOrdinal()
+		if err != nil {
+			return err
+		}
+		for o := latest; o >= earliest &&
+			len(fed) < len(s.branchJournals); o-- {
+			e, err := feed.readJournalEntry(o)
+			if err != nil {
+				return err
+			}
+			entry := e.(mdChangeFeedEntry)
+			if _, ok := s.branchJournals[entry.BID]; !ok {
+				continue
+			}
+			if _, ok := fed[entry.BID]; !ok {
+				fed[entry.BID] = entry.Revision
+			}
+		}
+	}
+
+	bids := make([]BranchID, 0, len(s.branchJournals))
+	for bid := range s.branchJournals {
+		bids = append(bids, bid)
+	}
+	sort.Sort(branchIDList(bids))
+
+	var entries []mdChangeFeedEntry
+	for _, bid := range bids {
+		j := s.branchJournals[bid]
+		earliestRev, err := j.readEarliestRevision()
+		if err != nil {
+			return err
+		}
+		if earliestRev == MetadataRevisionUninitialized {
+			continue
+		}
+		latestRev, err := j.readLatestRevision()
+		if err != nil {
+			return err
+		}
+
+		start := earliestRev
+		if fedRev, ok := fed[bid]; ok && fedRev+1 > start {
+			start = fedRev + 1
+		}
+		for r := start; r <= latestRev; r++ {
+			mdID, err := j.readMdID(r)
+			if err != nil {
+				return err
+			}
+			rmds, err := s.getMDReadLocked(mdID)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, mdChangeFeedEntry{
+				TlfID:    rmds.MD.ID,
+				BID:      bid,
+				Revision: r,
+				ID:       mdID,
+				UID:      rmds.MD.LastModifyingUser,
+			})
+		}
+	}
+	return s.appendChangeFeedLocked(entries...)
+}
+
+var errMDServerTlfStorageChangeFeedDisabled = errors.New(
+	"The change feed is not enabled")
+
+// consumeChangeFeed returns, in order, up to maxEvents of the change
+// feed events with sequence numbers greater than afterSeq, or all of
+// them if maxEvents isn't positive. A consumer starting out passes
+// 0, and then the sequence number of the last event it has
+// processed, which it can store with saveChangeFeedCheckpoint so that
+// it can resume from there after a restart.
+//
+// Delivery is at least once: a consumer that restarts before saving
+// its checkpoint gets the same events again, and can recognize them
+// by their sequence numbers. Also, if the process dies before MDs
+// buffered by put are written, their revisions may be fed again with
+// different MdIDs by later puts; the later event wins.
+func (s *mdServerTlfStorage) consumeChangeFeed(
+	afterSeq uint64, maxEvents int) ([]mdChangeFeedEvent, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	if !s.changeFeed {
+		return nil, errMDServerTlfStorageChangeFeedDisabled
+	}
+
+	feed := s.changeFeedJournal()
+	earliest, err := feed.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, MDServerError{err}
+	}
+	latest, err := feed.readLatestOrdinal()
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	start := journalOrdinal(afterSeq) + 1
+	if start < earliest {
+		start = earliest
+	}
+	var events []mdChangeFeedEvent
+	for o := start; o <= latest; o++ {
+		if maxEvents > 0 && len(events) >= maxEvents {
+			break
+		}
+		e, err := feed.readJournalEntry(o)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		events = append(events, mdChangeFeedEvent{
+			seq:               uint64(o),
+			mdChangeFeedEntry: e.(mdChangeFeedEntry),
+		})
+	}
+	return events, nil
+}
+
+// saveChangeFeedCheckpoint records that the given consumer has
+// processed the change feed up to and including the event with the
+// given sequence number. The checkpoint is replaced atomically, but
+// isn't fsynced.
+func (s *mdServerTlfStorage) saveChangeFeedCheckpoint(
+	consumer string, seq uint64) error {
+	if err := checkChangeFeedConsumerName(consumer); err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	path := s.changeFeedCheckpointPath(consumer)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(
+		tmpPath, []byte(journalOrdinal(seq).String()), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadChangeFeedCheckpoint returns the sequence number last saved by
+// saveChangeFeedCheckpoint for the given consumer, or 0 if there is
+// none.
+func (s *mdServerTlfStorage) loadChangeFeedCheckpoint(
+	consumer string) (uint64, error) {
+	if err := checkChangeFeedConsumerName(consumer); err != nil {
+		return 0, MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return 0, err
+	}
+
+	buf, err := ioutil.ReadFile(s.changeFeedCheckpointPath(consumer))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	seq, err := makeJournalOrdinal(string(buf))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(seq), nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// acquireColdRead is like acquireFile, but for a read from
+// s.coldMDsDir, within s.maxColdReads.
+func (s *mdServerTlfStorage) acquireColdRead(ctx context.Context) func() {
+	if s.coldReads == nil {
+		return func() {}
+	}
+	s.coldReads.acquire(mdServerTlfStoragePriorityFromContext(ctx))
+	return s.coldReads.release
+}
+
+// demoteColdMDs moves the MD objects of all but the latest
+// s.hotRevisions revisions of each branch from dir/mds to
+// s.coldMDsDir, and returns the number moved. It does nothing if
+// s.coldMDsDir is empty. It is meant to be called periodically, e.g.
+// from a background goroutine, and can be canceled through ctx
+// between objects. It runs with background priority, yielding the
+// lock between objects to any waiting normal-priority readers.
+func (s *mdServerTlfStorage) demoteColdMDs(ctx context.Context) (
+	int, error) {
+	ctx = withMDServerTlfStoragePriority(
+		ctx, mdServerTlfStoragePriorityBackground)
+
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return 0, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return 0, err
+	}
+	defer unfence()
+
+	if s.coldMDsDir == "" {
+		return 0, nil
+	}
+
+	// The branches may change while the lock is yielded, so
+	// iterate over a copy of their IDs.
+	bids := make([]BranchID, 0, len(s.branchJournals))
+	for bid := range s.branchJournals {
+		bids = append(bids, bid)
+	}
+
+	moved := 0
+	for _, bid := range bids {
+		n, err := s.demoteColdMDsForBranchLocked(ctx, bid)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// demoteColdMDsForBranchLocked does the work of demoteColdMDs for a
+// single branch, which may be removed or pruned whenever the lock is
+// yielded.
+func (s *mdServerTlfStorage) demoteColdMDsForBranchLocked(
+	ctx context.Context, bid BranchID) (int, error) {
+	moved := 0
+	r := MetadataRevisionUninitialized
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		// demoteColdMDs holds the fence throughout, so only
+		// whether s is still open needs rechecking.
+		if s.yieldToReadersLocked() {
+			if err := s.checkOpenReadLocked(); err != nil {
+				return moved, err
+			}
+		}
+
+		j, ok := s.branchJournals[bid]
+		if !ok {
+			return moved, nil
+		}
+		earliest, err := j.readEarliestRevision()
+		if err != nil {
+			return moved, err
+		}
+		latest, err := j.readLatestRevision()
+		if err != nil {
+			return moved, err
+		}
+		if earliest == MetadataRevisionUninitialized {
+			return moved, nil
+		}
+		if r < earliest {
+			r = earliest
+		}
+		if r > latest-MetadataRevision(s.hotRevisions) {
+			return moved, nil
+		}
+
+		mdID, err := j.readMdID(r)
+		if err != nil {
+			return moved, err
+		}
+		r++
+		if _, ok := s.writeBuffer[mdID]; ok {
+			// Not on disk yet.
+			continue
+		}
+
+		hotPath := s.mdPath(mdID)
+		_, err = os.Stat(hotPath)
+		if os.IsNotExist(err) {
+			// Already demoted.
+			continue
+		} else if err != nil {
+			return moved, err
+		}
+
+		err = s.moveMDFileLocked(ctx, hotPath, s.coldMDPath(mdID))
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+}
+
+// moveMDFileLocked moves the MD object file at src to dst, keeping
+// its modification time, which is its server timestamp.
+func (s *mdServerTlfStorage) moveMDFileLocked(
+	ctx context.Context, src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	// Fall back to copying, e.g. if the tiers are on different
+	// devices.
+	fileInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	release := s.acquireFile(ctx)
+	buf, err := s.readFile(src)
+	release()
+	if err != nil {
+		return err
+	}
+	release = s.acquireFile(ctx)
+	err = s.writeFile(dst, buf, 0600)
+	release()
+	if err == nil {
+		err = os.Chtimes(dst, fileInfo.ModTime(), fileInfo.ModTime())
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// mdDecodeLimits bounds the resources that decoding a stored MD
+// object may use. A non-positive field means no limit.
+//
+// The msgpack codec itself only caps the capacity it preallocates
+// for a collection (see codec.DecodeOptions.MaxInitLen), but fields
+// it doesn't know about are decoded generically, with arbitrary
+// nesting and size. So instead, the encoded object is scanned, and
+// rejected if it could exceed the limits, before it is decoded.
+type mdDecodeLimits struct {
+	// maxDepth is the maximum nesting depth of maps and arrays.
+	// A top-level map has depth 1.
+	maxDepth int
+	// maxElements is the maximum number of msgpack objects,
+	// counting containers, keys and values.
+	maxElements int
+	// maxAllocBytes bounds an estimate of the memory decoding
+	// would allocate: the total length of all strings, byte
+	// arrays and extensions, plus mdDecodeElementOverhead bytes
+	// per map or array element.
+	maxAllocBytes int64
+}
+
+// mdDecodeElementOverhead is the memory that decoding a map or array
+// element is assumed to take, beyond its contents, e.g. for an
+// interface value.
+const mdDecodeElementOverhead = 16
+
+func (l mdDecodeLimits) isSet() bool {
+	return l.maxDepth > 0 || l.maxElements > 0 || l.maxAllocBytes > 0
+}
+
+var errMDDecodeLimitExceeded = errors.New(
+	"Stored MD object exceeds the decode limits")
+
+// checkMsgpackDecodeLimits scans the msgpack object at the start of
+// buf without decoding it, and returns errMDDecodeLimitExceeded if
+// decoding it could exceed the given limits. It doesn't recurse, and
+// doesn't trust any length in buf that buf is too short to hold, so
+// it is safe on arbitrary input. The payloads of extensions aren't
+// scanned.
+func checkMsgpackDecodeLimits(buf []byte, limits mdDecodeLimits) error {
+	pos := 0
+	truncated := func() error {
+		return fmt.Errorf(
+			"Truncated or invalid msgpack at offset %d", pos)
+	}
+	readLen := func(size int) (uint64, error) {
+		if size > len(buf)-pos {
+			return 0, truncated()
+		}
+		var n uint64
+		switch size {
+		case 1:
+			n = uint64(buf[pos])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(buf[pos:]))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(buf[pos:]))
+		}
+		pos += size
+		return n, nil
+	}
+
+	// pending has, for each open container and for the top
+	// level, the number of objects in it still to be scanned.
+	pending := []uint64{1}
+	var elements uint64
+	var allocBytes uint64
+	for len(pending) > 0 {
+		top := len(pending) - 1
+		if pending[top] == 0 {
+			pending = pending[:top]
+			continue
+		}
+		pending[top]--
+
+		elements++
+		if limits.maxElements > 0 &&
+			elements > uint64(limits.maxElements) {
+			return errMDDecodeLimitExceeded
+		}
+
+		if pos >= len(buf) {
+			return truncated()
+		}
+		b := buf[pos]
+		pos++
+
+		// payload is the number of bytes that follow the
+		// header, and children the number of objects in the
+		// container, if b starts one.
+		var payload, children uint64
+		allocates := false
+		var err error
+		switch {
+		case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 ||
+			b == 0xc3:
+			// Fixints, nil and booleans.
+		case b&0xf0 == 0x80:
+			children = 2 * uint64(b&0x0f)
+		case b&0xf0 == 0x90:
+			children = uint64(b & 0x0f)
+		case b&0xe0 == 0xa0:
+			payload = uint64(b & 0x1f)
+			allocates = true
+		case b == 0xc4 || b == 0xd9:
+			payload, err = readLen(1)
+			allocates = true
+		case b == 0xc5 || b == 0xda:
+			payload, err = readLen(2)
+			allocates = true
+		case b == 0xc6 || b == 0xdb:
+			payload, err = readLen(4)
+			allocates = true
+		case b == 0xc7 || b == 0xc8 || b == 0xc9:
+			// Extensions have a type byte after the length.
+			payload, err = readLen(1 << (b - 0xc7))
+			payload++
+			allocates = true
+		case b == 0xcc || b == 0xd0:
+			payload = 1
+		case b == 0xcd || b == 0xd1:
+			payload = 2
+		case b == 0xca || b == 0xce || b == 0xd2:
+			payload = 4
+		case b == 0xcb || b == 0xcf || b == 0xd3:
+			payload = 8
+		case b >= 0xd4 && b <= 0xd8:
+			// Fixed-size extensions, plus the type byte.
+			payload = 1<<(b-0xd4) + 1
+			allocates = true
+		case b == 0xdc:
+			children, err = readLen(2)
+		case b == 0xdd:
+			children, err = readLen(4)
+		case b == 0xde:
+			children, err = readLen(2)
+			children *= 2
+		case b == 0xdf:
+			children, err = readLen(4)
+			children *= 2
+		default:
+			return truncated()
+		}
+		if err != nil {
+			return err
+		}
+
+		if payload > uint64(len(buf)-pos) {
+			return truncated()
+		}
+		pos += int(payload)
+		if allocates {
+			allocBytes += payload
+		}
+
+		if children > 0 {
+			if limits.maxElements > 0 &&
+				children > uint64(limits.maxElements)-elements {
+				return errMDDecodeLimitExceeded
+			}
+			// Each object takes at least one byte, so a
+			// count that the rest of buf can't hold is
+			// bogus.
+			if children > uint64(len(buf)-pos) {
+				return truncated()
+			}
+			pending = append(pending, children)
+			if limits.maxDepth > 0 &&
+				len(pending)-1 > limits.maxDepth {
+				return errMDDecodeLimitExceeded
+			}
+			allocBytes += children * mdDecodeElementOverhead
+		}
+
+		if limits.maxAllocBytes > 0 &&
+			allocBytes > uint64(limits.maxAllocBytes) {
+			return errMDDecodeLimitExceeded
+		}
+	}
+	return nil
+}
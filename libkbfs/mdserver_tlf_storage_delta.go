@@ -0,0 +1,229 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// mdDeltaMagic starts every MD object stored as a delta. An MD object
+// stored in full is an encoded RootMetadataSigned, which is a map, so
+// its first byte can never be 'M'.
+var mdDeltaMagic = []byte("MDDELTA\x00")
+
+// mdDeltaWindow is the size of the chunks of a base MD that are
+// looked for in a new MD when computing a delta.
+const mdDeltaWindow = 16
+
+// mdDeltaMaxRatio is the largest ratio of the size of a delta to the
+// size of the full MD for which the delta is stored instead of the
+// full MD.
+const mdDeltaMaxRatio = 0.5
+
+// mdDeltaOp is a single step in rebuilding an encoded MD from the
+// encoding of its base. Fields are exported only for serialization.
+type mdDeltaOp struct {
+	// If Data is non-empty, it is appended as is. Otherwise, Len
+	// bytes starting at Offset in the base are appended.
+	Offset int
+	Len    int
+	Data   []byte
+}
+
+// mdDelta is an encoded MD expressed as a list of changes to the
+// encoding of another MD. Fields are exported only for
+// serialization.
+type mdDelta struct {
+	BaseID MdID
+	Ops    []mdDeltaOp
+}
+
+func isMDDelta(data []byte) bool {
+	return bytes.HasPrefix(data, mdDeltaMagic)
+}
+
+// makeMDDeltaOps returns the ops that turn base into target.
+//
+// Every aligned chunk of base is indexed, and target is scanned for
+// those chunks at every offset. Each match is extended in both
+// directions as far as possible, and the bytes of target not covered
+// by any match are stored literally.
+func makeMDDeltaOps(base, target []byte) []mdDeltaOp {
+	index := make(map[string]int, len(base)/mdDeltaWindow)
+	for i := 0; i+mdDeltaWindow <= len(base); i += mdDeltaWindow {
+		key := string(base[i : i+mdDeltaWindow])
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+
+	var ops []mdDeltaOp
+	var literal []byte
+	for i := 0; i < len(target); {
+		var off int
+		var ok bool
+		if i+mdDeltaWindow <= len(target) {
+			off, ok = index[string(target[i:i+mdDeltaWindow])]
+		}
+		if !ok {
+			literal = append(literal, target[i])
+			i++
+			continue
+		}
+
+		// Extend the match backwards into the pending literal
+		// bytes, and then forwards.
+		for len(literal) > 0 && off > 0 &&
+			base[off-1] == literal[len(literal)-1] {
+			literal = literal[:len(literal)-1]
+			off--
+			i--
+		}
+		n := 0
+		for off+n < len(base) && i+n < len(target) &&
+			base[off+n] == target[i+n] {
+			n++
+		}
+
+		if len(literal) > 0 {
+			ops = append(ops, mdDeltaOp{Data: literal})
+			literal = nil
+		}
+		ops = append(ops, mdDeltaOp{Offset: off, Len: n})
+		i += n
+	}
+	if len(literal) > 0 {
+		ops = append(ops, mdDeltaOp{Data: literal})
+	}
+	return ops
+}
+
+// applyMDDeltaOps returns the result of applying the given ops to
+// base.
+func applyMDDeltaOps(base []byte, ops []mdDeltaOp) ([]byte, error) {
+	var buf []byte
+	for _, op := range ops {
+		if len(op.Data) > 0 {
+			buf = append(buf, op.Data...)
+			continue
+		}
+		if op.Offset < 0 || op.Len < 0 || op.Offset+op.Len > len(base) {
+			return nil, fmt.Errorf(
+				"Delta op copying %d bytes at offset %d is out of "+
+					"bounds for a base of %d bytes",
+				op.Len, op.Offset, len(base))
+		}
+		buf = append(buf, base[op.Offset:op.Offset+op.Len]...)
+	}
+	return buf, nil
+}
+
+// encodeMDDelta returns the stored form of the given delta.
+func encodeMDDelta(codec Codec, delta mdDelta) ([]byte, error) {
+	buf, err := codec.Encode(delta)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), mdDeltaMagic...), buf...), nil
+}
+
+// decodeMDDelta is the inverse of encodeMDDelta.
+func decodeMDDelta(codec Codec, data []byte) (mdDelta, error) {
+	if !isMDDelta(data) {
+		return mdDelta{}, fmt.Errorf("Data is not an MD delta")
+	}
+	var delta mdDelta
+	err := codec.Decode(data[len(mdDeltaMagic):], &delta)
+	if err != nil {
+		return mdDelta{}, err
+	}
+	return delta, nil
+}
+
+// maybeMakeDeltaLocked returns the form in which to store the given
+// MD, whose encoding is buf. That is a delta against the head of its
+// branch if deltas are enabled, the revision isn't a multiple of
+// s.deltaFullInterval, and the delta is small enough; otherwise it
+// is buf itself.
+//
+// Deltas are only made against MDs that are already on disk, so that
+// if the process dies with a non-empty write buffer, no delta is
+// left without its base.
+func (s *mdServerTlfStorage) maybeMakeDeltaLocked(ctx context.Context,
+	rmds *RootMetadataSigned, buf []byte) ([]byte, error) {
+	if s.deltaFullInterval <= 0 ||
+		rmds.MD.Revision%MetadataRevision(s.deltaFullInterval) == 0 {
+		return buf, nil
+	}
+
+	j, ok := s.branchJournals[rmds.MD.BID]
+	if !ok {
+		return buf, nil
+	}
+	baseID, err := j.getHead()
+	if err != nil {
+		return nil, err
+	}
+	if baseID == (MdID{}) {
+		return buf, nil
+	}
+	if _, ok := s.writeBuffer[baseID]; ok {
+		return buf, nil
+	}
+
+	base, _, err := s.readEncodedMDReadLocked(ctx, baseID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startMDServerTlfStorageSpan(ctx, "makeDelta")
+	defer span.Finish()
+	deltaBuf, err := encodeMDDelta(s.codec, mdDelta{
+		BaseID: baseID,
+		Ops:    makeMDDeltaOps(base, buf),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if float64(len(deltaBuf)) > mdDeltaMaxRatio*float64(len(buf)) {
+		return buf, nil
+	}
+	span.SetTag("savedBytes", len(buf)-len(deltaBuf))
+	return deltaBuf, nil
+}
+
+// storeInFullLocked rewrites the MD with the given ID in full if it
+// is stored as a delta, so that its bases can be removed. Its
+// timestamp is preserved.
+func (s *mdServerTlfStorage) storeInFullLocked(id MdID) error {
+	data, timestamp, err := s.readStoredMDReadLocked(
+		context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if !isMDDelta(data) {
+		return nil
+	}
+
+	data, _, err = s.readEncodedMDReadLocked(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	if b, ok := s.writeBuffer[id]; ok {
+		s.writeBufferBytes += int64(len(data) - len(b.buf))
+		b.buf = data
+		s.writeBuffer[id] = b
+		return nil
+	}
+
+	// Write to a temporary file first, so that the delta isn't
+	// lost if the write fails, and so that any hard links to it
+	// made by snapshot are left alone.
+	return s.rewriteMDLocked(id, data, timestamp)
+}
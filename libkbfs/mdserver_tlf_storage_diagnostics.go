@@ -0,0 +1,896 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// mdServerCompactionThreshold is the fragmentation score at or above
+// which compaction is recommended.
+const mdServerCompactionThreshold = 0.25
+
+// mdServerTlfStorageFragmentationReport describes the leftovers in
+// the storage that a compaction pass could remove.
+type mdServerTlfStorageFragmentationReport struct {
+	// splayDirs is the number of subdirectories of dir/mds, and
+	// emptySplayDirs is the number of those that are empty, e.g.
+	// because everything in them was pruned.
+	splayDirs      int
+	emptySplayDirs int
+	// mdObjects is the number of MD objects on disk, and
+	// orphanMDs holds the sorted IDs of those that aren't
+	// referenced by any branch journal, live or soft-deleted,
+	// e.g. because their branch was purged.
+	mdObjects int
+	orphanMDs []MdID
+	// journalEntries is the number of journal entry files of the
+	// live branches, and strayEntries maps each branch that has
+	// entry files outside of its [EARLIEST, LATEST] range, e.g.
+	// because a prune was interrupted, to their number.
+	journalEntries int
+	strayEntries   map[BranchID]int
+	// score is the fraction of all of the above that are
+	// leftovers, between 0 and 1.
+	score float64
+	// shouldCompact is whether score is at least
+	// mdServerCompactionThreshold.
+	shouldCompact bool
+}
+
+// scanBranchJournalDirReadLocked returns the MdIDs referenced by the
+// branch journal in the given directory, along with the total number
+// of entries in it, whether entry files or records of a compact
+// journal, and the number of those that are outside of its
+// [EARLIEST, LATEST] range.
+func (s *mdServerTlfStorage) scanBranchJournalDirReadLocked(dir string) (
+	mdIDs []MdID, entries, strayEntries int, err error) {
+	j := makeMDServerBranchJournal(s.codec, dir)
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if earliest != MetadataRevisionUninitialized {
+		_, mdIDs, err = j.getRange(earliest, latest)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	ordinals, err := j.j.scanOrdinals()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for _, o := range ordinals {
+		entries++
+		r := MetadataRevision(o)
+		if earliest == MetadataRevisionUninitialized ||
+			r < earliest || r > latest {
+			strayEntries++
+		}
+	}
+	return mdIDs, entries, strayEntries, nil
+}
+
+// fragmentationReport measures the leftovers in the storage; see
+// mdServerTlfStorageFragmentationReport. It doesn't modify anything.
+func (s *mdServerTlfStorage) fragmentationReport() (
+	mdServerTlfStorageFragmentationReport, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdServerTlfStorageFragmentationReport{}, err
+	}
+
+	report := mdServerTlfStorageFragmentationReport{
+		strayEntries: make(map[BranchID]int),
+	}
+
+	splayInfos, err := ioutil.ReadDir(s.mdsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return mdServerTlfStorageFragmentationReport{}, err
+	}
+	for _, splayInfo := range splayInfos {
+		if !splayInfo.IsDir() {
+			continue
+		}
+		report.splayDirs++
+		fileInfos, err := ioutil.ReadDir(
+			filepath.Join(s.mdsPath(), splayInfo.Name()))
+		if err != nil {
+			return mdServerTlfStorageFragmentationReport{}, err
+		}
+		if len(fileInfos) == 0 {
+			report.emptySplayDirs++
+		}
+	}
+
+	referenced := make(map[MdID]bool)
+	for bid := range s.branchJournals {
+		mdIDs, entries, strayEntries, err :=
+			s.scanBranchJournalDirReadLocked(s.branchJournalPath(bid))
+		if err != nil {
+			return mdServerTlfStorageFragmentationReport{}, err
+		}
+		for _, mdID := range mdIDs {
+			referenced[mdID] = true
+		}
+		report.journalEntries += entries
+		if strayEntries > 0 {
+			report.strayEntries[bid] = strayEntries
+		}
+	}
+
+	tombstoneInfos, err := ioutil.ReadDir(s.branchTombstonesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return mdServerTlfStorageFragmentationReport{}, err
+	}
+	for _, fi := range tombstoneInfos {
+		bid := ParseBranchID(fi.Name())
+		if bid == NullBranchID {
+			// Not a tombstone.
+			continue
+		}
+		mdIDs, _, _, err :=
+			s.scanBranchJournalDirReadLocked(s.branchTombstonePath(bid))
+		if err != nil {
+			return mdServerTlfStorageFragmentationReport{}, err
+		}
+		for _, mdID := range mdIDs {
+			referenced[mdID] = true
+		}
+	}
+
+	report.mdObjects = len(s.mdIDIndex)
+	for _, mdID := range s.mdIDIndex {
+		if !referenced[mdID] {
+			report.orphanMDs = append(report.orphanMDs, mdID)
+		}
+	}
+
+	totalStrayEntries := 0
+	for _, n := range report.strayEntries {
+		totalStrayEntries += n
+	}
+	leftovers := report.emptySplayDirs + len(report.orphanMDs) +
+		totalStrayEntries
+	total := report.splayDirs + report.mdObjects + report.journalEntries
+	if total > 0 {
+		report.score = float64(leftovers) / float64(total)
+	}
+	report.shouldCompact = report.score >= mdServerCompactionThreshold
+	return report, nil
+}
+
+// mdDuplicateCopy is a copy of an MD object at a path other than
+// the canonical one.
+type mdDuplicateCopy struct {
+	path string
+	// matches is whether the copy has the same contents as the
+	// canonical one, in which case it can be removed.
+	matches bool
+}
+
+// mdDuplicate describes an MD object stored at more than one path.
+type mdDuplicate struct {
+	id MdID
+	// canonicalPath is the path reads find the object at: its
+	// path in dir/mds if there's a copy there, and otherwise its
+	// path in s.coldMDsDir. It's empty if there's no copy at
+	// either, in which case reads can't find the object at all,
+	// and none of the copies are recommended for removal.
+	canonicalPath string
+	copies        []mdDuplicateCopy
+}
+
+// scanDuplicateMDs looks for MD objects stored at more than one path
+// in dir/mds and s.coldMDsDir, e.g. under a splay directory of the
+// wrong width because of a layout bug or an interrupted migration,
+// and returns them ordered by ID. A file is taken to be a copy of
+// the MD whose ID is the concatenation of the components of its
+// path below either directory. Unlike fragmentationReport, which
+// finds the objects that no journal references, it reads every
+// copy, to compare them with the canonical one. It doesn't modify
+// anything.
+func (s *mdServerTlfStorage) scanDuplicateMDs() ([]mdDuplicate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	paths := make(map[MdID][]string)
+	roots := []string{s.mdsPath()}
+	if s.coldMDsDir != "" {
+		roots = append(roots, s.coldMDsDir)
+	}
+	for _, root := range roots {
+		err := filepath.Walk(root,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) && path == root {
+						return nil
+					}
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				name := strings.Replace(
+					rel, string(filepath.Separator), "", -1)
+				h, err := HashFromString(name)
+				if err != nil {
+					// Not an MD object.
+					return nil
+				}
+				id := MdID{h}
+				paths[id] = append(paths[id], path)
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids mdIDList
+	for id, idPaths := range paths {
+		if len(idPaths) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(ids)
+
+	var duplicates []mdDuplicate
+	for _, id := range ids {
+		idPaths := paths[id]
+		d := mdDuplicate{id: id}
+		for _, path := range idPaths {
+			if path == s.mdPath(id) {
+				d.canonicalPath = path
+			}
+		}
+		if d.canonicalPath == "" && s.coldMDsDir != "" {
+			for _, path := range idPaths {
+				if path == s.coldMDPath(id) {
+					d.canonicalPath = path
+				}
+			}
+		}
+
+		var canonical []byte
+		if d.canonicalPath != "" {
+			var err error
+			canonical, err = ioutil.ReadFile(d.canonicalPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, path := range idPaths {
+			if path == d.canonicalPath {
+				continue
+			}
+			c := mdDuplicateCopy{path: path}
+			if d.canonicalPath != "" {
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				c.matches = bytes.Equal(buf, canonical)
+			}
+			d.copies = append(d.copies, c)
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, nil
+}
+
+// mdSizeHistogramBounds are the upper bounds, in bytes, of the
+// buckets of an mdSizeHistogram.
+var mdSizeHistogramBounds = []int64{
+	1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20,
+}
+
+// mdSizeHistogram is a histogram of MD object sizes, laid out like a
+// Prometheus histogram: counts[i] is the number of objects of at
+// most mdSizeHistogramBounds[i] bytes, so the counts are cumulative,
+// and count, the total number of objects, plays the part of the +Inf
+// bucket.
+type mdSizeHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    int64
+}
+
+func makeMDSizeHistogram() mdSizeHistogram {
+	return mdSizeHistogram{
+		counts: make([]uint64, len(mdSizeHistogramBounds)),
+	}
+}
+
+func (h *mdSizeHistogram) observe(size int64) {
+	for i, bound := range mdSizeHistogramBounds {
+		if size <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += size
+}
+
+// mdServerTlfStorageSizeHistograms holds histograms of the sizes on
+// disk of the MD objects in the storage. An object stored as a delta
+// counts with the size of the delta.
+type mdServerTlfStorageSizeHistograms struct {
+	// merged is for the objects referenced by the master branch,
+	// unmerged for those referenced by any other live branch, and
+	// other for the rest, e.g. those of soft-deleted branches.
+	merged   mdSizeHistogram
+	unmerged mdSizeHistogram
+	other    mdSizeHistogram
+}
+
+// sizeHistograms walks dir/mds and returns histograms of the sizes
+// of the MD objects in it. It doesn't modify anything.
+func (s *mdServerTlfStorage) sizeHistograms() (
+	mdServerTlfStorageSizeHistograms, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdServerTlfStorageSizeHistograms{}, err
+	}
+
+	branches := make(map[MdID]BranchID)
+	for bid, j := range s.branchJournals {
+		_, mdIDs, err := j.getRange(
+			MetadataRevisionInitial, math.MaxInt64)
+		if err != nil {
+			return mdServerTlfStorageSizeHistograms{}, err
+		}
+		for _, mdID := range mdIDs {
+			branches[mdID] = bid
+		}
+	}
+
+	histograms := mdServerTlfStorageSizeHistograms{
+		merged:   makeMDSizeHistogram(),
+		unmerged: makeMDSizeHistogram(),
+		other:    makeMDSizeHistogram(),
+	}
+
+	splayInfos, err := ioutil.ReadDir(s.mdsPath())
+	if os.IsNotExist(err) {
+		return histograms, nil
+	} else if err != nil {
+		return mdServerTlfStorageSizeHistograms{}, err
+	}
+	for _, splayInfo := range splayInfos {
+		if !splayInfo.IsDir() {
+			continue
+		}
+		fileInfos, err := ioutil.ReadDir(
+			filepath.Join(s.mdsPath(), splayInfo.Name()))
+		if err != nil {
+			return mdServerTlfStorageSizeHistograms{}, err
+		}
+		for _, fi := range fileInfos {
+			h, err := HashFromString(splayInfo.Name() + fi.Name())
+			if err != nil {
+				return mdServerTlfStorageSizeHistograms{}, fmt.Errorf(
+					"Unexpected file %s in %s: %v",
+					fi.Name(), splayInfo.Name(), err)
+			}
+			bid, ok := branches[MdID{h}]
+			switch {
+			case !ok:
+				histograms.other.observe(fi.Size())
+			case bid == NullBranchID:
+				histograms.merged.observe(fi.Size())
+			default:
+				histograms.unmerged.observe(fi.Size())
+			}
+		}
+	}
+	return histograms, nil
+}
+
+// mdSharedRef is a reference to an MD object from a branch journal.
+type mdSharedRef struct {
+	bid      BranchID
+	revision MetadataRevision
+}
+
+// mdSharingProblem describes an MD object referenced from more than
+// one place in the branch journals in a way that can't be explained
+// by an unmerged branch having the merged history before its
+// divergence point as a prefix. That may be due to a bug, or to a
+// revision from elsewhere having been spliced into a branch.
+type mdSharingProblem struct {
+	id MdID
+	// refs are all the references to the MD, ordered by branch
+	// ID, with the master branch first, and then by revision.
+	refs   []mdSharedRef
+	reason string
+}
+
+// verifySharing checks every MD object referenced from more than one
+// place in the retained parts of the branch journals. Such sharing
+// is legitimate only if the MD is at the same revision of the master
+// branch, once, and each unmerged branch referencing it does so at
+// or before its divergence point, i.e. within the prefix of its
+// journal that matches the master branch. It returns a problem for
+// each MD shared otherwise, ordered as the first references to them
+// are.
+func (s *mdServerTlfStorage) verifySharing() ([]mdSharingProblem, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	bids := make([]BranchID, 0, len(s.branchJournals))
+	for bid := range s.branchJournals {
+		if bid != NullBranchID {
+			bids = append(bids, bid)
+		}
+	}
+	sort.Sort(branchIDList(bids))
+	bids = append([]BranchID{NullBranchID}, bids...)
+
+	master, err := s.summarizeBranchReadLocked(NullBranchID)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	masterIDAt := func(rev MetadataRevision) MdID {
+		if len(master.MdIDs) == 0 || rev < master.Earliest ||
+			rev > master.Latest {
+			return MdID{}
+		}
+		return master.MdIDs[rev-master.Earliest]
+	}
+
+	// divergence is the last revision of the prefix of each
+	// unmerged branch's journal that matches the master branch.
+	divergence := make(map[BranchID]MetadataRevision)
+	refs := make(map[MdID][]mdSharedRef)
+	var ids []MdID
+	for _, bid := range bids {
+		summary, err := s.summarizeBranchReadLocked(bid)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		divergence[bid] = MetadataRevisionUninitialized
+		inPrefix := bid != NullBranchID
+		for i, id := range summary.MdIDs {
+			rev := summary.Earliest + MetadataRevision(i)
+			if inPrefix && masterIDAt(rev) == id {
+				divergence[bid] = rev
+			} else {
+				inPrefix = false
+			}
+			if _, ok := refs[id]; !ok {
+				ids = append(ids, id)
+			}
+			refs[id] = append(refs[id], mdSharedRef{bid, rev})
+		}
+	}
+
+	var problems []mdSharingProblem
+	for _, id := range ids {
+		idRefs := refs[id]
+		if len(idRefs) < 2 {
+			continue
+		}
+		reason := checkMDSharing(idRefs, divergence)
+		if reason != "" {
+			problems = append(problems, mdSharingProblem{
+				id:     id,
+				refs:   idRefs,
+				reason: reason,
+			})
+		}
+	}
+	return problems, nil
+}
+
+// checkMDSharing returns why the given references to an MD, as
+// collected by verifySharing, are illegitimate, or the empty string
+// if they're legitimate.
+func checkMDSharing(refs []mdSharedRef,
+	divergence map[BranchID]MetadataRevision) string {
+	// The master branch comes first.
+	if refs[0].bid != NullBranchID {
+		return "Shared only by unmerged branches"
+	}
+	masterRev := refs[0].revision
+	seen := make(map[BranchID]bool)
+	for _, ref := range refs {
+		if seen[ref.bid] {
+			return fmt.Sprintf("Referenced more than once "+
+				"by branch %s", ref.bid)
+		}
+		seen[ref.bid] = true
+		if ref.bid == NullBranchID {
+			continue
+		}
+		if ref.revision != masterRev {
+			return fmt.Sprintf("At revision %d of branch %s, but "+
+				"at revision %d of the master branch",
+				ref.revision, ref.bid, masterRev)
+		}
+		if ref.revision > divergence[ref.bid] {
+			return fmt.Sprintf("At revision %d of branch %s, "+
+				"after its divergence point",
+				ref.revision, ref.bid)
+		}
+	}
+	return ""
+}
+
+// mdHeadDepth is the depth of the head of a branch, as returned by
+// headDepth.
+type mdHeadDepth struct {
+	// retained is the number of revisions of the branch, up to
+	// and including the head, still in its journal.
+	retained int64
+	// total is the number of revisions from the first revision of
+	// the TLF up to and including the head, counting the merged
+	// ancestors of an unmerged branch. Since revisions are
+	// numbered consecutively, it's known even when history has
+	// been pruned.
+	total int64
+	// sinceDivergence is, for an unmerged branch, the number of
+	// revisions after its divergence point, or -1 if the
+	// divergence point can't be found. It's 0 for the master
+	// branch.
+	sinceDivergence int64
+	// pruned is whether some ancestors of the head are no longer
+	// stored, so that total counts more revisions than can be
+	// fetched.
+	pruned bool
+}
+
+// headDepth returns the depth of the head of the given branch,
+// computed from the journal pointers alone, without reading the
+// branch's history. An empty branch has a zero depth.
+func (s *mdServerTlfStorage) headDepth(bid BranchID) (mdHeadDepth, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdHeadDepth{}, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		if bid == NullBranchID {
+			return mdHeadDepth{}, nil
+		}
+		return mdHeadDepth{}, fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	earliestRevision, err := j.readEarliestRevision()
+	if err != nil {
+		return mdHeadDepth{}, MDServerError{err}
+	}
+	latestRevision, err := j.readLatestRevision()
+	if err != nil {
+		return mdHeadDepth{}, MDServerError{err}
+	}
+	if earliestRevision == MetadataRevisionUninitialized ||
+		latestRevision == MetadataRevisionUninitialized {
+		return mdHeadDepth{}, nil
+	}
+
+	depth := mdHeadDepth{
+		retained: int64(latestRevision-earliestRevision) + 1,
+		total:    int64(latestRevision-MetadataRevisionInitial) + 1,
+	}
+
+	if bid == NullBranchID {
+		depth.pruned = earliestRevision > MetadataRevisionInitial
+		return depth, nil
+	}
+
+	divergenceRevision, _, err := s.divergencePointReadLocked(bid)
+	if err != nil {
+		// E.g., the merged history it diverged from has been
+		// pruned.
+		depth.sinceDivergence = -1
+		depth.pruned = true
+		return depth, nil
+	}
+	depth.sinceDivergence = int64(latestRevision - divergenceRevision)
+
+	mergedEarliest, err :=
+		s.branchJournals[NullBranchID].readEarliestRevision()
+	if err != nil {
+		return mdHeadDepth{}, MDServerError{err}
+	}
+	depth.pruned = mergedEarliest > MetadataRevisionInitial
+	return depth, nil
+}
+
+// exportGraph writes the revision graph of all live branches to w, in
+// a line-based format meant for conversion into the input of graph
+// visualizers:
+//
+//	branch <bid>
+//	node <MdID> <revision>
+//	edge <MdID> <predecessor MdID>
+//	branchpoint <bid> <revision> <MdID>
+//
+// Each branch is written as a branch line followed by a node line for
+// each of its revisions, in order, each followed by an edge line to
+// its predecessor, if it has one. The predecessor of the earliest
+// revision of a branch may have been pruned. Unmerged branches come
+// after the master branch, and each is followed by a branchpoint line
+// naming the merged MD it diverged from, unless that can't be found.
+//
+// The server doesn't record which branches were merged back into the
+// master branch, so there are no merge edges.
+func (s *mdServerTlfStorage) exportGraph(w io.Writer) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	var bids []BranchID
+	for bid := range s.branchJournals {
+		if bid != NullBranchID {
+			bids = append(bids, bid)
+		}
+	}
+	sort.Sort(branchIDList(bids))
+	if _, ok := s.branchJournals[NullBranchID]; ok {
+		bids = append([]BranchID{NullBranchID}, bids...)
+	}
+
+	for _, bid := range bids {
+		_, mdIDs, err := s.branchJournals[bid].getRange(
+			MetadataRevisionInitial, math.MaxInt64)
+		if err != nil {
+			return MDServerError{err}
+		}
+		if len(mdIDs) == 0 {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "branch %s\n", bid); err != nil {
+			return err
+		}
+		for _, mdID := range mdIDs {
+			rmds, err := s.getMDReadLocked(mdID)
+			if err != nil {
+				return MDServerError{err}
+			}
+			_, err = fmt.Fprintf(w, "node %s %s\n", mdID, rmds.MD.Revision)
+			if err != nil {
+				return err
+			}
+			if rmds.MD.PrevRoot == (MdID{}) {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "edge %s %s\n", mdID, rmds.MD.PrevRoot)
+			if err != nil {
+				return err
+			}
+		}
+
+		if bid == NullBranchID {
+			continue
+		}
+		rev, mdID, err := s.divergencePointReadLocked(bid)
+		if err != nil {
+			// E.g., the merged history it diverged from
+			// has been pruned.
+			continue
+		}
+		_, err = fmt.Fprintf(w, "branchpoint %s %s %s\n", bid, rev, mdID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mdTimestampSkewTolerance is how far the server timestamp of an MD
+// may go back relative to that of its predecessor, or ahead of the
+// current time, before timestampAnomalyReport flags it.
+const mdTimestampSkewTolerance = time.Minute
+
+// mdTimestampAnomaly describes a revision whose server timestamp is
+// implausible.
+type mdTimestampAnomaly struct {
+	revision  MetadataRevision
+	timestamp time.Time
+	// prevTimestamp is the timestamp of the previous revision,
+	// if backwards is true.
+	prevTimestamp time.Time
+	// backwards is whether timestamp is before prevTimestamp,
+	// and future whether it is after the current time, in each
+	// case by more than mdTimestampSkewTolerance.
+	backwards bool
+	future    bool
+}
+
+// timestampAnomalyReport walks the given branch and returns the
+// revisions whose server timestamps go back in time relative to
+// their predecessors, or are in the future. Since the server writes
+// the timestamps, either suggests a restore from backup, a clock
+// problem, or tampering.
+func (s *mdServerTlfStorage) timestampAnomalyReport(bid BranchID) (
+	[]mdTimestampAnomaly, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	_, mdIDs, err := j.getRange(MetadataRevisionInitial, math.MaxInt64)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	now := s.clock.Now()
+	var anomalies []mdTimestampAnomaly
+	var prevTimestamp time.Time
+	for i, mdID := range mdIDs {
+		rmds, err := s.getMDReadLocked(mdID)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		timestamp := rmds.untrustedServerTimestamp
+
+		anomaly := mdTimestampAnomaly{
+			revision:  rmds.MD.Revision,
+			timestamp: timestamp,
+		}
+		if i > 0 &&
+			prevTimestamp.Sub(timestamp) > mdTimestampSkewTolerance {
+			anomaly.prevTimestamp = prevTimestamp
+			anomaly.backwards = true
+		}
+		if timestamp.Sub(now) > mdTimestampSkewTolerance {
+			anomaly.future = true
+		}
+		if anomaly.backwards || anomaly.future {
+			anomalies = append(anomalies, anomaly)
+		}
+		prevTimestamp = timestamp
+	}
+	return anomalies, nil
+}
+
+// mdHistoricalWriterViolation describes a revision whose last
+// modifying user wasn't allowed to write it by the membership of its
+// predecessor.
+type mdHistoricalWriterViolation struct {
+	revision MetadataRevision
+	mdID     MdID
+	writer   keybase1.UID
+}
+
+// verifyHistoricalWriters walks the history of the given branch and
+// returns the revisions whose LastModifyingUser was neither a writer
+// nor a reader making a valid rekey, according to the TLF handle of
+// the revision's predecessor, rather than the current merged head as
+// put does. This catches revisions by writers that have since been
+// removed, or that never were writers.
+//
+// The predecessor of the earliest revision of an unmerged branch is
+// its divergence point in the merged journal. An earliest revision
+// whose predecessor isn't stored, e.g. because it was pruned, can't
+// be checked, and is skipped. Signatures aren't checked.
+func (s *mdServerTlfStorage) verifyHistoricalWriters(bid BranchID) (
+	[]mdHistoricalWriterViolation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	earliestRevision, mdIDs, err := j.getRange(
+		MetadataRevisionInitial, math.MaxInt64)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if len(mdIDs) == 0 {
+		return nil, nil
+	}
+
+	// Find the predecessor of the earliest revision, which for
+	// the merged branch has been pruned.
+	var prev *RootMetadataSigned
+	if bid != NullBranchID && earliestRevision > MetadataRevisionInitial {
+		if mj, ok := s.branchJournals[NullBranchID]; ok {
+			_, mergedIDs, err := mj.getRange(
+				earliestRevision-1, earliestRevision-1)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			if len(mergedIDs) == 1 {
+				prev, err = s.getMDReadLocked(mergedIDs[0])
+				if err != nil {
+					return nil, MDServerError{err}
+				}
+			}
+		}
+	}
+
+	var violations []mdHistoricalWriterViolation
+	for i, mdID := range mdIDs {
+		rmds, err := s.getMDReadLocked(mdID)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+
+		if i == 0 && prev != nil {
+			prevID, err := s.idFunc(&prev.MD)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			if prevID != rmds.MD.PrevRoot {
+				// Not actually its predecessor.
+				prev = nil
+			}
+		}
+
+		if prev != nil {
+			writer := rmds.MD.LastModifyingUser
+			ok, err := isWriterOrValidRekey(s.codec, writer, prev, rmds)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			if !ok {
+				violations = append(violations,
+					mdHistoricalWriterViolation{
+						revision: rmds.MD.Revision,
+						mdID:     mdID,
+						writer:   writer,
+					})
+			}
+		}
+		prev = rmds
+	}
+	return violations, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "os"
+
+// mdEpochFence is how an open mdServerTlfStorage checks, before
+// writing, that no other instance has opened its dir since it did,
+// and keeps any from doing so until the write is done.
+type mdEpochFence struct {
+	// lock is the EPOCH_LOCK file. A shared lock is held on it
+	// while holds is positive, and opens take an exclusive lock
+	// on it to advance the epoch.
+	lock *os.File
+	// epoch is the EPOCH file written by this instance's open,
+	// which stays the EPOCH file until another open replaces it.
+	// It's kept open so that its inode can't be reused, and
+	// epochInfo is its FileInfo.
+	epoch     *os.File
+	epochInfo os.FileInfo
+	holds     int
+}
+
+// makeMDEpochFence returns a fence for the instance that wrote the
+// given EPOCH file, which it takes ownership of, using the
+// EPOCH_LOCK file at lockPath.
+func makeMDEpochFence(lockPath string, epoch *os.File) (
+	*mdEpochFence, error) {
+	epochInfo, err := epoch.Stat()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &mdEpochFence{
+		lock:      lock,
+		epoch:     epoch,
+		epochInfo: epochInfo,
+	}, nil
+}
+
+// hold returns errMDServerTlfStorageFenced if the EPOCH file at
+// epochPath is no longer the one written by this instance's open.
+// Otherwise, it keeps the epoch from being advanced until the
+// returned function is called. Holds may be nested, but the caller
+// must serialize them, e.g. by holding the storage's lock.
+func (f *mdEpochFence) hold(epochPath string) (release func(), err error) {
+	if f.holds == 0 {
+		err := lockOpenFileShared(f.lock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.holds++
+	release = func() {
+		f.holds--
+		if f.holds == 0 {
+			// Closing the file releases the lock anyway.
+			_ = unlockOpenFile(f.lock)
+		}
+	}
+
+	epochInfo, err := os.Stat(epochPath)
+	if err == nil && !os.SameFile(epochInfo, f.epochInfo) {
+		err = errMDServerTlfStorageFenced
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// close releases the files of the fence, along with any lock held.
+func (f *mdEpochFence) close() error {
+	err := f.lock.Close()
+	if epochErr := f.epoch.Close(); err == nil {
+		err = epochErr
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on the file at path, creating it if
+// needed, and returns the function that releases the lock. The lock
+// is exclusive or shared as requested. If wait is false and the lock
+// is held elsewhere in a conflicting mode, lockFile returns
+// errMDServerTlfStorageFileLocked instead of waiting for it.
+func lockFile(path string, exclusive, wait bool) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	err = syscall.Flock(int(f.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		_ = f.Close()
+		return nil, errMDServerTlfStorageFileLocked
+	} else if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return f.Close, nil
+}
+
+// lockOpenFileShared takes a shared advisory lock on the open file
+// f, waiting for it if needed.
+func lockOpenFileShared(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+}
+
+// unlockOpenFile releases the advisory lock held on the open file f.
+func unlockOpenFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
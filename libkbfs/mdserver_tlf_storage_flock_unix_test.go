@@ -0,0 +1,176 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestMDMaintenanceRunnerSkipsOpenTLFs(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage_root")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(root)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	ctx := context.Background()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	var tlfIDs []TlfID
+	var storages []*mdServerTlfStorage
+	for i := byte(1); i <= 2; i++ {
+		id := FakeTlfID(i, false)
+		tlfIDs = append(tlfIDs, id)
+		s := makeMDServerTlfStorage(
+			codec, crypto, filepath.Join(root, id.String()))
+		err := s.open(ctx)
+		require.NoError(t, err)
+		putMDRangeForTest(
+			t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+		storages = append(storages, s)
+	}
+	// Only the first TLF stays open.
+	err = storages[1].close()
+	require.NoError(t, err)
+
+	var ran []TlfID
+	runner := mdMaintenanceRunner{
+		codec:  codec,
+		crypto: crypto,
+		root:   root,
+	}
+	report, err := runner.run(ctx, func(ctx context.Context,
+		tlfID TlfID, s *mdServerTlfStorage) error {
+		ran = append(ran, tlfID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []TlfID{tlfIDs[1]}, ran)
+	require.Equal(t, []mdMaintenanceResult{
+		{tlfIDs[0], errMDServerTlfStorageFileLocked},
+	}, report.failed())
+
+	// The open instance wasn't fenced off.
+	head, err := storages[0].getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	headID, err := head.MD.MetadataID(crypto)
+	require.NoError(t, err)
+	putMDRangeForTest(t, storages[0], uid, deviceKID, tlfIDs[0], h,
+		NullBranchID, 2, 2, headID)
+
+	// Once it's closed, the TLF is no longer skipped.
+	err = storages[0].close()
+	require.NoError(t, err)
+	ran = nil
+	report, err = runner.run(ctx, func(ctx context.Context,
+		tlfID TlfID, s *mdServerTlfStorage) error {
+		ran = append(ran, tlfID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, tlfIDs, ran)
+	require.Len(t, report.failed(), 0)
+}
+
+func TestMDServerTlfStorageOpenDuringExclusiveOpen(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	ctx := context.Background()
+
+	exclusive := makeMDServerTlfStorage(codec, crypto, tempdir)
+	exclusive.exclusive = true
+	err = exclusive.open(ctx)
+	require.NoError(t, err)
+
+	// A normal open doesn't wait for the exclusive instance, but
+	// fails with a retriable error.
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.Equal(t, MDServerErrorThrottle{errMDServerTlfStorageFileLocked},
+		err)
+
+	err = exclusive.close()
+	require.NoError(t, err)
+
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	err = s.close()
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageFenceHeldDuringWrite(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	ctx := context.Background()
+
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	// While a write holds the fence, a newer open can't advance
+	// the epoch, so the write can't be raced.
+	s.lock.Lock()
+	unfence, err := s.fenceLocked()
+	require.NoError(t, err)
+	s2 := makeMDServerTlfStorage(codec, crypto, tempdir)
+	openErr := make(chan error, 1)
+	go func() {
+		openErr <- s2.open(ctx)
+	}()
+	select {
+	case err := <-openErr:
+		t.Fatalf("Open finished while the fence was held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unfence()
+	s.lock.Unlock()
+	require.NoError(t, <-openErr)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+
+	// Afterwards, the first instance is fenced off.
+	s.lock.Lock()
+	_, err = s.fenceLocked()
+	s.lock.Unlock()
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+}
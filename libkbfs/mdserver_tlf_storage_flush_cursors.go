@@ -0,0 +1,281 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// mdFlushCursor is the progress of a single downstream destination
+// through a branch, as reported by flushStatus.
+type mdFlushCursor struct {
+	destination string
+	// lastFlushed is the last revision the destination has
+	// confirmed having, or the revision before the earliest one
+	// in the journal when it was added.
+	lastFlushed MetadataRevision
+	// pending is the number of revisions in the journal after
+	// lastFlushed.
+	pending int64
+}
+
+func (s *mdServerTlfStorage) readFlushCursorsReadLocked(bid BranchID) (
+	map[string]MetadataRevision, error) {
+	buf, err := ioutil.ReadFile(s.flushCursorsPath(bid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cursors map[string]MetadataRevision
+	err = s.codec.Decode(buf, &cursors)
+	if err != nil {
+		return nil, err
+	}
+	return cursors, nil
+}
+
+// writeFlushCursorsLocked replaces the FLUSH_CURSORS file of the
+// given branch atomically, or removes it if there are no cursors, so
+// that an interrupted write can't lose the cursors and let prune go
+// past what has been flushed.
+func (s *mdServerTlfStorage) writeFlushCursorsLocked(
+	bid BranchID, cursors map[string]MetadataRevision) error {
+	if len(cursors) == 0 {
+		err := os.Remove(s.flushCursorsPath(bid))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	buf, err := s.codec.Encode(cursors)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.flushCursorsPath(bid), buf, 0600)
+}
+
+// flushCursorLimitReadLocked returns the revision up to which,
+// exclusive, the flush cursors of the given branch allow it to be
+// pruned, i.e. one past the lowest cursor, and whether it has any
+// cursors at all.
+func (s *mdServerTlfStorage) flushCursorLimitReadLocked(bid BranchID) (
+	MetadataRevision, bool, error) {
+	cursors, err := s.readFlushCursorsReadLocked(bid)
+	if err != nil {
+		return MetadataRevisionUninitialized, false, err
+	}
+	if len(cursors) == 0 {
+		return MetadataRevisionUninitialized, false, nil
+	}
+	first := true
+	var lowest MetadataRevision
+	for _, r := range cursors {
+		if first || r < lowest {
+			lowest = r
+			first = false
+		}
+	}
+	return lowest + 1, true, nil
+}
+
+var errMDFlushDestinationEmpty = errors.New(
+	"Flush destination names can't be empty")
+
+// addFlushDestination starts tracking the progress of the given
+// downstream destination through the given branch, from before its
+// earliest revision, so that prune keeps every revision from then on
+// until the destination has flushed past it. Adding a destination
+// that is already tracked is a no-op.
+func (s *mdServerTlfStorage) addFlushDestination(
+	bid BranchID, destination string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if destination == "" {
+		return errMDFlushDestinationEmpty
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	cursors, err := s.readFlushCursorsReadLocked(bid)
+	if err != nil {
+		return err
+	}
+	if _, ok := cursors[destination]; ok {
+		return nil
+	}
+
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return err
+	}
+	lastFlushed := MetadataRevisionUninitialized
+	if earliest != MetadataRevisionUninitialized {
+		lastFlushed = earliest - 1
+	}
+	if cursors == nil {
+		cursors = make(map[string]MetadataRevision)
+	}
+	cursors[destination] = lastFlushed
+	return s.writeFlushCursorsLocked(bid, cursors)
+}
+
+// removeFlushDestination stops tracking the given destination for
+// the given branch, so that it no longer holds back prune. Removing a
+// destination that isn't tracked is a no-op.
+func (s *mdServerTlfStorage) removeFlushDestination(
+	bid BranchID, destination string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if _, ok := s.branchJournals[bid]; !ok {
+		return nil
+	}
+
+	cursors, err := s.readFlushCursorsReadLocked(bid)
+	if err != nil {
+		return err
+	}
+	if _, ok := cursors[destination]; !ok {
+		return nil
+	}
+	delete(cursors, destination)
+	return s.writeFlushCursorsLocked(bid, cursors)
+}
+
+// advanceFlushCursor records that the given destination has flushed
+// the given branch up to and including the given revision. Cursors
+// only move forward, and not past the latest revision; each
+// destination advances its own, at its own pace.
+func (s *mdServerTlfStorage) advanceFlushCursor(
+	bid BranchID, destination string, rev MetadataRevision) error {
+	s.lock.lockAs(mdLockCategoryFlush)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+
+	cursors, err := s.readFlushCursorsReadLocked(bid)
+	if err != nil {
+		return err
+	}
+	lastFlushed, ok := cursors[destination]
+	if !ok {
+		return fmt.Errorf("Unknown flush destination %q for branch %s",
+			destination, bid)
+	}
+	if rev < lastFlushed {
+		return fmt.Errorf("Flush destination %q is already at "+
+			"revision %s of branch %s, past %s",
+			destination, lastFlushed, bid, rev)
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return err
+	}
+	if rev > latest {
+		return fmt.Errorf("Revision %s is past the latest revision %s "+
+			"of branch %s", rev, latest, bid)
+	}
+	if rev == lastFlushed {
+		return nil
+	}
+
+	cursors[destination] = rev
+	return s.writeFlushCursorsLocked(bid, cursors)
+}
+
+// mdFlushCursorList can be used to sort mdFlushCursors by
+// destination.
+type mdFlushCursorList []mdFlushCursor
+
+func (l mdFlushCursorList) Len() int {
+	return len(l)
+}
+
+func (l mdFlushCursorList) Less(i, j int) bool {
+	return l[i].destination < l[j].destination
+}
+
+func (l mdFlushCursorList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// flushStatus returns the cursors of the destinations tracked for the
+// given branch, ordered by destination.
+func (s *mdServerTlfStorage) flushStatus(bid BranchID) (
+	[]mdFlushCursor, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	cursors, err := s.readFlushCursorsReadLocked(bid)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(mdFlushCursorList, 0, len(cursors))
+	for destination, lastFlushed := range cursors {
+		status = append(status, mdFlushCursor{
+			destination: destination,
+			lastFlushed: lastFlushed,
+			pending:     int64(latest - lastFlushed),
+		})
+	}
+	sort.Sort(status)
+	return status, nil
+}
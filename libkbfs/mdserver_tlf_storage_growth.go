@@ -0,0 +1,138 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+)
+
+// defaultMDGrowthWindow is the default value of
+// mdServerTlfStorage.growthWindow.
+const defaultMDGrowthWindow = 24 * time.Hour
+
+// mdGrowthSamples is the number of samples an mdGrowthTracker keeps,
+// which bounds its memory use regardless of the rate of puts.
+const mdGrowthSamples = 64
+
+// mdGrowthSample is the number of MD objects, and their total stored
+// size, put up to some time.
+type mdGrowthSample struct {
+	time    time.Time
+	objects int64
+	bytes   int64
+}
+
+// mdGrowthTracker keeps a ring buffer of samples of the cumulative
+// number and size of the MD objects put, at most one per interval,
+// from which the growth rate over the last window can be computed.
+type mdGrowthTracker struct {
+	window   time.Duration
+	interval time.Duration
+	samples  [mdGrowthSamples]mdGrowthSample
+	// first is the index of the oldest sample, and count the
+	// number of samples.
+	first, count int
+}
+
+// makeMDGrowthTracker returns a tracker for the given window, with
+// nothing put as of now. A non-positive window means
+// defaultMDGrowthWindow.
+func makeMDGrowthTracker(
+	now time.Time, window time.Duration) *mdGrowthTracker {
+	if window <= 0 {
+		window = defaultMDGrowthWindow
+	}
+	// Leave room for one sample at or before the start of the
+	// window, plus the one being updated.
+	t := &mdGrowthTracker{
+		window:   window,
+		interval: window / (mdGrowthSamples - 2),
+	}
+	t.samples[0] = mdGrowthSample{time: now}
+	t.count = 1
+	return t
+}
+
+func (t *mdGrowthTracker) newest() *mdGrowthSample {
+	return &t.samples[(t.first+t.count-1)%mdGrowthSamples]
+}
+
+// record adds a put of the given number of objects and bytes at the
+// given time. Puts in the same interval update the same sample.
+func (t *mdGrowthTracker) record(now time.Time, objects, bytes int64) {
+	last := t.newest()
+	sample := mdGrowthSample{
+		time:    now,
+		objects: last.objects + objects,
+		bytes:   last.bytes + bytes,
+	}
+	if t.count > 1 && now.Truncate(t.interval).Equal(
+		last.time.Truncate(t.interval)) {
+		*last = sample
+		return
+	}
+	if t.count == mdGrowthSamples {
+		t.first = (t.first + 1) % mdGrowthSamples
+		t.count--
+	}
+	t.count++
+	*t.newest() = sample
+}
+
+// mdGrowthRate is the rate at which MD objects were put to a TLF
+// over a recent window.
+type mdGrowthRate struct {
+	objectsPerDay float64
+	bytesPerDay   float64
+	// since is the start of the time the rate was computed over,
+	// which is later than the start of the window if the storage
+	// was opened since then.
+	since time.Time
+}
+
+// rate returns the growth rate over the window ending now. It is
+// computed from the latest sample taken at or before the start of
+// the window, or else the oldest one, so it may cover up to one
+// interval more than the window.
+func (t *mdGrowthTracker) rate(now time.Time) mdGrowthRate {
+	start := now.Add(-t.window)
+	base := t.samples[t.first]
+	for i := 1; i < t.count; i++ {
+		s := t.samples[(t.first+i)%mdGrowthSamples]
+		if s.time.After(start) {
+			break
+		}
+		base = s
+	}
+
+	elapsed := now.Sub(base.time)
+	if elapsed <= 0 {
+		return mdGrowthRate{since: base.time}
+	}
+	last := t.newest()
+	days := elapsed.Hours() / 24
+	return mdGrowthRate{
+		objectsPerDay: float64(last.objects-base.objects) / days,
+		bytesPerDay:   float64(last.bytes-base.bytes) / days,
+		since:         base.time,
+	}
+}
+
+// growthRate returns the rate at which MD objects have been put to
+// the TLF, across all branches, over the last s.growthWindow, in
+// objects and stored bytes per day. Only puts since open count, and
+// MD objects that are removed again, e.g. by prune, still count, so
+// that a client in a write loop shows up even if the TLF is pruned
+// as it goes.
+func (s *mdServerTlfStorage) growthRate() (mdGrowthRate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdGrowthRate{}, err
+	}
+
+	return s.growth.rate(s.clock.Now()), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+)
+
+// mdStoredHeader is the stored header of an MD object, i.e. the
+// RootMetadataSigned without its serialized private metadata, which
+// is the bulk of a big MD. It lets the revision, keys, and other
+// unencrypted fields of an MD be read without reading or decoding
+// the whole object. Fields are exported only for serialization.
+type mdStoredHeader struct {
+	// ID is the ID of the whole MD object.
+	ID MdID
+	// BodySize is the length of the serialized private metadata
+	// left out of Header.
+	BodySize int
+	// Header is the encoded RootMetadataSigned with its
+	// SerializedPrivateMetadata cleared.
+	Header []byte
+	// Checksum is the hash of ID and Header together. The MD ID
+	// can't be checked without the body, so this is what lets
+	// the header be checked on its own.
+	Checksum Hash
+}
+
+// mdHeaderChecksumData returns the data over which the checksum of
+// the header of the MD with the given ID is computed.
+func mdHeaderChecksumData(id MdID, header []byte) []byte {
+	return append(append([]byte(nil), id.Bytes()...), header...)
+}
+
+// makeMDStoredHeader returns the stored header of the MD with the
+// given ID and encoding.
+func makeMDStoredHeader(codec Codec, id MdID, buf []byte) (
+	mdStoredHeader, error) {
+	var rmds RootMetadataSigned
+	err := codec.Decode(buf, &rmds)
+	if err != nil {
+		return mdStoredHeader{}, err
+	}
+	bodySize := len(rmds.MD.SerializedPrivateMetadata)
+	rmds.MD.SerializedPrivateMetadata = nil
+	header, err := codec.Encode(&rmds)
+	if err != nil {
+		return mdStoredHeader{}, err
+	}
+	checksum, err := DefaultHash(mdHeaderChecksumData(id, header))
+	if err != nil {
+		return mdStoredHeader{}, err
+	}
+	return mdStoredHeader{
+		ID:       id,
+		BodySize: bodySize,
+		Header:   header,
+		Checksum: checksum,
+	}, nil
+}
+
+// verify returns an error if h isn't the intact header of the MD
+// with the given ID.
+func (h mdStoredHeader) verify(id MdID) error {
+	if h.ID != id {
+		return fmt.Errorf(
+			"Header ID mismatch: expected %s, got %s", id, h.ID)
+	}
+	err := h.Checksum.Verify(mdHeaderChecksumData(id, h.Header))
+	if err != nil {
+		return fmt.Errorf("Corrupt header for MD %s: %v", id, err)
+	}
+	return nil
+}
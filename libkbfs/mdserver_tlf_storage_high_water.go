@@ -0,0 +1,216 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// mdHighWaterMark is the stored form of the highest revision a
+// branch has ever had on disk. Fields are exported only for
+// serialization.
+type mdHighWaterMark struct {
+	Revision MetadataRevision
+	// MAC is the HMAC of the branch ID and Revision, so that the
+	// mark can't be lowered, or copied from another branch,
+	// without the key.
+	MAC HMAC
+}
+
+// mdHighWaterMACData returns the data over which the MAC of the
+// high-water mark of the given branch is computed.
+func mdHighWaterMACData(bid BranchID, revision MetadataRevision) []byte {
+	buf := []byte(bid.String())
+	var revBuf [8]byte
+	binary.BigEndian.PutUint64(revBuf[:], uint64(revision))
+	return append(buf, revBuf[:]...)
+}
+
+// mdServerTlfStorageRollbackError is returned when the latest
+// revision of a branch is below its high-water mark, which means the
+// branch journal has been rolled back, e.g. to hide recent
+// revisions, since it was last written.
+type mdServerTlfStorageRollbackError struct {
+	bid       BranchID
+	latest    MetadataRevision
+	highWater MetadataRevision
+}
+
+func (e mdServerTlfStorageRollbackError) Error() string {
+	return fmt.Sprintf("Branch %s is at revision %d, below its "+
+		"high-water mark %d; it may have been rolled back",
+		e.bid, e.latest, e.highWater)
+}
+
+// writeHighWaterMarkLocked sets the high-water mark of the given
+// branch to the given revision.
+func (s *mdServerTlfStorage) writeHighWaterMarkLocked(
+	bid BranchID, revision MetadataRevision) error {
+	mac, err := DefaultHMAC(
+		s.highWaterKey, mdHighWaterMACData(bid, revision))
+	if err != nil {
+		return err
+	}
+	buf, err := s.codec.Encode(mdHighWaterMark{
+		Revision: revision,
+		MAC:      mac,
+	})
+	if err != nil {
+		return err
+	}
+	path := s.highWaterMarkPath(bid)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, buf, 0600)
+	if err != nil {
+		return err
+	}
+	s.highWaterMarks[bid] = revision
+	return nil
+}
+
+// raiseHighWaterMarkLocked raises the high-water mark of the given
+// branch to its latest revision, if that's higher, and if
+// highWaterKey is set.
+func (s *mdServerTlfStorage) raiseHighWaterMarkLocked(
+	bid BranchID, j mdServerBranchJournal) error {
+	if len(s.highWaterKey) == 0 {
+		return nil
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return err
+	}
+	if mark, ok := s.highWaterMarks[bid]; ok && latest <= mark {
+		return nil
+	}
+	if latest == MetadataRevisionUninitialized {
+		return nil
+	}
+	return s.writeHighWaterMarkLocked(bid, latest)
+}
+
+// loadHighWaterMarksLocked reads and verifies the stored high-water
+// marks into s.highWaterMarks. Branches without one, e.g. those
+// written before highWaterKey was set, get one at their latest
+// revision, which is trusted as is.
+func (s *mdServerTlfStorage) loadHighWaterMarksLocked() error {
+	s.highWaterMarks = make(map[BranchID]MetadataRevision)
+	dir := filepath.Join(s.dir, mdServerHighWaterMarksDirName)
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		bid := ParseBranchID(name)
+		if bid == NullBranchID && name != NullBranchID.String() {
+			return fmt.Errorf("Unexpected file %s in %s", name, dir)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		var mark mdHighWaterMark
+		err = s.codec.Decode(buf, &mark)
+		if err != nil {
+			return fmt.Errorf(
+				"High-water mark of branch %s: %v", bid, err)
+		}
+		err = mark.MAC.Verify(
+			s.highWaterKey, mdHighWaterMACData(bid, mark.Revision))
+		if err != nil {
+			return fmt.Errorf("High-water mark of branch %s "+
+				"doesn't verify: %v", bid, err)
+		}
+		s.highWaterMarks[bid] = mark.Revision
+	}
+
+	for bid, j := range s.branchJournals {
+		if _, ok := s.highWaterMarks[bid]; ok {
+			continue
+		}
+		err := s.raiseHighWaterMarkLocked(bid, j)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRollbackReadLocked returns an mdServerTlfStorageRollbackError
+// if the latest revision of the given branch is below its high-water
+// mark.
+func (s *mdServerTlfStorage) checkRollbackReadLocked(
+	bid BranchID, j mdServerBranchJournal) error {
+	mark, ok := s.highWaterMarks[bid]
+	if !ok {
+		return nil
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return err
+	}
+	if latest < mark {
+		return mdServerTlfStorageRollbackError{
+			bid:       bid,
+			latest:    latest,
+			highWater: mark,
+		}
+	}
+	return nil
+}
+
+// acceptRollback lowers the high-water mark of the given branch to
+// its latest revision, so that its head is served again after a
+// rollback, e.g. a deliberate restore, has been detected. It is for
+// operators, who should first make sure the rollback was intended.
+func (s *mdServerTlfStorage) acceptRollback(bid BranchID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	if len(s.highWaterKey) == 0 {
+		return MDServerErrorBadRequest{
+			Reason: "High-water marks are not enabled"}
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return fmt.Errorf("Unknown branch %s", bid)
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return MDServerError{err}
+	}
+	if latest == MetadataRevisionUninitialized {
+		delete(s.highWaterMarks, bid)
+		err := os.Remove(s.highWaterMarkPath(bid))
+		if err != nil && !os.IsNotExist(err) {
+			return MDServerError{err}
+		}
+		return nil
+	}
+	err = s.writeHighWaterMarkLocked(bid, latest)
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// mdKeyBundleRefMagic starts every MD object stored with its key
+// bundles moved out. Like mdDeltaMagic, it can't be mistaken for the
+// start of an MD stored in full, and it differs from mdDeltaMagic in
+// its first eight bytes.
+var mdKeyBundleRefMagic = []byte("MDKEYREF")
+
+// mdKeyBundleRef is an encoded MD whose writer and reader key
+// generations have been stored separately, under the IDs given
+// here. Empty IDs mean the MD has no key generations of that kind.
+// Fields are exported only for serialization.
+type mdKeyBundleRef struct {
+	WKeysID string
+	RKeysID string
+	// MD is the encoded RootMetadataSigned with its WKeys and
+	// RKeys cleared.
+	MD []byte
+}
+
+func isMDKeyBundleRef(data []byte) bool {
+	return bytes.HasPrefix(data, mdKeyBundleRefMagic)
+}
+
+// makeKeyBundleID returns the content-based ID under which the given
+// encoded key generations are stored.
+func makeKeyBundleID(buf []byte) (string, error) {
+	h, err := DefaultHash(buf)
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+// encodeMDKeyBundleRef returns the stored form of the given ref.
+func encodeMDKeyBundleRef(codec Codec, ref mdKeyBundleRef) ([]byte, error) {
+	buf, err := codec.Encode(ref)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), mdKeyBundleRefMagic...), buf...), nil
+}
+
+// decodeMDKeyBundleRef is the inverse of encodeMDKeyBundleRef.
+func decodeMDKeyBundleRef(codec Codec, data []byte) (mdKeyBundleRef, error) {
+	if !isMDKeyBundleRef(data) {
+		return mdKeyBundleRef{}, fmt.Errorf(
+			"Data is not an MD key bundle ref")
+	}
+	var ref mdKeyBundleRef
+	err := codec.Decode(data[len(mdKeyBundleRefMagic):], &ref)
+	if err != nil {
+		return mdKeyBundleRef{}, err
+	}
+	return ref, nil
+}
+
+// extractKeyBundlesLocked stores the key generations of the MD
+// encoded in buf under their content-based IDs, if not already
+// there, and returns an encoded mdKeyBundleRef to store in place of
+// buf.
+func (s *mdServerTlfStorage) extractKeyBundlesLocked(
+	ctx context.Context, buf []byte) ([]byte, error) {
+	_, span := startMDServerTlfStorageSpan(ctx, "extractKeyBundles")
+	defer span.Finish()
+
+	var rmds RootMetadataSigned
+	err := s.codec.Decode(buf, &rmds)
+	if err != nil {
+		return nil, err
+	}
+
+	var ref mdKeyBundleRef
+	storeBundle := func(bundle interface{}) (string, error) {
+		bundleBuf, err := s.codec.Encode(bundle)
+		if err != nil {
+			return "", err
+		}
+		id, err := makeKeyBundleID(bundleBuf)
+		if err != nil {
+			return "", err
+		}
+		path := s.keyBundlePath(id)
+		err = s.checkSymlinks(path)
+		if err != nil {
+			return "", err
+		}
+		release := s.acquireFile(ctx)
+		existing, err := s.readFile(path)
+		release()
+		if err == nil {
+			// Reuse the stored bundle only if it's intact;
+			// otherwise replace it below.
+			existingID, err := makeKeyBundleID(existing)
+			if err != nil {
+				return "", err
+			}
+			if existingID == id {
+				return id, nil
+			}
+			s.log.CWarningf(ctx,
+				"Replacing corrupt key bundle %s", id)
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return "", err
+		}
+		// Write the bundle to a temporary file and rename it
+		// into place, so that it's never seen partially
+		// written. The MD is written only after this returns,
+		// so a ref is never left without its bundle.
+		tmpPath := path + ".tmp"
+		release = s.acquireFile(ctx)
+		err = s.writeFile(tmpPath, bundleBuf, 0600)
+		release()
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return "", err
+		}
+		return id, nil
+	}
+	if len(rmds.MD.WKeys) > 0 {
+		ref.WKeysID, err = storeBundle(rmds.MD.WKeys)
+		if err != nil {
+			return nil, err
+		}
+		rmds.MD.WKeys = nil
+	}
+	if len(rmds.MD.RKeys) > 0 {
+		ref.RKeysID, err = storeBundle(rmds.MD.RKeys)
+		if err != nil {
+			return nil, err
+		}
+		rmds.MD.RKeys = nil
+	}
+
+	ref.MD, err = s.codec.Encode(&rmds)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMDKeyBundleRef(s.codec, ref)
+}
+
+// restoreKeyBundlesReadLocked returns the full encoding of the MD
+// stored as data, which may be an mdKeyBundleRef, or else is
+// returned as is.
+func (s *mdServerTlfStorage) restoreKeyBundlesReadLocked(
+	ctx context.Context, data []byte) ([]byte, error) {
+	if !isMDKeyBundleRef(data) {
+		return data, nil
+	}
+
+	_, span := startMDServerTlfStorageSpan(ctx, "restoreKeyBundles")
+	defer span.Finish()
+
+	err := s.checkDecodeLimits(data[len(mdKeyBundleRefMagic):])
+	if err != nil {
+		return nil, err
+	}
+	ref, err := decodeMDKeyBundleRef(s.codec, data)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkDecodeLimits(ref.MD)
+	if err != nil {
+		return nil, err
+	}
+	var rmds RootMetadataSigned
+	err = s.codec.Decode(ref.MD, &rmds)
+	if err != nil {
+		return nil, err
+	}
+
+	readBundle := func(id string, bundle interface{}) error {
+		path := s.keyBundlePath(id)
+		err := s.checkSymlinks(path)
+		if err != nil {
+			return err
+		}
+		release := s.acquireFile(ctx)
+		bundleBuf, err := s.readFile(path)
+		release()
+		if err != nil {
+			return fmt.Errorf("Couldn't read key bundle %s: %v", id, err)
+		}
+		err = s.checkDecodeLimits(bundleBuf)
+		if err != nil {
+			return err
+		}
+		return s.codec.Decode(bundleBuf, bundle)
+	}
+	if ref.WKeysID != "" {
+		err := readBundle(ref.WKeysID, &rmds.MD.WKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ref.RKeysID != "" {
+		err := readBundle(ref.RKeysID, &rmds.MD.RKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The result is checked against the MD's ID by
+	// getMDAndSizeReadLocked, like any other read.
+	return s.codec.Encode(&rmds)
+}
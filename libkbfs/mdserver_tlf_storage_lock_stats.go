@@ -0,0 +1,246 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// mdLockCategory is the kind of operation that takes the lock of an
+// mdServerTlfStorage, for its contention stats.
+type mdLockCategory int
+
+const (
+	mdLockCategoryOther mdLockCategory = iota
+	mdLockCategoryGet
+	mdLockCategoryPut
+	mdLockCategoryFlush
+	mdLockCategoryMaintenance
+	mdLockCategoryCount
+)
+
+func (c mdLockCategory) String() string {
+	switch c {
+	case mdLockCategoryOther:
+		return "Other"
+	case mdLockCategoryGet:
+		return "Get"
+	case mdLockCategoryPut:
+		return "Put"
+	case mdLockCategoryFlush:
+		return "Flush"
+	case mdLockCategoryMaintenance:
+		return "Maintenance"
+	default:
+		return fmt.Sprintf("mdLockCategory(%d)", int(c))
+	}
+}
+
+// mdLockMetrics are the metrics of one category and mode of lock
+// acquisitions. contended counts the acquisitions that found the lock
+// held, or waited for, in a conflicting mode, and so likely had to
+// wait.
+type mdLockMetrics struct {
+	contended metrics.Counter
+	wait      metrics.Timer
+	hold      metrics.Timer
+}
+
+// mdLockStats holds the mdLockMetrics of each category, for reads
+// and writes.
+type mdLockStats struct {
+	metrics [mdLockCategoryCount][2]mdLockMetrics
+}
+
+func lockModeName(write bool) string {
+	if write {
+		return "Write"
+	}
+	return "Read"
+}
+
+// makeMDLockStats registers the metrics of each category and mode in
+// the given registry, or finds them there, so that storages sharing a
+// registry share their stats.
+func makeMDLockStats(r metrics.Registry) *mdLockStats {
+	var stats mdLockStats
+	for c := mdLockCategory(0); c < mdLockCategoryCount; c++ {
+		for i, write := range []bool{false, true} {
+			prefix := fmt.Sprintf("MDServerTlfStorage.Lock.%s.%s.",
+				c, lockModeName(write))
+			stats.metrics[c][i] = mdLockMetrics{
+				contended: metrics.GetOrRegisterCounter(
+					prefix+"Contended", r),
+				wait: metrics.GetOrRegisterTimer(
+					prefix+"Wait", r),
+				hold: metrics.GetOrRegisterTimer(
+					prefix+"Hold", r),
+			}
+		}
+	}
+	return &stats
+}
+
+func (s *mdLockStats) get(c mdLockCategory, write bool) mdLockMetrics {
+	if write {
+		return s.metrics[c][1]
+	}
+	return s.metrics[c][0]
+}
+
+// mdServerTlfStorageLock is a sync.RWMutex that, if stats is set,
+// records how long each category of operation waits for it and holds
+// it. Lock and RLock count as mdLockCategoryOther, and since readers
+// can't be told apart on RUnlock, only readers that take the lock
+// with rLockAs have their hold times recorded.
+type mdServerTlfStorageLock struct {
+	mu sync.RWMutex
+	// stats is set on construction, by
+	// makeMDServerTlfStorageWithLockMetrics, and never changes.
+	stats *mdLockStats
+
+	// writers and readers are the numbers of holders of mu for
+	// writing and reading, plus those waiting for it, accessed
+	// atomically. They're only kept if stats is set, to tell
+	// whether an acquisition is contended.
+	writers int32
+	readers int32
+
+	// writeCategory and writeLockedAt describe the current
+	// holder of mu for writing, and are protected by it.
+	writeCategory mdLockCategory
+	writeLockedAt time.Time
+}
+
+// lockAs takes the lock for writing, for an operation of the given
+// category.
+func (l *mdServerTlfStorageLock) lockAs(c mdLockCategory) {
+	if l.stats == nil {
+		l.mu.Lock()
+		l.writeCategory = c
+		return
+	}
+	m := l.stats.get(c, true)
+	start := time.Now()
+	if atomic.AddInt32(&l.writers, 1) > 1 ||
+		atomic.LoadInt32(&l.readers) > 0 {
+		m.contended.Inc(1)
+	}
+	l.mu.Lock()
+	lockedAt := time.Now()
+	m.wait.Update(lockedAt.Sub(start))
+	l.writeCategory = c
+	l.writeLockedAt = lockedAt
+}
+
+// Lock takes the lock for writing, as mdLockCategoryOther.
+func (l *mdServerTlfStorageLock) Lock() {
+	l.lockAs(mdLockCategoryOther)
+}
+
+// Unlock releases the lock held for writing.
+func (l *mdServerTlfStorageLock) Unlock() {
+	if l.stats != nil {
+		l.stats.get(l.writeCategory, true).hold.UpdateSince(
+			l.writeLockedAt)
+		atomic.AddInt32(&l.writers, -1)
+	}
+	l.mu.Unlock()
+}
+
+// rLockAs takes the lock for reading, for an operation of the given
+// category, and returns the function that releases it.
+func (l *mdServerTlfStorageLock) rLockAs(c mdLockCategory) func() {
+	if l.stats == nil {
+		l.mu.RLock()
+		return l.mu.RUnlock
+	}
+	m := l.stats.get(c, false)
+	start := time.Now()
+	atomic.AddInt32(&l.readers, 1)
+	if atomic.LoadInt32(&l.writers) > 0 {
+		m.contended.Inc(1)
+	}
+	l.mu.RLock()
+	lockedAt := time.Now()
+	m.wait.Update(lockedAt.Sub(start))
+	return func() {
+		m.hold.UpdateSince(lockedAt)
+		l.RUnlock()
+	}
+}
+
+// RLock takes the lock for reading, as mdLockCategoryOther. Only the
+// wait is recorded.
+func (l *mdServerTlfStorageLock) RLock() {
+	_ = l.rLockAs(mdLockCategoryOther)
+}
+
+// RUnlock releases the lock held for reading by RLock.
+func (l *mdServerTlfStorageLock) RUnlock() {
+	if l.stats != nil {
+		atomic.AddInt32(&l.readers, -1)
+	}
+	l.mu.RUnlock()
+}
+
+// mdLockContention summarizes the acquisitions of the lock of an
+// mdServerTlfStorage by one category of operation, for reading or
+// for writing.
+type mdLockContention struct {
+	category mdLockCategory
+	write    bool
+	// acquisitions is the number of times the lock was taken,
+	// and contended the number of those that had to wait.
+	acquisitions int64
+	contended    int64
+	// meanWait and maxWait include the acquisitions that didn't
+	// have to wait.
+	meanWait time.Duration
+	maxWait  time.Duration
+	// holds is the number of recorded holds, which may be less
+	// than acquisitions for reads, or if the lock is still held.
+	holds    int64
+	meanHold time.Duration
+	maxHold  time.Duration
+}
+
+// contentionStats returns the contention of the lock for each
+// category of operation and mode in which it has been taken, ordered
+// by category, with reads first. It returns nil unless the storage
+// was made by makeMDServerTlfStorageWithLockMetrics. If its registry
+// is shared with other storages, so are the stats.
+func (s *mdServerTlfStorage) contentionStats() []mdLockContention {
+	if s.lock.stats == nil {
+		return nil
+	}
+	var stats []mdLockContention
+	for c := mdLockCategory(0); c < mdLockCategoryCount; c++ {
+		for _, write := range []bool{false, true} {
+			m := s.lock.stats.get(c, write)
+			wait, hold := m.wait.Snapshot(), m.hold.Snapshot()
+			if wait.Count() == 0 {
+				continue
+			}
+			stats = append(stats, mdLockContention{
+				category:     c,
+				write:        write,
+				acquisitions: wait.Count(),
+				contended:    m.contended.Count(),
+				meanWait:     time.Duration(wait.Mean()),
+				maxWait:      time.Duration(wait.Max()),
+				holds:        hold.Count(),
+				meanHold:     time.Duration(hold.Mean()),
+				maxHold:      time.Duration(hold.Max()),
+			})
+		}
+	}
+	return stats
+}
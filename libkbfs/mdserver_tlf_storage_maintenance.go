@@ -0,0 +1,183 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// mdMaintenanceOp is a maintenance operation, e.g. a prune or a
+// check, run by an mdMaintenanceRunner on the open storage of a
+// single TLF.
+type mdMaintenanceOp func(
+	ctx context.Context, tlfID TlfID, s *mdServerTlfStorage) error
+
+// mdMaintenanceRunner runs a maintenance operation over the
+// mdServerTlfStorages of many TLFs under a common root directory,
+// each in the subdirectory named after its TLF ID, a bounded number
+// at a time.
+type mdMaintenanceRunner struct {
+	codec  Codec
+	crypto cryptoPure
+	root   string
+
+	// tlfIDs are the TLFs to run on. If nil, the runner runs on
+	// all those listed by listTLFStorageDirs.
+	tlfIDs []TlfID
+
+	// workers is the maximum number of TLFs processed at once. A
+	// non-positive value means one.
+	workers int
+
+	// maxOpenFiles, if positive, is the maximum number of MD
+	// object files that may be open at once across all the
+	// storages being processed, which share a single semaphore.
+	maxOpenFiles int
+
+	// configure, if non-nil, is called on each storage before it
+	// is opened, e.g. to set options that must be set before
+	// open.
+	configure func(s *mdServerTlfStorage)
+}
+
+// mdMaintenanceResult is the outcome of a maintenance operation on a
+// single TLF. err is nil on success, and otherwise is the error from
+// opening the storage, the operation itself, or closing the storage,
+// in that order of precedence, or the context error if the TLF was
+// never started.
+type mdMaintenanceResult struct {
+	tlfID TlfID
+	err   error
+}
+
+// mdMaintenanceReport is the combined outcome of a run, with a result
+// for each TLF in the order they were given or listed.
+type mdMaintenanceReport struct {
+	results []mdMaintenanceResult
+}
+
+// failed returns the results of the TLFs on which the operation
+// failed.
+func (r mdMaintenanceReport) failed() []mdMaintenanceResult {
+	var failed []mdMaintenanceResult
+	for _, result := range r.results {
+		if result.err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// run runs op on each TLF, and returns the report once all of them
+// are done. The TLFs are handed out to the workers in order, so that
+// no more than one is waiting to be picked up at any time. If ctx is
+// canceled, no more TLFs are started, and run returns ctx.Err()
+// along with the report, in which the TLFs that weren't started
+// have that error. Otherwise, the returned error is non-nil only if
+// the TLFs couldn't be listed.
+func (r mdMaintenanceRunner) run(
+	ctx context.Context, op mdMaintenanceOp) (mdMaintenanceReport, error) {
+	tlfIDs := r.tlfIDs
+	if tlfIDs == nil {
+		var err error
+		tlfIDs, err = listTLFStorageDirs(r.root)
+		if err != nil {
+			return mdMaintenanceReport{}, err
+		}
+	}
+
+	workers := r.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var openFiles *mdServerTlfStorageSemaphore
+	if r.maxOpenFiles > 0 {
+		openFiles = newMDServerTlfStorageSemaphore(r.maxOpenFiles)
+	}
+
+	report := mdMaintenanceReport{
+		results: make([]mdMaintenanceResult, len(tlfIDs)),
+	}
+	for i, tlfID := range tlfIDs {
+		report.results[i].tlfID = tlfID
+	}
+
+	// Each worker writes only the results of the indices it
+	// receives, so the results need no further locking.
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				report.results[i].err = r.runOne(
+					ctx, tlfIDs[i], openFiles, op)
+			}
+		}()
+	}
+
+	next := 0
+	for next < len(tlfIDs) && ctx.Err() == nil {
+		select {
+		case indices <- next:
+			next++
+		case <-ctx.Done():
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	for ; next < len(tlfIDs); next++ {
+		report.results[next].err = ctx.Err()
+	}
+	return report, ctx.Err()
+}
+
+// runOne opens the storage of the given TLF exclusively, runs op on
+// it, and closes it. If another instance has the storage open, e.g.
+// because the TLF is being served, runOne skips the TLF and returns
+// errMDServerTlfStorageFileLocked rather than fence that instance
+// off.
+func (r mdMaintenanceRunner) runOne(ctx context.Context, tlfID TlfID,
+	openFiles *mdServerTlfStorageSemaphore, op mdMaintenanceOp) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := makeMDServerTlfStorage(
+		r.codec, r.crypto, filepath.Join(r.root, tlfID.String()))
+	if r.configure != nil {
+		r.configure(s)
+	}
+	s.exclusive = true
+	if openFiles != nil {
+		// open leaves openFiles alone when maxOpenFiles isn't
+		// set.
+		s.maxOpenFiles = 0
+		s.openFiles = openFiles
+	}
+
+	err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	err = op(ctx, tlfID, s)
+	closeErr := s.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// mdMaintenanceProgressFunc is called by long-running maintenance
+// operations after each item they process, with the number of items
+// processed so far, the total number of items, and a description of
+// the item just processed.
+type mdMaintenanceProgressFunc func(processed, total int, item string)
@@ -0,0 +1,246 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// mdServerMDCacheEvictionPolicy says which MD an mdServerMDCache
+// evicts when it's over budget.
+type mdServerMDCacheEvictionPolicy int
+
+const (
+	// mdServerMDCacheEvictLRU evicts the least recently used MD.
+	mdServerMDCacheEvictLRU mdServerMDCacheEvictionPolicy = iota
+	// mdServerMDCacheEvictLargest evicts the MD with the largest
+	// encoded size, or the least recently used of those if there
+	// are several, which frees the most memory per eviction at
+	// the cost of re-reading large MDs more often.
+	mdServerMDCacheEvictLargest
+)
+
+func (p mdServerMDCacheEvictionPolicy) String() string {
+	switch p {
+	case mdServerMDCacheEvictLRU:
+		return "LRU"
+	case mdServerMDCacheEvictLargest:
+		return "Largest"
+	default:
+		return "<unknown>"
+	}
+}
+
+// mdServerMDCacheKey includes the directory of the storage, so that
+// an mdServerMDCache can be shared by the storages of many TLFs.
+type mdServerMDCacheKey struct {
+	dir string
+	id  MdID
+}
+
+type mdServerMDCacheEntry struct {
+	key       mdServerMDCacheKey
+	buf       []byte
+	timestamp time.Time
+	// lastUse orders the entries of the same size in bySize, and
+	// index is the position of the entry there.
+	lastUse uint64
+	index   int
+}
+
+// mdServerMDCacheBySize is a heap.Interface of cache entries, the
+// largest first, and the least recently used first among those of
+// the same size.
+type mdServerMDCacheBySize []*mdServerMDCacheEntry
+
+func (h mdServerMDCacheBySize) Len() int { return len(h) }
+
+func (h mdServerMDCacheBySize) Less(i, j int) bool {
+	if len(h[i].buf) != len(h[j].buf) {
+		return len(h[i].buf) > len(h[j].buf)
+	}
+	return h[i].lastUse < h[j].lastUse
+}
+
+func (h mdServerMDCacheBySize) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *mdServerMDCacheBySize) Push(x interface{}) {
+	entry := x.(*mdServerMDCacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *mdServerMDCacheBySize) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// mdServerMDCache is an in-memory cache of the encodings of verified
+// MDs, along with their server timestamps, bounded by a number of
+// entries, a total encoded size in bytes, or both. Since MD objects
+// range from a few hundred bytes to many megabytes, only a byte
+// budget makes its memory use predictable.
+//
+// MDs are cached encoded, rather than decoded, since a decoded MD
+// can't be shared by callers that may modify it.
+type mdServerMDCache struct {
+	maxEntries int
+	maxBytes   int64
+	policy     mdServerMDCacheEvictionPolicy
+
+	lock sync.Mutex
+	// order holds *mdServerMDCacheEntry values, most recently used
+	// first.
+	order      *list.List
+	entries    map[mdServerMDCacheKey]*list.Element
+	totalBytes int64
+	// bySize holds the same entries as order, but is only kept
+	// with mdServerMDCacheEvictLargest, so that finding the
+	// victim doesn't take a scan of all the entries.
+	bySize mdServerMDCacheBySize
+	uses   uint64
+}
+
+// makeMDServerMDCache returns an mdServerMDCache that holds at most
+// maxEntries MDs, with a total encoded size of at most maxBytes,
+// evicting MDs according to policy when a put would exceed either.
+// A non-positive limit means no limit of that kind.
+func makeMDServerMDCache(maxEntries int, maxBytes int64,
+	policy mdServerMDCacheEvictionPolicy) *mdServerMDCache {
+	return &mdServerMDCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		policy:     policy,
+		order:      list.New(),
+		entries:    make(map[mdServerMDCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached encoding of the MD with the given ID from
+// the storage in the given directory, and its server timestamp. The
+// encoding must not be modified.
+func (c *mdServerMDCache) get(dir string, id MdID) (
+	[]byte, time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[mdServerMDCacheKey{dir, id}]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := e.Value.(*mdServerMDCacheEntry)
+	c.useLocked(e)
+	return entry.buf, entry.timestamp, true
+}
+
+// useLocked marks the given entry as the most recently used.
+func (c *mdServerMDCache) useLocked(e *list.Element) {
+	c.order.MoveToFront(e)
+	if c.policy == mdServerMDCacheEvictLargest {
+		entry := e.Value.(*mdServerMDCacheEntry)
+		c.uses++
+		entry.lastUse = c.uses
+		heap.Fix(&c.bySize, entry.index)
+	}
+}
+
+func (c *mdServerMDCache) overBudgetLocked() bool {
+	return (c.maxEntries > 0 && c.order.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.totalBytes > c.maxBytes)
+}
+
+// victimLocked returns the entry to evict according to policy.
+func (c *mdServerMDCache) victimLocked() *list.Element {
+	if c.policy != mdServerMDCacheEvictLargest {
+		return c.order.Back()
+	}
+	return c.entries[c.bySize[0].key]
+}
+
+func (c *mdServerMDCache) removeLocked(e *list.Element) {
+	entry := c.order.Remove(e).(*mdServerMDCacheEntry)
+	delete(c.entries, entry.key)
+	c.totalBytes -= int64(len(entry.buf))
+	if c.policy == mdServerMDCacheEvictLargest {
+		heap.Remove(&c.bySize, entry.index)
+	}
+}
+
+// put caches the given encoding of the MD with the given ID, and its
+// server timestamp, from the storage in the given directory,
+// replacing any cached one, and then evicts MDs until the cache is
+// within its limits again. An MD larger than maxBytes by itself isn't
+// cached at all.
+func (c *mdServerMDCache) put(
+	dir string, id MdID, buf []byte, timestamp time.Time) {
+	size := int64(len(buf))
+	key := mdServerMDCacheKey{dir, id}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if c.maxBytes > 0 && size > c.maxBytes {
+		if ok {
+			c.removeLocked(e)
+		}
+		return
+	}
+	if ok {
+		entry := e.Value.(*mdServerMDCacheEntry)
+		c.totalBytes += size - int64(len(entry.buf))
+		entry.buf = buf
+		entry.timestamp = timestamp
+		c.useLocked(e)
+	} else {
+		entry := &mdServerMDCacheEntry{
+			key:       key,
+			buf:       buf,
+			timestamp: timestamp,
+		}
+		c.entries[key] = c.order.PushFront(entry)
+		c.totalBytes += size
+		if c.policy == mdServerMDCacheEvictLargest {
+			c.uses++
+			entry.lastUse = c.uses
+			heap.Push(&c.bySize, entry)
+		}
+	}
+	for c.overBudgetLocked() {
+		c.removeLocked(c.victimLocked())
+	}
+}
+
+// remove evicts the MD with the given ID from the storage in the
+// given directory, if it's cached.
+func (c *mdServerMDCache) remove(dir string, id MdID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[mdServerMDCacheKey{dir, id}]; ok {
+		c.removeLocked(e)
+	}
+}
+
+// len returns the number of cached MDs.
+func (c *mdServerMDCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// bytes returns the total encoded size of the cached MDs.
+func (c *mdServerMDCache) bytes() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.totalBytes
+}
@@ -0,0 +1,246 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// mdIDList can be used to sort MdIDs by their bytes.
+type mdIDList []MdID
+
+func (l mdIDList) Len() int {
+	return len(l)
+}
+
+func (l mdIDList) Less(i, j int) bool {
+	return bytes.Compare(l[i].Bytes(), l[j].Bytes()) < 0
+}
+
+func (l mdIDList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// search returns the index at which id is or would be in the sorted
+// list l, and whether it is there.
+func (l mdIDList) search(id MdID) (int, bool) {
+	idBytes := id.Bytes()
+	i := sort.Search(len(l), func(i int) bool {
+		return bytes.Compare(l[i].Bytes(), idBytes) >= 0
+	})
+	return i, i < len(l) && l[i] == id
+}
+
+// insert adds id to the sorted list l, if it's not already there,
+// and returns the resulting list.
+func (l mdIDList) insert(id MdID) mdIDList {
+	i, ok := l.search(id)
+	if ok {
+		return l
+	}
+	l = append(l, MdID{})
+	copy(l[i+1:], l[i:])
+	l[i] = id
+	return l
+}
+
+// remove removes id from the sorted list l, if it's there, and
+// returns the resulting list.
+func (l mdIDList) remove(id MdID) mdIDList {
+	i, ok := l.search(id)
+	if !ok {
+		return l
+	}
+	return append(l[:i], l[i+1:]...)
+}
+
+// mdIDIndexFile is the stored form of the MDIDS file. Fields are
+// exported only for serialization.
+type mdIDIndexFile struct {
+	IDs mdIDList
+	// Pending, if not the zero MdID, is the MD object that was
+	// about to be stored or removed when the file was written, so
+	// it may or may not be on disk, whether or not it's in IDs.
+	Pending MdID
+}
+
+// scanMDIDsLocked returns the sorted IDs of all the MD objects in
+// dir/mds and s.coldMDsDir.
+func (s *mdServerTlfStorage) scanMDIDsLocked(
+	ctx context.Context) (mdIDList, error) {
+	ids, err := s.scanMDIDsInDir(ctx, s.mdsPath())
+	if err != nil {
+		return nil, err
+	}
+	if s.coldMDsDir != "" {
+		coldIDs, err := s.scanMDIDsInDir(ctx, s.coldMDsDir)
+		if err != nil {
+			return nil, err
+		}
+		// An object may briefly be in both places while
+		// being moved.
+		sort.Sort(ids)
+		for _, id := range coldIDs {
+			ids = ids.insert(id)
+		}
+	}
+
+	sort.Sort(ids)
+	return ids, nil
+}
+
+// scanMDIDsInDir returns the IDs of all the MD objects in dir, which
+// is laid out like dir/mds, in no particular order. Stray files,
+// whose names aren't MD IDs, are logged and skipped.
+func (s *mdServerTlfStorage) scanMDIDsInDir(
+	ctx context.Context, dir string) (mdIDList, error) {
+	ids := mdIDList{}
+	splayInfos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return ids, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, splayInfo := range splayInfos {
+		if !splayInfo.IsDir() {
+			continue
+		}
+		fileInfos, err := ioutil.ReadDir(
+			filepath.Join(dir, splayInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			h, err := HashFromString(splayInfo.Name() + fileInfo.Name())
+			if err != nil {
+				s.log.CWarningf(ctx, "Skipping unexpected "+
+					"file %s in %s: %v", fileInfo.Name(),
+					splayInfo.Name(), err)
+				continue
+			}
+			ids = append(ids, MdID{h})
+		}
+	}
+	return ids, nil
+}
+
+// loadMDIDIndexLocked reads the MDIDS file, settling whether its
+// pending MD object is on disk, or rebuilds its contents if it is
+// missing or invalid. In either of the latter cases, it writes the
+// result back, so that the next open needn't do the same.
+func (s *mdServerTlfStorage) loadMDIDIndexLocked(
+	ctx context.Context) (mdIDList, error) {
+	var index mdIDIndexFile
+	buf, err := ioutil.ReadFile(s.mdIDIndexPath())
+	if err == nil {
+		err = s.codec.Decode(buf, &index)
+		if err == nil && !sort.IsSorted(index.IDs) {
+			err = errors.New("MDIDS is not sorted")
+		}
+	}
+
+	ids := index.IDs
+	if ids == nil {
+		ids = mdIDList{}
+	}
+	switch {
+	case err != nil:
+		if !os.IsNotExist(err) {
+			s.log.CDebugf(ctx,
+				"Rebuilding the MD ID index: %v", err)
+		}
+		ids, err = s.scanMDIDsLocked(ctx)
+		if err != nil {
+			return nil, err
+		}
+	case index.Pending != MdID{}:
+		onDisk, err := s.isMDFileOnDisk(index.Pending)
+		if err != nil {
+			return nil, err
+		}
+		if onDisk {
+			ids = ids.insert(index.Pending)
+		} else {
+			ids = ids.remove(index.Pending)
+		}
+	default:
+		return ids, nil
+	}
+
+	err = s.saveMDIDIndexLocked(ids, MdID{})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// isMDFileOnDisk returns whether the MD object with the given ID has
+// a file in dir/mds or s.coldMDsDir.
+func (s *mdServerTlfStorage) isMDFileOnDisk(id MdID) (bool, error) {
+	paths := []string{s.mdPath(id)}
+	if s.coldMDsDir != "" {
+		paths = append(paths, s.coldMDPath(id))
+	}
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// saveMDIDIndexLocked atomically replaces the MDIDS file with the
+// given IDs and pending MD object.
+func (s *mdServerTlfStorage) saveMDIDIndexLocked(
+	ids mdIDList, pending MdID) error {
+	buf, err := s.codec.Encode(mdIDIndexFile{IDs: ids, Pending: pending})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(s.mdIDIndexPath(), buf, 0600)
+	if err != nil {
+		return err
+	}
+	s.mdIDIndexPending = pending
+	return nil
+}
+
+// beginMDIDIndexChangeLocked writes the MDIDS file with the given MD
+// object as pending, before that object's file is added or removed,
+// so that a later open checks whether it's on disk. It does nothing
+// if the index already has the object and add is true, or doesn't
+// have it and add is false.
+func (s *mdServerTlfStorage) beginMDIDIndexChangeLocked(
+	id MdID, add bool) (changing bool, err error) {
+	if _, ok := s.mdIDIndex.search(id); ok == add {
+		return false, nil
+	}
+	err = s.saveMDIDIndexLocked(s.mdIDIndex, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// abortMDIDIndexChangeLocked restores the MDIDS file as it was before
+// beginMDIDIndexChangeLocked, after adding or removing the pending
+// object's file failed, so that the failure leaves no trace on disk.
+// previous is the pending object before then.
+func (s *mdServerTlfStorage) abortMDIDIndexChangeLocked(previous MdID) {
+	// This is best-effort, since a later open settles whether the
+	// pending object is on disk anyway.
+	_ = s.saveMDIDIndexLocked(s.mdIDIndex, previous)
+}
@@ -0,0 +1,608 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// The Merkle tree of a branch has a leaf for each retained revision,
+// in order, and is built as in RFC 6962 (Certificate Transparency),
+// so that its inclusion and consistency proofs can be checked with
+// the usual algorithms. Leaf and interior node hashes are prefixed
+// differently so that one can't be passed off as the other.
+const (
+	mdMerkleLeafPrefix = 0x00
+	mdMerkleNodePrefix = 0x01
+)
+
+// mdMerkleCheckpoint is the root of the Merkle tree of a branch at
+// some point, as periodically published for clients to check the
+// heads they are served against. Fields are exported only for
+// serialization.
+type mdMerkleCheckpoint struct {
+	BID BranchID
+	// Earliest is the revision of the first leaf.
+	Earliest MetadataRevision
+	// Size is the number of leaves, so the latest revision
+	// covered is Earliest + Size - 1.
+	Size int64
+	Root Hash
+}
+
+// errMDMerkleProofInvalid is returned when a Merkle proof doesn't
+// verify.
+var errMDMerkleProofInvalid = errors.New("Invalid Merkle proof")
+
+// mdMerkleLeafHash returns the leaf hash of the given revision of a
+// branch, whose MD has the given ID.
+func mdMerkleLeafHash(revision MetadataRevision, id MdID) (Hash, error) {
+	buf := make([]byte, 9, 9+len(id.Bytes()))
+	buf[0] = mdMerkleLeafPrefix
+	binary.BigEndian.PutUint64(buf[1:], uint64(revision))
+	return DefaultHash(append(buf, id.Bytes()...))
+}
+
+// mdMerkleNodeHash returns the hash of the interior node with the
+// given children.
+func mdMerkleNodeHash(left, right Hash) (Hash, error) {
+	buf := []byte{mdMerkleNodePrefix}
+	buf = append(buf, left.Bytes()...)
+	return DefaultHash(append(buf, right.Bytes()...))
+}
+
+// mdMerkleSplit returns the largest power of two less than n, which
+// must be at least 2.
+func mdMerkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// mdMerkleTreeHash returns the root of the Merkle tree with the
+// given leaf hashes.
+func mdMerkleTreeHash(leaves []Hash) (Hash, error) {
+	switch len(leaves) {
+	case 0:
+		return DefaultHash(nil)
+	case 1:
+		return leaves[0], nil
+	}
+	k := mdMerkleSplit(len(leaves))
+	left, err := mdMerkleTreeHash(leaves[:k])
+	if err != nil {
+		return Hash{}, err
+	}
+	right, err := mdMerkleTreeHash(leaves[k:])
+	if err != nil {
+		return Hash{}, err
+	}
+	return mdMerkleNodeHash(left, right)
+}
+
+// mdMerkleInclusionPath returns the proof that leaves[m] is in the
+// Merkle tree with the given leaf hashes.
+func mdMerkleInclusionPath(leaves []Hash, m int) ([]Hash, error) {
+	if len(leaves) <= 1 {
+		return nil, nil
+	}
+	k := mdMerkleSplit(len(leaves))
+	if m < k {
+		path, err := mdMerkleInclusionPath(leaves[:k], m)
+		if err != nil {
+			return nil, err
+		}
+		right, err := mdMerkleTreeHash(leaves[k:])
+		if err != nil {
+			return nil, err
+		}
+		return append(path, right), nil
+	}
+	path, err := mdMerkleInclusionPath(leaves[k:], m-k)
+	if err != nil {
+		return nil, err
+	}
+	left, err := mdMerkleTreeHash(leaves[:k])
+	if err != nil {
+		return nil, err
+	}
+	return append(path, left), nil
+}
+
+// mdMerkleConsistencySubproof is SUBPROOF from RFC 6962.
+func mdMerkleConsistencySubproof(leaves []Hash, m int, complete bool) (
+	[]Hash, error) {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil, nil
+		}
+		root, err := mdMerkleTreeHash(leaves)
+		if err != nil {
+			return nil, err
+		}
+		return []Hash{root}, nil
+	}
+	k := mdMerkleSplit(n)
+	if m <= k {
+		proof, err := mdMerkleConsistencySubproof(
+			leaves[:k], m, complete)
+		if err != nil {
+			return nil, err
+		}
+		right, err := mdMerkleTreeHash(leaves[k:])
+		if err != nil {
+			return nil, err
+		}
+		return append(proof, right), nil
+	}
+	proof, err := mdMerkleConsistencySubproof(leaves[k:], m-k, false)
+	if err != nil {
+		return nil, err
+	}
+	left, err := mdMerkleTreeHash(leaves[:k])
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, left), nil
+}
+
+// mdMerkleConsistencyProof returns the proof that the Merkle tree
+// with the first m of the given leaf hashes is a prefix of the one
+// with all of them.
+func mdMerkleConsistencyProof(leaves []Hash, m int) ([]Hash, error) {
+	if m <= 0 || m >= len(leaves) {
+		return nil, nil
+	}
+	return mdMerkleConsistencySubproof(leaves, m, true)
+}
+
+// verifyMDMerkleInclusion checks that the given revision of the
+// checkpoint's branch has the given MD ID, using an inclusion proof
+// returned by mdServerTlfStorage.merkleInclusionProof. It trusts
+// only the checkpoint.
+func verifyMDMerkleInclusion(checkpoint mdMerkleCheckpoint,
+	revision MetadataRevision, id MdID, path []Hash) error {
+	if revision < checkpoint.Earliest {
+		return errMDMerkleProofInvalid
+	}
+	fn := int64(revision - checkpoint.Earliest)
+	sn := checkpoint.Size - 1
+	if fn > sn {
+		return errMDMerkleProofInvalid
+	}
+
+	r, err := mdMerkleLeafHash(revision, id)
+	if err != nil {
+		return err
+	}
+	for _, p := range path {
+		if sn == 0 {
+			return errMDMerkleProofInvalid
+		}
+		if fn&1 == 1 || fn == sn {
+			r, err = mdMerkleNodeHash(p, r)
+			if err != nil {
+				return err
+			}
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r, err = mdMerkleNodeHash(r, p)
+			if err != nil {
+				return err
+			}
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || r != checkpoint.Root {
+		return errMDMerkleProofInvalid
+	}
+	return nil
+}
+
+// verifyMDMerkleConsistency checks that the checkpoint newer extends
+// the checkpoint older of the same branch, i.e. that the history
+// older covers hasn't been rewritten, using a consistency proof
+// returned by mdServerTlfStorage.merkleConsistencyProof. It trusts
+// only the two checkpoints.
+func verifyMDMerkleConsistency(
+	older, newer mdMerkleCheckpoint, proof []Hash) error {
+	if older.BID != newer.BID || older.Earliest != newer.Earliest ||
+		older.Size < 1 || older.Size > newer.Size {
+		return errMDMerkleProofInvalid
+	}
+	if older.Size == newer.Size {
+		if len(proof) != 0 || older.Root != newer.Root {
+			return errMDMerkleProofInvalid
+		}
+		return nil
+	}
+
+	if older.Size&(older.Size-1) == 0 {
+		proof = append([]Hash{older.Root}, proof...)
+	}
+	if len(proof) == 0 {
+		return errMDMerkleProofInvalid
+	}
+
+	fn := older.Size - 1
+	sn := newer.Size - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errMDMerkleProofInvalid
+		}
+		var err error
+		if fn&1 == 1 || fn == sn {
+			fr, err = mdMerkleNodeHash(c, fr)
+			if err != nil {
+				return err
+			}
+			sr, err = mdMerkleNodeHash(c, sr)
+			if err != nil {
+				return err
+			}
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr, err = mdMerkleNodeHash(sr, c)
+			if err != nil {
+				return err
+			}
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || fr != older.Root || sr != newer.Root {
+		return errMDMerkleProofInvalid
+	}
+	return nil
+}
+
+// mdMerkleFrontier is the state needed to extend the Merkle tree of
+// a branch by a leaf, and to read its root, without the rest of the
+// tree: the roots of the perfect subtrees that its leaves split
+// into, which are the left siblings of the path of the next leaf.
+// Fields are exported only for serialization.
+type mdMerkleFrontier struct {
+	// Earliest is the revision of the first leaf, and Size the
+	// number of leaves, as in mdMerkleCheckpoint.
+	Earliest MetadataRevision
+	Size     int64
+	// LastID is the MD ID of the last leaf, so that a frontier
+	// that has fallen behind a rewritten journal can be detected.
+	LastID MdID
+	// Peaks are the roots of the perfect subtrees, largest
+	// first, one for each bit set in Size.
+	Peaks []Hash
+	Root  Hash
+}
+
+// makeMDMerkleFrontier returns the frontier of the Merkle tree with
+// the given leaves, whose first one is of revision earliest.
+func makeMDMerkleFrontier(
+	earliest MetadataRevision, mdIDs []MdID) (mdMerkleFrontier, error) {
+	f := mdMerkleFrontier{Earliest: earliest}
+	root, err := DefaultHash(nil)
+	if err != nil {
+		return mdMerkleFrontier{}, err
+	}
+	f.Root = root
+	for i, mdID := range mdIDs {
+		err := f.append(earliest+MetadataRevision(i), mdID)
+		if err != nil {
+			return mdMerkleFrontier{}, err
+		}
+	}
+	return f, nil
+}
+
+// append adds the leaf for the given revision, which must be the one
+// after the last leaf, to f, in O(log Size) hashes.
+func (f *mdMerkleFrontier) append(
+	revision MetadataRevision, id MdID) error {
+	if revision != f.Earliest+MetadataRevision(f.Size) {
+		return fmt.Errorf("Can't append revision %d to a Merkle "+
+			"tree of %d leaves from revision %d",
+			revision, f.Size, f.Earliest)
+	}
+	h, err := mdMerkleLeafHash(revision, id)
+	if err != nil {
+		return err
+	}
+	// Each trailing one bit of Size is a peak of the same size as
+	// the subtree being built, which absorbs it.
+	for size := f.Size; size&1 == 1; size >>= 1 {
+		h, err = mdMerkleNodeHash(f.Peaks[len(f.Peaks)-1], h)
+		if err != nil {
+			return err
+		}
+		f.Peaks = f.Peaks[:len(f.Peaks)-1]
+	}
+	f.Peaks = append(f.Peaks, h)
+	f.Size++
+	f.LastID = id
+
+	// Since each peak is bigger than all the ones after it put
+	// together, the tree is the peaks joined from the right.
+	root := f.Peaks[len(f.Peaks)-1]
+	for i := len(f.Peaks) - 2; i >= 0; i-- {
+		root, err = mdMerkleNodeHash(f.Peaks[i], root)
+		if err != nil {
+			return err
+		}
+	}
+	f.Root = root
+	return nil
+}
+
+// merkleLeavesReadLocked returns the summary of the given branch,
+// and the leaf hashes of its Merkle tree.
+func (s *mdServerTlfStorage) merkleLeavesReadLocked(bid BranchID) (
+	mdServerBranchSummary, []Hash, error) {
+	summary, err := s.summarizeBranchReadLocked(bid)
+	if err != nil {
+		return mdServerBranchSummary{}, nil, err
+	}
+	leaves := make([]Hash, len(summary.MdIDs))
+	for i, mdID := range summary.MdIDs {
+		leaves[i], err = mdMerkleLeafHash(
+			summary.Earliest+MetadataRevision(i), mdID)
+		if err != nil {
+			return mdServerBranchSummary{}, nil, err
+		}
+	}
+	return summary, leaves, nil
+}
+
+// readMerkleFrontierReadLocked returns the stored Merkle frontier of
+// the given branch, whose journal is j, and whether it is that of the
+// branch up to the given revision. A missing or corrupt frontier is
+// just out of date, since it can be rebuilt from the journal.
+func (s *mdServerTlfStorage) readMerkleFrontierReadLocked(bid BranchID,
+	j mdServerBranchJournal, latest MetadataRevision) (
+	mdMerkleFrontier, bool, error) {
+	buf, err := ioutil.ReadFile(s.merkleFrontierPath(bid))
+	if os.IsNotExist(err) {
+		return mdMerkleFrontier{}, false, nil
+	} else if err != nil {
+		return mdMerkleFrontier{}, false, err
+	}
+	var f mdMerkleFrontier
+	if err := s.codec.Decode(buf, &f); err != nil {
+		return mdMerkleFrontier{}, false, nil
+	}
+
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return mdMerkleFrontier{}, false, err
+	}
+	if earliest == MetadataRevisionUninitialized || latest < earliest ||
+		f.Earliest != earliest ||
+		f.Size != int64(latest-earliest)+1 {
+		return mdMerkleFrontier{}, false, nil
+	}
+	lastID, err := j.readMdID(latest)
+	if err != nil {
+		return mdMerkleFrontier{}, false, err
+	}
+	if lastID != f.LastID {
+		return mdMerkleFrontier{}, false, nil
+	}
+	return f, true, nil
+}
+
+// merkleFrontierReadLocked returns the Merkle frontier of the given
+// branch, as stored if it is up to date, or else rebuilt from the
+// journal, in which case stored is false.
+func (s *mdServerTlfStorage) merkleFrontierReadLocked(bid BranchID) (
+	f mdMerkleFrontier, stored bool, err error) {
+	if j, ok := s.branchJournals[bid]; ok {
+		latest, err := j.readLatestRevision()
+		if err != nil {
+			return mdMerkleFrontier{}, false, err
+		}
+		f, ok, err := s.readMerkleFrontierReadLocked(bid, j, latest)
+		if err != nil {
+			return mdMerkleFrontier{}, false, err
+		}
+		if ok {
+			return f, true, nil
+		}
+	}
+
+	summary, err := s.summarizeBranchReadLocked(bid)
+	if err != nil {
+		return mdMerkleFrontier{}, false, err
+	}
+	f, err = makeMDMerkleFrontier(summary.Earliest, summary.MdIDs)
+	if err != nil {
+		return mdMerkleFrontier{}, false, err
+	}
+	return f, false, nil
+}
+
+// writeMerkleFrontierLocked stores the given Merkle frontier of the
+// given branch, replacing the old one atomically, so that an
+// interrupted write can't leave a frontier that fails to decode.
+func (s *mdServerTlfStorage) writeMerkleFrontierLocked(
+	bid BranchID, f mdMerkleFrontier) error {
+	buf, err := s.codec.Encode(f)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.merkleFrontierPath(bid), buf, 0600)
+}
+
+// appendMerkleLeafLocked brings the stored Merkle frontier of the
+// given branch, whose journal is j, up to date after the given
+// revision has been appended to it, in O(log n) if the frontier was
+// up to date before, or else by rebuilding it.
+func (s *mdServerTlfStorage) appendMerkleLeafLocked(bid BranchID,
+	j mdServerBranchJournal, revision MetadataRevision, id MdID) error {
+	f, ok, err := s.readMerkleFrontierReadLocked(bid, j, revision-1)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = f.append(revision, id)
+		if err != nil {
+			return err
+		}
+	} else {
+		f, _, err = s.merkleFrontierReadLocked(bid)
+		if err != nil {
+			return err
+		}
+	}
+	return s.writeMerkleFrontierLocked(bid, f)
+}
+
+// checkMDMerkleCheckpoint returns an MDServerErrorBadRequest unless
+// the given checkpoint is of a prefix of the Merkle tree with the
+// given leaves, starting at earliest.
+func checkMDMerkleCheckpoint(checkpoint mdMerkleCheckpoint,
+	earliest MetadataRevision, leaves []Hash) error {
+	if checkpoint.Earliest != earliest {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Checkpoint starts at revision %d, but the branch "+
+				"now starts at %d",
+			checkpoint.Earliest, earliest)}
+	}
+	if checkpoint.Size < 1 || checkpoint.Size > int64(len(leaves)) {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Checkpoint size %d is out of range [1, %d]",
+			checkpoint.Size, len(leaves))}
+	}
+	root, err := mdMerkleTreeHash(leaves[:checkpoint.Size])
+	if err != nil {
+		return MDServerError{err}
+	}
+	if root != checkpoint.Root {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Checkpoint of size %d has root %s, not %s",
+			checkpoint.Size, checkpoint.Root, root)}
+	}
+	return nil
+}
+
+// merkleCheckpoint returns the current root of the Merkle tree of
+// the given branch, to be published as a checkpoint. The root is
+// read from the frontier put maintains, so this is O(1) unless the
+// frontier is out of date, e.g. after a crash, in which case it is
+// rebuilt from the journal, but not stored until the next put.
+func (s *mdServerTlfStorage) merkleCheckpoint(bid BranchID) (
+	mdMerkleCheckpoint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdMerkleCheckpoint{}, err
+	}
+
+	f, _, err := s.merkleFrontierReadLocked(bid)
+	if err != nil {
+		return mdMerkleCheckpoint{}, MDServerError{err}
+	}
+	return mdMerkleCheckpoint{
+		BID:      bid,
+		Earliest: f.Earliest,
+		Size:     f.Size,
+		Root:     f.Root,
+	}, nil
+}
+
+// merkleInclusionProof returns the ID of the MD at the given
+// revision of the checkpoint's branch, along with the proof, for
+// verifyMDMerkleInclusion, that it's in the tree the checkpoint is
+// the root of. The checkpoint must cover the revision, and be of
+// the current tree or of a prefix of it.
+func (s *mdServerTlfStorage) merkleInclusionProof(
+	checkpoint mdMerkleCheckpoint, revision MetadataRevision) (
+	MdID, []Hash, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return MdID{}, nil, err
+	}
+
+	summary, leaves, err := s.merkleLeavesReadLocked(checkpoint.BID)
+	if err != nil {
+		return MdID{}, nil, MDServerError{err}
+	}
+	earliest := summary.Earliest
+	err = checkMDMerkleCheckpoint(checkpoint, earliest, leaves)
+	if err != nil {
+		return MdID{}, nil, err
+	}
+	if revision < earliest ||
+		int64(revision-earliest) >= checkpoint.Size {
+		return MdID{}, nil, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("Revision %d isn't covered "+
+				"by the checkpoint", revision)}
+	}
+
+	i := int(revision - earliest)
+	path, err := mdMerkleInclusionPath(
+		leaves[:checkpoint.Size], i)
+	if err != nil {
+		return MdID{}, nil, MDServerError{err}
+	}
+	return summary.MdIDs[i], path, nil
+}
+
+// merkleConsistencyProof returns the proof, for
+// verifyMDMerkleConsistency, that the checkpoint newer extends the
+// checkpoint older of the same branch. Both must be of the current
+// tree or of a prefix of it.
+func (s *mdServerTlfStorage) merkleConsistencyProof(
+	older, newer mdMerkleCheckpoint) ([]Hash, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	if older.BID != newer.BID || older.Size > newer.Size {
+		return nil, MDServerErrorBadRequest{
+			Reason: "Checkpoints are of different branches or " +
+				"out of order"}
+	}
+	summary, leaves, err := s.merkleLeavesReadLocked(newer.BID)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	for _, checkpoint := range []mdMerkleCheckpoint{older, newer} {
+		err := checkMDMerkleCheckpoint(
+			checkpoint, summary.Earliest, leaves)
+		if err != nil {
+			return nil, err
+		}
+	}
+	proof, err := mdMerkleConsistencyProof(
+		leaves[:newer.Size], int(older.Size))
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	return proof, nil
+}
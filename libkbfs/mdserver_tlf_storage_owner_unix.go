@@ -0,0 +1,42 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkDirOwnership returns an mdServerTlfStorageOwnershipError if
+// dir isn't owned by the current user, or is writable by its group
+// or by others.
+func checkDirOwnership(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if uid := os.Getuid(); int(stat.Uid) != uid {
+			return mdServerTlfStorageOwnershipError{
+				dir: dir,
+				problem: fmt.Sprintf("it is owned by uid %d, not %d",
+					stat.Uid, uid),
+			}
+		}
+	}
+
+	if perm := fi.Mode().Perm(); perm&0022 != 0 {
+		return mdServerTlfStorageOwnershipError{
+			dir:     dir,
+			problem: fmt.Sprintf("it has mode %s", perm),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// recordingLogBackend is a logger.TestLogBackend that also keeps the
+// messages logged through it.
+type recordingLogBackend struct {
+	*testing.T
+	messages []string
+}
+
+func (b *recordingLogBackend) Logf(format string, args ...interface{}) {
+	b.messages = append(b.messages, fmt.Sprintf(format, args...))
+	b.T.Logf(format, args...)
+}
+
+func TestMDServerTlfStorageOwnershipCheck(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	err = os.Chmod(tempdir, 0777)
+	require.NoError(t, err)
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	ctx := context.Background()
+
+	// Refuse.
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.ownershipCheck = mdServerTlfStorageOwnershipRefuse
+	err = s.open(ctx)
+	require.IsType(t, mdServerTlfStorageOwnershipError{}, err)
+
+	// Warn.
+	backend := &recordingLogBackend{T: t}
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.ownershipCheck = mdServerTlfStorageOwnershipWarn
+	s.log = logger.NewTestLogger(backend)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	err = s.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(backend.messages))
+	require.True(t, strings.Contains(backend.messages[0], "may be shared"),
+		backend.messages[0])
+
+	// Once the mode is fixed, even a strict open succeeds.
+	err = os.Chmod(tempdir, 0700)
+	require.NoError(t, err)
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.ownershipCheck = mdServerTlfStorageOwnershipRefuse
+	err = s.open(ctx)
+	require.NoError(t, err)
+	err = s.close()
+	require.NoError(t, err)
+}
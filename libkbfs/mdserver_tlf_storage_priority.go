@@ -0,0 +1,116 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// mdServerTlfStoragePriority is the priority with which an
+// mdServerTlfStorage operation acquires shared resources, i.e. the
+// storage lock and open file slots.
+type mdServerTlfStoragePriority int
+
+const (
+	// mdServerTlfStoragePriorityNormal is the priority of client
+	// requests, and the default.
+	mdServerTlfStoragePriorityNormal mdServerTlfStoragePriority = iota
+	// mdServerTlfStoragePriorityBackground is the priority of
+	// maintenance, e.g. flushing the write buffer and demoting
+	// cold MDs, which yields to waiting normal-priority work.
+	mdServerTlfStoragePriorityBackground
+	numMDServerTlfStoragePriorities
+)
+
+// withMDServerTlfStoragePriority returns a context which causes
+// mdServerTlfStorage operations called with it to run with the given
+// priority.
+func withMDServerTlfStoragePriority(
+	ctx context.Context, p mdServerTlfStoragePriority) context.Context {
+	return context.WithValue(ctx, ctxMDServerTlfStoragePriorityKey, p)
+}
+
+// mdServerTlfStoragePriorityFromContext returns the priority set on
+// ctx, or mdServerTlfStoragePriorityNormal if there is none.
+func mdServerTlfStoragePriorityFromContext(
+	ctx context.Context) mdServerTlfStoragePriority {
+	p, ok := ctx.Value(
+		ctxMDServerTlfStoragePriorityKey).(mdServerTlfStoragePriority)
+	if !ok {
+		return mdServerTlfStoragePriorityNormal
+	}
+	return p
+}
+
+// mdServerTlfStorageSemaphore is a counting semaphore which, when
+// slots free up, grants them to waiting normal-priority acquirers
+// before any background ones. Background acquirers can therefore
+// starve while normal-priority work keeps arriving, which is the
+// point.
+type mdServerTlfStorageSemaphore struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	slots   int
+	used    int
+	waiting [numMDServerTlfStoragePriorities]int
+}
+
+func newMDServerTlfStorageSemaphore(slots int) *mdServerTlfStorageSemaphore {
+	sem := &mdServerTlfStorageSemaphore{slots: slots}
+	sem.cond = sync.NewCond(&sem.lock)
+	return sem
+}
+
+// mustWaitLocked returns whether an acquirer with the given priority
+// has to keep waiting.
+func (sem *mdServerTlfStorageSemaphore) mustWaitLocked(
+	p mdServerTlfStoragePriority) bool {
+	if sem.used >= sem.slots {
+		return true
+	}
+	for higher := mdServerTlfStoragePriority(0); higher < p; higher++ {
+		if sem.waiting[higher] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire blocks until a slot is free and no acquirer with a higher
+// priority is waiting, and then takes the slot.
+func (sem *mdServerTlfStorageSemaphore) acquire(p mdServerTlfStoragePriority) {
+	sem.lock.Lock()
+	defer sem.lock.Unlock()
+	sem.waiting[p]++
+	for sem.mustWaitLocked(p) {
+		sem.cond.Wait()
+	}
+	sem.waiting[p]--
+	sem.used++
+	if sem.used < sem.slots {
+		// Lower-priority acquirers may have been waiting on
+		// this one rather than on a slot.
+		sem.cond.Broadcast()
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (sem *mdServerTlfStorageSemaphore) release() {
+	sem.lock.Lock()
+	defer sem.lock.Unlock()
+	sem.used--
+	sem.cond.Broadcast()
+}
+
+// numWaiting returns the number of acquirers with the given priority
+// that are blocked.
+func (sem *mdServerTlfStorageSemaphore) numWaiting(
+	p mdServerTlfStoragePriority) int {
+	sem.lock.Lock()
+	defer sem.lock.Unlock()
+	return sem.waiting[p]
+}
@@ -0,0 +1,317 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// prune removes the revisions of the given branch below upTo from
+// its journal, along with their MD objects, and returns the number
+// of revisions removed. It never removes the head of the branch, and
+// it stops at the earliest pinned revision, so that EARLIEST is never
+// advanced past a pinned revision, and after the lowest flush cursor,
+// so that no revision is removed before every destination tracked by
+// addFlushDestination has flushed it.
+//
+// Since an MD contains its branch ID and revision, an MD object is
+// referenced by at most one journal entry, so it can be removed along
+// with its entry, unless it is held by a read snapshot, in which case
+// its removal is deferred until the snapshot is released.
+func (s *mdServerTlfStorage) prune(
+	bid BranchID, upTo MetadataRevision) (int, error) {
+	return s.pruneWithProgress(context.Background(), bid, upTo, nil)
+}
+
+// pruneWithProgress is like prune, but reports its progress to the
+// given function, if non-nil, after each revision removed, and can be
+// canceled through ctx. When ctx is canceled, it returns ctx.Err()
+// along with the number of revisions removed so far; the branch is
+// then as if prune had been called with a lower upTo. If the
+// earliest remaining revision would be stored as a delta, removal
+// continues up to the next one stored in full, which is at most
+// deltaFullInterval revisions further.
+func (s *mdServerTlfStorage) pruneWithProgress(ctx context.Context,
+	bid BranchID, upTo MetadataRevision,
+	progress mdMaintenanceProgressFunc) (int, error) {
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return 0, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return 0, err
+	}
+	defer unfence()
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return 0, nil
+	}
+
+	earliestRevision, limit, _, err := s.pruneLimitReadLocked(j, bid, upTo)
+	if err != nil {
+		return 0, err
+	}
+	if earliestRevision == MetadataRevisionUninitialized {
+		return 0, nil
+	}
+
+	if limit > earliestRevision {
+		// The MD that becomes the earliest one may be a
+		// delta against one of the MDs about to be removed.
+		newEarliestID, err := j.readMdID(limit)
+		if err != nil {
+			return 0, err
+		}
+		err = s.storeInFullLocked(newEarliestID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pruned := 0
+	total := int(limit - earliestRevision)
+	for r := earliestRevision; r < limit; r++ {
+		if ctx.Err() != nil {
+			// Only stop where the new earliest revision
+			// doesn't depend on the removed ones.
+			mdID, err := j.readMdID(r)
+			if err != nil {
+				return pruned, err
+			}
+			data, _, err := s.readStoredMDReadLocked(ctx, mdID)
+			if err != nil {
+				return pruned, err
+			}
+			if !isMDDelta(data) {
+				return pruned, ctx.Err()
+			}
+		}
+
+		_, mdID, err := j.removeEarliest()
+		if err != nil {
+			return pruned, err
+		}
+
+		if s.heldMDs[mdID] > 0 {
+			// A read snapshot still needs the MD, so
+			// remove it when the last one is released.
+			s.deferredRemovals[mdID] = true
+		} else {
+			err = s.removeMDLocked(mdID)
+			if err != nil {
+				return pruned, err
+			}
+		}
+		pruned++
+		if progress != nil {
+			progress(pruned, total, fmt.Sprintf("revision %s", r))
+		}
+	}
+
+	// The Merkle tree covers only the retained revisions, and
+	// RFC 6962 trees can't drop leaves from the front, so the
+	// frontier is rebuilt. A prune that stops early leaves the
+	// old frontier, which is then ignored as out of date.
+	if pruned > 0 {
+		f, _, err := s.merkleFrontierReadLocked(bid)
+		if err == nil {
+			err = s.writeMerkleFrontierLocked(bid, f)
+		}
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't rebuild the Merkle "+
+				"frontier of branch %s: %v", bid, err)
+		}
+	}
+	if pruned > 0 && s.revisionIndex {
+		err := s.rebuildRevisionIndexLocked(bid)
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't rebuild the revision "+
+				"index of branch %s: %v", bid, err)
+		}
+	}
+
+	return pruned, nil
+}
+
+// pruneLimitReadLocked returns the earliest revision of the given
+// branch, and the revision up to which, exclusive, prune would remove
+// revisions given upTo, along with the pinned revision that lowered
+// that limit, if any, unless a flush cursor or retainGrace lowered it
+// further. The earliest revision is MetadataRevisionUninitialized if
+// the branch is empty.
+func (s *mdServerTlfStorage) pruneLimitReadLocked(j mdServerBranchJournal,
+	bid BranchID, upTo MetadataRevision) (
+	earliest, limit, pinnedAt MetadataRevision, err error) {
+	earliest, err = j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	if earliest == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, nil
+	}
+
+	limit = upTo
+	if limit > latest {
+		limit = latest
+	}
+
+	pinned, err := s.readPinnedReadLocked(bid)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	pinnedAt = MetadataRevisionUninitialized
+	for _, p := range pinned {
+		if p >= earliest && p < limit {
+			limit = p
+			pinnedAt = p
+			break
+		}
+	}
+
+	flushLimit, ok, err := s.flushCursorLimitReadLocked(bid)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, err
+	}
+	if ok && flushLimit < limit {
+		limit = flushLimit
+		pinnedAt = MetadataRevisionUninitialized
+	}
+
+	if s.retainGrace > 0 {
+		graceLimit := upTo
+		if graceLimit > latest {
+			graceLimit = latest
+		}
+		if ok && flushLimit < graceLimit {
+			graceLimit = flushLimit
+		}
+		graceLimit -= MetadataRevision(s.retainGrace)
+		if graceLimit < earliest {
+			graceLimit = earliest
+		}
+		if graceLimit < limit {
+			limit = graceLimit
+			pinnedAt = MetadataRevisionUninitialized
+		}
+	}
+	return earliest, limit, pinnedAt, nil
+}
+
+// mdPruneRemoval is a revision that prune would remove.
+type mdPruneRemoval struct {
+	revision MetadataRevision
+	mdID     MdID
+	// size is the stored size of the MD object.
+	size int64
+}
+
+// mdPrunePlan describes what prune would do; see planPrune.
+type mdPrunePlan struct {
+	// removals are the revisions that would be removed, in
+	// order.
+	removals []mdPruneRemoval
+	// pinnedAt is the pinned revision at which prune would stop
+	// short of upTo, or MetadataRevisionUninitialized.
+	pinnedAt MetadataRevision
+	// deferred are the IDs of the MD objects of removals that
+	// read snapshots still hold, and that would therefore be
+	// kept until the snapshots are released.
+	deferred []MdID
+	// bytesFreed estimates the disk space that would be freed
+	// right away: the sizes of the removed MD objects that aren't
+	// held, less the growth of the new earliest MD if it has to
+	// be rewritten in full.
+	bytesFreed int64
+}
+
+// planPrune returns what prune(bid, upTo) would remove, without
+// changing anything.
+func (s *mdServerTlfStorage) planPrune(
+	bid BranchID, upTo MetadataRevision) (mdPrunePlan, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdPrunePlan{}, err
+	}
+
+	plan := mdPrunePlan{pinnedAt: MetadataRevisionUninitialized}
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return plan, nil
+	}
+
+	earliestRevision, limit, pinnedAt, err :=
+		s.pruneLimitReadLocked(j, bid, upTo)
+	if err != nil {
+		return mdPrunePlan{}, err
+	}
+	plan.pinnedAt = pinnedAt
+	if earliestRevision == MetadataRevisionUninitialized ||
+		limit <= earliestRevision {
+		return plan, nil
+	}
+
+	_, mdIDs, err := j.getRange(earliestRevision, limit-1)
+	if err != nil {
+		return mdPrunePlan{}, err
+	}
+	ctx := context.Background()
+	for i, mdID := range mdIDs {
+		data, _, err := s.readStoredMDReadLocked(ctx, mdID)
+		if err != nil {
+			return mdPrunePlan{}, err
+		}
+		size := int64(len(data))
+		plan.removals = append(plan.removals, mdPruneRemoval{
+			revision: earliestRevision + MetadataRevision(i),
+			mdID:     mdID,
+			size:     size,
+		})
+		if s.heldMDs[mdID] > 0 {
+			plan.deferred = append(plan.deferred, mdID)
+		} else {
+			plan.bytesFreed += size
+		}
+	}
+
+	newEarliestID, err := j.readMdID(limit)
+	if err != nil {
+		return mdPrunePlan{}, err
+	}
+	stored, _, err := s.readStoredMDReadLocked(ctx, newEarliestID)
+	if err != nil {
+		return mdPrunePlan{}, err
+	}
+	if isMDDelta(stored) {
+		full, _, err := s.readEncodedMDReadLocked(ctx, newEarliestID)
+		if err != nil {
+			return mdPrunePlan{}, err
+		}
+		plan.bytesFreed -= int64(len(full) - len(stored))
+	}
+	return plan, nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// mdServerCorruptDirName is the subdirectory of an mdServerTlfStorage
+// directory to which MD objects that fail verification are moved,
+// with quarantineCorrupt set.
+const mdServerCorruptDirName = "corrupt"
+
+// errMDCorruptQuarantined is returned for a read of an MD object that
+// failed verification and was moved to dir/corrupt, but couldn't be
+// repaired from quarantineFallback.
+var errMDCorruptQuarantined = errors.New(
+	"MD object is corrupt and has been quarantined")
+
+// mdCorruptError is returned by verifyMDAndSizeReadLocked for an MD
+// object that was read, but didn't decode, or decoded to an MD with
+// a different ID. Only these are quarantined; I/O errors aren't.
+type mdCorruptError struct {
+	id  MdID
+	err error
+}
+
+func (e mdCorruptError) Error() string {
+	return e.err.Error()
+}
+
+func (s *mdServerTlfStorage) corruptMDPath(id MdID) string {
+	return filepath.Join(s.dir, mdServerCorruptDirName, id.String())
+}
+
+// locateMDReadLocked returns the branch and revision under which the
+// MD with the given ID is recorded, by scanning the branch journals.
+// It's only used to repair corrupt objects, which should be rare
+// enough that the scan doesn't matter.
+func (s *mdServerTlfStorage) locateMDReadLocked(id MdID) (
+	BranchID, MetadataRevision, bool, error) {
+	for bid, j := range s.branchJournals {
+		revision, ok, err := locateMDInJournal(j, id)
+		if err != nil {
+			return NullBranchID, MetadataRevisionUninitialized,
+				false, err
+		} else if ok {
+			return bid, revision, true, nil
+		}
+	}
+	return NullBranchID, MetadataRevisionUninitialized, false, nil
+}
+
+func locateMDInJournal(j mdServerBranchJournal, id MdID) (
+	MetadataRevision, bool, error) {
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized, false, err
+	} else if earliest == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, false, nil
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return MetadataRevisionUninitialized, false, err
+	}
+	for r := latest; r >= earliest; r-- {
+		rID, err := j.readMdID(r)
+		if err != nil {
+			return MetadataRevisionUninitialized, false, err
+		} else if rID == id {
+			return r, true, nil
+		}
+	}
+	return MetadataRevisionUninitialized, false, nil
+}
+
+// tlfIDForRepairReadLocked returns the ID of the TLF, which the
+// storage doesn't otherwise know, from an MD near the given revision
+// of the given branch that isn't corrupt itself.
+func (s *mdServerTlfStorage) tlfIDForRepairReadLocked(ctx context.Context,
+	bid BranchID, revision MetadataRevision) (TlfID, bool) {
+	j := s.branchJournals[bid]
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return TlfID{}, false
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return TlfID{}, false
+	}
+	for _, r := range []MetadataRevision{
+		revision - 1, revision + 1, earliest, latest,
+	} {
+		if r == revision || r < earliest || r > latest {
+			continue
+		}
+		id, err := j.readMdID(r)
+		if err != nil {
+			continue
+		}
+		rmds, _, err := s.verifyMDAndSizeReadLocked(ctx, id)
+		if err != nil {
+			continue
+		}
+		return rmds.MD.ID, true
+	}
+	return TlfID{}, false
+}
+
+// quarantineMDReadLocked moves the MD object with the given ID,
+// which failed verification with the given error, to dir/corrupt,
+// and then tries to replace it with the same MD fetched from
+// quarantineFallback. It returns nil if the object was replaced, and
+// errMDCorruptQuarantined if not.
+//
+// Only the read lock is needed, since the object is replaced by a
+// rename, and since puts, which hold the write lock, never rewrite an
+// existing object. Concurrent readers of the same object are
+// serialized by quarantineLock, and all but the first find it
+// already repaired or quarantined.
+func (s *mdServerTlfStorage) quarantineMDReadLocked(
+	ctx context.Context, id MdID, verifyErr error) error {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+
+	if _, _, err := s.verifyMDAndSizeReadLocked(ctx, id); err == nil {
+		// Repaired by a concurrent reader.
+		return nil
+	}
+
+	path, fileInfo, err := s.statMDReadLocked(id)
+	switch {
+	case err == nil:
+		corruptPath := s.corruptMDPath(id)
+		err = os.MkdirAll(filepath.Dir(corruptPath), 0700)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(path, corruptPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.uncacheMD(id)
+		s.log.CWarningf(ctx, "Quarantined corrupt MD %s: %v",
+			id, verifyErr)
+	case os.IsNotExist(err):
+		// Quarantined earlier, but not repaired; the fallback
+		// may have it by now.
+		fileInfo, err = os.Stat(s.corruptMDPath(id))
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if s.quarantineFallback == nil {
+		return errMDCorruptQuarantined
+	}
+
+	err = s.repairMDReadLocked(ctx, id, fileInfo)
+	if err != nil {
+		s.log.CWarningf(ctx, "Couldn't repair corrupt MD %s: %v",
+			id, err)
+		return errMDCorruptQuarantined
+	}
+	s.log.CDebugf(ctx, "Repaired corrupt MD %s from fallback", id)
+	return nil
+}
+
+// repairMDReadLocked fetches the MD with the given ID from
+// quarantineFallback and, if it has that ID, writes it back in full
+// to dir/mds, with the modification time of the quarantined object
+// so that its server timestamp is kept.
+func (s *mdServerTlfStorage) repairMDReadLocked(
+	ctx context.Context, id MdID, quarantined os.FileInfo) error {
+	bid, revision, ok, err := s.locateMDReadLocked(id)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("MD %s isn't in any branch journal", id)
+	}
+
+	tlfID, ok := s.tlfIDForRepairReadLocked(ctx, bid, revision)
+	if !ok {
+		return fmt.Errorf(
+			"No other MD in branch %s to get the TLF ID from", bid)
+	}
+
+	mStatus := Merged
+	if bid != NullBranchID {
+		mStatus = Unmerged
+	}
+	rmdses, err := s.quarantineFallback.GetRange(
+		ctx, tlfID, bid, mStatus, revision, revision)
+	if err != nil {
+		return err
+	} else if len(rmdses) != 1 {
+		return fmt.Errorf("Fallback returned %d MDs for revision %s",
+			len(rmdses), revision)
+	}
+
+	fetchedID, err := s.idFunc(&rmdses[0].MD)
+	if err != nil {
+		return err
+	} else if fetchedID != id {
+		return fmt.Errorf(
+			"Fallback returned MD %s, not %s", fetchedID, id)
+	}
+	buf, err := s.codec.Encode(rmdses[0])
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that concurrent readers
+	// never see a partial object.
+	path := s.mdPath(id)
+	err = s.checkSymlinks(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.corruptMDPath(id) + ".repaired"
+	err = s.writeFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	mtime := quarantined.ModTime()
+	err = os.Chtimes(tmpPath, mtime, mtime)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	s.uncacheMD(id)
+	return nil
+}
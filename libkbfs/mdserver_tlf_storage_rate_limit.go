@@ -0,0 +1,156 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// mdWriteRateLimit configures the token buckets that limit the rate
+// of puts to an mdServerTlfStorage. Each put takes a token; tokens
+// are added at rate per second, up to burst. The merged branch and
+// the unmerged branches have separate buckets, so that a client
+// stuck resolving conflicts can't starve the merged branch, or vice
+// versa.
+type mdWriteRateLimit struct {
+	// rate is the number of puts per second allowed in the long
+	// run. A non-positive rate means no limit.
+	rate float64
+	// burst is the number of puts that may be made at once after
+	// a quiet period. It is at least 1.
+	burst int
+}
+
+func (l mdWriteRateLimit) maxTokens() float64 {
+	if l.burst < 1 {
+		return 1
+	}
+	return float64(l.burst)
+}
+
+// mdWriteTokenBucket is the state of one of the token buckets
+// configured by an mdWriteRateLimit.
+type mdWriteTokenBucket struct {
+	tokens float64
+	// last is when tokens was last updated. A zero last means
+	// the bucket is full.
+	last time.Time
+	// throttled is the number of puts rejected so far.
+	throttled uint64
+}
+
+// refill adds the tokens accrued up to now.
+func (b *mdWriteTokenBucket) refill(now time.Time, limit mdWriteRateLimit) {
+	if b.last.IsZero() {
+		b.tokens = limit.maxTokens()
+		b.last = now
+		return
+	}
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed.Seconds() * limit.rate
+	if b.tokens > limit.maxTokens() {
+		b.tokens = limit.maxTokens()
+	}
+	b.last = now
+}
+
+// take takes a token from the bucket if there is one, and otherwise
+// returns how long until there will be.
+func (b *mdWriteTokenBucket) take(
+	now time.Time, limit mdWriteRateLimit) (retryAfter time.Duration) {
+	b.refill(now, limit)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	b.throttled++
+	return time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+}
+
+// mdServerTlfStorageRateLimitedError is wrapped in an
+// MDServerErrorThrottle by put when the write rate limit of the
+// branch's bucket is exceeded.
+type mdServerTlfStorageRateLimitedError struct {
+	bid BranchID
+	// retryAfter is how long until the put would be allowed,
+	// barring other puts in the meantime.
+	retryAfter time.Duration
+}
+
+func (e mdServerTlfStorageRateLimitedError) Error() string {
+	return fmt.Sprintf("Write rate limit exceeded for branch %s; "+
+		"retry after %s", e.bid, e.retryAfter)
+}
+
+// mdWriteRateStatus reports the state of one write rate limit bucket.
+type mdWriteRateStatus struct {
+	// available is the number of puts that could be made right
+	// away.
+	available float64
+	// throttled is the number of puts rejected so far.
+	throttled uint64
+}
+
+// writeBucketLocked returns the write rate limit bucket for the
+// given branch.
+func (s *mdServerTlfStorage) writeBucketLocked(
+	bid BranchID) *mdWriteTokenBucket {
+	if bid == NullBranchID {
+		return &s.mergedWriteBucket
+	}
+	return &s.unmergedWriteBucket
+}
+
+// takeWriteTokenLocked takes a token from the write rate limit
+// bucket of the given branch, or returns an MDServerErrorThrottle if
+// there is none.
+func (s *mdServerTlfStorage) takeWriteTokenLocked(bid BranchID) error {
+	if s.writeRateLimit.rate <= 0 {
+		return nil
+	}
+	retryAfter := s.writeBucketLocked(bid).take(
+		s.clock.Now(), s.writeRateLimit)
+	if retryAfter > 0 {
+		return MDServerErrorThrottle{
+			Err: mdServerTlfStorageRateLimitedError{
+				bid:        bid,
+				retryAfter: retryAfter,
+			},
+		}
+	}
+	return nil
+}
+
+// writeRateStatus returns the state of the write rate limit buckets
+// of the merged branch and of the unmerged branches.
+func (s *mdServerTlfStorage) writeRateStatus() (
+	merged, unmerged mdWriteRateStatus, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdWriteRateStatus{}, mdWriteRateStatus{}, err
+	}
+
+	status := func(b mdWriteTokenBucket) mdWriteRateStatus {
+		// b is a copy, so refilling it doesn't need the
+		// write lock.
+		if s.writeRateLimit.rate > 0 {
+			b.refill(s.clock.Now(), s.writeRateLimit)
+		} else {
+			b.tokens = math.Inf(1)
+		}
+		return mdWriteRateStatus{
+			available: b.tokens,
+			throttled: b.throttled,
+		}
+	}
+	return status(s.mergedWriteBucket), status(s.unmergedWriteBucket), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"math"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// mdServerTlfStorageReadSnapshot is a stable view of the branches of
+// an mdServerTlfStorage as of when it was made by readSnapshot. The
+// MDs it refers to aren't removed by prune until it is released,
+// but it doesn't block writes.
+type mdServerTlfStorageReadSnapshot struct {
+	s *mdServerTlfStorage
+	// earliest and mdIDs describe each non-empty branch: its
+	// earliest revision, and the IDs of its MDs from then on.
+	earliest map[BranchID]MetadataRevision
+	mdIDs    map[BranchID][]MdID
+	// released is protected by s.lock.
+	released bool
+}
+
+// readSnapshot returns a read snapshot of the current contents of all
+// branches, which must be released once no longer needed.
+func (s *mdServerTlfStorage) readSnapshot() (
+	*mdServerTlfStorageReadSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	snapshot := &mdServerTlfStorageReadSnapshot{
+		s:        s,
+		earliest: make(map[BranchID]MetadataRevision),
+		mdIDs:    make(map[BranchID][]MdID),
+	}
+	for bid, j := range s.branchJournals {
+		earliest, mdIDs, err := j.getRange(
+			MetadataRevisionInitial, math.MaxInt64)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if len(mdIDs) == 0 {
+			continue
+		}
+		snapshot.earliest[bid] = earliest
+		snapshot.mdIDs[bid] = mdIDs
+	}
+
+	for _, mdIDs := range snapshot.mdIDs {
+		for _, mdID := range mdIDs {
+			s.heldMDs[mdID]++
+		}
+	}
+	return snapshot, nil
+}
+
+var errMDServerTlfStorageReadSnapshotReleased = errors.New(
+	"Read snapshot has been released")
+
+// getRange is like mdServerTlfStorage.getRange, but returns the MDs
+// in the snapshot.
+func (rs *mdServerTlfStorageReadSnapshot) getRange(ctx context.Context,
+	currentUID keybase1.UID, deviceKID keybase1.KID,
+	bid BranchID, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	s := rs.s
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	if rs.released {
+		return nil, errMDServerTlfStorageReadSnapshotReleased
+	}
+
+	err := s.checkGetParamsReadLocked(ctx, currentUID, deviceKID, bid)
+	if err != nil {
+		return nil, err
+	}
+
+	mdIDs := rs.mdIDs[bid]
+	earliest := rs.earliest[bid]
+	if start < earliest {
+		start = earliest
+	}
+	latest := earliest + MetadataRevision(len(mdIDs)) - 1
+	if stop > latest {
+		stop = latest
+	}
+
+	var rmdses []*RootMetadataSigned
+	for r := start; r <= stop; r++ {
+		rmds, _, err := s.getMDAndSizeReadLocked(
+			ctx, mdIDs[r-earliest])
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		rmdses = append(rmdses, rmds)
+	}
+	return rmdses, nil
+}
+
+// release lets prune remove the MDs held by the snapshot, and removes
+// the ones it has already pruned that no other snapshot holds.
+// Releasing a snapshot more than once is a no-op.
+func (rs *mdServerTlfStorageReadSnapshot) release() error {
+	s := rs.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if rs.released {
+		return nil
+	}
+	rs.released = true
+
+	if s.state != mdServerTlfStorageOpen {
+		// close has already done any deferred removals.
+		return nil
+	}
+
+	var toRemove []MdID
+	for _, mdIDs := range rs.mdIDs {
+		for _, mdID := range mdIDs {
+			s.heldMDs[mdID]--
+			if s.heldMDs[mdID] > 0 {
+				continue
+			}
+			delete(s.heldMDs, mdID)
+			if s.deferredRemovals[mdID] {
+				toRemove = append(toRemove, mdID)
+			}
+		}
+	}
+
+	if len(toRemove) == 0 {
+		return nil
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	for _, mdID := range toRemove {
+		err := s.removeMDLocked(mdID)
+		if err != nil {
+			return err
+		}
+		delete(s.deferredRemovals, mdID)
+	}
+	return nil
+}
@@ -0,0 +1,512 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// mdMergedReconstructionReport describes what reconstructMergedHead
+// was able to recover.
+type mdMergedReconstructionReport struct {
+	// earliest and latest are the range of revisions of the
+	// rebuilt merged journal, or MetadataRevisionUninitialized
+	// if nothing could be recovered.
+	earliest MetadataRevision
+	latest   MetadataRevision
+	// unrecovered holds the sorted IDs of the merged MD objects
+	// that couldn't be put into the rebuilt journal, because they
+	// aren't connected to its head by a chain of predecessors,
+	// e.g. because of a missing object in between.
+	unrecovered []MdID
+	// unanchoredBranches holds the branches whose divergence
+	// point isn't in the rebuilt journal.
+	unanchoredBranches []BranchID
+}
+
+// reconstructMergedHead is a last-resort recovery tool for when the
+// merged journal has been lost, but merged MD objects remain in
+// dir/mds. It finds the merged MD with the highest revision, follows
+// its chain of predecessors back as far as the objects allow, and
+// writes that chain as the new merged journal. The branches whose
+// divergence points aren't in it are reported, along with the
+// merged MD objects that were left out.
+//
+// It fails if the merged journal isn't empty.
+func (s *mdServerTlfStorage) reconstructMergedHead() (
+	mdMergedReconstructionReport, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return mdMergedReconstructionReport{}, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return mdMergedReconstructionReport{}, err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return mdMergedReconstructionReport{},
+			MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	if j, ok := s.branchJournals[NullBranchID]; ok {
+		length, err := j.journalLength()
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		if length > 0 {
+			return mdMergedReconstructionReport{}, errors.New(
+				"The merged journal isn't empty")
+		}
+	}
+
+	// Make sure every MD object is on disk, and thus in the index.
+	err = s.flushWriteBufferLocked()
+	if err != nil {
+		return mdMergedReconstructionReport{}, err
+	}
+
+	merged := make(map[MdID]*RootMetadataSigned)
+	var head MdID
+	for _, mdID := range s.mdIDIndex {
+		rmds, err := s.getMDReadLocked(mdID)
+		if err != nil {
+			// Skip objects that are unreadable, e.g.
+			// deltas whose base is gone.
+			continue
+		}
+		if rmds.MD.BID != NullBranchID {
+			continue
+		}
+		merged[mdID] = rmds
+		if head == (MdID{}) ||
+			rmds.MD.Revision > merged[head].MD.Revision {
+			head = mdID
+		}
+	}
+
+	report := mdMergedReconstructionReport{
+		earliest: MetadataRevisionUninitialized,
+		latest:   MetadataRevisionUninitialized,
+	}
+
+	// Follow the predecessors of the head, which are stored
+	// newest first.
+	var chain []MdID
+	inChain := make(map[MdID]bool)
+	for mdID, ok := head, head != (MdID{}); ok; {
+		chain = append(chain, mdID)
+		inChain[mdID] = true
+		rmds := merged[mdID]
+		prev, prevOK := merged[rmds.MD.PrevRoot]
+		if !prevOK || prev.MD.Revision != rmds.MD.Revision-1 {
+			break
+		}
+		mdID = rmds.MD.PrevRoot
+	}
+
+	if len(chain) > 0 {
+		j, err := s.getOrCreateBranchJournalLocked(NullBranchID)
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		mdIDs := make([]MdID, len(chain))
+		for i, mdID := range chain {
+			mdIDs[len(chain)-1-i] = mdID
+		}
+		err = j.appendBatch(merged[mdIDs[0]].MD.Revision, mdIDs)
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		_, err = s.rebuildWritersLocked(NullBranchID)
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		report.earliest = merged[chain[len(chain)-1]].MD.Revision
+		report.latest = merged[chain[0]].MD.Revision
+	}
+
+	for _, mdID := range s.mdIDIndex {
+		if _, ok := merged[mdID]; ok && !inChain[mdID] {
+			report.unrecovered = append(report.unrecovered, mdID)
+		}
+	}
+
+	for bid, j := range s.branchJournals {
+		if bid == NullBranchID {
+			continue
+		}
+		earliestRevision, err := j.readEarliestRevision()
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		if earliestRevision == MetadataRevisionUninitialized {
+			continue
+		}
+		earliestID, err := j.readMdID(earliestRevision)
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		earliest, err := s.getMDReadLocked(earliestID)
+		if err != nil {
+			return mdMergedReconstructionReport{}, err
+		}
+		if !inChain[earliest.MD.PrevRoot] {
+			report.unanchoredBranches = append(
+				report.unanchoredBranches, bid)
+		}
+	}
+	sort.Sort(branchIDList(report.unanchoredBranches))
+
+	return report, nil
+}
+
+// mdBranchPointerProblem describes a branch whose earliest and
+// latest revisions are inconsistent.
+type mdBranchPointerProblem struct {
+	bid BranchID
+	// err is the inconsistency found.
+	err error
+	// If repaired is true, earliest and latest are the new
+	// revisions; otherwise, if a repair was attempted, repairErr
+	// is why the branch needs manual intervention.
+	repaired         bool
+	earliest, latest MetadataRevision
+	repairErr        error
+}
+
+// checkBranchPointers looks for branches on disk whose earliest and
+// latest revisions are inconsistent, e.g. with EARLIEST greater than
+// LATEST, which makes open fail. If repair is true, it resets them to
+// the range of the journal entries actually present, if that range
+// is contiguous; a branch with gaps is left alone and reported.
+//
+// It may be called whether or not s is open.
+func (s *mdServerTlfStorage) checkBranchPointers(repair bool) (
+	[]mdBranchPointerProblem, error) {
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	switch s.state {
+	case mdServerTlfStorageClosed:
+		return nil, errMDServerTlfStorageClosed
+	case mdServerTlfStorageOpen:
+		if repair {
+			unfence, err := s.fenceLocked()
+			if err != nil {
+				return nil, err
+			}
+			defer unfence()
+		}
+	}
+
+	bids, err := s.getBranchIDsOnDiskReadLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []mdBranchPointerProblem
+	for _, bid := range bids {
+		j := makeMDServerBranchJournal(s.codec, s.branchJournalPath(bid))
+		err := j.checkPointers()
+		if err == nil {
+			continue
+		}
+		problem := mdBranchPointerProblem{
+			bid:      bid,
+			err:      err,
+			earliest: MetadataRevisionUninitialized,
+			latest:   MetadataRevisionUninitialized,
+		}
+		if repair {
+			earliest, latest, err := j.rebuildPointers()
+			if err != nil {
+				problem.repairErr = err
+			} else {
+				problem.repaired = true
+				problem.earliest = earliest
+				problem.latest = latest
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// dropUnwrittenTailLocked removes the entries at the end of the
+// given journal whose MD objects were never written to disk, which
+// can happen only if the process died while those MDs were buffered.
+func (s *mdServerTlfStorage) dropUnwrittenTailLocked(
+	j mdServerBranchJournal) error {
+	for {
+		headID, err := j.getHead()
+		if err != nil {
+			return err
+		}
+		if headID == (MdID{}) {
+			return nil
+		}
+
+		_, err = os.Stat(s.mdPath(headID))
+		if err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		_, _, err = j.removeLatest()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mdTimestampRepair describes a revision whose server timestamp was
+// replaced by repairTimestamps.
+type mdTimestampRepair struct {
+	revision     MetadataRevision
+	oldTimestamp time.Time
+	newTimestamp time.Time
+}
+
+// repairTimestamps reconstructs the server timestamps of the given
+// branch after they have been lost, e.g. when a restore from backup
+// set the modification times of all the MD object files, which are
+// the timestamps, to the time of the restore. The history of the
+// branch must have been written between windowStart and windowEnd.
+//
+// A timestamp is kept if it is within the window, and strictly
+// between the timestamps of the previous and next revisions. The
+// others are replaced, so that each run of them is spaced evenly
+// between the nearest kept timestamps before and after it, or the
+// ends of the window. The result increases strictly with revision.
+// Replaced timestamps are only approximations, and are listed by
+// approximateTimestamps from then on.
+//
+// It returns the replaced timestamps.
+func (s *mdServerTlfStorage) repairTimestamps(bid BranchID,
+	windowStart, windowEnd time.Time) ([]mdTimestampRepair, error) {
+	if !windowStart.Before(windowEnd) {
+		return nil, MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Empty timestamp window [%s, %s]",
+			windowStart, windowEnd)}
+	}
+
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return nil, err
+	}
+	defer unfence()
+
+	if s.quiesced {
+		return nil, MDServerErrorThrottle{errMDServerTlfStorageQuiesced}
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+
+	// The timestamps of buffered MDs aren't on disk yet.
+	err = s.flushWriteBufferLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	earliest, mdIDs, err := j.getRange(
+		MetadataRevisionInitial, math.MaxInt64)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	paths := make([]string, len(mdIDs))
+	timestamps := make([]time.Time, len(mdIDs))
+	for i, mdID := range mdIDs {
+		path, fileInfo, err := s.statMDReadLocked(mdID)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		paths[i] = path
+		timestamps[i] = fileInfo.ModTime()
+	}
+
+	keep := make([]bool, len(mdIDs))
+	for i, t := range timestamps {
+		keep[i] = t.After(windowStart) && t.Before(windowEnd) &&
+			(i == 0 || t.After(timestamps[i-1])) &&
+			(i == len(mdIDs)-1 || t.Before(timestamps[i+1]))
+	}
+	// A kept timestamp may still be out of order relative to the
+	// kept timestamps beyond its neighbors; drop those too, so
+	// that each run of replaced timestamps has room between its
+	// bounds.
+	var last time.Time
+	for i := range timestamps {
+		if !keep[i] {
+			continue
+		}
+		if !last.IsZero() && !timestamps[i].After(last) {
+			keep[i] = false
+			continue
+		}
+		last = timestamps[i]
+	}
+
+	approximate, err := s.readApproximateTimesReadLocked(bid)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	var repairs []mdTimestampRepair
+	for i := 0; i < len(mdIDs); {
+		if keep[i] {
+			i++
+			continue
+		}
+
+		// Find the run of replaced timestamps starting at i,
+		// and its bounds.
+		runEnd := i
+		for runEnd < len(mdIDs) && !keep[runEnd] {
+			runEnd++
+		}
+		lo := windowStart
+		if i > 0 {
+			lo = timestamps[i-1]
+		}
+		hi := windowEnd
+		if runEnd < len(mdIDs) {
+			hi = timestamps[runEnd]
+		}
+		step := hi.Sub(lo) / time.Duration(runEnd-i+1)
+		if step <= 0 {
+			return nil, MDServerError{fmt.Errorf(
+				"No room between %s and %s for the timestamps "+
+					"of %d revisions", lo, hi, runEnd-i)}
+		}
+
+		for k := i; k < runEnd; k++ {
+			newTimestamp := lo.Add(step * time.Duration(k-i+1))
+			// Rewrite the file rather than change its
+			// times in place, so that any hard links to
+			// it made by snapshot keep the old timestamp.
+			release := s.acquireFile(context.Background())
+			data, err := s.readFile(paths[k])
+			release()
+			if err == nil {
+				err = s.rewriteMDLocked(
+					mdIDs[k], data, newTimestamp)
+			}
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			revision := earliest + MetadataRevision(k)
+			repairs = append(repairs, mdTimestampRepair{
+				revision:     revision,
+				oldTimestamp: timestamps[k],
+				newTimestamp: newTimestamp,
+			})
+			approximate = append(approximate, revision)
+			timestamps[k] = newTimestamp
+		}
+		i = runEnd
+	}
+
+	if len(repairs) == 0 {
+		return nil, nil
+	}
+	err = s.writeApproximateTimesLocked(bid, approximate)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	return repairs, nil
+}
+
+// approximateTimestamps returns the retained revisions of the given
+// branch whose timestamps were reconstructed by repairTimestamps, in
+// order.
+func (s *mdServerTlfStorage) approximateTimestamps(bid BranchID) (
+	[]MetadataRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return nil, err
+	}
+
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil, nil
+	}
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	approximate, err := s.readApproximateTimesReadLocked(bid)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	// Skip pruned revisions.
+	var retained []MetadataRevision
+	for _, r := range approximate {
+		if r >= earliest {
+			retained = append(retained, r)
+		}
+	}
+	return retained, nil
+}
+
+func (s *mdServerTlfStorage) readApproximateTimesReadLocked(
+	bid BranchID) ([]MetadataRevision, error) {
+	buf, err := ioutil.ReadFile(s.approximateTimesPath(bid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var approximate []MetadataRevision
+	err = s.codec.Decode(buf, &approximate)
+	if err != nil {
+		return nil, err
+	}
+	return approximate, nil
+}
+
+func (s *mdServerTlfStorage) writeApproximateTimesLocked(
+	bid BranchID, approximate []MetadataRevision) error {
+	sort.Sort(revisionList(approximate))
+	// Drop duplicates from repeated repairs.
+	var deduped []MetadataRevision
+	for i, r := range approximate {
+		if i == 0 || r != approximate[i-1] {
+			deduped = append(deduped, r)
+		}
+	}
+	buf, err := s.codec.Encode(deduped)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.approximateTimesPath(bid), buf, 0600)
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mdRevisionIndexEntry is a line of the REVISIONS file of a branch.
+type mdRevisionIndexEntry struct {
+	revision MetadataRevision
+	id       MdID
+}
+
+func (s *mdServerTlfStorage) revisionIndexPath(bid BranchID) string {
+	return filepath.Join(s.branchJournalPath(bid), "REVISIONS")
+}
+
+// formatRevisionIndexEntry returns the line of the REVISIONS file for
+// the given revision and MD. Unlike the other files in the branch
+// subdirectory, which are encoded with s.codec, REVISIONS is plain
+// text, one line per revision:
+//
+//	<revision> <MdID> <path of the MD object relative to dir>
+//
+// so that it can be read without any tools. An MD object demoted to
+// coldMDsDir is at the same path, with dir/mds replaced by
+// coldMDsDir.
+func (s *mdServerTlfStorage) formatRevisionIndexEntry(
+	revision MetadataRevision, id MdID) string {
+	path, err := filepath.Rel(s.dir, s.mdPath(id))
+	if err != nil {
+		path = s.mdPath(id)
+	}
+	return fmt.Sprintf("%d %s %s\n", revision, id, path)
+}
+
+// appendRevisionIndexLocked adds the given revision, which has just
+// been appended to the journal of the given branch, to its REVISIONS
+// file.
+func (s *mdServerTlfStorage) appendRevisionIndexLocked(
+	bid BranchID, revision MetadataRevision, id MdID) error {
+	f, err := os.OpenFile(s.revisionIndexPath(bid),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(s.formatRevisionIndexEntry(revision, id))
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// rebuildRevisionIndexLocked rewrites the REVISIONS file of the given
+// branch from its journal, which is authoritative.
+func (s *mdServerTlfStorage) rebuildRevisionIndexLocked(
+	bid BranchID) error {
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return nil
+	}
+	start, mdIDs, err := j.getRange(
+		MetadataRevisionInitial, MetadataRevision(math.MaxInt64))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for i, mdID := range mdIDs {
+		buf.WriteString(s.formatRevisionIndexEntry(
+			start+MetadataRevision(i), mdID))
+	}
+	return writeFileAtomically(s.revisionIndexPath(bid), buf.Bytes(), 0600)
+}
+
+// readRevisionIndexReadLocked returns the entries of the REVISIONS
+// file of the given branch, in order.
+func (s *mdServerTlfStorage) readRevisionIndexReadLocked(bid BranchID) (
+	[]mdRevisionIndexEntry, error) {
+	f, err := os.Open(s.revisionIndexPath(bid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []mdRevisionIndexEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf(
+				"Malformed REVISIONS line %q", scanner.Text())
+		}
+		r, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		h, err := HashFromString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, mdRevisionIndexEntry{
+			revision: MetadataRevision(r),
+			id:       MdID{h},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
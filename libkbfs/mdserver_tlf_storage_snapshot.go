@@ -0,0 +1,160 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mdServerSnapshotEntries are the entries of dir that snapshot
+// copies: the config, the journals, and the objects. The rest, e.g.
+// the EPOCH and lock files, the MDIDS index, and leftovers of
+// interrupted writes, belongs to the instances that opened dir, and
+// the copy's first open makes its own.
+var mdServerSnapshotEntries = map[string]bool{
+	"VERSION":                            true,
+	"CONFIG":                             true,
+	mdServerBranchJournalsDirName:        true,
+	mdServerBranchTombstonesDirName:      true,
+	mdServerMDsDirName:                   true,
+	"key_bundles":                        true,
+	mdServerChangeFeedDirName:            true,
+	mdServerChangeFeedCheckpointsDirName: true,
+	mdServerMDHeadersDirName:             true,
+	mdServerHighWaterMarksDirName:        true,
+	mdServerAnnotationsDirName:           true,
+}
+
+// snapshot makes a point-in-time copy of the storage in destDir,
+// which must not already exist. Any buffered MDs are flushed first,
+// and the write lock is held while copying so that the copy is
+// consistent.
+//
+// MD objects are never modified once written, so they're hard-linked
+// when possible, and otherwise copied along with their timestamps;
+// everything else is copied, since it may be rewritten in place.
+// Only the entries in mdServerSnapshotEntries are copied, so the
+// copy starts with a fresh epoch. It can be opened as a separate
+// mdServerTlfStorage.
+func (s *mdServerTlfStorage) snapshot(destDir string) error {
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	err := s.flushWriteBufferLocked()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(destDir)
+	if err == nil {
+		return fmt.Errorf("Snapshot destination %s already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	mdsPath := s.mdsPath()
+	err = filepath.Walk(s.dir,
+		func(path string, info os.FileInfo, walkErr error) error {
+			rel, err := filepath.Rel(s.dir, path)
+			if err != nil {
+				return err
+			}
+			// Skip everything else before looking at
+			// walkErr, since e.g. puts stage MDs without
+			// the lock, so dir/md_staging may change or
+			// vanish under the walk.
+			top := strings.SplitN(
+				rel, string(filepath.Separator), 2)[0]
+			if rel != "." && !mdServerSnapshotEntries[top] {
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if walkErr != nil {
+				return walkErr
+			}
+			destPath := filepath.Join(destDir, rel)
+
+			if info.IsDir() {
+				return os.MkdirAll(destPath, 0700)
+			}
+
+			if strings.HasSuffix(path, ".tmp") {
+				// Left by an interrupted atomic write.
+				return nil
+			}
+
+			if filepath.Dir(filepath.Dir(path)) == mdsPath {
+				return s.linkOrCopyFile(path, destPath)
+			}
+
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(destPath, buf, 0600)
+		})
+	if err != nil || s.coldMDsDir == "" {
+		return err
+	}
+
+	// Bring the cold MD objects into the copy's dir/mds, so that
+	// the copy doesn't depend on s.coldMDsDir.
+	destMDsPath := filepath.Join(destDir, mdServerMDsDirName)
+	return filepath.Walk(s.coldMDsDir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == s.coldMDsDir {
+					return nil
+				}
+				return err
+			}
+
+			rel, err := filepath.Rel(s.coldMDsDir, path)
+			if err != nil {
+				return err
+			}
+			destPath := filepath.Join(destMDsPath, rel)
+
+			if info.IsDir() {
+				return os.MkdirAll(destPath, 0700)
+			}
+			return s.linkOrCopyFile(path, destPath)
+		})
+}
+
+// linkOrCopyFile hard-links the MD object file src to dst if
+// possible, and otherwise, e.g. if they're on different devices,
+// copies it, keeping its modification time, which is the MD's
+// server timestamp.
+func (s *mdServerTlfStorage) linkOrCopyFile(src, dst string) error {
+	err := s.linkFile(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	fileInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dst, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fileInfo.ModTime(), fileInfo.ModTime())
+}
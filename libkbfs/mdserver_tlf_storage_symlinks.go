@@ -0,0 +1,151 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mdServerTlfStorageSymlinkCheck is the strictness of the checks an
+// mdServerTlfStorage makes on symlinks within its directory, which
+// could otherwise make it read or write files outside of it.
+type mdServerTlfStorageSymlinkCheck int
+
+const (
+	// mdServerTlfStorageSymlinksIgnore follows symlinks as usual.
+	mdServerTlfStorageSymlinksIgnore mdServerTlfStorageSymlinkCheck = iota
+	// mdServerTlfStorageSymlinksContain follows only the symlinks
+	// that resolve to somewhere within the directory.
+	mdServerTlfStorageSymlinksContain
+	// mdServerTlfStorageSymlinksRefuse follows no symlinks.
+	mdServerTlfStorageSymlinksRefuse
+)
+
+// mdServerTlfStorageSymlinkError is returned when a symlink within a
+// storage directory fails the check set for it.
+type mdServerTlfStorageSymlinkError struct {
+	path    string
+	problem string
+}
+
+func (e mdServerTlfStorageSymlinkError) Error() string {
+	return fmt.Sprintf("Symlink %s in storage directory: %s",
+		e.path, e.problem)
+}
+
+// isPathWithin returns whether path is root or somewhere under it.
+// Both must be clean, and either both absolute or both relative.
+func isPathWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkSymlink returns an mdServerTlfStorageSymlinkError if the
+// symlink at path, within root, fails the given check.
+func checkSymlink(
+	root, path string, check mdServerTlfStorageSymlinkCheck) error {
+	switch check {
+	case mdServerTlfStorageSymlinksIgnore:
+		return nil
+	case mdServerTlfStorageSymlinksRefuse:
+		return mdServerTlfStorageSymlinkError{
+			path: path, problem: "symlinks aren't allowed"}
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return mdServerTlfStorageSymlinkError{
+			path: path, problem: "it doesn't resolve"}
+	} else if err != nil {
+		return err
+	}
+	if !isPathWithin(resolvedRoot, target) {
+		return mdServerTlfStorageSymlinkError{
+			path: path,
+			problem: fmt.Sprintf("it resolves to %s, outside of %s",
+				target, root),
+		}
+	}
+	return nil
+}
+
+// checkPathSymlinks checks each existing component of path below
+// root, which is trusted, for symlinks that fail the given check. It
+// does nothing if path isn't under root.
+func checkPathSymlinks(
+	root, path string, check mdServerTlfStorageSymlinkCheck) error {
+	if check == mdServerTlfStorageSymlinksIgnore {
+		return nil
+	}
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	if !isPathWithin(root, path) || path == root {
+		return nil
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	p := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, name)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			// Whatever is missing will be made as a
+			// regular file or directory.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := checkSymlink(root, p, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDirSymlinks checks every symlink under dir, which is trusted,
+// against the given check, and returns the error for the first one
+// that fails it.
+func checkDirSymlinks(dir string, check mdServerTlfStorageSymlinkCheck) error {
+	if check == mdServerTlfStorageSymlinksIgnore {
+		return nil
+	}
+	// Walk doesn't follow symlinks, so walk the directory dir
+	// resolves to, in case dir is a symlink itself.
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(resolvedDir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			rel, err := filepath.Rel(resolvedDir, path)
+			if err != nil {
+				return err
+			}
+			return checkSymlink(dir, filepath.Join(dir, rel), check)
+		})
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func requireSymlinkErrorForTest(t *testing.T, err error) {
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "Symlink"), err.Error())
+}
+
+func TestMDServerTlfStorageSymlinkCheck(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(root)
+		require.NoError(t, err)
+	}()
+
+	dir := filepath.Join(root, "storage")
+	outside := filepath.Join(root, "outside")
+	err = os.MkdirAll(outside, 0700)
+	require.NoError(t, err)
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	ctx := context.Background()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	openForTest := func(check mdServerTlfStorageSymlinkCheck) (
+		*mdServerTlfStorage, error) {
+		s := makeMDServerTlfStorage(codec, crypto, dir)
+		s.symlinkCheck = check
+		return s, s.open(ctx)
+	}
+
+	s, err := openForTest(mdServerTlfStorageSymlinksRefuse)
+	require.NoError(t, err)
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+	err = s.close()
+	require.NoError(t, err)
+
+	// Move the directory of the first MD outside of the storage
+	// directory, and leave a symlink to it in its place.
+	splayDir := filepath.Dir(s.mdPath(mdIDs[0]))
+	movedDir := filepath.Join(outside, filepath.Base(splayDir))
+	err = os.Rename(splayDir, movedDir)
+	require.NoError(t, err)
+	err = os.Symlink(movedDir, splayDir)
+	require.NoError(t, err)
+
+	for _, check := range []mdServerTlfStorageSymlinkCheck{
+		mdServerTlfStorageSymlinksContain,
+		mdServerTlfStorageSymlinksRefuse,
+	} {
+		_, err = openForTest(check)
+		requireSymlinkErrorForTest(t, err)
+	}
+
+	// Without checks, the symlink is followed.
+	s, err = openForTest(mdServerTlfStorageSymlinksIgnore)
+	require.NoError(t, err)
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rmdses))
+	err = s.close()
+	require.NoError(t, err)
+
+	// A symlink that stays within the storage directory is
+	// followed unless all symlinks are refused.
+	err = os.Remove(splayDir)
+	require.NoError(t, err)
+	insideDir := filepath.Join(dir, "moved")
+	err = os.Rename(movedDir, insideDir)
+	require.NoError(t, err)
+	err = os.Symlink(insideDir, splayDir)
+	require.NoError(t, err)
+
+	_, err = openForTest(mdServerTlfStorageSymlinksRefuse)
+	requireSymlinkErrorForTest(t, err)
+
+	s, err = openForTest(mdServerTlfStorageSymlinksContain)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+	rmdses, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rmdses))
+
+	// A symlink made after open is caught when it is read
+	// through...
+	err = os.Remove(splayDir)
+	require.NoError(t, err)
+	err = os.Rename(insideDir, movedDir)
+	require.NoError(t, err)
+	err = os.Symlink(movedDir, splayDir)
+	require.NoError(t, err)
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 1)
+	requireSymlinkErrorForTest(t, err)
+
+	// ...or written through, and nothing is written outside.
+	err = os.Remove(splayDir)
+	require.NoError(t, err)
+	err = os.Rename(movedDir, splayDir)
+	require.NoError(t, err)
+	rmds := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	mdID, err := rmds.MD.MetadataID(crypto)
+	require.NoError(t, err)
+	newSplayDir := filepath.Dir(s.mdPath(mdID))
+	_, err = os.Stat(newSplayDir)
+	require.True(t, os.IsNotExist(err))
+	newMovedDir := filepath.Join(outside, "new")
+	err = os.MkdirAll(newMovedDir, 0700)
+	require.NoError(t, err)
+	err = os.Symlink(newMovedDir, newSplayDir)
+	require.NoError(t, err)
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	requireSymlinkErrorForTest(t, err)
+	fis, err := ioutil.ReadDir(newMovedDir)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(fis))
+}
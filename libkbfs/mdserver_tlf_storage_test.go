@@ -5,12 +5,28 @@
 package libkbfs
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	keybase1 "github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func getMDJournalLength(t *testing.T, s *mdServerTlfStorage, bid BranchID) int {
@@ -19,6 +35,66 @@ func getMDJournalLength(t *testing.T, s *mdServerTlfStorage, bid BranchID) int {
 	return int(len)
 }
 
+func setupMDServerTlfStorageTest(t *testing.T) (
+	tempdir string, s *mdServerTlfStorage) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(context.Background())
+	require.NoError(t, err)
+	return tempdir, s
+}
+
+func teardownMDServerTlfStorageTest(
+	t *testing.T, tempdir string, s *mdServerTlfStorage) {
+	err := s.close()
+	require.NoError(t, err)
+	err = os.RemoveAll(tempdir)
+	require.NoError(t, err)
+}
+
+// makeMDForTest returns a new signed MD for the given TLF with the
+// given revision and previous root.
+func makeMDForTest(t *testing.T, id TlfID, h BareTlfHandle,
+	revision MetadataRevision, prevRoot MdID) *RootMetadataSigned {
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	require.NoError(t, err)
+	rmds.MD.SerializedPrivateMetadata = make([]byte, 1)
+	rmds.MD.SerializedPrivateMetadata[0] = 0x1
+	rmds.MD.Revision = revision
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.PrevRoot = prevRoot
+	rmds.MD.clearCachedMetadataIDForTest()
+	return rmds
+}
+
+// putMDRangeForTest puts MDs for revisions start through stop
+// (inclusive) to the given branch, with the first one pointing to
+// prevRoot, and returns the IDs of the MDs put.
+func putMDRangeForTest(t *testing.T, s *mdServerTlfStorage,
+	uid keybase1.UID, deviceKID keybase1.KID, id TlfID,
+	h BareTlfHandle, bid BranchID, start, stop MetadataRevision,
+	prevRoot MdID) []MdID {
+	var mdIDs []MdID
+	for i := start; i <= stop; i++ {
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		if bid != NullBranchID {
+			rmds.MD.WFlags |= MetadataFlagUnmerged
+			rmds.MD.BID = bid
+		}
+		_, err := s.put(context.Background(), uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, prevRoot)
+	}
+	return mdIDs
+}
+
 // TestMDServerTlfStorageBasic copies TestMDServerBasics, but for a
 // single mdServerTlfStorage.
 func TestMDServerTlfStorageBasic(t *testing.T) {
@@ -32,8 +108,15 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
+	ctx := context.Background()
+
 	s := makeMDServerTlfStorage(codec, crypto, tempdir)
-	defer s.shutdown()
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
 
 	require.Equal(t, 0, getMDJournalLength(t, s, NullBranchID))
 
@@ -45,7 +128,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	// (1) Validate merged branch is empty.
 
-	head, err := s.getForTLF(uid, deviceKID, NullBranchID)
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
 	require.NoError(t, err)
 	require.Nil(t, head)
 
@@ -67,7 +150,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 		if i > 1 {
 			rmds.MD.PrevRoot = prevRoot
 		}
-		recordBranchID, err := s.put(uid, deviceKID, rmds)
+		recordBranchID, err := s.put(ctx, uid, deviceKID, rmds)
 		require.NoError(t, err)
 		require.False(t, recordBranchID)
 		prevRoot, err = rmds.MD.MetadataID(crypto)
@@ -88,7 +171,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 	rmds.MD.SerializedPrivateMetadata[0] = 0x1
 	FakeInitialRekey(&rmds.MD, h)
 	rmds.MD.PrevRoot = prevRoot
-	_, err = s.put(uid, deviceKID, rmds)
+	_, err = s.put(ctx, uid, deviceKID, rmds)
 	require.IsType(t, MDServerErrorConflictRevision{}, err)
 
 	require.Equal(t, 10, getMDJournalLength(t, s, NullBranchID))
@@ -109,7 +192,11 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 		rmds.MD.clearCachedMetadataIDForTest()
 		rmds.MD.WFlags |= MetadataFlagUnmerged
 		rmds.MD.BID = bid
-		recordBranchID, err := s.put(uid, deviceKID, rmds)
+		recordBranchID, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		require.Equal(t, i == MetadataRevision(6), recordBranchID)
+		// A retried put returns the same recordBranchID.
+		recordBranchID, err = s.put(ctx, uid, deviceKID, rmds)
 		require.NoError(t, err)
 		require.Equal(t, i == MetadataRevision(6), recordBranchID)
 		prevRoot, err = rmds.MD.MetadataID(crypto)
@@ -121,7 +208,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	// (5) Check for proper unmerged head.
 
-	head, err = s.getForTLF(uid, deviceKID, bid)
+	head, err = s.getForTLF(ctx, uid, deviceKID, bid)
 	require.NoError(t, err)
 	require.NotNil(t, head)
 	require.Equal(t, MetadataRevision(40), head.MD.Revision)
@@ -131,7 +218,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	// (6) Try to get unmerged range.
 
-	rmdses, err := s.getRange(uid, deviceKID, bid, 1, 100)
+	rmdses, err := s.getRange(ctx, uid, deviceKID, bid, 1, 100)
 	require.NoError(t, err)
 	require.Equal(t, 35, len(rmdses))
 	for i := MetadataRevision(6); i < 16; i++ {
@@ -142,14 +229,14 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	// (10) Check for proper merged head.
 
-	head, err = s.getForTLF(uid, deviceKID, NullBranchID)
+	head, err = s.getForTLF(ctx, uid, deviceKID, NullBranchID)
 	require.NoError(t, err)
 	require.NotNil(t, head)
 	require.Equal(t, MetadataRevision(10), head.MD.Revision)
 
 	// (11) Try to get merged range.
 
-	rmdses, err = s.getRange(uid, deviceKID, NullBranchID, 1, 100)
+	rmdses, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 100)
 	require.NoError(t, err)
 	require.Equal(t, 10, len(rmdses))
 	for i := MetadataRevision(1); i <= 10; i++ {
@@ -159,3 +246,7268 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 	require.Equal(t, 10, getMDJournalLength(t, s, NullBranchID))
 	require.Equal(t, 35, getMDJournalLength(t, s, bid))
 }
+
+func TestMDServerTlfStorageDivergencePoint(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Fork a branch off of merged revision 5.
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 6, 8, mergedIDs[4])
+
+	rev, mdID, err := s.divergencePoint(bid)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), rev)
+	require.Equal(t, mergedIDs[4], mdID)
+
+	_, _, err = s.divergencePoint(NullBranchID)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	_, _, err = s.divergencePoint(FakeBranchID(2))
+	require.Error(t, err)
+
+	// Branches that don't descend cleanly from master can't be
+	// put, so make their journals directly, out of existing MD
+	// objects.
+	makeJournal := func(bid BranchID, start MetadataRevision, id MdID) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		j, err := s.getOrCreateBranchJournalLocked(bid)
+		require.NoError(t, err)
+		err = j.append(start, id)
+		require.NoError(t, err)
+	}
+
+	// The first MD of this branch claims merged revision 3 as its
+	// predecessor, but the branch starts at revision 7.
+	bid2 := FakeBranchID(2)
+	makeJournal(bid2, 7, mergedIDs[3])
+	_, _, err = s.divergencePoint(bid2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "but the merged journal has")
+
+	// This branch diverges past the merged head...
+	bid3 := FakeBranchID(3)
+	makeJournal(bid3, 12, mergedIDs[3])
+	_, _, err = s.divergencePoint(bid3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't in the merged journal")
+
+	// ...and this one before the first merged revision.
+	bid4 := FakeBranchID(4)
+	makeJournal(bid4, MetadataRevisionInitial, mergedIDs[0])
+	_, _, err = s.divergencePoint(bid4)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no merged predecessor")
+}
+
+func TestMDServerTlfStorageVerifySharing(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid1 := FakeBranchID(1)
+	unmergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid1, 4, 5, mdIDs[2])
+
+	problems, err := s.verifySharing()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	makeJournal := func(bid BranchID, ids ...MdID) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		j, err := s.getOrCreateBranchJournalLocked(bid)
+		require.NoError(t, err)
+		for i, id := range ids {
+			err := j.append(MetadataRevision(i+1), id)
+			require.NoError(t, err)
+		}
+	}
+
+	// A branch whose journal starts with the merged history up to
+	// its divergence point shares that prefix legitimately.
+	bid2 := FakeBranchID(2)
+	makeJournal(bid2, mdIDs[0], mdIDs[1], mdIDs[2], fakeMdID(4))
+	problems, err = s.verifySharing()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// A merged revision spliced in after the divergence point is
+	// flagged, as is a revision spliced in from another unmerged
+	// branch.
+	bid3 := FakeBranchID(3)
+	makeJournal(bid3, mdIDs[0], mdIDs[1], fakeMdID(3), mdIDs[3],
+		unmergedIDs[1])
+	problems, err = s.verifySharing()
+	require.NoError(t, err)
+	require.Equal(t, []mdSharingProblem{
+		{
+			id: mdIDs[3],
+			refs: []mdSharedRef{
+				{NullBranchID, 4},
+				{bid3, 4},
+			},
+			reason: fmt.Sprintf("At revision 4 of branch %s, "+
+				"after its divergence point", bid3),
+		},
+		{
+			id: unmergedIDs[1],
+			refs: []mdSharedRef{
+				{bid1, 5},
+				{bid3, 5},
+			},
+			reason: "Shared only by unmerged branches",
+		},
+	}, problems)
+}
+
+// testMDServerTlfStorageAuthorizer denies all accesses by the UIDs
+// in denied, and fails with err if it's set.
+type testMDServerTlfStorageAuthorizer struct {
+	denied map[keybase1.UID]bool
+	err    error
+	reqs   []mdAuthzRequest
+}
+
+func (a *testMDServerTlfStorageAuthorizer) Authorize(
+	ctx context.Context, req mdAuthzRequest) (bool, error) {
+	a.reqs = append(a.reqs, req)
+	if a.err != nil {
+		return false, a.err
+	}
+	return !a.denied[req.uid], nil
+}
+
+func TestMDServerTlfStorageAuthorizer(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+
+	authorizer := &testMDServerTlfStorageAuthorizer{
+		denied: make(map[keybase1.UID]bool),
+	}
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.authorizer = authorizer
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	writer := keybase1.MakeTestUID(1)
+	reader := keybase1.MakeTestUID(2)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{writer},
+		[]keybase1.UID{reader}, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, writer, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+	require.Equal(t, mdAuthzWrite, authorizer.reqs[0].op)
+	require.Equal(t, writer, authorizer.reqs[0].uid)
+	require.NotNil(t, authorizer.reqs[0].rmds)
+
+	_, err = s.getForTLF(ctx, reader, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	_, _, err = s.getForTLFIfChanged(
+		ctx, reader, deviceKID, NullBranchID, MdID{})
+	require.NoError(t, err)
+
+	// Once the reader is denied, it can't read, through either
+	// the plain or the cached reader check, even though it's a
+	// reader of the folder.
+	authorizer.denied[reader] = true
+	_, err = s.getForTLF(ctx, reader, deviceKID, NullBranchID)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+	_, err = s.getRange(ctx, reader, deviceKID, NullBranchID, 1, 2)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+	_, _, err = s.getForTLFIfChanged(
+		ctx, reader, deviceKID, NullBranchID, MdID{})
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+
+	// The writer is unaffected.
+	_, err = s.getForTLF(ctx, writer, deviceKID, NullBranchID)
+	require.NoError(t, err)
+
+	// Nor can a denied writer put.
+	authorizer.denied[writer] = true
+	rmds := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	_, err = s.put(ctx, writer, deviceKID, rmds)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), length)
+
+	// A failing authorizer denies everything.
+	authorizer.denied = nil
+	authorizer.err = errors.New("authorizer unavailable")
+	_, err = s.getForTLF(ctx, writer, deviceKID, NullBranchID)
+	require.Equal(t, MDServerError{authorizer.err}, err)
+	_, err = s.put(ctx, writer, deviceKID, rmds)
+	require.Equal(t, MDServerError{authorizer.err}, err)
+
+	authorizer.err = nil
+	_, err = s.put(ctx, writer, deviceKID, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageGetRangeBudget(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// An entry budget.
+	rmdses, truncated, err := s.getRangeWithBudget(
+		ctx, uid, deviceKID, NullBranchID, 3, 100,
+		mdRangeBudget{maxEntries: 4})
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, 4, len(rmdses))
+	for i, rmds := range rmdses {
+		require.Equal(t, MetadataRevision(i+3), rmds.MD.Revision)
+	}
+
+	// A byte budget that fits exactly two and a half MDs.
+	var sizes []int64
+	for i := 0; i < 3; i++ {
+		id, err := rmdses[i].MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		fi, err := os.Stat(s.mdPath(id))
+		require.NoError(t, err)
+		sizes = append(sizes, fi.Size())
+	}
+	rmdses, truncated, err = s.getRangeWithBudget(
+		ctx, uid, deviceKID, NullBranchID, 3, 100,
+		mdRangeBudget{maxBytes: sizes[0] + sizes[1] + sizes[2]/2})
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, 2, len(rmdses))
+	require.Equal(t, MetadataRevision(3), rmdses[0].MD.Revision)
+	require.Equal(t, MetadataRevision(4), rmdses[1].MD.Revision)
+
+	// A budget that is big enough.
+	rmdses, truncated, err = s.getRangeWithBudget(
+		ctx, uid, deviceKID, NullBranchID, 3, 100,
+		mdRangeBudget{maxEntries: 8})
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Equal(t, 8, len(rmdses))
+
+	// A canceled context.
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = s.getRangeWithBudget(
+		ctx2, uid, deviceKID, NullBranchID, 1, 100, mdRangeBudget{})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestMDServerTlfStorageGetRangeWithCoverage(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// No journal at all.
+	rmdses, coverage, err := s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(rmdses))
+	require.Equal(t, mdRangeCoverage{shortfall: mdRangeEndOfJournal},
+		coverage)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Within the journal.
+	rmdses, coverage, err = s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 3, 8)
+	require.NoError(t, err)
+	require.Equal(t, 6, len(rmdses))
+	require.Equal(t, mdRangeCoverage{
+		first: 3, last: 8, shortfall: mdRangeComplete}, coverage)
+
+	// Past LATEST.
+	rmdses, coverage, err = s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 3, 100)
+	require.NoError(t, err)
+	require.Equal(t, 8, len(rmdses))
+	require.Equal(t, mdRangeCoverage{
+		first: 3, last: 10, shortfall: mdRangeEndOfJournal}, coverage)
+
+	dj := s.branchJournals[NullBranchID].j.(diskJournal)
+
+	// An MD of the wrong revision recorded for revision 8.
+	o, err := revisionToOrdinal(8)
+	require.NoError(t, err)
+	buf, err := s.codec.Encode(mdIDs[8])
+	require.NoError(t, err)
+	err = ioutil.WriteFile(dj.journalEntryPath(o), buf, 0600)
+	require.NoError(t, err)
+
+	rmdses, coverage, err = s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 3, 100)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(rmdses))
+	require.Equal(t, mdRangeCoverage{
+		first: 3, last: 7, shortfall: mdRangeGap, gap: 8}, coverage)
+
+	// A missing entry for revision 6, which getRange fails on.
+	o, err = revisionToOrdinal(6)
+	require.NoError(t, err)
+	err = os.Remove(dj.journalEntryPath(o))
+	require.NoError(t, err)
+
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 3, 100)
+	require.Error(t, err)
+
+	rmdses, coverage, err = s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 3, 100)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(rmdses))
+	for i, rmds := range rmdses {
+		require.Equal(t, MetadataRevision(i+3), rmds.MD.Revision)
+	}
+	require.Equal(t, mdRangeCoverage{
+		first: 3, last: 5, shortfall: mdRangeGap, gap: 6}, coverage)
+
+	// A range starting at the gap returns nothing.
+	rmdses, coverage, err = s.getRangeWithCoverage(
+		ctx, uid, deviceKID, NullBranchID, 6, 100)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(rmdses))
+	require.Equal(t, mdRangeCoverage{shortfall: mdRangeGap, gap: 6},
+		coverage)
+}
+
+func TestListTLFStorageDirs(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage_root")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(root)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Two valid storage directories.
+	id1 := FakeTlfID(1, false)
+	id2 := FakeTlfID(2, false)
+	for _, id := range []TlfID{id1, id2} {
+		s := makeMDServerTlfStorage(
+			codec, crypto, filepath.Join(root, id.String()))
+		err := s.open(context.Background())
+		require.NoError(t, err)
+		putMDRangeForTest(
+			t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+		err = s.close()
+		require.NoError(t, err)
+	}
+
+	// A partially-initialized storage directory.
+	id3 := FakeTlfID(3, false)
+	err = os.MkdirAll(filepath.Join(
+		root, id3.String(), mdServerBranchJournalsDirName), 0700)
+	require.NoError(t, err)
+
+	// An unrelated directory with the right layout, and a stray
+	// file.
+	err = os.MkdirAll(filepath.Join(
+		root, "unrelated", mdServerBranchJournalsDirName), 0700)
+	require.NoError(t, err)
+	err = os.MkdirAll(
+		filepath.Join(root, "unrelated", mdServerMDsDirName), 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(root, "stray"), nil, 0600)
+	require.NoError(t, err)
+
+	tlfIDs, err := listTLFStorageDirs(root)
+	require.NoError(t, err)
+	require.Equal(t, []TlfID{id1, id2}, tlfIDs)
+}
+
+func TestMDMaintenanceRunner(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage_root")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(root)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	var tlfIDs []TlfID
+	for i := byte(1); i <= 5; i++ {
+		id := FakeTlfID(i, false)
+		tlfIDs = append(tlfIDs, id)
+		s := makeMDServerTlfStorage(
+			codec, crypto, filepath.Join(root, id.String()))
+		err := s.open(context.Background())
+		require.NoError(t, err)
+		putMDRangeForTest(
+			t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+		err = s.close()
+		require.NoError(t, err)
+	}
+
+	// The op blocks until proceed is closed, so that the test can
+	// see how many run at once.
+	var active, maxActive int32
+	proceed := make(chan struct{})
+	errFailed := errors.New("op failed")
+	op := func(ctx context.Context, tlfID TlfID,
+		s *mdServerTlfStorage) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m ||
+				atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		<-proceed
+
+		head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+		if err != nil {
+			return err
+		}
+		if head.MD.Revision != 1 || head.MD.ID != tlfID {
+			return fmt.Errorf("Unexpected head %d of %s",
+				head.MD.Revision, head.MD.ID)
+		}
+		if tlfID == tlfIDs[2] {
+			return errFailed
+		}
+		return nil
+	}
+
+	runner := mdMaintenanceRunner{
+		codec:        codec,
+		crypto:       crypto,
+		root:         root,
+		workers:      2,
+		maxOpenFiles: 1,
+	}
+	var report mdMaintenanceReport
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		report, err = runner.run(context.Background(), op)
+		errCh <- err
+	}()
+
+	waitForConditionForTest(t, func() bool {
+		return atomic.LoadInt32(&active) == 2
+	})
+	close(proceed)
+	err = <-errCh
+	require.NoError(t, err)
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxActive))
+	require.Len(t, report.results, len(tlfIDs))
+	for i, result := range report.results {
+		require.Equal(t, tlfIDs[i], result.tlfID)
+	}
+	require.Equal(t, []mdMaintenanceResult{{tlfIDs[2], errFailed}},
+		report.failed())
+
+	// Nothing is started once the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runner.tlfIDs = tlfIDs[:2]
+	report, err = runner.run(ctx, op)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, []mdMaintenanceResult{
+		{tlfIDs[0], context.Canceled},
+		{tlfIDs[1], context.Canceled},
+	}, report.failed())
+}
+
+func TestMDServerTlfStorageMaxMDSize(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	rmds := makeMDForTest(t, id, h, MetadataRevisionInitial, MdID{})
+	buf, err := s.codec.Encode(rmds)
+	require.NoError(t, err)
+	size := int64(len(buf))
+
+	// Just over the limit.
+	s.maxMDSize = size - 1
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	_, err = os.Stat(s.mdPath(mdID))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, 0, getMDJournalLength(t, s, NullBranchID))
+
+	// Just under the limit.
+	s.maxMDSize = size
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	require.Equal(t, 1, getMDJournalLength(t, s, NullBranchID))
+}
+
+func TestMDServerTlfStorageQuiesce(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	// Quiescing twice is fine.
+	err = s.quiesce()
+	require.NoError(t, err)
+	err = s.quiesce()
+	require.NoError(t, err)
+
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), head.MD.Revision)
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(rmdses))
+
+	rmds := makeMDForTest(t, id, h, 6, mdIDs[4])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.IsType(t, MDServerErrorThrottle{}, err)
+	require.Equal(t, 5, getMDJournalLength(t, s, NullBranchID))
+
+	err = s.unquiesce()
+	require.NoError(t, err)
+
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	require.Equal(t, 6, getMDJournalLength(t, s, NullBranchID))
+}
+
+func TestMDServerTlfStorageWritersOf(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid1, uid2}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	writers, err := s.writersOf(NullBranchID)
+	require.NoError(t, err)
+	require.Nil(t, writers)
+
+	// Alternate writers, with uid2 writing last.
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 4; i++ {
+		uid := uid1
+		if i%2 == 0 {
+			uid = uid2
+		}
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		rmds.MD.LastModifyingUser = uid
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+
+	expectedWriters := []keybase1.UID{uid1, uid2}
+	sort.Sort(uidList(expectedWriters))
+
+	writers, err = s.writersOf(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, expectedWriters, writers)
+
+	// Delete the index, which should then be rebuilt.
+	err = os.Remove(s.writersPath(NullBranchID))
+	require.NoError(t, err)
+
+	writers, err = s.writersOf(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, expectedWriters, writers)
+
+	_, err = os.Stat(s.writersPath(NullBranchID))
+	require.NoError(t, err)
+
+	// A put that can't update the index fails without appending
+	// the MD.
+	err = os.Remove(s.writersPath(NullBranchID))
+	require.NoError(t, err)
+	err = os.Mkdir(s.writersPath(NullBranchID), 0700)
+	require.NoError(t, err)
+	rmds := makeMDForTest(t, id, h, 5, prevRoot)
+	_, err = s.put(ctx, uid1, deviceKID, rmds)
+	require.IsType(t, MDServerError{}, err)
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), length)
+}
+
+func TestMDServerTlfStorageGetHeadWithin(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	clock := newTestClockNow()
+	s.clock = clock
+
+	head, err := s.getHeadWithin(
+		ctx, uid, deviceKID, NullBranchID, time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+
+	// Pin the head's timestamp to the fake clock.
+	err = os.Chtimes(s.mdPath(mdIDs[0]), clock.Now(), clock.Now())
+	require.NoError(t, err)
+
+	clock.Add(30 * time.Second)
+	head, err = s.getHeadWithin(
+		ctx, uid, deviceKID, NullBranchID, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(1), head.MD.Revision)
+
+	clock.Add(time.Minute)
+	_, err = s.getHeadWithin(
+		ctx, uid, deviceKID, NullBranchID, time.Minute)
+	require.IsType(t, mdServerTlfStorageStaleHeadError{}, err)
+
+	// The head's timestamp and the last revision every flush
+	// destination has are available with the head itself.
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 2, 2, mdIDs[0])
+	_, state, err := s.getForTLFWithSyncState(
+		ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, state.lastSynced)
+	require.False(t, state.headTime.IsZero())
+
+	err = s.addFlushDestination(NullBranchID, "replica1")
+	require.NoError(t, err)
+	err = s.addFlushDestination(NullBranchID, "replica2")
+	require.NoError(t, err)
+	err = s.advanceFlushCursor(NullBranchID, "replica1", 2)
+	require.NoError(t, err)
+	err = s.advanceFlushCursor(NullBranchID, "replica2", 1)
+	require.NoError(t, err)
+	head, state, err = s.getForTLFWithSyncState(
+		ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(2), head.MD.Revision)
+	require.Equal(t, MetadataRevision(1), state.lastSynced)
+	require.Equal(t, head.untrustedServerTimestamp, state.headTime)
+}
+
+func TestMDServerTlfStorageVersion(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	ctx := context.Background()
+
+	buf, err := ioutil.ReadFile(s.versionPath())
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(mdServerTlfStorageVersion), string(buf))
+
+	openWithVersion := func(version string) error {
+		err := ioutil.WriteFile(s.versionPath(), []byte(version), 0600)
+		require.NoError(t, err)
+		s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+		defer func() {
+			err := s2.close()
+			require.NoError(t, err)
+		}()
+		return s2.open(ctx)
+	}
+
+	// Same version.
+	err = openWithVersion(strconv.Itoa(mdServerTlfStorageVersion))
+	require.NoError(t, err)
+
+	// Older version, which gets upgraded.
+	err = openWithVersion(strconv.Itoa(mdServerTlfStorageVersion - 1))
+	require.NoError(t, err)
+	buf, err = ioutil.ReadFile(s.versionPath())
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(mdServerTlfStorageVersion), string(buf))
+
+	// Newer version.
+	err = openWithVersion(strconv.Itoa(mdServerTlfStorageVersion + 1))
+	require.Equal(t, mdServerTlfStorageVersionTooNewError{
+		dir:              tempdir,
+		version:          mdServerTlfStorageVersion + 1,
+		supportedVersion: mdServerTlfStorageVersion,
+	}, err)
+
+	// Garbage.
+	err = openWithVersion("garbage")
+	require.Error(t, err)
+}
+
+func TestMDServerTlfStorageEstimateRange(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	count, bytes, err := s.estimateRange(
+		uid, deviceKID, NullBranchID, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	require.Equal(t, int64(0), bytes)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// The window should be clamped to what's available.
+	count, bytes, err = s.estimateRange(
+		uid, deviceKID, NullBranchID, 4, 100)
+	require.NoError(t, err)
+	require.Equal(t, 7, count)
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 4, 100)
+	require.NoError(t, err)
+	require.Equal(t, count, len(rmdses))
+
+	var actualBytes int64
+	for _, rmds := range rmdses {
+		buf, err := s.codec.Encode(rmds)
+		require.NoError(t, err)
+		actualBytes += int64(len(buf))
+	}
+	require.Equal(t, actualBytes, bytes)
+}
+
+func TestMDServerTlfStorageSoftDeleteBranch(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	clock := newTestClockNow()
+	s.clock = clock
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid1 := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid1, 6, 8, mergedIDs[4])
+	bid2 := FakeBranchID(2)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid2, 6, 7, mergedIDs[4])
+
+	err = s.softDeleteBranch(ctx, NullBranchID)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// Soft-delete bid1, which should make it invisible.
+	err = s.softDeleteBranch(ctx, bid1)
+	require.NoError(t, err)
+
+	head, err := s.getForTLF(ctx, uid, deviceKID, bid1)
+	require.NoError(t, err)
+	require.Nil(t, head)
+	rmdses, err := s.getRange(ctx, uid, deviceKID, bid1, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(rmdses))
+
+	// Restore it.
+	err = s.undeleteBranch(bid1)
+	require.NoError(t, err)
+	head, err = s.getForTLF(ctx, uid, deviceKID, bid1)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(8), head.MD.Revision)
+
+	err = s.undeleteBranch(bid1)
+	require.Error(t, err)
+
+	// A branch that isn't loaded can be soft-deleted too.
+	func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.branchJournals, bid1)
+	}()
+	err = s.softDeleteBranch(ctx, bid1)
+	require.NoError(t, err)
+	err = s.undeleteBranch(bid1)
+	require.NoError(t, err)
+
+	// Soft-delete both, an hour apart.
+	err = s.softDeleteBranch(ctx, bid1)
+	require.NoError(t, err)
+	clock.Add(time.Hour)
+	err = s.softDeleteBranch(ctx, bid2)
+	require.NoError(t, err)
+
+	// Only bid1 is past the grace period.
+	clock.Add(30 * time.Minute)
+	purged, err := s.purgeTombstones(time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []BranchID{bid1}, purged)
+
+	err = s.undeleteBranch(bid1)
+	require.Error(t, err)
+
+	// bid2 is still restorable.
+	err = s.undeleteBranch(bid2)
+	require.NoError(t, err)
+	head, err = s.getForTLF(ctx, uid, deviceKID, bid2)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(7), head.MD.Revision)
+}
+
+func TestMDServerTlfStorageCloseBranch(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid := FakeBranchID(1)
+	branchIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 6, 8, mergedIDs[4])
+
+	err = s.closeBranch(NullBranchID)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	err = s.closeBranch(FakeBranchID(2))
+	require.Error(t, err)
+
+	err = s.closeBranch(bid)
+	require.NoError(t, err)
+	// Closing it again is a no-op.
+	err = s.closeBranch(bid)
+	require.NoError(t, err)
+
+	// Puts to the branch are rejected...
+	rmds := makeMDForTest(t, id, h, MetadataRevision(9), branchIDs[2])
+	rmds.MD.WFlags |= MetadataFlagUnmerged
+	rmds.MD.BID = bid
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, MDServerErrorBranchClosed{BID: bid}, err)
+
+	// ...but its history can still be read, and the master branch
+	// is unaffected.
+	rmdses, err := s.getRange(ctx, uid, deviceKID, bid, 6, 8)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 3)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 6, 6, mergedIDs[4])
+
+	requireBranches := func(s *mdServerTlfStorage) {
+		infos, err := s.listBranches()
+		require.NoError(t, err)
+		require.Equal(t, []mdBranchInfo{
+			{bid: NullBranchID, latest: 6},
+			{bid: bid, latest: 8, closed: true},
+		}, infos)
+	}
+	requireBranches(s)
+
+	// The flag survives a restart.
+	err = s.close()
+	require.NoError(t, err)
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+	requireBranches(s2)
+
+	// A late put can't recreate the branch once it's
+	// soft-deleted either.
+	err = s2.softDeleteBranch(ctx, bid)
+	require.NoError(t, err)
+	rmds = makeMDForTest(t, id, h, MetadataRevision(6), mergedIDs[4])
+	rmds.MD.WFlags |= MetadataFlagUnmerged
+	rmds.MD.BID = bid
+	_, err = s2.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, MDServerErrorBranchClosed{BID: bid}, err)
+}
+
+func TestMDServerTlfStorageBranchSummaries(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid1 := FakeBranchID(1)
+	bid1IDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid1, 4, 5, mergedIDs[2])
+	bid2 := FakeBranchID(2)
+	bid2IDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid2, 3, 6, mergedIDs[1])
+	err = s.closeBranch(bid1)
+	require.NoError(t, err)
+
+	summaries, err := s.branchSummaries(ctx, uid, deviceKID)
+	require.NoError(t, err)
+	require.Len(t, summaries, 3)
+
+	expected := []struct {
+		bid    BranchID
+		rev    MetadataRevision
+		headID MdID
+		length uint64
+		closed bool
+	}{
+		{NullBranchID, 5, mergedIDs[4], 5, false},
+		{bid1, 5, bid1IDs[1], 2, true},
+		{bid2, 6, bid2IDs[3], 4, false},
+	}
+	for i, e := range expected {
+		summary := summaries[i]
+		require.Equal(t, e.bid, summary.bid)
+		require.Equal(t, e.rev, summary.headRevision)
+		require.Equal(t, e.headID, summary.headID)
+		require.Equal(t, e.length, summary.length)
+		require.Equal(t, e.closed, summary.closed)
+
+		// The summaries agree with the separate calls they
+		// replace.
+		head, err := s.getForTLF(ctx, uid, deviceKID, e.bid)
+		require.NoError(t, err)
+		require.Equal(t, head.MD.Revision, summary.headRevision)
+		require.Equal(t, head.untrustedServerTimestamp,
+			summary.headTime)
+		length, err := s.journalLength(e.bid)
+		require.NoError(t, err)
+		require.Equal(t, length, summary.length)
+	}
+
+	// The permission check applies to the whole call.
+	_, err = s.branchSummaries(
+		ctx, keybase1.MakeTestUID(2), deviceKID)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+}
+
+func TestMDServerTlfStorageGrowthRate(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	clock := newTestClockNow()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.clock = clock
+	s.growthWindow = time.Hour
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	rate, err := s.growthRate()
+	require.NoError(t, err)
+	require.Equal(t, float64(0), rate.objectsPerDay)
+
+	// A put every ten minutes for three hours, i.e. 144 a day.
+	rmdses := makeBigMDsForTest(t, crypto, id, h, 18+60)
+	for _, rmds := range rmdses[:18] {
+		clock.Add(10 * time.Minute)
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+	}
+	steady, err := s.growthRate()
+	require.NoError(t, err)
+	require.InEpsilon(t, 144, steady.objectsPerDay, 0.2)
+	require.True(t, steady.bytesPerDay > 144*4096, "%v", steady)
+	require.True(t, steady.since.After(clock.Now().Add(-2*time.Hour)))
+
+	// A burst of puts within a minute shows up as a much higher
+	// rate over the window.
+	for _, rmds := range rmdses[18:] {
+		clock.Add(time.Second)
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+	}
+	burst, err := s.growthRate()
+	require.NoError(t, err)
+	require.True(t, burst.objectsPerDay > 5*steady.objectsPerDay,
+		"steady=%v burst=%v", steady, burst)
+
+	// Once the burst is past the window, the rate drops again.
+	clock.Add(2 * time.Hour)
+	after, err := s.growthRate()
+	require.NoError(t, err)
+	require.Equal(t, float64(0), after.objectsPerDay)
+}
+
+func TestMDServerTlfStoragePutCounts(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	written := metrics.NewMeter()
+	deduped := metrics.NewMeter()
+	s.putWrittenMeter = written
+	s.putDedupedMeter = deduped
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+
+	// Store the next MD without journaling it, as a put whose
+	// reply was lost after its MD object was written would.
+	rmds := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	buf, err := s.codec.Encode(rmds)
+	require.NoError(t, err)
+	s.lock.Lock()
+	err = s.writeMDLocked(ctx, mdID, buf)
+	s.lock.Unlock()
+	require.NoError(t, err)
+
+	// Re-putting it counts as deduped, not written.
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	w, d := s.putCounts()
+	require.Equal(t, uint64(2), w)
+	require.Equal(t, uint64(1), d)
+	require.Equal(t, int64(2), written.Count())
+	require.Equal(t, int64(1), deduped.Count())
+
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdID)
+	w, d = s.putCounts()
+	require.Equal(t, uint64(3), w)
+	require.Equal(t, uint64(1), d)
+	require.Equal(t, int64(3), written.Count())
+	require.Equal(t, int64(1), deduped.Count())
+}
+
+func TestMDServerTlfStorageBootstrapBranchID(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid1 := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid1, 6, 7, mergedIDs[4])
+	err = s.softDeleteBranch(ctx, bid1)
+	require.NoError(t, err)
+
+	makeBootstrap := func(bid BranchID) *RootMetadataSigned {
+		rmds := makeMDForTest(t, id, h, MetadataRevision(6), mergedIDs[4])
+		rmds.MD.WFlags |= MetadataFlagUnmerged
+		rmds.MD.BID = bid
+		return rmds
+	}
+
+	// A null branch ID can't start a branch.
+	_, err = s.put(ctx, uid, deviceKID, makeBootstrap(NullBranchID))
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// Neither can the ID of a deleted branch.
+	_, err = s.put(ctx, uid, deviceKID, makeBootstrap(bid1))
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	head, err := s.getForTLF(ctx, uid, deviceKID, bid1)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	// A fresh ID is fine.
+	bid2 := FakeBranchID(2)
+	recordBranchID, err := s.put(ctx, uid, deviceKID, makeBootstrap(bid2))
+	require.NoError(t, err)
+	require.True(t, recordBranchID)
+
+	// The deleted branch can still be restored.
+	err = s.undeleteBranch(bid1)
+	require.NoError(t, err)
+	head, err = s.getForTLF(ctx, uid, deviceKID, bid1)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(7), head.MD.Revision)
+}
+
+func TestMDServerTlfStorageForEachBranch(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid1 := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid1, 6, 8, mergedIDs[4])
+
+	// Open a second storage on the same directory, which
+	// should pick up the existing branches.
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s2.open(context.Background())
+	require.NoError(t, err)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+
+	lengths := make(map[BranchID]uint64)
+	err = s2.forEachBranch(func(bid BranchID, j mdServerBranchJournal) error {
+		length, err := j.journalLength()
+		if err != nil {
+			return err
+		}
+		lengths[bid] = length
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[BranchID]uint64{
+		NullBranchID: 5,
+		bid1:         3,
+	}, lengths)
+}
+
+func TestMDServerTlfStorageForEachBranchRace(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	// Create new branches while iterating.
+	const branchCount = 20
+	errCh := make(chan error, 1)
+	go func() {
+		for i := 1; i <= branchCount; i++ {
+			rmds := makeMDForTest(t, id, h, 6, mergedIDs[4])
+			rmds.MD.WFlags |= MetadataFlagUnmerged
+			rmds.MD.BID = FakeBranchID(byte(i))
+			_, err := s.put(context.Background(), uid, deviceKID, rmds)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for i := 0; i < branchCount; i++ {
+		visited := make(map[BranchID]bool)
+		err := s.forEachBranch(
+			func(bid BranchID, j mdServerBranchJournal) error {
+				if visited[bid] {
+					return fmt.Errorf("Visited %s twice", bid)
+				}
+				visited[bid] = true
+				_, err := j.getHead()
+				return err
+			})
+		require.NoError(t, err)
+		require.True(t, visited[NullBranchID])
+	}
+
+	require.NoError(t, <-errCh)
+
+	visited := make(map[BranchID]bool)
+	err = s.forEachBranch(func(bid BranchID, j mdServerBranchJournal) error {
+		visited[bid] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, branchCount+1, len(visited))
+}
+
+func TestMDServerTlfStorageLifecycle(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+
+	// Use before open.
+	_, err = s.journalLength(NullBranchID)
+	require.Equal(t, errMDServerTlfStorageNotOpen, err)
+	_, err = s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.Equal(t, errMDServerTlfStorageNotOpen, err)
+	_, err = s.put(ctx, uid, deviceKID,
+		makeMDForTest(t, id, h, MetadataRevisionInitial, MdID{}))
+	require.Equal(t, errMDServerTlfStorageNotOpen, err)
+
+	err = s.open(ctx)
+	require.NoError(t, err)
+	err = s.open(ctx)
+	require.Error(t, err)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	err = s.close()
+	require.NoError(t, err)
+
+	// Use after close.
+	_, err = s.journalLength(NullBranchID)
+	require.Equal(t, errMDServerTlfStorageClosed, err)
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.Equal(t, errMDServerTlfStorageClosed, err)
+	err = s.open(ctx)
+	require.Equal(t, errMDServerTlfStorageClosed, err)
+	err = s.close()
+	require.NoError(t, err)
+
+	// A new storage loads the existing branches on open.
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(3), head.MD.Revision)
+	err = s.close()
+	require.NoError(t, err)
+
+	// Insane pointers make open fail.
+	j := makeMDServerBranchJournal(codec, s.branchJournalPath(NullBranchID))
+	err = j.writeEarliestRevision(MetadataRevision(4))
+	require.NoError(t, err)
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.Error(t, err)
+	err = s.close()
+	require.NoError(t, err)
+}
+
+// fakeMDServerGetRange is an MDServer that serves GetRange from a
+// fixed list of MDs.
+type fakeMDServerGetRange struct {
+	MDServer
+
+	rmdses []*RootMetadataSigned
+}
+
+func (s fakeMDServerGetRange) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	var rmdses []*RootMetadataSigned
+	for _, rmds := range s.rmdses {
+		if rmds.MD.Revision >= start && rmds.MD.Revision <= stop {
+			rmdses = append(rmdses, rmds)
+		}
+	}
+	return rmdses, nil
+}
+
+func TestMDServerTlfStorageGetRangeWithFallback(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	allRmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+
+	// Simulate pruning everything below revision 5 locally.
+	err = s.branchJournals[NullBranchID].writeEarliestRevision(5)
+	require.NoError(t, err)
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 2, 7)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(rmdses))
+
+	fallback := fakeMDServerGetRange{rmdses: allRmdses[:4]}
+
+	checkRange := func(start, stop MetadataRevision) {
+		rmdses, err := s.getRangeWithFallback(ctx, uid, deviceKID,
+			NullBranchID, start, stop, fallback)
+		require.NoError(t, err)
+		require.Equal(t, int(stop-start+1), len(rmdses))
+		for i, rmds := range rmdses {
+			require.Equal(t, start+MetadataRevision(i),
+				rmds.MD.Revision)
+		}
+	}
+
+	// Spanning the boundary, entirely below it, and entirely
+	// above it.
+	checkRange(2, 7)
+	checkRange(1, 3)
+	checkRange(6, 10)
+
+	// A fallback returning a different MD for revision 3 should
+	// fail verification.
+	badRmds := makeMDForTest(t, id, h, 3, MdID{})
+	badFallback := fakeMDServerGetRange{
+		rmdses: []*RootMetadataSigned{
+			allRmdses[0], allRmdses[1], badRmds, allRmdses[3],
+		},
+	}
+	_, err = s.getRangeWithFallback(ctx, uid, deviceKID,
+		NullBranchID, 2, 7, badFallback)
+	require.IsType(t, MDServerError{}, err)
+}
+
+func TestMDServerTlfStorageQuarantineCorrupt(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	allRmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 5)
+	require.NoError(t, err)
+
+	s.quarantineCorrupt = true
+	s.quarantineFallback = fakeMDServerGetRange{rmdses: allRmdses}
+
+	// Corrupt the object in place, keeping its modification
+	// time, as bit rot would.
+	corrupt := func(mdID MdID) {
+		path := s.mdPath(mdID)
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(path, []byte("garbage"), 0600)
+		require.NoError(t, err)
+		err = os.Chtimes(path, fi.ModTime(), fi.ModTime())
+		require.NoError(t, err)
+	}
+
+	// A corrupt object with the fallback available is repaired
+	// and served as if nothing had happened, with its original
+	// timestamp.
+	corrupt(mdIDs[2])
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, allRmdses, rmdses)
+
+	buf, err := ioutil.ReadFile(s.corruptMDPath(mdIDs[2]))
+	require.NoError(t, err)
+	require.Equal(t, []byte("garbage"), buf)
+	rmds, err := s.getMDReadLocked(mdIDs[2])
+	require.NoError(t, err)
+	require.Equal(t, allRmdses[2], rmds)
+
+	// Without a fallback, the object is still moved out of the
+	// way, and reads of it fail with errMDCorruptQuarantined,
+	// then and later.
+	s.quarantineFallback = nil
+	corrupt(mdIDs[3])
+	for i := 0; i < 2; i++ {
+		_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 5)
+		require.Equal(t, MDServerError{errMDCorruptQuarantined}, err)
+	}
+	_, err = os.Stat(s.mdPath(mdIDs[3]))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(s.corruptMDPath(mdIDs[3]))
+	require.NoError(t, err)
+
+	// Once a fallback has the MD, the quarantined object is
+	// repaired on the next read.
+	s.quarantineFallback = fakeMDServerGetRange{rmdses: allRmdses}
+	rmdses, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, allRmdses, rmdses)
+}
+
+func TestMDServerTlfStorageMDCacheByteBudget(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// Put MDs of widely varying sizes.
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 10; i++ {
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		size := 10
+		if i%3 == 0 {
+			size = 4000
+		}
+		rmds.MD.SerializedPrivateMetadata = make([]byte, size)
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+	uncached, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+
+	const budget = 6000
+	for _, policy := range []mdServerMDCacheEvictionPolicy{
+		mdServerMDCacheEvictLRU, mdServerMDCacheEvictLargest,
+	} {
+		s.mdCache = makeMDServerMDCache(0, budget, policy)
+
+		// Reads through the cache, in both directions, return
+		// the same MDs, and keep the cache within its byte
+		// budget throughout.
+		for pass := 0; pass < 2; pass++ {
+			for i := MetadataRevision(1); i <= 10; i++ {
+				r := i
+				if pass == 1 {
+					r = 11 - i
+				}
+				rmdses, err := s.getRange(
+					ctx, uid, deviceKID, NullBranchID, r, r)
+				require.NoError(t, err, "policy=%s", policy)
+				require.Equal(t, uncached[r-1:r], rmdses,
+					"policy=%s", policy)
+				require.True(t, s.mdCache.bytes() <= budget,
+					"policy=%s bytes=%d", policy,
+					s.mdCache.bytes())
+			}
+		}
+		require.NotEqual(t, 0, s.mdCache.len(), "policy=%s", policy)
+	}
+
+	// With the largest-first policy, a large MD is evicted before
+	// the small ones around it, no matter how recently it was
+	// used.
+	cache := makeMDServerMDCache(0, 100, mdServerMDCacheEvictLargest)
+	now := time.Now()
+	cache.put(tempdir, fakeMdID(1), make([]byte, 10), now)
+	cache.put(tempdir, fakeMdID(2), make([]byte, 60), now)
+	cache.put(tempdir, fakeMdID(3), make([]byte, 10), now)
+	cache.put(tempdir, fakeMdID(4), make([]byte, 30), now)
+	require.Equal(t, 3, cache.len())
+	require.Equal(t, int64(50), cache.bytes())
+	_, _, ok := cache.get(tempdir, fakeMdID(2))
+	require.False(t, ok)
+	_, _, ok = cache.get(tempdir, fakeMdID(1))
+	require.True(t, ok)
+
+	// An MD larger than the whole budget isn't cached.
+	cache.put(tempdir, fakeMdID(5), make([]byte, 101), now)
+	_, _, ok = cache.get(tempdir, fakeMdID(5))
+	require.False(t, ok)
+	require.Equal(t, int64(50), cache.bytes())
+
+	// Among MDs of the same size, the least recently used one is
+	// evicted first.
+	cache = makeMDServerMDCache(0, 30, mdServerMDCacheEvictLargest)
+	cache.put(tempdir, fakeMdID(1), make([]byte, 10), now)
+	cache.put(tempdir, fakeMdID(2), make([]byte, 10), now)
+	cache.put(tempdir, fakeMdID(3), make([]byte, 10), now)
+	_, _, ok = cache.get(tempdir, fakeMdID(1))
+	require.True(t, ok)
+	cache.put(tempdir, fakeMdID(4), make([]byte, 10), now)
+	_, _, ok = cache.get(tempdir, fakeMdID(2))
+	require.False(t, ok)
+	for _, i := range []byte{1, 3, 4} {
+		_, _, ok = cache.get(tempdir, fakeMdID(i))
+		require.True(t, ok)
+	}
+
+	// Putting a cached MD again replaces its encoding and
+	// timestamp.
+	later := now.Add(time.Minute)
+	cache = makeMDServerMDCache(0, 100, mdServerMDCacheEvictLRU)
+	cache.put(tempdir, fakeMdID(1), make([]byte, 10), now)
+	cache.put(tempdir, fakeMdID(1), make([]byte, 20), later)
+	buf, timestamp, ok := cache.get(tempdir, fakeMdID(1))
+	require.True(t, ok)
+	require.Len(t, buf, 20)
+	require.Equal(t, later, timestamp)
+	require.Equal(t, 1, cache.len())
+	require.Equal(t, int64(20), cache.bytes())
+
+	// And a replacement larger than the whole budget drops it.
+	cache.put(tempdir, fakeMdID(1), make([]byte, 101), later)
+	_, _, ok = cache.get(tempdir, fakeMdID(1))
+	require.False(t, ok)
+	require.Equal(t, int64(0), cache.bytes())
+}
+
+func TestMDServerTlfStorageMDCacheEviction(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	s.mdCache = makeMDServerMDCache(0, 0, mdServerMDCacheEvictLRU)
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, s.mdCache.len())
+
+	isCached := func(mdID MdID) bool {
+		_, _, ok := s.mdCache.get(s.dir, mdID)
+		return ok
+	}
+
+	// Removing an MD evicts it.
+	_, err = s.prune(NullBranchID, 2)
+	require.NoError(t, err)
+	require.False(t, isCached(mdIDs[0]))
+	require.True(t, isCached(mdIDs[1]))
+
+	// A put of an MD that's cached but missing from disk writes
+	// it again.
+	rmds := makeMDForTest(t, id, h, MetadataRevision(2), mdIDs[0])
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[1], mdID)
+	buf, err := s.codec.Encode(rmds)
+	require.NoError(t, err)
+	err = os.Remove(s.mdPath(mdIDs[1]))
+	require.NoError(t, err)
+	s.lock.Lock()
+	wrote, err := s.putMDLocked(
+		ctx, rmds, mdPreparedPut{id: mdID, buf: buf})
+	s.lock.Unlock()
+	require.NoError(t, err)
+	require.True(t, wrote)
+	_, err = os.Stat(s.mdPath(mdIDs[1]))
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStoragePinRevision(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	err = s.pinRevision(NullBranchID, 11)
+	require.Error(t, err)
+
+	err = s.pinRevision(NullBranchID, 7)
+	require.NoError(t, err)
+	err = s.pinRevision(NullBranchID, 4)
+	require.NoError(t, err)
+	err = s.pinRevision(NullBranchID, 4)
+	require.NoError(t, err)
+
+	pinned, err := s.listPinned(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, []MetadataRevision{4, 7}, pinned)
+
+	// An aggressive prune should stop at the first pinned
+	// revision.
+	pruned, err := s.prune(NullBranchID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 3, pruned)
+	require.Equal(t, 7, getMDJournalLength(t, s, NullBranchID))
+	for i := 0; i < 3; i++ {
+		_, err := os.Stat(s.mdPath(mdIDs[i]))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(rmdses))
+	require.Equal(t, MetadataRevision(4), rmdses[0].MD.Revision)
+
+	// Unpinning revision 4 lets the prune advance to revision 7.
+	err = s.unpinRevision(NullBranchID, 4)
+	require.NoError(t, err)
+	pruned, err = s.prune(NullBranchID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 3, pruned)
+	require.Equal(t, 4, getMDJournalLength(t, s, NullBranchID))
+
+	// Unpinning everything still keeps the head.
+	err = s.unpinRevision(NullBranchID, 7)
+	require.NoError(t, err)
+	pinned, err = s.listPinned(NullBranchID)
+	require.NoError(t, err)
+	require.Nil(t, pinned)
+	pruned, err = s.prune(NullBranchID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 3, pruned)
+	require.Equal(t, 1, getMDJournalLength(t, s, NullBranchID))
+
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(10), head.MD.Revision)
+}
+
+func TestMDServerTlfStorageFlushCursors(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 4, MdID{})
+
+	err = s.addFlushDestination(NullBranchID, "fast")
+	require.NoError(t, err)
+	err = s.addFlushDestination(NullBranchID, "slow")
+	require.NoError(t, err)
+	err = s.addFlushDestination(NullBranchID, "")
+	require.Equal(t, errMDFlushDestinationEmpty, err)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 5, 20, mdIDs[3])
+
+	// Nothing has been flushed anywhere, so nothing is pruned.
+	pruned, err := s.prune(NullBranchID, 20)
+	require.NoError(t, err)
+	require.Equal(t, 0, pruned)
+
+	// The two destinations flush at different rates: the fast
+	// one three revisions at a time, and the slow one one at a
+	// time. Each prune only goes as far as the slow one.
+	var fast, slow MetadataRevision
+	for i := 0; i < 5; i++ {
+		fast += 3
+		slow++
+		err = s.advanceFlushCursor(NullBranchID, "fast", fast)
+		require.NoError(t, err)
+		err = s.advanceFlushCursor(NullBranchID, "slow", slow)
+		require.NoError(t, err)
+
+		_, err = s.prune(NullBranchID, 20)
+		require.NoError(t, err)
+		earliest, err :=
+			s.branchJournals[NullBranchID].readEarliestRevision()
+		require.NoError(t, err)
+		require.Equal(t, slow+1, earliest)
+
+		status, err := s.flushStatus(NullBranchID)
+		require.NoError(t, err)
+		require.Equal(t, []mdFlushCursor{
+			{"fast", fast, int64(20 - fast)},
+			{"slow", slow, int64(20 - slow)},
+		}, status)
+	}
+
+	// Cursors don't go backwards, or past the head.
+	err = s.advanceFlushCursor(NullBranchID, "fast", fast-1)
+	require.Error(t, err)
+	err = s.advanceFlushCursor(NullBranchID, "fast", 21)
+	require.Error(t, err)
+	err = s.advanceFlushCursor(NullBranchID, "unknown", 20)
+	require.Error(t, err)
+
+	// Once the slow destination is gone, prune catches up to the
+	// fast one.
+	err = s.removeFlushDestination(NullBranchID, "slow")
+	require.NoError(t, err)
+	plan, err := s.planPrune(NullBranchID, 20)
+	require.NoError(t, err)
+	require.Equal(t, int(fast-slow), len(plan.removals))
+	_, err = s.prune(NullBranchID, 20)
+	require.NoError(t, err)
+	earliest, err := s.branchJournals[NullBranchID].readEarliestRevision()
+	require.NoError(t, err)
+	require.Equal(t, fast+1, earliest)
+}
+
+func TestMDServerTlfStorageRetainGrace(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	const grace = 3
+	s.retainGrace = grace
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 20, MdID{})
+
+	requireOnDisk := func(first, last MetadataRevision) {
+		earliest, err :=
+			s.branchJournals[NullBranchID].readEarliestRevision()
+		require.NoError(t, err)
+		require.Equal(t, first, earliest)
+		for i, mdID := range mdIDs {
+			_, err := os.Stat(s.mdPath(mdID))
+			r := MetadataRevision(i + 1)
+			if r >= first && r <= last {
+				require.NoError(t, err, "revision %d", r)
+			} else {
+				require.True(t, os.IsNotExist(err),
+					"revision %d", r)
+			}
+		}
+	}
+
+	// Without flush cursors, the grace is counted back from upTo.
+	pruned, err := s.prune(NullBranchID, 6)
+	require.NoError(t, err)
+	require.Equal(t, 6-1-grace, pruned)
+	requireOnDisk(6-grace, 20)
+
+	// With a flush cursor, exactly the last grace flushed
+	// revisions stay on disk.
+	err = s.addFlushDestination(NullBranchID, "remote")
+	require.NoError(t, err)
+	err = s.advanceFlushCursor(NullBranchID, "remote", 12)
+	require.NoError(t, err)
+	_, err = s.prune(NullBranchID, 20)
+	require.NoError(t, err)
+	requireOnDisk(12-grace+1, 20)
+
+	// A pinned revision below the grace tail is still kept, and
+	// so stops prune.
+	err = s.advanceFlushCursor(NullBranchID, "remote", 18)
+	require.NoError(t, err)
+	err = s.pinRevision(NullBranchID, 11)
+	require.NoError(t, err)
+	plan, err := s.planPrune(NullBranchID, 20)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(11), plan.pinnedAt)
+	_, err = s.prune(NullBranchID, 20)
+	require.NoError(t, err)
+	requireOnDisk(11, 20)
+
+	err = s.unpinRevision(NullBranchID, 11)
+	require.NoError(t, err)
+	_, err = s.prune(NullBranchID, 20)
+	require.NoError(t, err)
+	requireOnDisk(18-grace+1, 20)
+}
+
+func TestMDServerTlfStorageAnnotations(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	var mdIDs []MdID
+	putAnnotated := func(rev MetadataRevision,
+		annotations map[string]string) *RootMetadataSigned {
+		prevRoot := MdID{}
+		if rev > 1 {
+			prevRoot = mdIDs[rev-2]
+		}
+		rmds := makeMDForTest(t, id, h, rev, prevRoot)
+		_, err := s.putAnnotated(ctx, uid, deviceKID, rmds, annotations)
+		require.NoError(t, err)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		return rmds
+	}
+
+	putAnnotated(1, map[string]string{"source": "import"})
+	putAnnotated(2, nil)
+	rmds3 := putAnnotated(3, map[string]string{
+		"source":              "import",
+		mdAnnotationRetention: mdRetentionLegal,
+	})
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 6, mdIDs[2])...)
+
+	annotations, err := s.getAnnotations(mdIDs[0])
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"source": "import"}, annotations)
+	annotations, err = s.getAnnotations(mdIDs[1])
+	require.NoError(t, err)
+	require.Nil(t, annotations)
+
+	// Annotations don't affect the stored MD.
+	rmds, _, err := s.getMD(ctx, uid, deviceKID, mdIDs[2], false)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(3), rmds.MD.Revision)
+
+	// Putting the same MD again merges its annotations, with the
+	// existing values winning.
+	_, err = s.putAnnotated(ctx, uid, deviceKID, rmds3, map[string]string{
+		"source": "replay",
+		"batch":  "7",
+	})
+	require.NoError(t, err)
+	annotations, err = s.getAnnotations(mdIDs[2])
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"source":              "import",
+		mdAnnotationRetention: mdRetentionLegal,
+		"batch":               "7",
+	}, annotations)
+
+	// A different MD at the same revision is still a conflict.
+	_, err = s.putAnnotated(ctx, uid, deviceKID,
+		makeMDForTest(t, id, h, 3, mdIDs[0]),
+		map[string]string{"source": "replay"})
+	require.IsType(t, MDServerErrorConflictRevision{}, err)
+
+	_, err = s.putAnnotated(ctx, uid, deviceKID, rmds3,
+		map[string]string{"": "empty"})
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// The revision under legal retention is pinned for good, so
+	// prune stops there.
+	pinned, err := s.listPinned(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, []MetadataRevision{3}, pinned)
+	err = s.unpinRevision(NullBranchID, 3)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	pruned, err := s.prune(NullBranchID, 6)
+	require.NoError(t, err)
+	require.Equal(t, 2, pruned)
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 6)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 4)
+	require.Equal(t, MetadataRevision(3), rmdses[0].MD.Revision)
+
+	// Pruned MDs lose their annotations.
+	annotations, err = s.getAnnotations(mdIDs[0])
+	require.NoError(t, err)
+	require.Nil(t, annotations)
+}
+
+func TestMDServerTlfStorageDiffAgainst(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Make a replica that is three revisions behind.
+	tempdir2, replica := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir2, replica)
+	putMDRangeForTest(
+		t, replica, uid, deviceKID, id, h, NullBranchID, 1, 7, MdID{})
+
+	// The summary should survive a round-trip through the codec.
+	summary, err := replica.summarizeBranch(NullBranchID)
+	require.NoError(t, err)
+	buf, err := s.codec.Encode(summary)
+	require.NoError(t, err)
+	var decodedSummary mdServerBranchSummary
+	err = s.codec.Decode(buf, &decodedSummary)
+	require.NoError(t, err)
+	require.Equal(t, summary, decodedSummary)
+
+	missing, err := s.diffAgainst(decodedSummary)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[7:], missing)
+
+	// An up-to-date replica is missing nothing.
+	summary, err = s.summarizeBranch(NullBranchID)
+	require.NoError(t, err)
+	missing, err = s.diffAgainst(summary)
+	require.NoError(t, err)
+	require.Nil(t, missing)
+
+	// An empty replica is missing everything.
+	missing, err = s.diffAgainst(mdServerBranchSummary{
+		BID:      NullBranchID,
+		Earliest: MetadataRevisionUninitialized,
+		Latest:   MetadataRevisionUninitialized,
+	})
+	require.NoError(t, err)
+	require.Equal(t, mdIDs, missing)
+
+	// A diverged replica is an error.
+	summary.MdIDs[2] = mdIDs[3]
+	_, err = s.diffAgainst(summary)
+	require.Error(t, err)
+
+	// So is a malformed summary.
+	summary.MdIDs = summary.MdIDs[1:]
+	_, err = s.diffAgainst(summary)
+	require.Error(t, err)
+}
+
+func TestMDServerTlfStorageMerkleProofs(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Publish a checkpoint after each put.
+	var mdIDs []MdID
+	var checkpoints []mdMerkleCheckpoint
+	prevRoot := MdID{}
+	for rev := MetadataRevision(1); rev <= 7; rev++ {
+		mdIDs = append(mdIDs, putMDRangeForTest(t, s, uid, deviceKID,
+			id, h, NullBranchID, rev, rev, prevRoot)...)
+		prevRoot = mdIDs[len(mdIDs)-1]
+		checkpoint, err := s.merkleCheckpoint(NullBranchID)
+		require.NoError(t, err)
+		require.Equal(t, MetadataRevision(1), checkpoint.Earliest)
+		require.Equal(t, int64(rev), checkpoint.Size)
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	// Every revision is provably in every checkpoint that
+	// covers it.
+	for _, checkpoint := range checkpoints {
+		for i := int64(0); i < checkpoint.Size; i++ {
+			rev := MetadataRevision(i + 1)
+			mdID, path, err := s.merkleInclusionProof(
+				checkpoint, rev)
+			require.NoError(t, err)
+			require.Equal(t, mdIDs[i], mdID)
+			err = verifyMDMerkleInclusion(
+				checkpoint, rev, mdID, path)
+			require.NoError(t, err, "Revision %d in size %d",
+				rev, checkpoint.Size)
+		}
+	}
+
+	head := checkpoints[6]
+	mdID, path, err := s.merkleInclusionProof(head, 3)
+	require.NoError(t, err)
+
+	// A proof doesn't verify for an MD that isn't a member at
+	// that revision, nor for a revision the checkpoint doesn't
+	// cover.
+	err = verifyMDMerkleInclusion(head, 3, mdIDs[3], path)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+	err = verifyMDMerkleInclusion(head, 4, mdID, path)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+	err = verifyMDMerkleInclusion(head, 8, mdID, path)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+	err = verifyMDMerkleInclusion(checkpoints[5], 3, mdID, path)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+	err = verifyMDMerkleInclusion(head, 3, mdID, path[1:])
+	require.Equal(t, errMDMerkleProofInvalid, err)
+
+	_, _, err = s.merkleInclusionProof(checkpoints[2], 4)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// Every checkpoint is provably consistent with every later
+	// one.
+	for i, older := range checkpoints {
+		for _, newer := range checkpoints[i:] {
+			proof, err := s.merkleConsistencyProof(older, newer)
+			require.NoError(t, err)
+			err = verifyMDMerkleConsistency(older, newer, proof)
+			require.NoError(t, err, "Size %d to %d",
+				older.Size, newer.Size)
+		}
+	}
+
+	proof, err := s.merkleConsistencyProof(checkpoints[2], head)
+	require.NoError(t, err)
+	forged := checkpoints[2]
+	forged.Root = checkpoints[3].Root
+	err = verifyMDMerkleConsistency(forged, head, proof)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+	err = verifyMDMerkleConsistency(checkpoints[3], head, proof)
+	require.Equal(t, errMDMerkleProofInvalid, err)
+
+	// The storage won't prove anything about a checkpoint that
+	// doesn't match its history.
+	_, err = s.merkleConsistencyProof(forged, head)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	_, _, err = s.merkleInclusionProof(forged, 1)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// Nor about one from before a prune.
+	_, err = s.prune(NullBranchID, 3)
+	require.NoError(t, err)
+	_, _, err = s.merkleInclusionProof(head, 5)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+}
+
+func TestMDMerkleFrontier(t *testing.T) {
+	var mdIDs []MdID
+	for i := 0; i < 20; i++ {
+		mdIDs = append(mdIDs, fakeMdID(byte(i+1)))
+	}
+
+	// The frontier of every prefix has the same root as the
+	// tree recomputed from scratch.
+	for n := 0; n <= len(mdIDs); n++ {
+		f, err := makeMDMerkleFrontier(5, mdIDs[:n])
+		require.NoError(t, err)
+		require.Equal(t, int64(n), f.Size)
+		var leaves []Hash
+		for i, mdID := range mdIDs[:n] {
+			leaf, err := mdMerkleLeafHash(
+				5+MetadataRevision(i), mdID)
+			require.NoError(t, err)
+			leaves = append(leaves, leaf)
+		}
+		root, err := mdMerkleTreeHash(leaves)
+		require.NoError(t, err)
+		require.Equal(t, root, f.Root, "Size %d", n)
+	}
+
+	f, err := makeMDMerkleFrontier(5, mdIDs[:3])
+	require.NoError(t, err)
+	err = f.append(9, mdIDs[3])
+	require.Error(t, err)
+}
+
+func TestMDServerTlfStorageMerkleFrontier(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// requireRoot checks that the checkpoint has the same root as
+	// the tree recomputed from scratch, and whether its frontier
+	// was read as stored.
+	requireRoot := func(stored bool) mdMerkleCheckpoint {
+		checkpoint, err := s.merkleCheckpoint(NullBranchID)
+		require.NoError(t, err)
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		summary, leaves, err := s.merkleLeavesReadLocked(NullBranchID)
+		require.NoError(t, err)
+		root, err := mdMerkleTreeHash(leaves)
+		require.NoError(t, err)
+		require.Equal(t, summary.Earliest, checkpoint.Earliest)
+		require.Equal(t, int64(len(leaves)), checkpoint.Size)
+		require.Equal(t, root, checkpoint.Root)
+		_, ok, err := s.merkleFrontierReadLocked(NullBranchID)
+		require.NoError(t, err)
+		require.Equal(t, stored, ok)
+		return checkpoint
+	}
+
+	requireRoot(false)
+
+	prevRoot := MdID{}
+	putOne := func(rev MetadataRevision) {
+		mdIDs := putMDRangeForTest(t, s, uid, deviceKID, id, h,
+			NullBranchID, rev, rev, prevRoot)
+		prevRoot = mdIDs[0]
+	}
+
+	for rev := MetadataRevision(1); rev <= 9; rev++ {
+		putOne(rev)
+		requireRoot(true)
+	}
+	stale, err := ioutil.ReadFile(s.merkleFrontierPath(NullBranchID))
+	require.NoError(t, err)
+
+	// After a prune, the tree covers only the retained
+	// revisions.
+	_, err = s.prune(NullBranchID, 5)
+	require.NoError(t, err)
+	checkpoint := requireRoot(true)
+	require.Equal(t, MetadataRevision(5), checkpoint.Earliest)
+	require.Equal(t, int64(5), checkpoint.Size)
+	putOne(10)
+	requireRoot(true)
+
+	// A stale frontier is ignored, and replaced on the next put.
+	err = ioutil.WriteFile(
+		s.merkleFrontierPath(NullBranchID), stale, 0600)
+	require.NoError(t, err)
+	requireRoot(false)
+	putOne(11)
+	requireRoot(true)
+
+	// So is a missing or corrupt one.
+	err = os.Remove(s.merkleFrontierPath(NullBranchID))
+	require.NoError(t, err)
+	requireRoot(false)
+	putOne(12)
+	requireRoot(true)
+
+	err = ioutil.WriteFile(
+		s.merkleFrontierPath(NullBranchID), []byte("junk"), 0600)
+	require.NoError(t, err)
+	requireRoot(false)
+	putOne(13)
+	requireRoot(true)
+}
+
+func TestMDServerTlfStorageRevisionIndex(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.revisionIndex = true
+	err = s.open(context.Background())
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// requireIndex checks that the index of the given branch
+	// matches its journal exactly, and that each entry names an
+	// existing MD object.
+	requireIndex := func(bid BranchID, earliest, latest MetadataRevision) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		entries, err := s.readRevisionIndexReadLocked(bid)
+		require.NoError(t, err)
+		start, mdIDs, err := s.branchJournals[bid].getRange(
+			MetadataRevisionInitial,
+			MetadataRevision(math.MaxInt64))
+		require.NoError(t, err)
+		require.Equal(t, earliest, start)
+		require.Equal(t, int(latest-earliest+1), len(entries))
+		for i, e := range entries {
+			require.Equal(t, start+MetadataRevision(i), e.revision)
+			require.Equal(t, mdIDs[i], e.id)
+			_, err := os.Stat(s.mdPath(e.id))
+			require.NoError(t, err)
+		}
+	}
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	requireIndex(NullBranchID, 1, 10)
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 11, 13, mdIDs[9])
+	requireIndex(bid, 11, 13)
+
+	// The index is plain text, with the path of each object.
+	buf, err := ioutil.ReadFile(s.revisionIndexPath(NullBranchID))
+	require.NoError(t, err)
+	path, err := filepath.Rel(s.dir, s.mdPath(mdIDs[0]))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf),
+		fmt.Sprintf("1 %s %s\n", mdIDs[0], path)), string(buf))
+
+	// Prunes and later puts keep it up to date.
+	_, err = s.prune(NullBranchID, 5)
+	require.NoError(t, err)
+	requireIndex(NullBranchID, 5, 10)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 11, 12, mdIDs[9])
+	requireIndex(NullBranchID, 5, 12)
+
+	// A lost or damaged index is rebuilt from the journal by the
+	// next open.
+	err = os.Remove(s.revisionIndexPath(NullBranchID))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(s.revisionIndexPath(bid), []byte("12 x"), 0600)
+	require.NoError(t, err)
+	err = s.close()
+	require.NoError(t, err)
+
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.revisionIndex = true
+	err = s.open(context.Background())
+	require.NoError(t, err)
+	requireIndex(NullBranchID, 5, 12)
+	requireIndex(bid, 11, 13)
+
+	// A failure to rebuild the index, here because a directory
+	// is in the way of its temporary file, doesn't keep the
+	// storage from opening.
+	err = s.close()
+	require.NoError(t, err)
+	err = os.Mkdir(s.revisionIndexPath(bid)+".tmp", 0700)
+	require.NoError(t, err)
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.revisionIndex = true
+	err = s.open(context.Background())
+	require.NoError(t, err)
+	requireIndex(NullBranchID, 5, 12)
+}
+
+func TestMDServerTlfStorageBlockRefChanges(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+	RegisterOps(s.codec)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, true)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid},
+		[]keybase1.UID{keybase1.PublicUID}, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	ptr := func(b byte) BlockPointer {
+		return BlockPointer{ID: fakeBlockID(b)}
+	}
+
+	// Revision 1 creates a file, revision 2 writes to it, and
+	// revision 3 removes it, each updating the root directory.
+	// Revision 2 also has a no-op update, which adds and removes
+	// nothing.
+	create, err := newCreateOp("a", ptr(1), File)
+	require.NoError(t, err)
+	create.AddRefBlock(ptr(10))
+	create.AddUpdate(ptr(1), ptr(2))
+	sync, err := newSyncOp(ptr(10))
+	require.NoError(t, err)
+	sync.AddRefBlock(ptr(11))
+	sync.AddUpdate(ptr(10), ptr(12))
+	sync.AddUpdate(ptr(2), ptr(2))
+	rm, err := newRmOp("a", ptr(2))
+	require.NoError(t, err)
+	rm.AddUnrefBlock(ptr(11))
+	rm.AddUnrefBlock(ptr(12))
+	rm.AddUpdate(ptr(2), ptr(3))
+
+	prevRoot := MdID{}
+	for i, o := range []op{create, sync, rm} {
+		// Public TLFs have no keys to fake, so makeMDForTest
+		// can't be used.
+		rmds, err := NewRootMetadataSignedForTest(id, h)
+		require.NoError(t, err)
+		rmds.MD.Revision = MetadataRevision(i + 1)
+		rmds.MD.PrevRoot = prevRoot
+		rmds.MD.SerializedPrivateMetadata, err = s.codec.Encode(
+			PrivateMetadata{Changes: BlockChanges{Ops: opsList{o}}})
+		require.NoError(t, err)
+		_, err = s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+
+	changes, err := s.getBlockRefChanges(
+		ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, []mdBlockRefChanges{
+		{
+			revision: 1,
+			added:    []BlockPointer{ptr(10), ptr(2)},
+			removed:  []BlockPointer{ptr(1)},
+		},
+		{
+			revision: 2,
+			added:    []BlockPointer{ptr(11), ptr(12)},
+			removed:  []BlockPointer{ptr(10)},
+		},
+		{
+			revision: 3,
+			added:    []BlockPointer{ptr(3)},
+			removed:  []BlockPointer{ptr(11), ptr(12), ptr(2)},
+		},
+	}, changes)
+
+	// A sub-range reports only its own revisions.
+	changes, err = s.getBlockRefChanges(
+		ctx, uid, deviceKID, NullBranchID, 2, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, MetadataRevision(2), changes[0].revision)
+
+	// The changes of a private TLF are encrypted, so can't be
+	// reported.
+	privateH, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	_, err = s.blockRefChangesForMD(
+		makeMDForTest(t, FakeTlfID(2, false), privateH, 1, MdID{}))
+	require.Error(t, err)
+}
+
+type testMDServerTlfStorageSpan struct {
+	name     string
+	tags     map[string]interface{}
+	children []*testMDServerTlfStorageSpan
+	finished bool
+}
+
+func (s *testMDServerTlfStorageSpan) SetTag(key string, value interface{}) {
+	s.tags[key] = value
+}
+
+func (s *testMDServerTlfStorageSpan) Finish() {
+	s.finished = true
+}
+
+type testMDServerTlfStorageSpanKey struct{}
+
+// testMDServerTlfStorageTracer records the spans started with it as
+// a tree. It's not safe for concurrent use.
+type testMDServerTlfStorageTracer struct {
+	roots []*testMDServerTlfStorageSpan
+}
+
+func (t *testMDServerTlfStorageTracer) StartSpan(
+	ctx context.Context, name string) (
+	context.Context, mdServerTlfStorageSpan) {
+	span := &testMDServerTlfStorageSpan{
+		name: name,
+		tags: make(map[string]interface{}),
+	}
+	if parent, ok := ctx.Value(
+		testMDServerTlfStorageSpanKey{}).(*testMDServerTlfStorageSpan); ok {
+		parent.children = append(parent.children, span)
+	} else {
+		t.roots = append(t.roots, span)
+	}
+	return context.WithValue(ctx, testMDServerTlfStorageSpanKey{}, span), span
+}
+
+// spanTree returns the names of the given spans and their
+// descendants, with children in parentheses, and checks that they
+// are all finished.
+func spanTree(t *testing.T, spans []*testMDServerTlfStorageSpan) string {
+	var str string
+	for i, span := range spans {
+		require.True(t, span.finished, span.name)
+		if i > 0 {
+			str += " "
+		}
+		str += span.name
+		if len(span.children) > 0 {
+			str += "(" + spanTree(t, span.children) + ")"
+		}
+	}
+	return str
+}
+
+func TestMDServerTlfStorageTrace(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Untraced operations shouldn't need a tracer.
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+
+	tracer := &testMDServerTlfStorageTracer{}
+	ctx := withMDServerTlfStorageTracer(context.Background(), tracer)
+
+	rmds := makeMDForTest(t, id, h, MetadataRevision(2), mdIDs[0])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	require.Equal(t,
+		"put(prepare(encode stage) putMD(moveStaged) journalAppend)",
+		spanTree(t, tracer.roots))
+	putSpan := tracer.roots[0]
+	require.Equal(t, NullBranchID, putSpan.tags["branch"])
+	require.Equal(t, MetadataRevision(2), putSpan.tags["revision"])
+	require.Equal(t, mdID, putSpan.tags["mdID"])
+	require.IsType(t, time.Duration(0), putSpan.tags["lockHeld"])
+
+	tracer.roots = nil
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t,
+		"getRange(getMD(read decode) getMD(read decode))",
+		spanTree(t, tracer.roots))
+	getMDSpan := tracer.roots[0].children[1]
+	require.Equal(t, MetadataRevision(2), getMDSpan.tags["revision"])
+	require.Equal(t, mdID, getMDSpan.tags["mdID"])
+}
+
+func TestMDServerTlfStorageGetMultiple(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid := FakeBranchID(1)
+	branchMdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 11, 12, mdIDs[9])
+
+	// Make an MdID that isn't stored.
+	absentMD := makeMDForTest(t, id, h, MetadataRevision(20), mdIDs[9])
+	absentID, err := absentMD.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	ids := []MdID{
+		mdIDs[4], absentID, branchMdIDs[1], mdIDs[0], absentID, mdIDs[4],
+	}
+	ctx := context.Background()
+	rmdses, errs, err := s.getMultiple(ctx, uid, deviceKID, ids)
+	require.NoError(t, err)
+	require.Len(t, rmdses, len(ids))
+	require.Len(t, errs, len(ids))
+	for i, expectedID := range ids {
+		if expectedID == absentID {
+			require.Nil(t, rmdses[i])
+			require.Equal(t,
+				mdServerTlfStorageNoSuchMDIDError{absentID}, errs[i])
+			continue
+		}
+		require.NoError(t, errs[i])
+		mdID, err := rmdses[i].MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		require.Equal(t, expectedID, mdID)
+	}
+
+	// An empty batch is fine.
+	rmdses, errs, err = s.getMultiple(ctx, uid, deviceKID, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 0)
+	require.Len(t, errs, 0)
+
+	// A cancelled context fails the whole batch.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = s.getMultiple(cancelledCtx, uid, deviceKID, ids)
+	require.Equal(t, context.Canceled, err)
+
+	// So does a non-reader.
+	_, _, err = s.getMultiple(
+		ctx, keybase1.MakeTestUID(2), deviceKID, ids)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+}
+
+func TestMDServerTlfStorageEpochFence(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	// Open a second instance on the same directory, which
+	// fences off the first.
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	ctx := context.Background()
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+
+	rmds := makeMDForTest(t, id, h, MetadataRevision(6), mdIDs[4])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+
+	err = s.pinRevision(NullBranchID, MetadataRevision(2))
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+
+	_, err = s.prune(NullBranchID, MetadataRevision(3))
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+
+	// Reads through the fenced instance still work.
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), head.MD.Revision)
+
+	// The second instance can write.
+	_, err = s2.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+
+	head, err = s2.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(6), head.MD.Revision)
+}
+
+func TestMDServerTlfStorageConcurrentEpochs(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	// Concurrent openers of the same dir never share an epoch,
+	// and the EPOCH file is always whole.
+	const openers = 16
+	epochs := make(chan uint64, openers)
+	errs := make(chan error, 2*openers)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+			_, err := s.readEpoch()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < openers; i++ {
+		go func() {
+			s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+			epoch, epochFile, err := s2.advanceEpoch()
+			if err == nil {
+				err = epochFile.Close()
+			}
+			epochs <- epoch
+			errs <- err
+		}()
+	}
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < openers; i++ {
+		require.NoError(t, <-errs)
+		epoch := <-epochs
+		require.False(t, seen[epoch], "epoch %d seen twice", epoch)
+		seen[epoch] = true
+	}
+	close(done)
+	require.NoError(t, <-errs)
+
+	epoch, err := s.readEpoch()
+	require.NoError(t, err)
+	require.Equal(t, s.epoch+openers, epoch)
+}
+
+func TestMDServerTlfStoragePutConflict(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	// Race several puts of revision 6; exactly one should win.
+	const numPuts = 5
+	errs := make(chan error, numPuts)
+	for i := 0; i < numPuts; i++ {
+		rmds := makeMDForTest(t, id, h, MetadataRevision(6), mdIDs[4])
+		// Make each MD distinct.
+		rmds.MD.RefBytes = uint64(i)
+		rmds.MD.DiskUsage = uint64(i)
+		go func() {
+			_, err := s.put(context.Background(), uid, deviceKID, rmds)
+			errs <- err
+		}()
+	}
+
+	var numWinners int
+	for i := 0; i < numPuts; i++ {
+		err := <-errs
+		if err == nil {
+			numWinners++
+			continue
+		}
+		conflictErr, ok := err.(MDServerErrorConflictRevision)
+		require.True(t, ok, "%v", err)
+		require.Equal(t, MetadataRevision(7), conflictErr.Expected)
+		require.Equal(t, MetadataRevision(6), conflictErr.Actual)
+	}
+	require.Equal(t, 1, numWinners)
+
+	head, err := s.getForTLF(
+		context.Background(), uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(6), head.MD.Revision)
+
+	// A put that skips ahead also conflicts.
+	rmds := makeMDForTest(t, id, h, MetadataRevision(8), mdIDs[4])
+	_, err = s.put(context.Background(), uid, deviceKID, rmds)
+	require.Equal(t, MDServerErrorConflictRevision{
+		Desc: fmt.Sprintf("Conflict: head of branch %s is at "+
+			"revision 6, so expected revision 7, actual 8",
+			NullBranchID),
+		Expected: 7,
+		Actual:   8,
+	}, err)
+}
+
+func TestMDServerTlfStorageGetMDTrustedTimestamp(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+
+	ctx := context.Background()
+
+	// By default, the timestamp is only available as untrusted.
+	rmds, trustedTimestamp, err := s.getMD(
+		ctx, uid, deviceKID, mdIDs[1], false)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(2), rmds.MD.Revision)
+	require.False(t, rmds.untrustedServerTimestamp.IsZero())
+	require.True(t, trustedTimestamp.IsZero())
+
+	// With the flag, the same timestamp is returned as trusted.
+	rmds, trustedTimestamp, err = s.getMD(
+		ctx, uid, deviceKID, mdIDs[1], true)
+	require.NoError(t, err)
+	require.Equal(t, rmds.untrustedServerTimestamp, trustedTimestamp)
+
+	// The other getters are unaffected.
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, rmds.untrustedServerTimestamp,
+		head.untrustedServerTimestamp)
+
+	// Make an MdID that isn't stored.
+	absentMD := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	absentID, err := absentMD.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	_, _, err = s.getMD(ctx, uid, deviceKID, absentID, true)
+	require.Equal(t, mdServerTlfStorageNoSuchMDIDError{absentID}, err)
+}
+
+// snapshotDirForTest returns the contents of all files and
+// directories under dir, keyed by path.
+func snapshotDirForTest(t *testing.T, dir string) map[string]string {
+	snapshot := make(map[string]string)
+	err := filepath.Walk(dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				snapshot[path] = "<dir>"
+				return nil
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			snapshot[path] = string(buf)
+			return nil
+		})
+	require.NoError(t, err)
+	return snapshot
+}
+
+func TestMDServerTlfStoragePutDiskFull(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Simulate running out of space halfway through a write.
+	diskFull := true
+	s.writeFile = func(
+		filename string, data []byte, perm os.FileMode) error {
+		if !diskFull {
+			return ioutil.WriteFile(filename, data, perm)
+		}
+		err := ioutil.WriteFile(filename, data[:len(data)/2], perm)
+		if err != nil {
+			return err
+		}
+		return &os.PathError{
+			Op: "write", Path: filename, Err: syscall.ENOSPC}
+	}
+
+	ctx := context.Background()
+	expectedErr := MDServerErrorThrottle{errMDServerTlfStorageDiskFull}
+
+	// The first put would create the mds directory.
+	before := snapshotDirForTest(t, s.dir)
+	rmds := makeMDForTest(t, id, h, MetadataRevision(1), MdID{})
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, expectedErr, err)
+	require.Equal(t, before, snapshotDirForTest(t, s.dir))
+
+	diskFull = false
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	diskFull = true
+
+	before = snapshotDirForTest(t, s.dir)
+	rmds = makeMDForTest(t, id, h, MetadataRevision(6), mdIDs[4])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, expectedErr, err)
+	require.Equal(t, before, snapshotDirForTest(t, s.dir))
+
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), length)
+
+	// Once there's space again, the same put succeeds.
+	diskFull = false
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStoragePutStagesOnlyWriters(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	var staged []string
+	s.writeFile = func(
+		filename string, data []byte, perm os.FileMode) error {
+		if filepath.Base(filepath.Dir(filename)) ==
+			mdServerMDStagingDirName {
+			staged = append(staged, filename)
+		}
+		return ioutil.WriteFile(filename, data, perm)
+	}
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+	require.Len(t, staged, 1)
+
+	// A put by a user who isn't a writer fails the writer check
+	// before anything is staged.
+	staged = nil
+	ctx := context.Background()
+	rmds := makeMDForTest(t, id, h, MetadataRevision(2), mdIDs[0])
+	_, err = s.put(ctx, keybase1.MakeTestUID(2), deviceKID, rmds)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+	require.Len(t, staged, 0)
+}
+
+func TestMDServerTlfStoragePutStoreFailureSplitHeaders(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.splitHeaders = true
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+
+	// Fail only the write of the MD itself.
+	diskFull := true
+	s.writeFile = func(
+		filename string, data []byte, perm os.FileMode) error {
+		if diskFull && strings.HasPrefix(filename,
+			filepath.Join(s.dir, mdServerMDStagingDirName)) {
+			return &os.PathError{
+				Op: "write", Path: filename,
+				Err: syscall.ENOSPC}
+		}
+		return ioutil.WriteFile(filename, data, perm)
+	}
+
+	// The failed put leaves no header behind.
+	ctx := context.Background()
+	before := snapshotDirForTest(t, s.dir)
+	rmds := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t,
+		MDServerErrorThrottle{errMDServerTlfStorageDiskFull}, err)
+	require.Equal(t, before, snapshotDirForTest(t, s.dir))
+
+	// Once there's space again, the same put stores the header
+	// too.
+	diskFull = false
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	_, err = os.Stat(s.mdHeaderPath(mdID))
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageRetainedWindow(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	checkWindow := func(bid BranchID,
+		expectedEarliest, expectedLatest MetadataRevision) {
+		earliest, latest, err := s.retainedWindow(bid)
+		require.NoError(t, err)
+		require.Equal(t, expectedEarliest, earliest)
+		require.Equal(t, expectedLatest, latest)
+	}
+
+	// Empty branch.
+	checkWindow(NullBranchID,
+		MetadataRevisionUninitialized, MetadataRevisionUninitialized)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 6, 8, mergedIDs[4])
+
+	checkWindow(NullBranchID, 1, 10)
+	checkWindow(bid, 6, 8)
+	checkWindow(FakeBranchID(2),
+		MetadataRevisionUninitialized, MetadataRevisionUninitialized)
+
+	// Pruning only moves the start of the window of the pruned
+	// branch.
+	_, err = s.prune(NullBranchID, 5)
+	require.NoError(t, err)
+	checkWindow(NullBranchID, 5, 10)
+	checkWindow(bid, 6, 8)
+
+	// Everything in the window can be read, and nothing before
+	// it.
+	ctx := context.Background()
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+	require.Equal(t, MetadataRevision(5), rmdses[0].MD.Revision)
+}
+
+func TestMDServerTlfStorageFilterRange(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// Make revisions 3, 4, and 7 rekeys.
+	rekeyRevisions := map[MetadataRevision]bool{3: true, 4: true, 7: true}
+	var prevRoot MdID
+	for i := MetadataRevision(1); i <= 10; i++ {
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		if rekeyRevisions[i] {
+			rmds.MD.Flags |= MetadataFlagRekey
+		}
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+
+	isRekey := func(rmds *RootMetadataSigned) bool {
+		return rmds.MD.IsRekeySet()
+	}
+
+	rmdses, err := s.filterRange(
+		ctx, uid, deviceKID, NullBranchID, 1, 10, isRekey)
+	require.NoError(t, err)
+	var revisions []MetadataRevision
+	for _, rmds := range rmdses {
+		revisions = append(revisions, rmds.MD.Revision)
+	}
+	require.Equal(t, []MetadataRevision{3, 4, 7}, revisions)
+
+	// The range bounds are respected.
+	rmdses, err = s.filterRange(
+		ctx, uid, deviceKID, NullBranchID, 4, 6, isRekey)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 1)
+	require.Equal(t, MetadataRevision(4), rmdses[0].MD.Revision)
+
+	// A nonexistent branch has no matches.
+	rmdses, err = s.filterRange(
+		ctx, uid, deviceKID, FakeBranchID(1), 1, 10, isRekey)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 0)
+}
+
+func TestMDServerTlfStorageRangeByWriter(t *testing.T) {
+	testMDServerTlfStorageRangeByWriter(t, false)
+}
+
+func TestMDServerTlfStorageRangeByWriterSplitHeaders(t *testing.T) {
+	testMDServerTlfStorageRangeByWriter(t, true)
+}
+
+func testMDServerTlfStorageRangeByWriter(t *testing.T, splitHeaders bool) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+	s.splitHeaders = splitHeaders
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+	uid3 := keybase1.MakeTestUID(3)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid1, uid2, uid3}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// uid1 writes revisions 1, 2, 5, 6, 9 and 10, and uid2 the
+	// others. uid3 never writes.
+	var uid1Revisions []MetadataRevision
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 10; i++ {
+		uid := uid2
+		if i%4 == 1 || i%4 == 2 {
+			uid = uid1
+			uid1Revisions = append(uid1Revisions, i)
+		}
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		rmds.MD.LastModifyingUser = uid
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+
+	revisionsByWriter := func(writerUID keybase1.UID,
+		start, stop MetadataRevision) []MetadataRevision {
+		rmdses, err := s.rangeByWriter(ctx, uid3, deviceKID,
+			NullBranchID, writerUID, start, stop)
+		require.NoError(t, err)
+		var revisions []MetadataRevision
+		for _, rmds := range rmdses {
+			require.Equal(t, writerUID, rmds.MD.LastModifyingUser)
+			// Whole MDs are returned, not just headers.
+			require.NotNil(t, rmds.MD.SerializedPrivateMetadata)
+			revisions = append(revisions, rmds.MD.Revision)
+		}
+		return revisions
+	}
+
+	require.Equal(t, uid1Revisions, revisionsByWriter(uid1, 1, 10))
+	require.Equal(t, []MetadataRevision{3, 4, 7, 8},
+		revisionsByWriter(uid2, 1, 10))
+	require.Equal(t, []MetadataRevision{5, 6},
+		revisionsByWriter(uid1, 3, 8))
+	require.Nil(t, revisionsByWriter(uid3, 1, 10))
+
+	// Without the index of writers, the result is the same.
+	err = os.Remove(s.writersPath(NullBranchID))
+	require.NoError(t, err)
+	require.Equal(t, uid1Revisions, revisionsByWriter(uid1, 1, 10))
+	require.Nil(t, revisionsByWriter(uid3, 1, 10))
+
+	// The requesting user still needs to be able to read.
+	_, err = s.rangeByWriter(ctx, keybase1.MakeTestUID(4), deviceKID,
+		NullBranchID, uid1, 1, 10)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+}
+
+func TestMDServerTlfStorageSnapshot(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	snapshotRoot, err := ioutil.TempDir(os.TempDir(), "mdserver_snapshot")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(snapshotRoot)
+		require.NoError(t, err)
+	}()
+
+	// Make the MDs up front, so that the goroutine doing the puts
+	// doesn't need t.
+	var toPut []*RootMetadataSigned
+	prevRoot := mdIDs[4]
+	for i := MetadataRevision(6); i <= 30; i++ {
+		rmds := makeMDForTest(t, id, h, i, prevRoot)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		toPut = append(toPut, rmds)
+	}
+
+	// Take snapshots while puts are in progress.
+	const numSnapshots = 5
+	putErrCh := make(chan error, 1)
+	go func() {
+		for _, rmds := range toPut {
+			_, err := s.put(context.Background(), uid, deviceKID, rmds)
+			if err != nil {
+				putErrCh <- err
+				return
+			}
+		}
+		putErrCh <- nil
+	}()
+
+	var snapshotDirs []string
+	for i := 0; i < numSnapshots; i++ {
+		snapshotDir := filepath.Join(snapshotRoot, strconv.Itoa(i))
+		err := s.snapshot(snapshotDir)
+		require.NoError(t, err)
+		snapshotDirs = append(snapshotDirs, snapshotDir)
+	}
+	require.NoError(t, <-putErrCh)
+
+	// A snapshot can't overwrite an existing directory.
+	err = s.snapshot(snapshotDirs[0])
+	require.Error(t, err)
+
+	ctx := context.Background()
+	for _, snapshotDir := range snapshotDirs {
+		snapshot := makeMDServerTlfStorage(s.codec, s.crypto, snapshotDir)
+		err := snapshot.open(ctx)
+		require.NoError(t, err)
+
+		// Every revision up to the head must be readable and
+		// chained.
+		head, err := snapshot.getForTLF(ctx, uid, deviceKID, NullBranchID)
+		require.NoError(t, err)
+		rmdses, err := snapshot.getRange(
+			ctx, uid, deviceKID, NullBranchID, 1, head.MD.Revision)
+		require.NoError(t, err)
+		require.Len(t, rmdses, int(head.MD.Revision))
+		var prevRoot MdID
+		for _, rmds := range rmdses {
+			require.Equal(t, prevRoot, rmds.MD.PrevRoot)
+			prevRoot, err = rmds.MD.MetadataID(s.crypto)
+			require.NoError(t, err)
+		}
+
+		err = snapshot.close()
+		require.NoError(t, err)
+	}
+
+	// Writes to the original don't affect an existing snapshot.
+	headBefore, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	snapshotDir := filepath.Join(snapshotRoot, "last")
+	err = s.snapshot(snapshotDir)
+	require.NoError(t, err)
+	headID, err := headBefore.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID,
+		headBefore.MD.Revision+1, headBefore.MD.Revision+1, headID)
+
+	snapshot := makeMDServerTlfStorage(s.codec, s.crypto, snapshotDir)
+	err = snapshot.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := snapshot.close()
+		require.NoError(t, err)
+	}()
+	head, err := snapshot.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, headBefore.MD.Revision, head.MD.Revision)
+}
+
+func TestMDServerTlfStorageSnapshotCopy(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+	for i, mdID := range mdIDs {
+		timestamp := time.Unix(int64(1000*(i+1)), 0)
+		err := os.Chtimes(s.mdPath(mdID), timestamp, timestamp)
+		require.NoError(t, err)
+	}
+
+	// Act as if the snapshot were on another device.
+	s.linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname,
+			Err: syscall.EXDEV}
+	}
+
+	snapshotDir, err := ioutil.TempDir(os.TempDir(), "mdserver_snapshot")
+	require.NoError(t, err)
+	err = os.RemoveAll(snapshotDir)
+	require.NoError(t, err)
+	err = s.snapshot(snapshotDir)
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(snapshotDir)
+		require.NoError(t, err)
+	}()
+
+	// The copies are separate files with the same timestamps.
+	snapshot := makeMDServerTlfStorage(s.codec, s.crypto, snapshotDir)
+	for _, mdID := range mdIDs {
+		srcInfo, err := os.Stat(s.mdPath(mdID))
+		require.NoError(t, err)
+		destInfo, err := os.Stat(snapshot.mdPath(mdID))
+		require.NoError(t, err)
+		require.False(t, os.SameFile(srcInfo, destInfo))
+		require.Equal(t, srcInfo.ModTime(), destInfo.ModTime())
+	}
+
+	// The state of the open instance isn't copied.
+	for _, path := range []string{snapshot.epochPath(),
+		snapshot.epochLockPath(), snapshot.openLockPath(),
+		snapshot.mdIDIndexPath()} {
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err), "%s: %v", path, err)
+	}
+
+	ctx := context.Background()
+	err = snapshot.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := snapshot.close()
+		require.NoError(t, err)
+	}()
+	rmdses, err := snapshot.getRange(
+		ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 3)
+	for i, rmds := range rmdses {
+		require.Equal(t, time.Unix(int64(1000*(i+1)), 0),
+			rmds.untrustedServerTimestamp)
+	}
+}
+
+func TestMDServerTlfStoragePutIfHead(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// The first put expects an empty branch.
+	rmds := makeMDForTest(t, id, h, MetadataRevision(1), MdID{})
+	_, err = s.putIfHead(ctx, uid, deviceKID, rmds, MdID{})
+	require.NoError(t, err)
+	headID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	// Succeeds when the head matches.
+	rmds = makeMDForTest(t, id, h, MetadataRevision(2), headID)
+	_, err = s.putIfHead(ctx, uid, deviceKID, rmds, headID)
+	require.NoError(t, err)
+	staleHeadID := headID
+	headID, err = rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	// Fails when another writer has advanced the head, and
+	// returns the actual head.
+	rmds = makeMDForTest(t, id, h, MetadataRevision(3), headID)
+	_, err = s.putIfHead(ctx, uid, deviceKID, rmds, staleHeadID)
+	condErr, ok := err.(MDServerErrorConditionFailed)
+	require.True(t, ok, "%v", err)
+	headMovedErr, ok := condErr.Err.(mdServerTlfStorageHeadMovedError)
+	require.True(t, ok, "%v", condErr.Err)
+	require.Equal(t, mdServerTlfStorageHeadMovedError{
+		bid:        NullBranchID,
+		expectedID: staleHeadID,
+		actualID:   headID,
+	}, headMovedErr)
+
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), length)
+
+	// Retrying with the returned head succeeds.
+	_, err = s.putIfHead(ctx, uid, deviceKID, rmds, headMovedErr.actualID)
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageWriteBuffer(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	clock := newTestClockNow()
+	s.clock = clock
+	// Big enough for a few MDs.
+	s.writeBufferConfig = mdWriteBufferConfig{
+		maxBytes: 5 * 1024,
+		maxAge:   time.Minute,
+	}
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	isOnDisk := func(mdID MdID) bool {
+		_, err := os.Stat(s.mdPath(mdID))
+		if os.IsNotExist(err) {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	// Buffered MDs are readable, but not yet on disk.
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+	for _, mdID := range mdIDs {
+		require.False(t, isOnDisk(mdID))
+	}
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 2)
+	require.Equal(t, clock.Now(), rmdses[1].untrustedServerTimestamp)
+	count, bytes, err := s.estimateRange(
+		uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, s.writeBufferBytes, bytes)
+
+	// sync flushes.
+	err = s.sync()
+	require.NoError(t, err)
+	for _, mdID := range mdIDs {
+		require.True(t, isOnDisk(mdID))
+	}
+	require.Len(t, s.writeBuffer, 0)
+	require.Equal(t, int64(0), s.writeBufferBytes)
+
+	// A put after the oldest buffered MD is too old flushes.
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 3, 3, mdIDs[1])...)
+	require.False(t, isOnDisk(mdIDs[2]))
+	clock.Add(time.Minute)
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdIDs[2])...)
+	require.True(t, isOnDisk(mdIDs[2]))
+	require.True(t, isOnDisk(mdIDs[3]))
+
+	// Enough puts to go over the size limit flush.
+	var mdSize int64
+	for i := MetadataRevision(5); s.writeBufferBytes+mdSize <
+		s.writeBufferConfig.maxBytes; i++ {
+		bytesBefore := s.writeBufferBytes
+		mdIDs = append(mdIDs, putMDRangeForTest(
+			t, s, uid, deviceKID, id, h, NullBranchID, i, i,
+			mdIDs[len(mdIDs)-1])...)
+		require.False(t, isOnDisk(mdIDs[len(mdIDs)-1]))
+		mdSize = s.writeBufferBytes - bytesBefore
+	}
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID,
+		MetadataRevision(len(mdIDs)+1), MetadataRevision(len(mdIDs)+1),
+		mdIDs[len(mdIDs)-1])...)
+	for _, mdID := range mdIDs {
+		require.True(t, isOnDisk(mdID))
+	}
+
+	// If the process dies with buffered MDs, the next open drops
+	// the journal entries for them.
+	lastOnDisk := MetadataRevision(len(mdIDs))
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID,
+		lastOnDisk+1, lastOnDisk+2, mdIDs[len(mdIDs)-1])
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	head, err := s2.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, lastOnDisk, head.MD.Revision)
+	err = s2.close()
+	require.NoError(t, err)
+
+	// The fenced-off first instance can't flush its buffer.
+	err = s.sync()
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+	err = s.close()
+	require.Equal(t, errMDServerTlfStorageFenced, err)
+}
+
+func TestMDServerTlfStorageWriteBufferFlushOrder(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.writeBufferConfig = mdWriteBufferConfig{maxBytes: 1024 * 1024}
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Fail the write of revision 3.
+	writeErr := errors.New("write failed")
+	s.writeFile = func(
+		filename string, data []byte, perm os.FileMode) error {
+		if strings.HasPrefix(
+			filepath.Base(filename), mdIDs[2].String()) {
+			return writeErr
+		}
+		return ioutil.WriteFile(filename, data, perm)
+	}
+
+	// The flush stops at revision 3, so nothing after it is on
+	// disk.
+	err = s.sync()
+	require.Equal(t, writeErr, err)
+	for i, mdID := range mdIDs {
+		_, err := os.Stat(s.mdPath(mdID))
+		if i < 2 {
+			require.NoError(t, err)
+		} else {
+			require.True(t, os.IsNotExist(err))
+		}
+	}
+	require.Len(t, s.writeBuffer, len(mdIDs)-2)
+
+	s.writeFile = ioutil.WriteFile
+	err = s.sync()
+	require.NoError(t, err)
+	for _, mdID := range mdIDs {
+		_, err := os.Stat(s.mdPath(mdID))
+		require.NoError(t, err)
+	}
+}
+
+func TestMDServerTlfStoragePutAsync(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	requireReady := func(written <-chan error) error {
+		select {
+		case err, ok := <-written:
+			require.True(t, ok)
+			// The channel must be closed afterwards.
+			_, ok = <-written
+			require.False(t, ok)
+			return err
+		default:
+			t.Fatal("Durability channel not ready")
+			return nil
+		}
+	}
+	requireNotReady := func(written <-chan error) {
+		select {
+		case err := <-written:
+			t.Fatalf("Durability channel unexpectedly ready: %v", err)
+		default:
+		}
+	}
+
+	// Without buffering, the channel is ready right away.
+	rmds := makeMDForTest(t, id, h, MetadataRevision(1), MdID{})
+	_, written, err := s.putAsync(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	require.NoError(t, requireReady(written))
+	prevRoot, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	// With buffering, the channel is ready only after a flush.
+	s.writeBufferConfig = mdWriteBufferConfig{maxBytes: 1024 * 1024}
+	rmds = makeMDForTest(t, id, h, MetadataRevision(2), prevRoot)
+	_, written, err = s.putAsync(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	requireNotReady(written)
+	prevRoot, err = rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	err = s.sync()
+	require.NoError(t, err)
+	require.NoError(t, requireReady(written))
+	_, err = os.Stat(s.mdPath(prevRoot))
+	require.NoError(t, err)
+
+	// A flush error is passed along.
+	writeErr := errors.New("write failed")
+	s.writeFile = func(string, []byte, os.FileMode) error {
+		return writeErr
+	}
+	rmds = makeMDForTest(t, id, h, MetadataRevision(3), prevRoot)
+	_, written, err = s.putAsync(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	requireNotReady(written)
+
+	err = s.sync()
+	require.Equal(t, writeErr, err)
+	require.Equal(t, writeErr, requireReady(written))
+
+	// A failed put returns no channel.
+	_, written, err = s.putAsync(ctx, uid, deviceKID,
+		makeMDForTest(t, id, h, MetadataRevision(3), MdID{}))
+	require.IsType(t, MDServerErrorConflictRevision{}, err)
+	require.Nil(t, written)
+
+	// A retried put of the buffered MD waits for the same flush.
+	_, written, err = s.putAsync(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	requireNotReady(written)
+
+	// The MD is still buffered, so a later successful flush
+	// writes it.
+	s.writeFile = ioutil.WriteFile
+	err = s.sync()
+	require.NoError(t, err)
+	require.NoError(t, requireReady(written))
+}
+
+func TestMDServerTlfStorageReaderChanges(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	reader1 := keybase1.MakeTestUID(2)
+	reader2 := keybase1.MakeTestUID(3)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+
+	makeHandle := func(readers ...keybase1.UID) BareTlfHandle {
+		h, err := MakeBareTlfHandle(
+			[]keybase1.UID{uid}, readers, nil, nil, nil)
+		require.NoError(t, err)
+		return h
+	}
+
+	// Revision 3 adds reader2, and revision 5 removes reader1.
+	handles := []BareTlfHandle{
+		makeHandle(reader1),
+		makeHandle(reader1),
+		makeHandle(reader1, reader2),
+		makeHandle(reader1, reader2),
+		makeHandle(reader2),
+		makeHandle(reader2),
+	}
+	var prevRoot MdID
+	ctx := context.Background()
+	for i, h := range handles {
+		rmds := makeMDForTest(t, id, h, MetadataRevision(i+1), prevRoot)
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+
+	changes, err := s.readerChanges(
+		ctx, uid, deviceKID, NullBranchID, 1, 6)
+	require.NoError(t, err)
+	require.Equal(t, []mdReaderChange{
+		{
+			revision: 3,
+			before:   []keybase1.UID{uid, reader1},
+			after:    []keybase1.UID{uid, reader1, reader2},
+			added:    []keybase1.UID{reader2},
+		},
+		{
+			revision: 5,
+			before:   []keybase1.UID{uid, reader1, reader2},
+			after:    []keybase1.UID{uid, reader2},
+			removed:  []keybase1.UID{reader1},
+		},
+	}, changes)
+
+	// A range starting at a change still reports it, and one
+	// without changes reports nothing.
+	changes, err = s.readerChanges(
+		ctx, uid, deviceKID, NullBranchID, 5, 6)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, MetadataRevision(5), changes[0].revision)
+
+	changes, err = s.readerChanges(
+		ctx, uid, deviceKID, NullBranchID, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+}
+
+func TestMDServerTlfStorageMDIDIndex(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid := FakeBranchID(1)
+	branchMdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 11, 12, mdIDs[9])
+
+	absentMD := makeMDForTest(t, id, h, MetadataRevision(20), mdIDs[9])
+	absentID, err := absentMD.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	requireExists := func(s *mdServerTlfStorage, id MdID, expected bool) {
+		exists, err := s.existsMD(id)
+		require.NoError(t, err)
+		require.Equal(t, expected, exists)
+	}
+
+	for _, mdID := range append(mdIDs, branchMdIDs...) {
+		requireExists(s, mdID, true)
+	}
+	requireExists(s, absentID, false)
+
+	// Deletes are reflected.
+	_, err = s.prune(NullBranchID, 4)
+	require.NoError(t, err)
+	for i, mdID := range mdIDs {
+		requireExists(s, mdID, i >= 3)
+	}
+
+	// The index always matches a scan of the mds directory.
+	ctx := context.Background()
+	requireMatchesScan := func(s *mdServerTlfStorage) {
+		scanned, err := s.scanMDIDsLocked(ctx)
+		require.NoError(t, err)
+		require.Equal(t, scanned, s.mdIDIndex)
+		require.Len(t, scanned, 9)
+	}
+	requireMatchesScan(s)
+
+	// The index is kept on disk, and loaded on open.
+	err = s.close()
+	require.NoError(t, err)
+	s = makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	requireMatchesScan(s)
+	requireExists(s, mdIDs[9], true)
+
+	// If the process dies before an object marked as pending is
+	// added or removed, the next open checks whether it's there.
+	_, err = s.beginMDIDIndexChangeLocked(absentID, true)
+	require.NoError(t, err)
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	requireMatchesScan(s2)
+	requireExists(s2, absentID, false)
+	_, err = s2.beginMDIDIndexChangeLocked(mdIDs[9], false)
+	require.NoError(t, err)
+	err = s2.close()
+	require.NoError(t, err)
+	s2 = makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	requireMatchesScan(s2)
+	requireExists(s2, mdIDs[9], true)
+	err = s2.close()
+	require.NoError(t, err)
+
+	// If the index is corrupt, open rebuilds it, skipping stray
+	// files.
+	err = ioutil.WriteFile(s.mdIDIndexPath(), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(filepath.Dir(s.mdPath(mdIDs[9])),
+		"stray"), []byte("stray"), 0600)
+	require.NoError(t, err)
+	s3 := makeMDServerTlfStorage(s.codec, s.crypto, s.dir)
+	err = s3.open(ctx)
+	require.NoError(t, err)
+	requireMatchesScan(s3)
+	err = s3.close()
+	require.NoError(t, err)
+
+	err = s.close()
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageConfig(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	configPath := filepath.Join(tempdir, "CONFIG")
+
+	// Settings on disk override the ones the storage was made
+	// with.
+	err = ioutil.WriteFile(configPath,
+		[]byte(`{"MaxMDSize": 1000, "WriteBufferMaxAge": "30s"}`), 0600)
+	require.NoError(t, err)
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.writeBufferConfig = mdWriteBufferConfig{maxBytes: 2000}
+	err = s.open(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), s.maxMDSize)
+	require.Equal(t, mdWriteBufferConfig{
+		maxBytes: 2000,
+		maxAge:   30 * time.Second,
+	}, s.writeBufferConfig)
+
+	// Setting a new config writes it, and unset fields revert.
+	maxBytes := int64(0)
+	err = s.setConfig(mdServerTlfStorageConfig{
+		WriteBufferMaxBytes: &maxBytes,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(defaultMDServerMaxMDSize), s.maxMDSize)
+	require.Equal(t, mdWriteBufferConfig{}, s.writeBufferConfig)
+	_, err = os.Stat(configPath + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	// An invalid config is rejected and not written.
+	badAge := "soon"
+	err = s.setConfig(mdServerTlfStorageConfig{WriteBufferMaxAge: &badAge})
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	err = s.close()
+	require.NoError(t, err)
+
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.writeBufferConfig = mdWriteBufferConfig{maxBytes: 2000}
+	err = s.open(ctx)
+	require.NoError(t, err)
+	require.Equal(t, mdWriteBufferConfig{}, s.writeBufferConfig)
+	err = s.close()
+	require.NoError(t, err)
+
+	// An invalid config on disk fails open.
+	for _, config := range []string{
+		`not json`,
+		`{"WriteBufferMaxBytes": -1}`,
+		`{"WriteBufferMaxAge": "soon"}`,
+	} {
+		err = ioutil.WriteFile(configPath, []byte(config), 0600)
+		require.NoError(t, err)
+		s = makeMDServerTlfStorage(codec, crypto, tempdir)
+		err = s.open(ctx)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Invalid config in "+configPath)
+	}
+}
+
+func TestMDServerTlfStorageFragmentationReport(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	clock := newTestClockNow()
+	s.clock = clock
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// An empty store isn't fragmented.
+	report, err := s.fragmentationReport()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, report.score)
+	require.False(t, report.shouldCompact)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 40, MdID{})
+	bid := FakeBranchID(1)
+	branchIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 41, 42, mergedIDs[39])
+
+	// Neither is a fresh one.
+	report, err = s.fragmentationReport()
+	require.NoError(t, err)
+	require.Equal(t, 0, report.emptySplayDirs)
+	require.Equal(t, 42, report.mdObjects)
+	require.Len(t, report.orphanMDs, 0)
+	require.Equal(t, 42, report.journalEntries)
+	require.Len(t, report.strayEntries, 0)
+	require.Equal(t, 0.0, report.score)
+	require.False(t, report.shouldCompact)
+
+	// A heavily-pruned one leaves many empty splay dirs.
+	_, err = s.prune(NullBranchID, 40)
+	require.NoError(t, err)
+	report, err = s.fragmentationReport()
+	require.NoError(t, err)
+	require.Equal(t, 3, report.mdObjects)
+	require.True(t, report.emptySplayDirs > report.splayDirs/2)
+	require.True(t, report.shouldCompact)
+
+	// Purging a branch orphans its MDs.
+	err = s.softDeleteBranch(context.Background(), bid)
+	require.NoError(t, err)
+	report, err = s.fragmentationReport()
+	require.NoError(t, err)
+	require.Len(t, report.orphanMDs, 0)
+
+	clock.Add(time.Hour)
+	_, err = s.purgeTombstones(time.Minute)
+	require.NoError(t, err)
+	report, err = s.fragmentationReport()
+	require.NoError(t, err)
+	sort.Sort(mdIDList(branchIDs))
+	require.Equal(t, branchIDs, report.orphanMDs)
+
+	// Stray entry files are counted per branch.
+	strayPath := filepath.Join(
+		s.branchJournalPath(NullBranchID), fmt.Sprintf("%016x", 1))
+	err = ioutil.WriteFile(strayPath, nil, 0600)
+	require.NoError(t, err)
+	report, err = s.fragmentationReport()
+	require.NoError(t, err)
+	require.Equal(t, map[BranchID]int{NullBranchID: 1}, report.strayEntries)
+}
+
+func TestMDServerTlfStorageScanDuplicateMDs(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	duplicates, err := s.scanDuplicateMDs()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(duplicates))
+
+	// plant copies the MD object with the given ID, or writes
+	// the given contents, under a splay directory of the given
+	// width instead of 4.
+	plant := func(mdID MdID, width int, buf []byte) string {
+		idStr := mdID.String()
+		path := filepath.Join(
+			s.mdsPath(), idStr[:width], idStr[width:])
+		if buf == nil {
+			buf, err = ioutil.ReadFile(s.mdPath(mdID))
+			require.NoError(t, err)
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(path, buf, 0600)
+		require.NoError(t, err)
+		return path
+	}
+	samePath := plant(mdIDs[0], 2, nil)
+	differentPath := plant(mdIDs[2], 2, []byte("different"))
+
+	// Both are found, with the canonical copy identified, but
+	// only the identical one is recommended for removal.
+	duplicates, err = s.scanDuplicateMDs()
+	require.NoError(t, err)
+	expected := []mdDuplicate{
+		{
+			id:            mdIDs[0],
+			canonicalPath: s.mdPath(mdIDs[0]),
+			copies:        []mdDuplicateCopy{{samePath, true}},
+		},
+		{
+			id:            mdIDs[2],
+			canonicalPath: s.mdPath(mdIDs[2]),
+			copies: []mdDuplicateCopy{
+				{differentPath, false},
+			},
+		},
+	}
+	if bytes.Compare(mdIDs[0].Bytes(), mdIDs[2].Bytes()) > 0 {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	require.Equal(t, expected, duplicates)
+
+	// Without a canonical copy, nothing is recommended.
+	otherPath := plant(mdIDs[1], 6, nil)
+	samePath = plant(mdIDs[1], 2, nil)
+	err = os.Remove(s.mdPath(mdIDs[1]))
+	require.NoError(t, err)
+	duplicates, err = s.scanDuplicateMDs()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(duplicates))
+	var found bool
+	for _, d := range duplicates {
+		if d.id != mdIDs[1] {
+			continue
+		}
+		found = true
+		require.Equal(t, "", d.canonicalPath)
+		require.Equal(t, 2, len(d.copies))
+		for _, c := range d.copies {
+			require.Contains(
+				t, []string{samePath, otherPath}, c.path)
+			require.False(t, c.matches)
+		}
+	}
+	require.True(t, found)
+}
+
+func TestMDServerTlfStorageRekeyLease(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	clock := newTestClockNow()
+	s.clock = clock
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+
+	ctx := context.Background()
+	expectedErr := MDServerErrorThrottle{errMDServerTlfStorageRekeyInProgress}
+
+	err = s.beginRekey(NullBranchID)
+	require.NoError(t, err)
+
+	// Only one rekey at a time.
+	err = s.beginRekey(NullBranchID)
+	require.Equal(t, expectedErr, err)
+
+	// A normal put is throttled...
+	rmds := makeMDForTest(t, id, h, MetadataRevision(3), mdIDs[1])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, expectedErr, err)
+
+	// ...but other branches aren't affected...
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 3, 3, mdIDs[1])
+
+	// ...as is a put that only sets the rekey flag...
+	rmds.MD.Flags |= MetadataFlagRekey
+	rmds.MD.clearCachedMetadataIDForTest()
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, expectedErr, err)
+
+	// ...but a valid rekey put goes through.
+	rmds.MD.Flags |= MetadataFlagWriterMetadataCopied
+	rmds.MD.clearCachedMetadataIDForTest()
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	prevRoot, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+
+	// Normal puts are allowed again after endRekey.
+	err = s.endRekey(NullBranchID)
+	require.NoError(t, err)
+	mdIDs = putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, prevRoot)
+
+	// A lease expires on its own.
+	err = s.beginRekey(NullBranchID)
+	require.NoError(t, err)
+	rmds = makeMDForTest(t, id, h, MetadataRevision(5), mdIDs[0])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, expectedErr, err)
+	clock.Add(mdServerRekeyLeaseDuration)
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStoragePagedRange(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 25, MdID{})
+
+	ctx := context.Background()
+	budget := mdRangeBudget{maxEntries: 4}
+
+	// Page through revisions 3 to 23.
+	var all []*RootMetadataSigned
+	var token []byte
+	pages := 0
+	for {
+		rmdses, nextToken, err := s.pagedRange(ctx, uid, deviceKID,
+			NullBranchID, 3, 23, budget, token)
+		require.NoError(t, err)
+		all = append(all, rmdses...)
+		pages++
+		if nextToken == nil {
+			break
+		}
+		token = nextToken
+	}
+	require.Equal(t, 6, pages)
+	require.Len(t, all, 21)
+	for i, rmds := range all {
+		require.Equal(t, MetadataRevision(i+3), rmds.MD.Revision)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i+2], mdID)
+	}
+
+	// Get a token for the second page.
+	_, token, err = s.pagedRange(
+		ctx, uid, deviceKID, NullBranchID, 1, 25, budget, nil)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+
+	// A token can't be used for a different branch or range.
+	_, _, err = s.pagedRange(
+		ctx, uid, deviceKID, FakeBranchID(1), 1, 25, budget, token)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	_, _, err = s.pagedRange(
+		ctx, uid, deviceKID, NullBranchID, 1, 24, budget, token)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// Garbage is rejected.
+	_, _, err = s.pagedRange(ctx, uid, deviceKID,
+		NullBranchID, 1, 25, budget, []byte("garbage"))
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// A token is stale once its next revision is pruned.
+	_, err = s.prune(NullBranchID, 10)
+	require.NoError(t, err)
+	_, _, err = s.pagedRange(
+		ctx, uid, deviceKID, NullBranchID, 1, 25, budget, token)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	require.Contains(t, err.Error(), "has been pruned")
+}
+
+func TestMDServerTlfStorageCatchUp(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 20, MdID{})
+
+	ctx := context.Background()
+	budget := mdRangeBudget{maxEntries: 4}
+
+	// Catch up from revision 7, a page at a time.
+	var all []*RootMetadataSigned
+	fromID := mdIDs[6]
+	pages := 0
+	for {
+		rmdses, truncated, err := s.catchUp(
+			ctx, uid, deviceKID, NullBranchID, fromID, budget)
+		require.NoError(t, err)
+		all = append(all, rmdses...)
+		pages++
+		if !truncated {
+			break
+		}
+		fromID, err = rmdses[len(rmdses)-1].MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, pages)
+	require.Len(t, all, 13)
+	for i, rmds := range all {
+		require.Equal(t, MetadataRevision(i+8), rmds.MD.Revision)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i+7], mdID)
+	}
+
+	// There's nothing to catch up on from the head.
+	rmdses, truncated, err := s.catchUp(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[19], mdRangeBudget{})
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Len(t, rmdses, 0)
+
+	// An unknown MD means a resync.
+	_, _, err = s.catchUp(ctx, uid, deviceKID,
+		NullBranchID, fakeMdID(1), mdRangeBudget{})
+	require.IsType(t, mdServerTlfStorageResyncError{}, err)
+
+	// So does a pruned one, or one in another branch.
+	_, err = s.prune(NullBranchID, 10)
+	require.NoError(t, err)
+	_, _, err = s.catchUp(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[6], mdRangeBudget{})
+	require.IsType(t, mdServerTlfStorageResyncError{}, err)
+	_, _, err = s.catchUp(ctx, uid, deviceKID,
+		FakeBranchID(1), mdIDs[15], mdRangeBudget{})
+	require.IsType(t, mdServerTlfStorageResyncError{}, err)
+
+	// The earliest retained revision can still be caught up from.
+	rmdses, truncated, err = s.catchUp(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[9], mdRangeBudget{})
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Len(t, rmdses, 10)
+}
+
+// makeBigMDsForTest returns a chain of MDs for revisions 1 through
+// count, each with a few KB of private metadata of which only a
+// couple of bytes change from one revision to the next.
+func makeBigMDsForTest(t testing.TB, crypto cryptoPure, id TlfID,
+	h BareTlfHandle, count int) []*RootMetadataSigned {
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	var rmdses []*RootMetadataSigned
+	var prevRoot MdID
+	for i := 1; i <= count; i++ {
+		rmds, err := NewRootMetadataSignedForTest(id, h)
+		require.NoError(t, err)
+		data[(i*131)%len(data)] ^= 0xff
+		rmds.MD.SerializedPrivateMetadata = append([]byte(nil), data...)
+		rmds.MD.Revision = MetadataRevision(i)
+		FakeInitialRekey(&rmds.MD, h)
+		rmds.MD.PrevRoot = prevRoot
+		rmds.MD.clearCachedMetadataIDForTest()
+		prevRoot, err = rmds.MD.MetadataID(crypto)
+		require.NoError(t, err)
+		rmdses = append(rmdses, rmds)
+	}
+	return rmdses
+}
+
+func mdsDiskUsageForTest(t testing.TB, s *mdServerTlfStorage) int64 {
+	var total int64
+	err := filepath.Walk(s.mdsPath(),
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				total += info.Size()
+			}
+			return nil
+		})
+	require.NoError(t, err)
+	return total
+}
+
+func TestMDServerTlfStorageDeltas(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	fullDir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(fullDir)
+		require.NoError(t, err)
+	}()
+	ctx := context.Background()
+	full := makeMDServerTlfStorage(s.codec, s.crypto, fullDir)
+	err = full.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := full.close()
+		require.NoError(t, err)
+	}()
+
+	s.deltaFullInterval = 8
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	rmdses := makeBigMDsForTest(t, s.crypto, id, h, 20)
+	var mdIDs []MdID
+	for _, rmds := range rmdses {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		_, err = full.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	// Only the first revision and the multiples of 8 are stored
+	// in full.
+	for i, mdID := range mdIDs {
+		rev := i + 1
+		buf, err := ioutil.ReadFile(s.mdPath(mdID))
+		require.NoError(t, err)
+		require.Equal(t, rev != 1 && rev%8 != 0, isMDDelta(buf),
+			"revision %d", rev)
+	}
+
+	require.True(t, mdsDiskUsageForTest(t, s) <
+		mdsDiskUsageForTest(t, full)/2)
+
+	checkSame := func(start MetadataRevision) {
+		deltaRmdses, err := s.getRange(
+			ctx, uid, deviceKID, NullBranchID, start, 20)
+		require.NoError(t, err)
+		fullRmdses, err := full.getRange(
+			ctx, uid, deviceKID, NullBranchID, start, 20)
+		require.NoError(t, err)
+		require.Equal(t, len(fullRmdses), len(deltaRmdses))
+		for i := range fullRmdses {
+			deltaID, err := deltaRmdses[i].MD.MetadataID(s.crypto)
+			require.NoError(t, err)
+			fullID, err := fullRmdses[i].MD.MetadataID(s.crypto)
+			require.NoError(t, err)
+			require.Equal(t, fullID, deltaID)
+
+			deltaBuf, err := s.codec.Encode(deltaRmdses[i])
+			require.NoError(t, err)
+			fullBuf, err := s.codec.Encode(fullRmdses[i])
+			require.NoError(t, err)
+			require.Equal(t, fullBuf, deltaBuf)
+		}
+	}
+	checkSame(1)
+
+	// Sizes are estimated from the full MDs, not the deltas.
+	count, deltaBytes, err := s.estimateRange(
+		uid, deviceKID, NullBranchID, 1, 20)
+	require.NoError(t, err)
+	require.Equal(t, 20, count)
+	_, fullBytes, err := full.estimateRange(
+		uid, deviceKID, NullBranchID, 1, 20)
+	require.NoError(t, err)
+	require.Equal(t, fullBytes, deltaBytes)
+
+	// Pruning up to revision 6 stores it in full, without
+	// changing its timestamp, so that it and the deltas after it
+	// can still be read.
+	fi, err := os.Stat(s.mdPath(mdIDs[5]))
+	require.NoError(t, err)
+	_, err = s.prune(NullBranchID, 6)
+	require.NoError(t, err)
+	_, err = full.prune(NullBranchID, 6)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadFile(s.mdPath(mdIDs[5]))
+	require.NoError(t, err)
+	require.False(t, isMDDelta(buf))
+	fi2, err := os.Stat(s.mdPath(mdIDs[5]))
+	require.NoError(t, err)
+	require.Equal(t, fi.ModTime(), fi2.ModTime())
+	checkSame(6)
+
+	// A corrupt delta fails verification.
+	buf, err = ioutil.ReadFile(s.mdPath(mdIDs[9]))
+	require.NoError(t, err)
+	delta, err := decodeMDDelta(s.codec, buf)
+	require.NoError(t, err)
+	for i, op := range delta.Ops {
+		if len(op.Data) > 0 {
+			delta.Ops[i].Data[0] ^= 0xff
+			break
+		}
+	}
+	buf, err = encodeMDDelta(s.codec, delta)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(s.mdPath(mdIDs[9]), buf, 0600)
+	require.NoError(t, err)
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 10, 10)
+	require.Error(t, err)
+}
+
+func TestMDServerTlfStorageDeltaOps(t *testing.T) {
+	base := []byte("the quick brown fox jumps over the lazy dog, " +
+		"and then the quick brown fox jumps over the lazy dog again")
+	for _, target := range [][]byte{
+		nil,
+		base,
+		[]byte("something else entirely"),
+		append([]byte("prefix "), base...),
+		append(append([]byte(nil), base[:30]...), base[40:]...),
+		bytes.Replace(base, []byte("lazy"), []byte("LAZY"), -1),
+	} {
+		ops := makeMDDeltaOps(base, target)
+		result, err := applyMDDeltaOps(base, ops)
+		require.NoError(t, err)
+		require.Equal(t, string(target), string(result))
+	}
+
+	_, err := applyMDDeltaOps(base, []mdDeltaOp{{Offset: 100, Len: 10}})
+	require.Error(t, err)
+}
+
+// BenchmarkMDServerTlfStorageGetRange measures reading a range of
+// MDs stored in full and as deltas, and reports the resulting disk
+// usage.
+func BenchmarkMDServerTlfStorageGetRange(b *testing.B) {
+	for _, interval := range []int{0, 8, 32} {
+		b.Run(fmt.Sprintf("deltaFullInterval=%d", interval),
+			func(b *testing.B) {
+				benchmarkMDServerTlfStorageGetRange(b, interval)
+			})
+	}
+}
+
+func benchmarkMDServerTlfStorageGetRange(b *testing.B, interval int) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(b)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(b, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(b, err)
+	}()
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.deltaFullInterval = interval
+	err = s.open(ctx)
+	require.NoError(b, err)
+	defer func() {
+		err := s.close()
+		require.NoError(b, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(b, err)
+
+	const count = 64
+	for _, rmds := range makeBigMDsForTest(b, crypto, id, h, count) {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(b, err)
+	}
+	b.Logf("%d MDs use %d bytes on disk",
+		count, mdsDiskUsageForTest(b, s))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, count)
+		require.NoError(b, err)
+	}
+}
+
+func TestMDServerTlfStorageConcurrentPuts(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	// A crash may leave staged MDs behind, which open removes.
+	stagingDir := filepath.Join(tempdir, mdServerMDStagingDirName)
+	err = os.MkdirAll(stagingDir, 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(
+		filepath.Join(stagingDir, "leftover"), []byte("x"), 0600)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	timer := metrics.NewTimer()
+	s.putLockHoldTimer = timer
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	_, err = os.Stat(stagingDir)
+	require.True(t, os.IsNotExist(err))
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Each writer puts its own copy of the same revisions, so that
+	// every revision is raced for, and the MDs of the losers are
+	// already stored, or staged but not moved into place. Since
+	// the copies are identical, every put succeeds, but each
+	// revision is appended once.
+	const writers = 8
+	const count = 16
+	mdses := make([][]*RootMetadataSigned, writers)
+	for i := range mdses {
+		mdses[i] = makeBigMDsForTest(t, crypto, id, h, count)
+	}
+	var mdIDs []MdID
+	for _, rmds := range mdses[0] {
+		mdID, err := rmds.MD.MetadataID(crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	var puts int32
+	errs := make(chan error, 2*writers)
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				_, err := s.getForTLF(
+					ctx, uid, deviceKID, NullBranchID)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(rmdses []*RootMetadataSigned) {
+			defer wg.Done()
+			for _, rmds := range rmdses {
+				_, err := s.put(ctx, uid, deviceKID, rmds)
+				switch err.(type) {
+				case nil:
+					atomic.AddInt32(&puts, 1)
+				case MDServerErrorConflictRevision:
+				default:
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(mdses[i])
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(writers*count), puts)
+	require.Equal(t, int64(writers*count), timer.Count())
+
+	rmdses, err := s.getRange(
+		ctx, uid, deviceKID, NullBranchID, 1, count)
+	require.NoError(t, err)
+	require.Equal(t, count, len(rmdses))
+	for i, rmds := range rmdses {
+		mdID, err := rmds.MD.MetadataID(crypto)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i], mdID)
+	}
+
+	_, err = os.Stat(stagingDir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMDServerTlfStoragePutByNonWriter(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	var staged []string
+	writeFile := s.writeFile
+	s.writeFile = func(
+		path string, data []byte, perm os.FileMode) error {
+		if strings.Contains(path, mdServerMDStagingDirName) {
+			staged = append(staged, path)
+		}
+		return writeFile(path, data, perm)
+	}
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+	require.Len(t, staged, 1)
+
+	// A put by a non-writer stages nothing, and leaves the MD
+	// without a cached ID.
+	staged = nil
+	rmds := makeMDForTest(t, id, h, 2, mdIDs[0])
+	ctx := context.Background()
+	_, err = s.put(ctx, keybase1.MakeTestUID(2), deviceKID, rmds)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+	require.Len(t, staged, 0)
+	require.Equal(t, MdID{}, rmds.MD.mdID)
+}
+
+func TestMDServerTlfStorageConcurrentIdenticalPuts(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// Many goroutines put the very same MD at once, for the first
+	// revision of the branch and for a later one. All of them
+	// succeed, but each MD is stored and appended once.
+	const putters = 32
+	prevRoot := MdID{}
+	for rev := MetadataRevision(1); rev <= 2; rev++ {
+		rmds := makeMDForTest(t, id, h, rev, prevRoot)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+
+		start := make(chan struct{})
+		errs := make(chan error, putters)
+		var wg sync.WaitGroup
+		for i := 0; i < putters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := s.put(ctx, uid, deviceKID, rmds)
+				errs <- err
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		_, mdIDs, err := s.branchJournals[NullBranchID].getRange(
+			MetadataRevisionInitial, rev+1)
+		require.NoError(t, err)
+		require.Len(t, mdIDs, int(rev))
+		require.Equal(t, mdID, mdIDs[rev-1])
+		prevRoot = mdID
+	}
+
+	written, deduped := s.putCounts()
+	require.Equal(t, uint64(2), written)
+	require.Equal(t, uint64(2*(putters-1)), deduped)
+
+	// A different MD at an existing revision is still a conflict.
+	_, err = s.put(ctx, uid, deviceKID, makeMDForTest(t, id, h, 2, MdID{}))
+	require.IsType(t, MDServerErrorConflictRevision{}, err)
+}
+
+func TestMDServerTlfStorageContentionStats(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	require.Nil(t, makeMDServerTlfStorage(
+		codec, crypto, tempdir).contentionStats())
+	registry := metrics.NewRegistry()
+	s := makeMDServerTlfStorageWithLockMetrics(
+		codec, crypto, tempdir, registry)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 2, MdID{})
+
+	// Hold the lock as maintenance would, while gets queue up
+	// behind it.
+	const getters = 4
+	const held = 50 * time.Millisecond
+	s.lock.lockAs(mdLockCategoryMaintenance)
+	errs := make(chan error, getters)
+	for i := 0; i < getters; i++ {
+		go func() {
+			_, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+			errs <- err
+		}()
+	}
+	for atomic.LoadInt32(&s.waitingReaders) < getters {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(held)
+	s.lock.Unlock()
+	for i := 0; i < getters; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	find := func(category mdLockCategory, write bool) mdLockContention {
+		for _, c := range s.contentionStats() {
+			if c.category == category && c.write == write {
+				return c
+			}
+		}
+		t.Fatalf("No stats for %s (write=%t)", category, write)
+		return mdLockContention{}
+	}
+
+	// The gets all had to wait, most of them for about as long as
+	// the lock was held.
+	get := find(mdLockCategoryGet, false)
+	require.Equal(t, int64(getters), get.acquisitions)
+	require.Equal(t, int64(getters), get.contended)
+	require.Equal(t, int64(getters), get.holds)
+	require.True(t, get.maxWait >= held/2, "maxWait=%s", get.maxWait)
+
+	maintenance := find(mdLockCategoryMaintenance, true)
+	require.Equal(t, int64(1), maintenance.acquisitions)
+	require.Equal(t, int64(0), maintenance.contended)
+	require.True(t, maintenance.maxHold >= held,
+		"maxHold=%s", maintenance.maxHold)
+
+	// The puts went uncontended.
+	put := find(mdLockCategoryPut, true)
+	require.Equal(t, int64(2), put.acquisitions)
+	require.Equal(t, int64(0), put.contended)
+
+	// The same stats are in the registry.
+	counter, ok := registry.Get(
+		"MDServerTlfStorage.Lock.Get.Read.Contended").(metrics.Counter)
+	require.True(t, ok)
+	require.Equal(t, int64(getters), counter.Count())
+}
+
+func BenchmarkMDServerTlfStoragePut(b *testing.B) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(b)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(b, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(b, err)
+	}()
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	timer := metrics.NewTimer()
+	s.putLockHoldTimer = timer
+	err = s.open(ctx)
+	require.NoError(b, err)
+	defer func() {
+		err := s.close()
+		require.NoError(b, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(b, err)
+
+	rmdses := makeBigMDsForTest(b, crypto, id, h, b.N)
+	for _, rmds := range rmdses {
+		rmds.MD.clearCachedMetadataIDForTest()
+	}
+
+	// The time spent outside the lock, i.e. the difference
+	// between ns/op and lock-ns/op, is the time by which puts no
+	// longer hold up other operations on the TLF.
+	b.ResetTimer()
+	for _, rmds := range rmdses {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(b, err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(timer.Sum())/float64(b.N), "lock-ns/op")
+}
+
+func TestMDServerTlfStorageMaxOpenFiles(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	// Count the files open at once.
+	var lock sync.Mutex
+	var open, maxOpen, total int
+	countOpen := func() func() {
+		lock.Lock()
+		defer lock.Unlock()
+		open++
+		total++
+		if open > maxOpen {
+			maxOpen = open
+		}
+		return func() {
+			// Make overlapping opens more likely.
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			open--
+		}
+	}
+
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.maxOpenFiles = 2
+	s.readFile = func(filename string) ([]byte, error) {
+		defer countOpen()()
+		return ioutil.ReadFile(filename)
+	}
+	s.writeFile = func(
+		filename string, data []byte, perm os.FileMode) error {
+		defer countOpen()()
+		return ioutil.WriteFile(filename, data, perm)
+	}
+
+	ctx := context.Background()
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 16, MdID{})
+
+	const goroutines = 16
+	errs := make(chan error, 2*goroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rmdses, err := s.getRange(
+				ctx, uid, deviceKID, NullBranchID, 1, 16)
+			if err == nil && len(rmdses) != 16 {
+				err = fmt.Errorf("Got %d MDs", len(rmdses))
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, err := s.getMultiple(ctx, uid, deviceKID, mdIDs)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.True(t, total > 2*goroutines*16)
+	require.True(t, maxOpen >= 1)
+	require.True(t, maxOpen <= 2, "maxOpen=%d", maxOpen)
+}
+
+// waitForConditionForTest polls until f returns true, and fails the
+// test if that takes too long.
+func waitForConditionForTest(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMDServerTlfStoragePriorityFiles(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	// Record the order in which MD objects are read.
+	var lock sync.Mutex
+	var reads []string
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.maxOpenFiles = 1
+	s.readFile = func(filename string) ([]byte, error) {
+		lock.Lock()
+		reads = append(reads, filename)
+		lock.Unlock()
+		return ioutil.ReadFile(filename)
+	}
+
+	ctx := context.Background()
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Hold the only file slot, and queue up background reads
+	// behind it, as if background IO were saturating the storage.
+	bgCtx := withMDServerTlfStoragePriority(
+		ctx, mdServerTlfStoragePriorityBackground)
+	s.openFiles.acquire(mdServerTlfStoragePriorityBackground)
+	const background = 4
+	errs := make(chan error, background+1)
+	for i := 0; i < background; i++ {
+		go func(rev MetadataRevision) {
+			_, err := s.getRange(
+				bgCtx, uid, deviceKID, NullBranchID, rev, rev)
+			errs <- err
+		}(MetadataRevision(i + 1))
+	}
+	waitForConditionForTest(t, func() bool {
+		return s.openFiles.numWaiting(
+			mdServerTlfStoragePriorityBackground) == background
+	})
+
+	go func() {
+		_, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 10, 10)
+		errs <- err
+	}()
+	waitForConditionForTest(t, func() bool {
+		return s.openFiles.numWaiting(
+			mdServerTlfStoragePriorityNormal) == 1
+	})
+
+	// The normal-priority read waits for the current holder of
+	// the slot only, and not for the queued background reads.
+	lock.Lock()
+	reads = nil
+	lock.Unlock()
+	s.openFiles.release()
+	for i := 0; i < background+1; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// Each getRange reads the head, which here is revision 10,
+	// and then the requested revision.
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 2*(background+1), len(reads))
+	require.Equal(t, s.mdPath(mdIDs[9]), reads[0])
+}
+
+func TestMDServerTlfStorageYieldToReaders(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	ctx := context.Background()
+
+	// Hold the lock for writing, as a background operation
+	// would.
+	s.lock.Lock()
+	require.False(t, s.yieldToReadersLocked())
+
+	// Background-priority readers aren't counted as waiting.
+	bgCtx := withMDServerTlfStoragePriority(
+		ctx, mdServerTlfStoragePriorityBackground)
+	bgDone := make(chan error, 1)
+	go func() {
+		_, err := s.getForTLF(bgCtx, uid, deviceKID, NullBranchID)
+		bgDone <- err
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+		done <- err
+	}()
+	waitForConditionForTest(t, func() bool {
+		return atomic.LoadInt32(&s.waitingReaders) == 1
+	})
+
+	// Yielding lets the waiting reader run to completion before
+	// the lock is taken again.
+	require.True(t, s.yieldToReadersLocked())
+	require.Equal(t, int32(0), atomic.LoadInt32(&s.waitingReaders))
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Reader didn't run during the yield")
+	}
+	require.False(t, s.yieldToReadersLocked())
+	s.lock.Unlock()
+
+	require.NoError(t, <-bgDone)
+}
+
+func TestMDServerTlfStorageReadSnapshot(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	ctx := context.Background()
+	rs1, err := s.readSnapshot()
+	require.NoError(t, err)
+	rs2, err := s.readSnapshot()
+	require.NoError(t, err)
+
+	// Writes aren't blocked by snapshots.
+	mdIDs = append(mdIDs, putMDRangeForTest(t, s, uid, deviceKID,
+		id, h, NullBranchID, 11, 11, mdIDs[len(mdIDs)-1])...)
+
+	pruned, err := s.prune(NullBranchID, 6)
+	require.NoError(t, err)
+	require.Equal(t, 5, pruned)
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 11)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+
+	checkSnapshot := func(rs *mdServerTlfStorageReadSnapshot) {
+		rmdses, err := rs.getRange(
+			ctx, uid, deviceKID, NullBranchID, 1, 11)
+		require.NoError(t, err)
+		require.Len(t, rmdses, 10)
+		for i, rmds := range rmdses {
+			mdID, err := rmds.MD.MetadataID(s.crypto)
+			require.NoError(t, err)
+			require.Equal(t, mdIDs[i], mdID)
+		}
+	}
+
+	checkPrunedExist := func(expected bool) {
+		for _, mdID := range mdIDs[:5] {
+			_, err := os.Stat(s.mdPath(mdID))
+			require.Equal(t, expected, err == nil)
+		}
+	}
+
+	checkSnapshot(rs1)
+	checkSnapshot(rs2)
+	checkPrunedExist(true)
+
+	// The pruned MDs stay until the last snapshot is released.
+	err = rs1.release()
+	require.NoError(t, err)
+	_, err = rs1.getRange(ctx, uid, deviceKID, NullBranchID, 1, 11)
+	require.Equal(t, errMDServerTlfStorageReadSnapshotReleased, err)
+	checkSnapshot(rs2)
+	checkPrunedExist(true)
+
+	err = rs2.release()
+	require.NoError(t, err)
+	checkPrunedExist(false)
+	for _, mdID := range mdIDs[:5] {
+		exists, err := s.existsMD(mdID)
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+
+	// Releasing again is a no-op.
+	err = rs2.release()
+	require.NoError(t, err)
+
+	// The remaining MDs are unaffected.
+	rmdses, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 11)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+}
+
+func TestMDServerTlfStorageSizeHistograms(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	histograms, err := s.sizeHistograms()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), histograms.merged.count)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+	bid := FakeBranchID(1)
+	unmergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 4, 5, mergedIDs[2])
+	otherRmds := makeMDForTest(t, id, h, 10, MdID{})
+	otherID, err := otherRmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Dir(s.mdPath(otherID)), 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(s.mdPath(otherID), nil, 0600)
+	require.NoError(t, err)
+
+	// Give each object a known size; the histograms look only at
+	// the sizes.
+	setSize := func(mdID MdID, size int64) {
+		err := os.Truncate(s.mdPath(mdID), size)
+		require.NoError(t, err)
+	}
+	setSize(mergedIDs[0], 100)
+	setSize(mergedIDs[1], 1024)
+	setSize(mergedIDs[2], 1025)
+	setSize(unmergedIDs[0], 5000)
+	setSize(unmergedIDs[1], 2<<20)
+	setSize(otherID, 100<<20)
+
+	cumulative := func(counts ...uint64) []uint64 {
+		var total uint64
+		var result []uint64
+		for _, c := range counts {
+			total += c
+			result = append(result, total)
+		}
+		return result
+	}
+
+	histograms, err = s.sizeHistograms()
+	require.NoError(t, err)
+	require.Equal(t, mdServerTlfStorageSizeHistograms{
+		merged: mdSizeHistogram{
+			counts: cumulative(2, 1, 0, 0, 0, 0, 0, 0, 0),
+			count:  3,
+			sum:    100 + 1024 + 1025,
+		},
+		unmerged: mdSizeHistogram{
+			counts: cumulative(0, 0, 1, 0, 0, 0, 1, 0, 0),
+			count:  2,
+			sum:    5000 + 2<<20,
+		},
+		other: mdSizeHistogram{
+			counts: cumulative(0, 0, 0, 0, 0, 0, 0, 0, 0),
+			count:  1,
+			sum:    100 << 20,
+		},
+	}, histograms)
+}
+
+func TestMDServerTlfStorageReconstructMergedHead(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid1 := FakeBranchID(1)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid1, 6, 7, mergedIDs[4])
+	bid2 := FakeBranchID(2)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid2, 3, 4, mergedIDs[1])
+
+	// There's nothing to reconstruct yet.
+	_, err = s.reconstructMergedHead()
+	require.Error(t, err)
+
+	// Lose the merged journal, along with the MD for revision 4.
+	err = s.close()
+	require.NoError(t, err)
+	err = os.RemoveAll(s.branchJournalPath(NullBranchID))
+	require.NoError(t, err)
+	err = os.Remove(s.mdPath(mergedIDs[3]))
+	require.NoError(t, err)
+	err = os.Remove(s.mdIDIndexPath())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+
+	// Revisions 5 to 10 can be recovered, and so can bid1, which
+	// diverges at revision 5, but not bid2, which diverges at
+	// revision 2.
+	report, err := s2.reconstructMergedHead()
+	require.NoError(t, err)
+	unrecovered := mdIDList{mergedIDs[0], mergedIDs[1], mergedIDs[2]}
+	sort.Sort(unrecovered)
+	require.Equal(t, mdMergedReconstructionReport{
+		earliest:           5,
+		latest:             10,
+		unrecovered:        unrecovered,
+		unanchoredBranches: []BranchID{bid2},
+	}, report)
+
+	rmdses, err := s2.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+	for i, rmds := range rmdses {
+		mdID, err := rmds.MD.MetadataID(s2.crypto)
+		require.NoError(t, err)
+		require.Equal(t, mergedIDs[i+4], mdID)
+	}
+
+	rev, mdID, err := s2.divergencePoint(bid1)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), rev)
+	require.Equal(t, mergedIDs[4], mdID)
+
+	_, _, err = s2.divergencePoint(bid2)
+	require.Error(t, err)
+
+	// The merged branch can be written to again.
+	putMDRangeForTest(
+		t, s2, uid, deviceKID, id, h, NullBranchID, 11, 11, mergedIDs[9])
+
+	// And it's no longer empty, so can't be reconstructed again.
+	_, err = s2.reconstructMergedHead()
+	require.Error(t, err)
+}
+
+func TestMDServerTlfStorageVerifyHistoricalWriters(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+	uid3 := keybase1.MakeTestUID(3)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h12, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid1, uid2}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	h1, err := MakeBareTlfHandle([]keybase1.UID{uid1}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// uid2 is removed as a writer at revision 4, but still writes
+	// revision 6, and uid3 never was a writer, but writes
+	// revision 3. All puts are done by uid1, so they're accepted.
+	ctx := context.Background()
+	var prevRoot MdID
+	var mdIDs []MdID
+	for rev := MetadataRevision(1); rev <= 7; rev++ {
+		h := h12
+		if rev >= 4 {
+			h = h1
+		}
+		rmds := makeMDForTest(t, id, h, rev, prevRoot)
+		switch rev {
+		case 3:
+			rmds.MD.LastModifyingUser = uid3
+		case 6:
+			rmds.MD.LastModifyingUser = uid2
+		default:
+			rmds.MD.LastModifyingUser = uid1
+		}
+		_, err := s.put(ctx, uid1, deviceKID, rmds)
+		require.NoError(t, err)
+		prevRoot, err = rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, prevRoot)
+	}
+
+	violations, err := s.verifyHistoricalWriters(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, []mdHistoricalWriterViolation{
+		{revision: 3, mdID: mdIDs[2], writer: uid3},
+		{revision: 6, mdID: mdIDs[5], writer: uid2},
+	}, violations)
+
+	// Once revisions 1 to 3 are pruned, revision 4 has no
+	// predecessor to check against.
+	_, err = s.prune(NullBranchID, 4)
+	require.NoError(t, err)
+	violations, err = s.verifyHistoricalWriters(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, []mdHistoricalWriterViolation{
+		{revision: 6, mdID: mdIDs[5], writer: uid2},
+	}, violations)
+
+	// The earliest revision of a branch is checked against its
+	// divergence point.
+	bid := FakeBranchID(1)
+	rmds := makeMDForTest(t, id, h1, 8, mdIDs[6])
+	rmds.MD.WFlags |= MetadataFlagUnmerged
+	rmds.MD.BID = bid
+	rmds.MD.LastModifyingUser = uid2
+	_, err = s.put(ctx, uid1, deviceKID, rmds)
+	require.NoError(t, err)
+	branchID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	violations, err = s.verifyHistoricalWriters(bid)
+	require.NoError(t, err)
+	require.Equal(t, []mdHistoricalWriterViolation{
+		{revision: 8, mdID: branchID, writer: uid2},
+	}, violations)
+
+	// An unknown branch has no violations.
+	violations, err = s.verifyHistoricalWriters(FakeBranchID(2))
+	require.NoError(t, err)
+	require.Nil(t, violations)
+}
+
+func testMDServerTlfStoragePruneCancel(t *testing.T,
+	deltaFullInterval int, expectedPruned int) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.deltaFullInterval = deltaFullInterval
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	var mdIDs []MdID
+	for _, rmds := range makeBigMDsForTest(t, s.crypto, id, h, 20) {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	// Cancel after the fifth revision is removed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var items []string
+	progress := func(processed, total int, item string) {
+		require.Equal(t, len(items)+1, processed)
+		require.Equal(t, 14, total)
+		items = append(items, item)
+		if processed == 5 {
+			cancel()
+		}
+	}
+	pruned, err := s.pruneWithProgress(ctx, NullBranchID, 15, progress)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, expectedPruned, pruned)
+	require.Len(t, items, expectedPruned)
+	require.Equal(t, "revision 1", items[0])
+
+	// The store is as if prune had stopped there.
+	earliest, latest, err := s.retainedWindow(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(expectedPruned+1), earliest)
+	require.Equal(t, MetadataRevision(20), latest)
+	for i, mdID := range mdIDs {
+		exists, err := s.existsMD(mdID)
+		require.NoError(t, err)
+		require.Equal(t, i >= expectedPruned, exists)
+	}
+
+	err = s.close()
+	require.NoError(t, err)
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s2.open(context.Background())
+	require.NoError(t, err)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+	rmdses, err := s2.getRange(
+		context.Background(), uid, deviceKID, NullBranchID, 1, 20)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 20-expectedPruned)
+}
+
+func TestMDServerTlfStoragePruneCancel(t *testing.T) {
+	testMDServerTlfStoragePruneCancel(t, 0, 5)
+}
+
+// With deltas, a canceled prune keeps going until the earliest
+// remaining revision is stored in full.
+func TestMDServerTlfStoragePruneCancelDeltas(t *testing.T) {
+	testMDServerTlfStoragePruneCancel(t, 4, 7)
+}
+
+func TestMDServerTlfStorageCheckBranchPointers(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 3, 6, mergedIDs[1])
+
+	problems, err := s.checkBranchPointers(false)
+	require.NoError(t, err)
+	require.Nil(t, problems)
+
+	err = s.close()
+	require.NoError(t, err)
+
+	// Invert the pointers of both branches, and make a gap in
+	// the unmerged one.
+	invert := func(bid BranchID, earliest, latest string) {
+		dir := s.branchJournalPath(bid)
+		err := ioutil.WriteFile(
+			filepath.Join(dir, "EARLIEST"), []byte(earliest), 0600)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(
+			filepath.Join(dir, "LATEST"), []byte(latest), 0600)
+		require.NoError(t, err)
+	}
+	invert(NullBranchID, journalOrdinal(8).String(),
+		journalOrdinal(3).String())
+	invert(bid, journalOrdinal(6).String(), journalOrdinal(3).String())
+	err = os.Remove(filepath.Join(
+		s.branchJournalPath(bid), journalOrdinal(4).String()))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	s2 := makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	defer func() {
+		err := s2.close()
+		require.NoError(t, err)
+	}()
+	err = s2.open(ctx)
+	require.Error(t, err)
+
+	// Detect without repairing.
+	problems, err = s2.checkBranchPointers(false)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	for _, p := range problems {
+		require.Error(t, p.err)
+		require.False(t, p.repaired)
+		require.NoError(t, p.repairErr)
+	}
+	err = s2.open(ctx)
+	require.Error(t, err)
+
+	// Repair what can be repaired.
+	problems, err = s2.checkBranchPointers(true)
+	require.NoError(t, err)
+	problemsByBranch := make(map[BranchID]mdBranchPointerProblem)
+	for _, p := range problems {
+		problemsByBranch[p.bid] = p
+	}
+	require.Len(t, problemsByBranch, 2)
+	merged := problemsByBranch[NullBranchID]
+	require.True(t, merged.repaired)
+	require.Equal(t, MetadataRevision(1), merged.earliest)
+	require.Equal(t, MetadataRevision(10), merged.latest)
+	unmerged := problemsByBranch[bid]
+	require.False(t, unmerged.repaired)
+	require.Error(t, unmerged.repairErr)
+
+	// Remove the broken branch by hand, after which the storage
+	// opens with the true range of the merged branch.
+	err = os.RemoveAll(s.branchJournalPath(bid))
+	require.NoError(t, err)
+	problems, err = s2.checkBranchPointers(true)
+	require.NoError(t, err)
+	require.Nil(t, problems)
+
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	rmdses, err := s2.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 10)
+}
+
+func TestMDServerTlfStorageReconcileJournals(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer func() {
+		teardownMDServerTlfStorageTest(t, tempdir, s)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	err = s.close()
+	require.NoError(t, err)
+
+	reopen := func() {
+		s = makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+		err := s.open(ctx)
+		require.NoError(t, err)
+	}
+	requireHead := func(rev MetadataRevision, mdID MdID) {
+		head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+		require.NoError(t, err)
+		require.Equal(t, rev, head.MD.Revision)
+		headID, err := head.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		require.Equal(t, mdID, headID)
+	}
+
+	// Crash after the entry of the put of revision 6 was written,
+	// but before LATEST was.
+	dj := makeDiskJournal(s.codec, s.branchJournalPath(NullBranchID),
+		reflect.TypeOf(MdID{}))
+	err = dj.writeJournalEntry(6, fakeMdID(1))
+	require.NoError(t, err)
+
+	reopen()
+	requireHead(5, mdIDs[4])
+	_, err = os.Stat(dj.journalEntryPath(6))
+	require.True(t, os.IsNotExist(err))
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 6, 6, mdIDs[4])...)
+	requireHead(6, mdIDs[5])
+	err = s.close()
+	require.NoError(t, err)
+
+	// Crash after LATEST was written for the put of revision 7,
+	// with the write of its entry lost.
+	err = dj.writeLatestOrdinal(7)
+	require.NoError(t, err)
+
+	reopen()
+	requireHead(6, mdIDs[5])
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 7, 7, mdIDs[5])
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), length)
+}
+
+func TestMDServerTlfStorageColdTier(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	dir := filepath.Join(tempdir, "hot")
+	coldDir := filepath.Join(tempdir, "cold")
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, dir)
+	s.coldMDsDir = coldDir
+	err = s.open(ctx)
+	require.Error(t, err)
+	s.hotRevisions = 3
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	bid := FakeBranchID(1)
+	unmergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 3, 8, mergedIDs[1])
+
+	countIn := func(dir string, mdIDs []MdID) int {
+		n := 0
+		for _, mdID := range mdIDs {
+			idStr := mdID.String()
+			_, err := os.Stat(filepath.Join(dir, idStr[:4], idStr[4:]))
+			if err == nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Everything is written hot.
+	require.Equal(t, 10, countIn(s.mdsPath(), mergedIDs))
+	require.Equal(t, 6, countIn(s.mdsPath(), unmergedIDs))
+
+	moved, err := s.demoteColdMDs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 7+3, moved)
+	require.Equal(t, 3, countIn(s.mdsPath(), mergedIDs))
+	require.Equal(t, 7, countIn(coldDir, mergedIDs))
+	require.Equal(t, 3, countIn(s.mdsPath(), unmergedIDs))
+	require.Equal(t, 3, countIn(coldDir, unmergedIDs))
+
+	// Nothing more to do until there are new revisions.
+	moved, err = s.demoteColdMDs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 11, 12, mergedIDs[9])
+	moved, err = s.demoteColdMDs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, moved)
+	require.Equal(t, 1, countIn(s.mdsPath(), mergedIDs))
+
+	// Reads of demoted objects work as usual.
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 10)
+	rmdses, err = s.getRange(ctx, uid, deviceKID, bid, 3, 8)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+
+	// A snapshot brings the cold objects along.
+	snapshotDir := filepath.Join(tempdir, "snapshot")
+	err = s.snapshot(snapshotDir)
+	require.NoError(t, err)
+	s2 := makeMDServerTlfStorage(codec, crypto, snapshotDir)
+	err = s2.open(ctx)
+	require.NoError(t, err)
+	rmdses, err = s2.getRange(ctx, uid, deviceKID, NullBranchID, 1, 12)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 12)
+	err = s2.close()
+	require.NoError(t, err)
+
+	// Pruning removes cold objects too.
+	_, err = s.prune(NullBranchID, 3)
+	require.NoError(t, err)
+	require.Equal(t, 7, countIn(coldDir, mergedIDs))
+	for _, mdID := range mergedIDs[:2] {
+		exists, err := s.existsMD(mdID)
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+
+	// A rebuilt index includes the cold objects.
+	err = s.close()
+	require.NoError(t, err)
+	err = os.Remove(s.mdIDIndexPath())
+	require.NoError(t, err)
+	s3 := makeMDServerTlfStorage(codec, crypto, dir)
+	s3.coldMDsDir = coldDir
+	s3.hotRevisions = 3
+	err = s3.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s3.close()
+		require.NoError(t, err)
+	}()
+	for i, mdID := range mergedIDs {
+		exists, err := s3.existsMD(mdID)
+		require.NoError(t, err)
+		require.Equal(t, i >= 2, exists)
+	}
+}
+
+func TestMDServerTlfStorageMaxColdReads(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	coldDir := filepath.Join(tempdir, "cold")
+
+	// Make cold reads slow, and count how many run at once.
+	const coldReadDelay = 100 * time.Millisecond
+	var coldLock sync.Mutex
+	var coldOpen, maxColdOpen int
+	s := makeMDServerTlfStorage(
+		codec, crypto, filepath.Join(tempdir, "hot"))
+	s.coldMDsDir = coldDir
+	s.hotRevisions = 2
+	s.maxOpenFiles = 2
+	s.maxColdReads = 1
+	s.readFile = func(filename string) ([]byte, error) {
+		if !isPathWithin(coldDir, filename) {
+			return ioutil.ReadFile(filename)
+		}
+		coldLock.Lock()
+		coldOpen++
+		if coldOpen > maxColdOpen {
+			maxColdOpen = coldOpen
+		}
+		coldLock.Unlock()
+		defer func() {
+			coldLock.Lock()
+			defer coldLock.Unlock()
+			coldOpen--
+		}()
+		time.Sleep(coldReadDelay)
+		return ioutil.ReadFile(filename)
+	}
+
+	ctx := context.Background()
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	moved, err := s.demoteColdMDs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 8, moved)
+
+	// Saturate the cold tier with more scanners than there are
+	// file slots.
+	const coldScanners = 4
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, coldScanners)
+	for i := 0; i < coldScanners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rev := MetadataRevision(i%8 + 1)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := s.getRange(ctx, uid, deviceKID,
+					NullBranchID, rev, rev)
+				if err != nil {
+					errs <- err
+					return
+				}
+				rev = rev%8 + 1
+			}
+		}(i)
+	}
+
+	// Let the scanners pile up before reading the head.
+	time.Sleep(coldReadDelay / 2)
+	var maxHotLatency time.Duration
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+		latency := time.Since(start)
+		require.NoError(t, err)
+		require.Equal(t, MetadataRevision(10), head.MD.Revision)
+		if latency > maxHotLatency {
+			maxHotLatency = latency
+		}
+		time.Sleep(coldReadDelay / 10)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Since the cold reads only ever hold one of the two file
+	// slots, head reads never wait for one of them.
+	require.True(t, maxHotLatency < coldReadDelay/2,
+		"Head read took %s", maxHotLatency)
+	require.Equal(t, 1, maxColdOpen)
+}
+
+func TestMDServerTlfStorageTimestampAnomalyReport(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	clock := newTestClockNow()
+	s.clock = clock
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 6, MdID{})
+
+	// Space the revisions an hour apart, ending now.
+	start := clock.Now().Add(-6 * time.Hour)
+	timestamps := make([]time.Time, len(mdIDs))
+	setTimestamp := func(i int, timestamp time.Time) {
+		// Drop any sub-second part, which some filesystems
+		// can't store.
+		timestamp = timestamp.Truncate(time.Second)
+		err := os.Chtimes(s.mdPath(mdIDs[i]), timestamp, timestamp)
+		require.NoError(t, err)
+		timestamps[i] = timestamp
+	}
+	for i := range mdIDs {
+		setTimestamp(i, start.Add(time.Duration(i)*time.Hour))
+	}
+
+	anomalies, err := s.timestampAnomalyReport(NullBranchID)
+	require.NoError(t, err)
+	require.Nil(t, anomalies)
+
+	// A small step back is tolerated.
+	setTimestamp(2, timestamps[1].Add(-30*time.Second))
+	anomalies, err = s.timestampAnomalyReport(NullBranchID)
+	require.NoError(t, err)
+	require.Nil(t, anomalies)
+
+	// Move revision 3 back a day, and revision 6 into the future.
+	setTimestamp(2, timestamps[1].Add(-24*time.Hour))
+	setTimestamp(5, clock.Now().Add(time.Hour))
+	anomalies, err = s.timestampAnomalyReport(NullBranchID)
+	require.NoError(t, err)
+	require.Len(t, anomalies, 2)
+	require.Equal(t, MetadataRevision(3), anomalies[0].revision)
+	require.True(t, anomalies[0].backwards)
+	require.False(t, anomalies[0].future)
+	require.True(t, timestamps[2].Equal(anomalies[0].timestamp))
+	require.True(t, timestamps[1].Equal(anomalies[0].prevTimestamp))
+	require.Equal(t, MetadataRevision(6), anomalies[1].revision)
+	require.False(t, anomalies[1].backwards)
+	require.True(t, anomalies[1].future)
+}
+
+func TestMDServerTlfStorageRepairTimestamps(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	setTimestamp := func(i int, timestamp time.Time) {
+		err := os.Chtimes(s.mdPath(mdIDs[i]), timestamp, timestamp)
+		require.NoError(t, err)
+	}
+	getTimestamps := func() []time.Time {
+		rmdses, err := s.getRange(
+			ctx, uid, deviceKID, NullBranchID, 1, 10)
+		require.NoError(t, err)
+		var timestamps []time.Time
+		for _, rmds := range rmdses {
+			timestamps = append(
+				timestamps, rmds.untrustedServerTimestamp)
+		}
+		return timestamps
+	}
+
+	// Collapse all the timestamps to the time of a restore.
+	restoreTime := time.Now().Truncate(time.Second)
+	for i := range mdIDs {
+		setTimestamp(i, restoreTime)
+	}
+
+	_, err = s.repairTimestamps(NullBranchID, restoreTime, restoreTime)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	// The history was written in the ten hours before the backup.
+	windowStart := restoreTime.Add(-11 * time.Hour)
+	windowEnd := restoreTime.Add(-time.Hour)
+	repairs, err := s.repairTimestamps(NullBranchID, windowStart, windowEnd)
+	require.NoError(t, err)
+	require.Len(t, repairs, 10)
+
+	timestamps := getTimestamps()
+	prev := windowStart
+	for i, timestamp := range timestamps {
+		require.True(t, timestamp.After(prev),
+			"Revision %d at %s isn't after %s",
+			i+1, timestamp, prev)
+		require.True(t, timestamp.Before(windowEnd))
+		require.Equal(t, MetadataRevision(i+1), repairs[i].revision)
+		require.Equal(t, restoreTime, repairs[i].oldTimestamp)
+		require.True(t, timestamp.Equal(repairs[i].newTimestamp))
+		prev = timestamp
+	}
+
+	approximate, err := s.approximateTimestamps(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, []MetadataRevision{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		approximate)
+
+	// Nothing more to repair.
+	repairs, err = s.repairTimestamps(NullBranchID, windowStart, windowEnd)
+	require.NoError(t, err)
+	require.Nil(t, repairs)
+
+	// With good timestamps a minute apart, except for revision 5,
+	// which went back in time, revisions 4 and 5 are out of order,
+	// and are respaced between revisions 3 and 6.
+	base := restoreTime.Add(-time.Hour)
+	for i := range mdIDs {
+		setTimestamp(i, base.Add(time.Duration(i+1)*time.Minute))
+	}
+	setTimestamp(4, base)
+	repairs, err = s.repairTimestamps(
+		NullBranchID, base.Add(-time.Hour), restoreTime)
+	require.NoError(t, err)
+	require.Len(t, repairs, 2)
+	require.Equal(t, MetadataRevision(4), repairs[0].revision)
+	require.Equal(t, MetadataRevision(5), repairs[1].revision)
+	timestamps = getTimestamps()
+	for i, timestamp := range timestamps {
+		expected := base.Add(time.Duration(i+1) * time.Minute)
+		require.True(t, timestamp.Equal(expected),
+			"Revision %d at %s", i+1, timestamp)
+	}
+
+	// Repairs are seen through the MD cache, and leave hard
+	// links to the old files alone.
+	s.mdCache = makeMDServerMDCache(0, 0, mdServerMDCacheEvictLRU)
+	timestamps = getTimestamps()
+	linkPath := filepath.Join(tempdir, "link")
+	err = os.Link(s.mdPath(mdIDs[9]), linkPath)
+	require.NoError(t, err)
+	repairs, err = s.repairTimestamps(
+		NullBranchID, base, base.Add(9*time.Minute+30*time.Second))
+	require.NoError(t, err)
+	require.Len(t, repairs, 1)
+	require.Equal(t, MetadataRevision(10), repairs[0].revision)
+	require.True(t, getTimestamps()[9].Equal(repairs[0].newTimestamp))
+	fi, err := os.Stat(linkPath)
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(timestamps[9]))
+}
+
+func TestMDServerTlfStorageGetMDHeader(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// An MD put without splitHeaders has its header read from the
+	// whole MD.
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 1, MdID{})
+	s.splitHeaders = true
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 2, 4, mdIDs[0])...)
+
+	var readPaths []string
+	s.readFile = func(filename string) ([]byte, error) {
+		readPaths = append(readPaths, filename)
+		return ioutil.ReadFile(filename)
+	}
+
+	checkHeader := func(i int, header *RootMetadataSigned, bodySize int) {
+		full, _, err := s.getMD(ctx, uid, deviceKID, mdIDs[i], false)
+		require.NoError(t, err)
+		require.Equal(t, MetadataRevision(i+1), header.MD.Revision)
+		require.Nil(t, header.MD.SerializedPrivateMetadata)
+		require.Equal(t,
+			len(full.MD.SerializedPrivateMetadata), bodySize)
+		require.NotEmpty(t, header.MD.WKeys)
+		require.Equal(t, full.MD.WKeys, header.MD.WKeys)
+		require.Equal(t, full.MD.RKeys, header.MD.RKeys)
+		require.Equal(t, full.SigInfo, header.SigInfo)
+		require.True(t, full.untrustedServerTimestamp.Equal(
+			header.untrustedServerTimestamp))
+	}
+
+	readPaths = nil
+	header, bodySize, err := s.getMDHeader(ctx, uid, deviceKID, mdIDs[0])
+	require.NoError(t, err)
+	require.Contains(t, readPaths, s.mdPath(mdIDs[0]))
+	checkHeader(0, header, bodySize)
+
+	readPaths = nil
+	header, bodySize, err = s.getMDHeader(ctx, uid, deviceKID, mdIDs[1])
+	require.NoError(t, err)
+	// The head is read too, to check the caller's permissions.
+	require.Contains(t, readPaths, s.mdHeaderPath(mdIDs[1]))
+	require.NotContains(t, readPaths, s.mdPath(mdIDs[1]))
+	checkHeader(1, header, bodySize)
+
+	// With its body corrupted, an MD can still have its header
+	// read, since the body isn't read.
+	err = ioutil.WriteFile(s.mdPath(mdIDs[1]), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	header, _, err = s.getMDHeader(ctx, uid, deviceKID, mdIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(2), header.MD.Revision)
+	_, _, err = s.getMD(ctx, uid, deviceKID, mdIDs[1], false)
+	require.IsType(t, MDServerError{}, err)
+
+	// A corrupted header is caught on its own.
+	headerBuf, err := ioutil.ReadFile(s.mdHeaderPath(mdIDs[2]))
+	require.NoError(t, err)
+	var storedHeader mdStoredHeader
+	err = s.codec.Decode(headerBuf, &storedHeader)
+	require.NoError(t, err)
+	storedHeader.Header[len(storedHeader.Header)-1] ^= 0x1
+	headerBuf, err = s.codec.Encode(storedHeader)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(s.mdHeaderPath(mdIDs[2]), headerBuf, 0600)
+	require.NoError(t, err)
+	_, _, err = s.getMDHeader(ctx, uid, deviceKID, mdIDs[2])
+	require.IsType(t, MDServerError{}, err)
+
+	// Removing an MD removes its header too.
+	err = s.removeMDLocked(mdIDs[1])
+	require.NoError(t, err)
+	_, err = os.Stat(s.mdHeaderPath(mdIDs[1]))
+	require.True(t, os.IsNotExist(err))
+	_, _, err = s.getMDHeader(ctx, uid, deviceKID, mdIDs[1])
+	require.Equal(t, mdServerTlfStorageNoSuchMDIDError{mdIDs[1]}, err)
+}
+
+func TestMDServerTlfStorageDecodeLimits(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.decodeLimits = mdDecodeLimits{
+		maxDepth:      32,
+		maxElements:   10000,
+		maxAllocBytes: 1 << 20,
+	}
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Real MDs are well within the limits.
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 3)
+
+	// readCrafted stores the given data as an MD object and
+	// reads it back.
+	craftedID := fakeMdID(100)
+	readCrafted := func(data []byte) error {
+		path := s.mdPath(craftedID)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(path, data, 0600)
+		require.NoError(t, err)
+
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		_, err = s.getMDReadLocked(craftedID)
+		return err
+	}
+
+	// Deeply nested arrays.
+	deep := append(bytes.Repeat([]byte{0x91}, 100000), 0xc0)
+	require.Equal(t, errMDDecodeLimitExceeded, readCrafted(deep))
+
+	// A map that claims to have 2^32-1 entries fails before
+	// anything is allocated for them.
+	bomb := []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xc0, 0xc0}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = readCrafted(bomb)
+	runtime.ReadMemStats(&after)
+	require.Equal(t, errMDDecodeLimitExceeded, err)
+	require.True(t, after.TotalAlloc-before.TotalAlloc < 1<<20,
+		"Allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+
+	// Many strings adding up to more than maxAllocBytes.
+	str := append([]byte{0xc6, 0x00, 0x01, 0x00, 0x00},
+		make([]byte, 1<<16)...)
+	big := append([]byte{0xdc, 0x00, 0x20}, bytes.Repeat(str, 32)...)
+	require.Equal(t, errMDDecodeLimitExceeded, readCrafted(big))
+
+	// Too many elements.
+	many := append([]byte{0xdc, 0x4e, 0x20},
+		bytes.Repeat([]byte{0xc0}, 20000)...)
+	require.Equal(t, errMDDecodeLimitExceeded, readCrafted(many))
+
+	// An array claiming more elements than there are bytes left
+	// is rejected as corrupt rather than decoded.
+	err = readCrafted([]byte{0xdc, 0x00, 0x10, 0xc0})
+	require.Error(t, err)
+	require.NotEqual(t, errMDDecodeLimitExceeded, err)
+}
+
+func TestMDServerTlfStorageWriteRateLimit(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	clock := newTestClockNow()
+	s.clock = clock
+	// Use binary fractions, so that token counts are exact.
+	s.writeRateLimit = mdWriteRateLimit{rate: 8, burst: 4}
+
+	var mergedIDs []MdID
+	putMerged := func() error {
+		rev := MetadataRevision(len(mergedIDs) + 1)
+		prevRoot := MdID{}
+		if len(mergedIDs) > 0 {
+			prevRoot = mergedIDs[len(mergedIDs)-1]
+		}
+		rmds := makeMDForTest(t, id, h, rev, prevRoot)
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		if err != nil {
+			return err
+		}
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mergedIDs = append(mergedIDs, mdID)
+		return nil
+	}
+	requireRateLimited := func(
+		err error) mdServerTlfStorageRateLimitedError {
+		require.IsType(t, MDServerErrorThrottle{}, err)
+		throttleErr := err.(MDServerErrorThrottle).Err
+		rlErr, ok := throttleErr.(mdServerTlfStorageRateLimitedError)
+		require.True(t, ok, "Unexpected error %v", err)
+		return rlErr
+	}
+
+	// A burst up to the bucket size succeeds.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, putMerged())
+	}
+
+	// The next put is throttled, with a hint of when to retry.
+	rlErr := requireRateLimited(putMerged())
+	require.Equal(t, NullBranchID, rlErr.bid)
+	require.Equal(t, time.Second/8, rlErr.retryAfter)
+
+	// Unmerged branches have their own bucket.
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 5, 5, mergedIDs[3])
+
+	// After the burst, retrying as fast as possible gets only the
+	// refill rate.
+	successes := 0
+	for i := 0; i < 128; i++ {
+		clock.Add(time.Second / 64)
+		err := putMerged()
+		if err == nil {
+			successes++
+		} else {
+			requireRateLimited(err)
+		}
+	}
+	require.Equal(t, 16, successes)
+
+	merged, unmerged, err := s.writeRateStatus()
+	require.NoError(t, err)
+	require.Equal(t, float64(0), merged.available)
+	require.Equal(t, uint64(1+128-16), merged.throttled)
+	require.Equal(t, float64(4), unmerged.available)
+	require.Equal(t, uint64(0), unmerged.throttled)
+}
+
+func TestMDServerTlfStorageHighWaterMark(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	key := []byte("high-water key")
+	openStorage := func() (*mdServerTlfStorage, error) {
+		s := makeMDServerTlfStorage(codec, crypto, tempdir)
+		s.highWaterKey = key
+		return s, s.open(ctx)
+	}
+	s, err := openStorage()
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), head.MD.Revision)
+
+	// Roll LATEST back behind the storage's back.
+	err = s.branchJournals[NullBranchID].writeLatestRevision(3)
+	require.NoError(t, err)
+
+	rollbackErr := MDServerError{mdServerTlfStorageRollbackError{
+		bid:       NullBranchID,
+		latest:    3,
+		highWater: 5,
+	}}
+	_, err = s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.Equal(t, rollbackErr, err)
+
+	// Nor can the rolled-back head be extended, which would
+	// rewrite history.
+	rmds := makeMDForTest(t, id, h, 4, mdIDs[2])
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, rollbackErr, err)
+
+	// The rollback is still detected after reopening.
+	err = s.close()
+	require.NoError(t, err)
+	s, err = openStorage()
+	require.NoError(t, err)
+	_, err = s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.Equal(t, rollbackErr, err)
+
+	// The mark can't be lowered without the key.
+	err = s.close()
+	require.NoError(t, err)
+	markPath := s.highWaterMarkPath(NullBranchID)
+	markBuf, err := ioutil.ReadFile(markPath)
+	require.NoError(t, err)
+	var mark mdHighWaterMark
+	err = codec.Decode(markBuf, &mark)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), mark.Revision)
+	mark.Revision = 3
+	forgedBuf, err := codec.Encode(mark)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(markPath, forgedBuf, 0600)
+	require.NoError(t, err)
+	_, err = openStorage()
+	require.Error(t, err)
+
+	err = ioutil.WriteFile(markPath, markBuf, 0600)
+	require.NoError(t, err)
+	s, err = openStorage()
+	require.NoError(t, err)
+
+	// Once the operator accepts the rollback, the head is served,
+	// and can be extended, again.
+	err = s.acceptRollback(NullBranchID)
+	require.NoError(t, err)
+	head, err = s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(3), head.MD.Revision)
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdIDs[2])
+	require.Equal(t, MetadataRevision(4), s.highWaterMarks[NullBranchID])
+}
+
+func TestMDServerTlfStorageParanoidPuts(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(t, s, uid, deviceKID, id, h,
+		NullBranchID, MetadataRevisionInitial, 3, MdID{})
+
+	// Revision 4 points to revision 2 instead of the head.
+	rmds := makeMDForTest(t, id, h, 4, mdIDs[1])
+
+	// Without paranoid puts, the successor check catches it.
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.IsType(t, MDServerErrorConflictPrevRoot{}, err)
+
+	s.paranoidPuts = true
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.IsType(t, MDServerError{}, err)
+	mismatch, ok := err.(MDServerError).Err.(mdServerTlfStoragePrevRootMismatchError)
+	require.True(t, ok, "unexpected error %v", err)
+	require.Equal(t, mdIDs[1], mismatch.prevRoot)
+	require.Equal(t, mdIDs[2], mismatch.headID)
+	require.Equal(t, MetadataRevision(3), mismatch.headRevision)
+
+	// Good puts, including the first put to an unmerged branch,
+	// still go through.
+	mdIDs = putMDRangeForTest(t, s, uid, deviceKID, id, h,
+		NullBranchID, 4, 5, mdIDs[2])
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 6, 7, mdIDs[1])
+}
+
+// testMDServerTlfStorageAsymmetricCodec is a Codec that, when broken
+// is set, decodes MDs with their revision off by one, as if a field
+// didn't survive encoding.
+type testMDServerTlfStorageAsymmetricCodec struct {
+	Codec
+	broken bool
+}
+
+func (c *testMDServerTlfStorageAsymmetricCodec) Decode(
+	buf []byte, obj interface{}) error {
+	err := c.Codec.Decode(buf, obj)
+	if err != nil {
+		return err
+	}
+	if rmds, ok := obj.(*RootMetadataSigned); ok && c.broken {
+		rmds.MD.Revision++
+	}
+	return nil
+}
+
+func TestMDServerTlfStorageVerifyEncodedPuts(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	codec := &testMDServerTlfStorageAsymmetricCodec{Codec: s.codec}
+	s.codec = codec
+	s.verifyEncodedPuts = true
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// MDs that round-trip cleanly go through.
+	mdIDs := putMDRangeForTest(t, s, uid, deviceKID, id, h,
+		NullBranchID, MetadataRevisionInitial, 3, MdID{})
+
+	// An asymmetry is caught by the put, and nothing is written.
+	codec.broken = true
+	rmds := makeMDForTest(t, id, h, 4, mdIDs[2])
+	mdID, err := rmds.MD.MetadataID(s.crypto)
+	require.NoError(t, err)
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.IsType(t, MDServerError{}, err)
+	roundTripErr, ok := err.(MDServerError).Err.(mdServerTlfStorageRoundTripError)
+	require.True(t, ok, "unexpected error %v", err)
+	require.Equal(t, mdID, roundTripErr.id)
+	require.NotEqual(t, mdID, roundTripErr.decodedID)
+	_, err = os.Stat(s.mdPath(mdID))
+	require.True(t, os.IsNotExist(err))
+	length, err := s.journalLength(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), length)
+
+	codec.broken = false
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerTlfStorageExportGraph(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	// Fork a branch off of merged revision 2.
+	bid := FakeBranchID(1)
+	unmergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 3, 4, mergedIDs[1])
+
+	var buf bytes.Buffer
+	err = s.exportGraph(&buf)
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf("branch %s\n", NullBranchID) +
+		fmt.Sprintf("node %s 1\n", mergedIDs[0]) +
+		fmt.Sprintf("node %s 2\n", mergedIDs[1]) +
+		fmt.Sprintf("edge %s %s\n", mergedIDs[1], mergedIDs[0]) +
+		fmt.Sprintf("node %s 3\n", mergedIDs[2]) +
+		fmt.Sprintf("edge %s %s\n", mergedIDs[2], mergedIDs[1]) +
+		fmt.Sprintf("branch %s\n", bid) +
+		fmt.Sprintf("node %s 3\n", unmergedIDs[0]) +
+		fmt.Sprintf("edge %s %s\n", unmergedIDs[0], mergedIDs[1]) +
+		fmt.Sprintf("node %s 4\n", unmergedIDs[1]) +
+		fmt.Sprintf("edge %s %s\n", unmergedIDs[1], unmergedIDs[0]) +
+		fmt.Sprintf("branchpoint %s 2 %s\n", bid, mergedIDs[1])
+	require.Equal(t, expected, buf.String())
+}
+
+func TestMDServerTlfStorageMaxBranches(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.maxBranches = 2
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+
+	bid1 := FakeBranchID(1)
+	ids1 := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid1, 6, 6, mergedIDs[4])
+	bid2 := FakeBranchID(2)
+	ids2 := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid2, 6, 6, mergedIDs[4])
+
+	rmds := makeMDForTest(t, id, h, 6, mergedIDs[4])
+	rmds.MD.WFlags |= MetadataFlagUnmerged
+	rmds.MD.BID = FakeBranchID(3)
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.Equal(t, MDServerErrorTooManyBranches{Limit: 2}, err)
+	require.Equal(t, 3, len(s.branchJournals))
+
+	// Existing branches, including the master branch, still take
+	// puts.
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid1, 7, 8, ids1[0])
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid2, 7, 7, ids2[0])
+	putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 6, 6, mergedIDs[4])
+}
+
+func TestMDServerTlfStorageCompactJournals(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.compactJournals = true
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+	require.True(t, s.branchJournals[NullBranchID].isCompact())
+
+	_, err = s.prune(NullBranchID, 4)
+	require.NoError(t, err)
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(rmdses))
+	require.Equal(t, MetadataRevision(4), rmdses[0].MD.Revision)
+
+	// The format sticks across a reopen, even without
+	// compactJournals, and the journal can be converted back.
+	err = s.close()
+	require.NoError(t, err)
+	dir := s.branchJournalPath(NullBranchID)
+	s = makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	require.True(t, s.branchJournals[NullBranchID].isCompact())
+	head, err := s.getForTLF(ctx, uid, deviceKID, NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(10), head.MD.Revision)
+	err = s.close()
+	require.NoError(t, err)
+
+	err = convertMDServerBranchJournal(s.codec, dir, false)
+	require.NoError(t, err)
+	s = makeMDServerTlfStorage(s.codec, s.crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+	require.False(t, s.branchJournals[NullBranchID].isCompact())
+	rmdses, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(rmdses))
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID,
+		11, 11, mergedIDs[9])
+}
+
+func TestMDServerTlfStorageHeadDepth(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	depth, err := s.headDepth(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{}, depth)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 10, MdID{})
+
+	// Fork a branch off of merged revision 5.
+	bid := FakeBranchID(1)
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, bid, 6, 8, mergedIDs[4])
+
+	depth, err = s.headDepth(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{retained: 10, total: 10}, depth)
+
+	depth, err = s.headDepth(bid)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{
+		retained: 3, total: 8, sinceDivergence: 3}, depth)
+
+	_, err = s.headDepth(FakeBranchID(2))
+	require.Error(t, err)
+
+	// Pruning up to before the divergence point keeps it.
+	_, err = s.prune(NullBranchID, 3)
+	require.NoError(t, err)
+
+	depth, err = s.headDepth(NullBranchID)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{
+		retained: 8, total: 10, pruned: true}, depth)
+
+	depth, err = s.headDepth(bid)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{
+		retained: 3, total: 8, sinceDivergence: 3, pruned: true}, depth)
+
+	// Pruning past it loses it.
+	_, err = s.prune(NullBranchID, 7)
+	require.NoError(t, err)
+
+	depth, err = s.headDepth(bid)
+	require.NoError(t, err)
+	require.Equal(t, mdHeadDepth{
+		retained: 3, total: 8, sinceDivergence: -1, pruned: true}, depth)
+}
+
+func TestMDServerTlfStorageIDFunc(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.idFunc = func(md *RootMetadata) (MdID, error) {
+		return fakeMdID(byte(md.Revision)), nil
+	}
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	// The MDs are stored under the injected IDs.
+	_, mdIDs, err := s.branchJournals[NullBranchID].getRange(1, 3)
+	require.NoError(t, err)
+	require.Equal(t, []MdID{fakeMdID(1), fakeMdID(2), fakeMdID(3)}, mdIDs)
+	for _, mdID := range mdIDs {
+		_, err := os.Stat(s.mdPath(mdID))
+		require.NoError(t, err)
+	}
+
+	rmdses, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(rmdses))
+
+	// The integrity check on reads uses the injected function
+	// too.
+	s.idFunc = func(md *RootMetadata) (MdID, error) {
+		return fakeMdID(byte(md.Revision) + 100), nil
+	}
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 3)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "Metadata ID mismatch"),
+		err.Error())
+}
+
+func TestMDServerTlfStorageWaitForHeadAfter(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	// The head is already past revision 2.
+	head, err := s.waitForHeadAfter(
+		ctx, uid, deviceKID, NullBranchID, 2, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(3), head.MD.Revision)
+
+	// Nothing advances the head.
+	_, err = s.waitForHeadAfter(
+		ctx, uid, deviceKID, NullBranchID, 3, time.Millisecond)
+	require.Equal(t, errMDServerTlfStorageHeadWaitTimedOut, err)
+
+	// A put wakes up a waiter.
+	type result struct {
+		head *RootMetadataSigned
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		head, err := s.waitForHeadAfter(
+			ctx, uid, deviceKID, NullBranchID, 3, time.Minute)
+		resultCh <- result{head, err}
+	}()
+	putMDRangeForTest(t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdIDs[2])
+	r := <-resultCh
+	require.NoError(t, r.err)
+	require.Equal(t, MetadataRevision(4), r.head.MD.Revision)
+
+	// Canceling the context stops the wait.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.waitForHeadAfter(
+		cancelCtx, uid, deviceKID, NullBranchID, 4, time.Minute)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestMDServerTlfStorageGetForTLFIfChanged(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// An empty branch is unchanged from MdID{}.
+	rmds, changed, err := s.getForTLFIfChanged(
+		ctx, uid, deviceKID, NullBranchID, MdID{})
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Nil(t, rmds)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	var mdReads int
+	s.readFile = func(filename string) ([]byte, error) {
+		mdReads++
+		return ioutil.ReadFile(filename)
+	}
+
+	// A stale known head gets the current one.
+	rmds, changed, err = s.getForTLFIfChanged(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[1])
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, MetadataRevision(3), rmds.MD.Revision)
+	require.NotZero(t, mdReads)
+
+	// The current head is resolved without reading any MD.
+	mdReads = 0
+	rmds, changed, err = s.getForTLFIfChanged(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[2])
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Nil(t, rmds)
+	require.Zero(t, mdReads)
+
+	// Others are still refused.
+	_, _, err = s.getForTLFIfChanged(ctx, keybase1.MakeTestUID(2),
+		deviceKID, NullBranchID, mdIDs[2])
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+
+	// Once the head moves, it's changed again.
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdIDs[2])...)
+	rmds, changed, err = s.getForTLFIfChanged(
+		ctx, uid, deviceKID, NullBranchID, mdIDs[2])
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, MetadataRevision(4), rmds.MD.Revision)
+}
+
+func TestMDServerTlfStorageChangeFeed(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.changeFeed = true
+	err = s.open(ctx)
+	require.NoError(t, err)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	events, err := s.consumeChangeFeed(0, 0)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	mergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 5, MdID{})
+	bid := FakeBranchID(1)
+	unmergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, bid, 3, 4, mergedIDs[1])
+	moreMergedIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 6, 6, mergedIDs[4])
+
+	type change struct {
+		bid  BranchID
+		rev  MetadataRevision
+		mdID MdID
+	}
+	var expected []change
+	for i, mdID := range mergedIDs {
+		expected = append(expected,
+			change{NullBranchID, MetadataRevision(i + 1), mdID})
+	}
+	for i, mdID := range unmergedIDs {
+		expected = append(expected,
+			change{bid, MetadataRevision(i + 3), mdID})
+	}
+	expected = append(expected, change{NullBranchID, 6, moreMergedIDs[0]})
+
+	checkEvents := func(afterSeq uint64, events []mdChangeFeedEvent) {
+		require.Equal(t, len(expected)-int(afterSeq), len(events))
+		for i, e := range events {
+			c := expected[int(afterSeq)+i]
+			require.Equal(t, afterSeq+uint64(i)+1, e.seq)
+			require.Equal(t, id, e.TlfID)
+			require.Equal(t, c.bid, e.BID)
+			require.Equal(t, c.rev, e.Revision)
+			require.Equal(t, c.mdID, e.ID)
+			require.Equal(t, uid, e.UID)
+		}
+	}
+
+	events, err = s.consumeChangeFeed(0, 0)
+	require.NoError(t, err)
+	checkEvents(0, events)
+
+	// Consume a page of events, and checkpoint after it.
+	events, err = s.consumeChangeFeed(0, 3)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	seq, err := s.loadChangeFeedCheckpoint("indexer")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), seq)
+	err = s.saveChangeFeedCheckpoint("indexer", events[2].seq)
+	require.NoError(t, err)
+
+	err = s.saveChangeFeedCheckpoint("../indexer", 1)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	err = s.close()
+	require.NoError(t, err)
+
+	// A consumer resuming from its checkpoint gets exactly the
+	// events after it, in order.
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.changeFeed = true
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	seq, err = s.loadChangeFeedCheckpoint("indexer")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), seq)
+	events, err = s.consumeChangeFeed(seq, 0)
+	require.NoError(t, err)
+	checkEvents(seq, events)
+
+	// Nothing is left after the last event.
+	events, err = s.consumeChangeFeed(uint64(len(expected)), 0)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func TestMDServerTlfStorageChangeFeedCatchUp(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	// Put some MDs without a change feed.
+	ctx := context.Background()
+	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	err = s.open(ctx)
+	require.NoError(t, err)
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	mdIDs := putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 1, 3, MdID{})
+
+	_, err = s.consumeChangeFeed(0, 0)
+	require.Equal(t, errMDServerTlfStorageChangeFeedDisabled, err)
+
+	err = s.close()
+	require.NoError(t, err)
+
+	// Enabling the feed feeds the stored revisions, and then the
+	// new ones.
+	s = makeMDServerTlfStorage(codec, crypto, tempdir)
+	s.changeFeed = true
+	err = s.open(ctx)
+	require.NoError(t, err)
+	defer func() {
+		err := s.close()
+		require.NoError(t, err)
+	}()
+
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 4, 4, mdIDs[2])...)
+
+	events, err := s.consumeChangeFeed(0, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	for i, e := range events {
+		require.Equal(t, uint64(i+1), e.seq)
+		require.Equal(t, MetadataRevision(i+1), e.Revision)
+		require.Equal(t, mdIDs[i], e.ID)
+	}
+
+	// A put whose revision can't be fed still succeeds, and the
+	// next put catches the feed up.
+	feedPath := filepath.Join(tempdir, mdServerChangeFeedDirName)
+	err = os.Rename(feedPath, feedPath+".bak")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(feedPath, nil, 0600)
+	require.NoError(t, err)
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 5, 5, mdIDs[3])...)
+	err = os.Remove(feedPath)
+	require.NoError(t, err)
+	err = os.Rename(feedPath+".bak", feedPath)
+	require.NoError(t, err)
+	mdIDs = append(mdIDs, putMDRangeForTest(
+		t, s, uid, deviceKID, id, h, NullBranchID, 6, 6, mdIDs[4])...)
+
+	events, err = s.consumeChangeFeed(4, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for i, e := range events {
+		require.Equal(t, uint64(i+5), e.seq)
+		require.Equal(t, MetadataRevision(i+5), e.Revision)
+		require.Equal(t, mdIDs[i+4], e.ID)
+	}
+}
+
+// makeMDsWithKeyBundlesForTest is like makeBigMDsForTest, but the
+// MDs have key generations for the given number of extra writers,
+// which change every rekeyInterval revisions.
+func makeMDsWithKeyBundlesForTest(t testing.TB, crypto cryptoPure,
+	id TlfID, h BareTlfHandle, count, writers, rekeyInterval int) []*RootMetadataSigned {
+	rmdses := makeBigMDsForTest(t, crypto, id, h, count)
+	var prevRoot MdID
+	for i, rmds := range rmdses {
+		generation := byte(i / rekeyInterval)
+		for w := 0; w < writers; w++ {
+			uid := keybase1.MakeTestUID(uint32(w + 100))
+			k := MakeFakeCryptPublicKeyOrBust(string(uid))
+			data := make([]byte, 64)
+			for j := range data {
+				data[j] = byte(j) + generation
+			}
+			rmds.MD.WKeys[0].WKeys[uid] = DeviceKeyInfoMap{
+				k.kid: TLFCryptKeyInfo{
+					ClientHalf: EncryptedTLFCryptKeyClientHalf{
+						EncryptedData: data,
+					},
+				},
+			}
+		}
+		rmds.MD.PrevRoot = prevRoot
+		rmds.MD.clearCachedMetadataIDForTest()
+		var err error
+		prevRoot, err = rmds.MD.MetadataID(crypto)
+		require.NoError(t, err)
+	}
+	return rmdses
+}
+
+func keyBundlesDiskUsageForTest(t testing.TB, s *mdServerTlfStorage) int64 {
+	var total int64
+	err := filepath.Walk(filepath.Join(s.dir, "key_bundles"),
+		func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				total += info.Size()
+			}
+			return nil
+		})
+	require.NoError(t, err)
+	return total
+}
+
+func TestMDServerTlfStorageDedupKeyBundles(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.dedupKeyBundles = true
+	s.deltaFullInterval = 4
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	rmdses := makeMDsWithKeyBundlesForTest(t, s.crypto, id, h, 12, 8, 5)
+	var mdIDs []MdID
+	for _, rmds := range rmdses {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	// Revisions stored in full refer to their key bundles.
+	buf, err := ioutil.ReadFile(s.mdPath(mdIDs[0]))
+	require.NoError(t, err)
+	require.True(t, isMDKeyBundleRef(buf))
+	ref, err := decodeMDKeyBundleRef(s.codec, buf)
+	require.NoError(t, err)
+	require.NotEqual(t, "", ref.WKeysID)
+	require.NotEqual(t, "", ref.RKeysID)
+
+	// Three writer bundles, one per rekey, and one (empty)
+	// reader bundle.
+	var bundles int
+	err = filepath.Walk(filepath.Join(s.dir, "key_bundles"),
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				bundles++
+			}
+			return err
+		})
+	require.NoError(t, err)
+	require.Equal(t, 4, bundles)
+
+	// Reads reconstruct the same MDs, including deltas based on
+	// deduplicated MDs, and verify their IDs.
+	got, err := s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 12)
+	require.NoError(t, err)
+	require.Equal(t, len(rmdses), len(got))
+	for i, rmds := range got {
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i], mdID)
+		require.Equal(t, rmdses[i].MD.WKeys, rmds.MD.WKeys)
+		require.Equal(t, rmdses[i].MD.RKeys, rmds.MD.RKeys)
+	}
+
+	// A tampered bundle fails the ID check.
+	bundlePath := s.keyBundlePath(ref.WKeysID)
+	var wKeys TLFWriterKeyGenerations
+	bundleBuf, err := ioutil.ReadFile(bundlePath)
+	require.NoError(t, err)
+	err = s.codec.Decode(bundleBuf, &wKeys)
+	require.NoError(t, err)
+	delete(wKeys[0].WKeys, keybase1.MakeTestUID(100))
+	bundleBuf, err = s.codec.Encode(wKeys)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(bundlePath, bundleBuf, 0600)
+	require.NoError(t, err)
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 1)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "Metadata ID mismatch"),
+		err.Error())
+
+	// A put that needs the tampered bundle replaces it, rather
+	// than reusing it.
+	s.deltaFullInterval = 0
+	rmds := makeMDForTest(t, id, h, MetadataRevision(13), mdIDs[11])
+	rmds.MD.WKeys = rmdses[0].MD.WKeys
+	rmds.MD.RKeys = rmdses[0].MD.RKeys
+	rmds.MD.clearCachedMetadataIDForTest()
+	_, err = s.put(ctx, uid, deviceKID, rmds)
+	require.NoError(t, err)
+	_, err = s.getRange(ctx, uid, deviceKID, NullBranchID, 1, 13)
+	require.NoError(t, err)
+	_, err = os.Stat(bundlePath + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func BenchmarkMDServerTlfStorageDedupKeyBundles(b *testing.B) {
+	for _, dedup := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dedupKeyBundles=%t", dedup),
+			func(b *testing.B) {
+				benchmarkMDServerTlfStorageDedupKeyBundles(b, dedup)
+			})
+	}
+}
+
+// benchmarkMDServerTlfStorageDedupKeyBundles puts a history with a
+// rekey every 50 revisions, and reports the space it takes.
+func benchmarkMDServerTlfStorageDedupKeyBundles(b *testing.B, dedup bool) {
+	crypto := makeTestCryptoCommon(b)
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(b, err)
+	ctx := context.Background()
+
+	rmdses := makeMDsWithKeyBundlesForTest(b, crypto, id, h, 200, 50, 50)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+		require.NoError(b, err)
+		s := makeMDServerTlfStorage(NewCodecMsgpack(), crypto, tempdir)
+		s.dedupKeyBundles = dedup
+		err = s.open(ctx)
+		require.NoError(b, err)
+		b.StartTimer()
+
+		for _, rmds := range rmdses {
+			_, err := s.put(ctx, uid, deviceKID, rmds)
+			require.NoError(b, err)
+		}
+
+		b.StopTimer()
+		usage := mdsDiskUsageForTest(b, s) + keyBundlesDiskUsageForTest(b, s)
+		if i == 0 {
+			b.Logf("%d revisions take %d bytes", len(rmdses), usage)
+		}
+		err = s.close()
+		require.NoError(b, err)
+		err = os.RemoveAll(tempdir)
+		require.NoError(b, err)
+		b.StartTimer()
+	}
+}
+
+// dirContentsForTest returns the contents of all the regular files
+// under dir, keyed by path.
+func dirContentsForTest(t *testing.T, dir string) map[string]string {
+	contents := make(map[string]string)
+	err := filepath.Walk(dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			contents[path] = string(buf)
+			return nil
+		})
+	require.NoError(t, err)
+	return contents
+}
+
+func TestMDServerTlfStoragePlanPrune(t *testing.T) {
+	tempdir, s := setupMDServerTlfStorageTest(t)
+	defer teardownMDServerTlfStorageTest(t, tempdir, s)
+
+	s.deltaFullInterval = 4
+
+	uid := keybase1.MakeTestUID(1)
+	deviceKID := keybase1.KID("fake kid")
+	id := FakeTlfID(1, false)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var mdIDs []MdID
+	for _, rmds := range makeBigMDsForTest(t, s.crypto, id, h, 12) {
+		_, err := s.put(ctx, uid, deviceKID, rmds)
+		require.NoError(t, err)
+		mdID, err := rmds.MD.MetadataID(s.crypto)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	err = s.pinRevision(NullBranchID, 7)
+	require.NoError(t, err)
+
+	before := dirContentsForTest(t, tempdir)
+	plan, err := s.planPrune(NullBranchID, 10)
+	require.NoError(t, err)
+	require.Equal(t, before, dirContentsForTest(t, tempdir))
+
+	require.Equal(t, MetadataRevision(7), plan.pinnedAt)
+	require.Equal(t, 6, len(plan.removals))
+	for i, removal := range plan.removals {
+		require.Equal(t, MetadataRevision(i+1), removal.revision)
+		require.Equal(t, mdIDs[i], removal.mdID)
+	}
+	require.Equal(t, 0, len(plan.deferred))
+
+	// The real prune removes exactly the planned revisions, and
+	// frees the estimated space.
+	usage := mdsDiskUsageForTest(t, s)
+	pruned, err := s.prune(NullBranchID, 10)
+	require.NoError(t, err)
+	require.Equal(t, len(plan.removals), pruned)
+	require.Equal(t, plan.bytesFreed, usage-mdsDiskUsageForTest(t, s))
+	for i, mdID := range mdIDs {
+		_, err := os.Stat(s.mdPath(mdID))
+		if i < 6 {
+			require.True(t, os.IsNotExist(err))
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// Objects held by a read snapshot are reported as deferred.
+	err = s.unpinRevision(NullBranchID, 7)
+	require.NoError(t, err)
+	snapshot, err := s.readSnapshot()
+	require.NoError(t, err)
+	defer snapshot.release()
+	plan, err = s.planPrune(NullBranchID, 9)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, plan.pinnedAt)
+	require.Equal(t, []MdID{mdIDs[6], mdIDs[7]}, plan.deferred)
+	require.True(t, plan.bytesFreed <= 0)
+}
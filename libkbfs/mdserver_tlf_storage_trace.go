@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// mdServerTlfStorageSpan is a single timed operation within a trace
+// of an mdServerTlfStorage call.
+type mdServerTlfStorageSpan interface {
+	// SetTag annotates the span with the given key and value.
+	SetTag(key string, value interface{})
+	// Finish ends the span.
+	Finish()
+}
+
+// mdServerTlfStorageTracer starts spans for mdServerTlfStorage
+// operations. It is a narrow interface so that any tracing library
+// (e.g., OpenTracing) can be adapted to it.
+type mdServerTlfStorageTracer interface {
+	// StartSpan starts a new span with the given name, as a child
+	// of the span in ctx, if any. The returned context carries
+	// the new span, so that spans started with it become its
+	// children.
+	StartSpan(ctx context.Context, name string) (
+		context.Context, mdServerTlfStorageSpan)
+}
+
+// ctxMDServerTlfStorageTagKey is the type used for unique context
+// tags within mdServerTlfStorage.
+type ctxMDServerTlfStorageTagKey int
+
+const (
+	// ctxMDServerTlfStorageTracerKey is the type of the tag for
+	// the optional tracer used by mdServerTlfStorage.
+	ctxMDServerTlfStorageTracerKey ctxMDServerTlfStorageTagKey = iota
+	// ctxMDServerTlfStoragePriorityKey is the type of the tag for
+	// the priority of an mdServerTlfStorage operation.
+	ctxMDServerTlfStoragePriorityKey
+)
+
+// withMDServerTlfStorageTracer returns a context which causes
+// mdServerTlfStorage operations called with it to be traced with the
+// given tracer.
+func withMDServerTlfStorageTracer(
+	ctx context.Context, tracer mdServerTlfStorageTracer) context.Context {
+	return context.WithValue(ctx, ctxMDServerTlfStorageTracerKey, tracer)
+}
+
+type noopMDServerTlfStorageSpan struct{}
+
+func (noopMDServerTlfStorageSpan) SetTag(string, interface{}) {}
+
+func (noopMDServerTlfStorageSpan) Finish() {}
+
+// startMDServerTlfStorageSpan starts a span with the given name using
+// the tracer in ctx. If there is no tracer, it returns ctx unchanged
+// along with a span that does nothing, and doesn't allocate.
+func startMDServerTlfStorageSpan(ctx context.Context, name string) (
+	context.Context, mdServerTlfStorageSpan) {
+	tracer, ok := ctx.Value(
+		ctxMDServerTlfStorageTracerKey).(mdServerTlfStorageTracer)
+	if !ok {
+		return ctx, noopMDServerTlfStorageSpan{}
+	}
+	return tracer.StartSpan(ctx, name)
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// mdWriteBufferConfig configures the buffering of MD object writes
+// in memory. With buffering, put still validates the MD and appends
+// it to the journal synchronously, but the MD object itself is only
+// written to disk when the buffer is flushed. Reads see buffered MDs
+// as usual.
+//
+// If the process dies with a non-empty buffer, the buffered puts are
+// lost: on the next open, journal entries at the end of a branch
+// whose MD objects are missing are dropped.
+type mdWriteBufferConfig struct {
+	// maxBytes is the total encoded size of buffered MDs above
+	// which the buffer is flushed. Zero disables buffering.
+	maxBytes int64
+	// maxAge is the age of the oldest buffered MD above which
+	// the buffer is flushed, as checked on each put. Zero means
+	// no age limit.
+	maxAge time.Duration
+}
+
+type bufferedMD struct {
+	buf     []byte
+	putTime time.Time
+	// putNum is the value of writeBufferPuts when this MD was
+	// buffered.
+	putNum uint64
+	// waiters are the channels returned by putAsync for this
+	// MD, which are notified once it is written.
+	waiters []chan<- error
+}
+
+// notifyWriteWaiters sends err to each of the given channels,
+// which must be buffered, and closes them.
+func notifyWriteWaiters(waiters []chan<- error, err error) {
+	for _, w := range waiters {
+		w <- err
+		close(w)
+	}
+}
+
+// bufferMDLocked adds the given encoded MD to the write buffer, and
+// flushes the buffer if it is now over its size or age limit.
+func (s *mdServerTlfStorage) bufferMDLocked(id MdID, buf []byte) error {
+	now := s.clock.Now()
+	if s.writeBuffer == nil {
+		s.writeBuffer = make(map[MdID]bufferedMD)
+	}
+	s.writeBufferPuts++
+	s.writeBuffer[id] = bufferedMD{
+		buf: buf, putTime: now, putNum: s.writeBufferPuts}
+	s.writeBufferBytes += int64(len(buf))
+
+	if s.writeBufferBytes >= s.writeBufferConfig.maxBytes {
+		return s.flushWriteBufferLocked()
+	}
+
+	if s.writeBufferConfig.maxAge > 0 {
+		for _, b := range s.writeBuffer {
+			if now.Sub(b.putTime) >= s.writeBufferConfig.maxAge {
+				return s.flushWriteBufferLocked()
+			}
+		}
+	}
+
+	return nil
+}
+
+// bufferedMDIDList can be used to sort the IDs of buffered MDs in
+// the order they were put.
+type bufferedMDIDList struct {
+	ids    []MdID
+	buffer map[MdID]bufferedMD
+}
+
+func (l bufferedMDIDList) Len() int {
+	return len(l.ids)
+}
+
+func (l bufferedMDIDList) Less(i, j int) bool {
+	return l.buffer[l.ids[i]].putNum < l.buffer[l.ids[j]].putNum
+}
+
+func (l bufferedMDIDList) Swap(i, j int) {
+	l.ids[i], l.ids[j] = l.ids[j], l.ids[i]
+}
+
+// flushWriteBufferLocked writes all buffered MDs to disk, in the
+// order they were put, which for each branch is revision order. It
+// stops at the first error, leaving that MD and all later ones
+// buffered, so that what's on disk never has a gap in the middle of
+// a branch.
+func (s *mdServerTlfStorage) flushWriteBufferLocked() error {
+	if len(s.writeBuffer) == 0 {
+		return nil
+	}
+
+	unfence, err := s.fenceLocked()
+	if err != nil {
+		return err
+	}
+	defer unfence()
+
+	ctx := withMDServerTlfStoragePriority(
+		context.Background(), mdServerTlfStoragePriorityBackground)
+	ids := bufferedMDIDList{
+		ids:    make([]MdID, 0, len(s.writeBuffer)),
+		buffer: s.writeBuffer,
+	}
+	for id := range s.writeBuffer {
+		ids.ids = append(ids.ids, id)
+	}
+	sort.Sort(ids)
+
+	for _, id := range ids.ids {
+		b := s.writeBuffer[id]
+		err := s.writeMDLocked(ctx, id, b.buf)
+		if err != nil {
+			// The MD stays buffered so that a later flush
+			// can retry, but its current waiters are told
+			// about the failure.
+			notifyWriteWaiters(b.waiters, err)
+			b.waiters = nil
+			s.writeBuffer[id] = b
+			return err
+		}
+		delete(s.writeBuffer, id)
+		s.writeBufferBytes -= int64(len(b.buf))
+		notifyWriteWaiters(b.waiters, nil)
+	}
+
+	for bid, j := range s.branchJournals {
+		err := s.raiseHighWaterMarkLocked(bid, j)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWriteWaiterLocked arranges for written to be notified once
+// the given MD is written to disk, which may be immediately.
+func (s *mdServerTlfStorage) addWriteWaiterLocked(
+	id MdID, written chan<- error) {
+	b, ok := s.writeBuffer[id]
+	if !ok {
+		notifyWriteWaiters([]chan<- error{written}, nil)
+		return
+	}
+	b.waiters = append(b.waiters, written)
+	s.writeBuffer[id] = b
+}
+
+// removeBufferedMDLocked removes the given MD from the write buffer,
+// if it's there.
+func (s *mdServerTlfStorage) removeBufferedMDLocked(id MdID) {
+	if b, ok := s.writeBuffer[id]; ok {
+		delete(s.writeBuffer, id)
+		s.writeBufferBytes -= int64(len(b.buf))
+		notifyWriteWaiters(b.waiters,
+			fmt.Errorf("MD %s was removed before being written", id))
+	}
+}
+
+// sync writes any MDs buffered by put to disk; see
+// mdWriteBufferConfig.
+func (s *mdServerTlfStorage) sync() error {
+	s.lock.lockAs(mdLockCategoryFlush)
+	defer s.lock.Unlock()
+
+	if err := s.checkOpenReadLocked(); err != nil {
+		return err
+	}
+
+	return s.flushWriteBufferLocked()
+}
@@ -694,6 +694,29 @@ func (md *RootMetadata) MetadataID(crypto cryptoPure) (MdID, error) {
 	return mdID, nil
 }
 
+// copyWithoutCachedID returns a shallow copy of md, without its
+// cached MdID, so that the ID of the copy can be computed without
+// caching it in md. It copies field by field, since copying *md
+// would copy mdIDLock; TestRootMetadataCopyWithoutCachedIDFields
+// catches fields added to RootMetadata but not here.
+func (md *RootMetadata) copyWithoutCachedID() *RootMetadata {
+	return &RootMetadata{
+		WriterMetadata:         md.WriterMetadata,
+		WriterMetadataSigInfo:  md.WriterMetadataSigInfo,
+		LastModifyingUser:      md.LastModifyingUser,
+		Flags:                  md.Flags,
+		Revision:               md.Revision,
+		PrevRoot:               md.PrevRoot,
+		RKeys:                  md.RKeys,
+		UnresolvedReaders:      md.UnresolvedReaders,
+		ConflictInfo:           md.ConflictInfo,
+		FinalizedInfo:          md.FinalizedInfo,
+		UnknownFieldSetHandler: md.UnknownFieldSetHandler,
+		data:                   md.data,
+		tlfHandle:              md.tlfHandle,
+	}
+}
+
 // clearMetadataID forgets the cached version of the RootMetadata's MdID
 func (md *RootMetadata) clearCachedMetadataIDForTest() {
 	md.mdIDLock.Lock()
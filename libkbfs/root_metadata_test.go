@@ -709,3 +709,34 @@ func TestRootMetadataFinalVerify(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+// Test that copyWithoutCachedID knows about every field of
+// RootMetadata. If this fails, copy the new field in
+// copyWithoutCachedID, and add it here.
+func TestRootMetadataCopyWithoutCachedIDFields(t *testing.T) {
+	expectedFields := []string{
+		"ConflictInfo",
+		"FinalizedInfo",
+		"Flags",
+		"LastModifyingUser",
+		"PrevRoot",
+		"RKeys",
+		"Revision",
+		"UnknownFieldSetHandler",
+		"UnresolvedReaders",
+		"WriterMetadata",
+		"WriterMetadataSigInfo",
+		"data",
+		"mdID",
+		"mdIDLock",
+		"tlfHandle",
+	}
+
+	rmdType := reflect.TypeOf(RootMetadata{})
+	var fields []string
+	for i := 0; i < rmdType.NumField(); i++ {
+		fields = append(fields, rmdType.Field(i).Name)
+	}
+	sort.Strings(fields)
+	require.Equal(t, expectedFields, fields)
+}